@@ -0,0 +1,251 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Who caused an action
+const (
+	// A silo made the request, from Record.RemoteIP
+	ActorSilo = "silo"
+	// The backend acted on its own, e.g. cleaning up after a failed creation
+	ActorSystem = "system"
+)
+
+// What was done
+const (
+	ActionCreatePod            = "create_pod"
+	ActionDeletePod            = "delete_pod"
+	ActionDeleteUserStorage    = "delete_user_storage"
+	ActionDeleteService        = "delete_service"
+	ActionDeletePodCache       = "delete_pod_cache"
+	ActionDeleteCompanion      = "delete_companion" // a ConfigMap, Secret or Ingress from a pod's manifest
+	ActionCreateProject        = "create_project"
+	ActionUpdateProject        = "update_project" // a change of the project's members
+	ActionDeleteProject        = "delete_project"
+	ActionDeleteProjectStorage = "delete_project_storage"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Lines longer than this can't be read back by Open, Query or Verify
+const maxLineBytes = 1 << 20
+
+// One line of the audit log.
+// Hash is the sha256 of the json encoding of the record with an empty Hash,
+// and PrevHash is the Hash of the record before it, so that editing or removing
+// any line breaks the chain from that point on.
+type Record struct {
+	Time            time.Time `json:"time"`
+	Action          string    `json:"action"`
+	Actor           string    `json:"actor"`
+	RemoteIP        string    `json:"remote_ip,omitempty"`
+	UserID          string    `json:"user_id,omitempty"`
+	PodName         string    `json:"pod_name,omitempty"`
+	Resource        string    `json:"resource,omitempty"`
+	Manifest        string    `json:"manifest,omitempty"`
+	ManifestURL     string    `json:"manifest_url,omitempty"`
+	Outcome         string    `json:"outcome"`
+	Reason          string    `json:"reason,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	PrevHash        string    `json:"prev_hash"`
+	Hash            string    `json:"hash"`
+}
+
+func (r Record) computeHash() string {
+	r.Hash = ""
+	encoded, _ := json.Marshal(r)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// An append-only audit log stored as json lines in a file.
+// A nil *Log discards every record, so auditing can be left unconfigured.
+type Log struct {
+	path     string
+	file     *os.File
+	lastHash string
+	mutex    *sync.Mutex
+}
+
+// Open the audit log at path for appending, creating it if it doesn't exist.
+// New records are chained onto the last record already in the file.
+func Open(path string) (*Log, error) {
+	lastHash := ""
+	existing, err := os.Open(path)
+	if err == nil {
+		err = readRecords(existing, func(record Record) error {
+			lastHash = record.Hash
+			return nil
+		})
+		existing.Close()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't read audit log %s: %s", path, err.Error()))
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var m sync.Mutex
+	return &Log{path: path, file: file, lastHash: lastHash, mutex: &m}, nil
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+// Chain record onto the end of the log and write it to disk.
+// Time is filled in if it isn't set.
+func (l *Log) Append(record Record) error {
+	if l == nil {
+		return nil
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Time = record.Time.UTC()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	record.PrevHash = l.lastHash
+	record.Hash = record.computeHash()
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(encoded, '\n'))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't write to audit log %s: %s", l.path, err.Error()))
+	}
+	err = l.file.Sync()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't sync audit log %s: %s", l.path, err.Error()))
+	}
+	l.lastHash = record.Hash
+	return nil
+}
+
+// Selects records from the log. Empty or zero fields match everything.
+type Filter struct {
+	UserID string
+	Since  time.Time
+	Until  time.Time
+	// Return at most the Limit most recent matching records
+	Limit int
+}
+
+func (f Filter) matches(record Record) bool {
+	if f.UserID != "" && record.UserID != f.UserID {
+		return false
+	}
+	if !f.Since.IsZero() && record.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && record.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Return the records that match filter, oldest first.
+// The whole file is read for each query, which is fine for the volume of actions the backend sees.
+func (l *Log) Query(filter Filter) ([]Record, error) {
+	if l == nil {
+		return nil, errors.New("Audit log is not configured")
+	}
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []Record
+	err = readRecords(file, func(record Record) error {
+		if filter.matches(record) {
+			records = append(records, record)
+			if filter.Limit > 0 && len(records) > filter.Limit {
+				records = records[1:]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Check the hash chain of the whole log, returning the number of valid records before the first broken one
+func (l *Log) Verify() (int, error) {
+	if l == nil {
+		return 0, errors.New("Audit log is not configured")
+	}
+	file, err := os.Open(l.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return Verify(file)
+}
+
+// Check the hash chain of the json lines read from r,
+// returning the number of valid records before the first broken one
+func Verify(r io.Reader) (int, error) {
+	valid := 0
+	prevHash := ""
+	err := readRecords(r, func(record Record) error {
+		if record.PrevHash != prevHash {
+			return errors.New(fmt.Sprintf("record %d doesn't follow the previous record", valid+1))
+		}
+		if record.Hash != record.computeHash() {
+			return errors.New(fmt.Sprintf("record %d doesn't match its hash", valid+1))
+		}
+		prevHash = record.Hash
+		valid++
+		return nil
+	})
+	return valid, err
+}
+
+// Decode each line of r as a Record and pass it to handle, stopping at the first error
+func readRecords(r io.Reader, handle func(Record) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxLineBytes)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d isn't a valid record: %s", line, err.Error()))
+		}
+		err = handle(record)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
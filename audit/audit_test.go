@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendAndVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	base := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []Record{
+		{Time: base, Action: ActionCreatePod, Actor: ActorSilo, UserID: "foo@bar", PodName: "jupyter-foo-bar", Outcome: OutcomeSuccess},
+		{Time: base.Add(time.Hour), Action: ActionCreatePod, Actor: ActorSilo, UserID: "baz", Outcome: OutcomeFailure},
+		{Time: base.Add(2 * time.Hour), Action: ActionDeletePod, Actor: ActorSystem, UserID: "foo@bar", PodName: "jupyter-foo-bar", Outcome: OutcomeSuccess},
+	}
+	for _, record := range records[:2] {
+		if err := log.Append(record); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	log.Close()
+
+	// Reopening should continue the chain rather than start a new one
+	log, err = Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer log.Close()
+	if err := log.Append(records[2]); err != nil {
+		t.Fatal(err.Error())
+	}
+	valid, err := log.Verify()
+	if err != nil || valid != 3 {
+		t.Fatalf("Expected 3 valid records, got %d with error %v", valid, err)
+	}
+
+	found, err := log.Query(Filter{UserID: "foo@bar"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(found) != 2 || found[0].Action != ActionCreatePod || found[1].Action != ActionDeletePod {
+		t.Fatalf("Unexpected records for foo@bar: %+v", found)
+	}
+	found, _ = log.Query(Filter{Since: base.Add(30 * time.Minute), Until: base.Add(90 * time.Minute)})
+	if len(found) != 1 || found[0].UserID != "baz" {
+		t.Fatalf("Unexpected records in time range: %+v", found)
+	}
+	found, _ = log.Query(Filter{Limit: 1})
+	if len(found) != 1 || found[0].Action != ActionDeletePod {
+		t.Fatalf("Expected only the most recent record, got %+v", found)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, userID := range []string{"foo", "bar", "baz"} {
+		log.Append(Record{Action: ActionDeletePod, Actor: ActorSilo, UserID: userID, Outcome: OutcomeSuccess})
+	}
+	log.Close()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+
+	edited := strings.Replace(string(contents), `"user_id":"bar"`, `"user_id":"qux"`, 1)
+	valid, err := Verify(strings.NewReader(edited))
+	if err == nil || valid != 1 {
+		t.Fatalf("Edited record wasn't detected, got %d valid records and error %v", valid, err)
+	}
+
+	removed := strings.Join([]string{lines[0], lines[2]}, "\n")
+	valid, err = Verify(strings.NewReader(removed))
+	if err == nil || valid != 1 {
+		t.Fatalf("Removed record wasn't detected, got %d valid records and error %v", valid, err)
+	}
+}
@@ -5,10 +5,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	watch "k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -16,10 +22,18 @@ import (
 	"k8s.io/client-go/tools/remotecommand"
 )
 
+// Record the latency of an API call that started at start, and count it as an error if *err isn't nil
+func observeAPICall(verb string, resource string, start time.Time, err *error) {
+	metrics.APICallSeconds.ObserveSince(start, verb, resource)
+	if *err != nil {
+		metrics.APICallErrors.Inc(verb, resource)
+	}
+}
+
 // Struct to wrap kubernetes client functions
 type K8sClient struct {
-	config        *rest.Config
-	clientset     *kubernetes.Clientset
+	config       *rest.Config
+	clientset    *kubernetes.Clientset
 	globalConfig util.GlobalConfig
 }
 
@@ -36,8 +50,8 @@ func NewK8sClient(globalConfig util.GlobalConfig) K8sClient {
 		panic(err.Error())
 	}
 	return K8sClient{
-		config:    config,
-		clientset: clientset,
+		config:       config,
+		clientset:    clientset,
 		globalConfig: globalConfig,
 	}
 }
@@ -52,28 +66,48 @@ func (c *K8sClient) WatchFor(
 	listOptions := metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", name)}
 	var err error
 	var watcher watch.Interface
+	// the API resource name, used to label metrics
+	var resource string
+	start := time.Now()
 	// create a watcher for the API resource of the correct type
 	switch resourceType {
 	case "Pod":
+		resource = "pods"
 		watcher, err = c.clientset.CoreV1().Pods(c.globalConfig.Namespace).Watch(context.TODO(), listOptions)
 	case "PV":
+		resource = "persistentvolumes"
 		watcher, err = c.clientset.CoreV1().PersistentVolumes().Watch(context.TODO(), listOptions)
 	case "PVC":
+		resource = "persistentvolumeclaims"
 		watcher, err = c.clientset.CoreV1().PersistentVolumeClaims(c.globalConfig.Namespace).Watch(context.TODO(), listOptions)
 	case "SVC":
+		resource = "services"
 		watcher, err = c.clientset.CoreV1().Services(c.globalConfig.Namespace).Watch(context.TODO(), listOptions)
+	case "CM":
+		resource = "configmaps"
+		watcher, err = c.clientset.CoreV1().ConfigMaps(c.globalConfig.Namespace).Watch(context.TODO(), listOptions)
+	case "Secret":
+		resource = "secrets"
+		watcher, err = c.clientset.CoreV1().Secrets(c.globalConfig.Namespace).Watch(context.TODO(), listOptions)
+	case "Ingress":
+		resource = "ingresses"
+		watcher, err = c.clientset.NetworkingV1().Ingresses(c.globalConfig.Namespace).Watch(context.TODO(), listOptions)
 	default:
+		resource = resourceType
 		err = errors.New("Unsupported resource type for watcher")
 	}
+	observeAPICall("watch", resource, start, &err)
 	if err != nil {
 		ch.Send(false)
-		fmt.Printf("Error in WatchFor: %s\n", err.Error())
+		logging.Default().Error("Couldn't start watcher", "resource", resource, "name", name, "error", err)
 		return
 	}
 	// In a goroutine, wait until there's a value in the channel, and then stop the watcher.
 	// This will ensure that either a successful event or the timeout will terminate signalFunc
 	go func() {
-		ch.Receive()
+		if !ch.Receive() && ch.Reason() == util.ReasonTimeout {
+			metrics.WatchTimeouts.Inc(resource)
+		}
 		watcher.Stop()
 	}()
 	// In this goroutine, call the function to ch<-true when the desired event occurs
@@ -135,19 +169,29 @@ func signalPVCReady(watcher watch.Interface, ch *util.ReadyChannel) {
 	}
 }
 
-func (c *K8sClient) ListPods(opt metav1.ListOptions) (*apiv1.PodList, error) {
+func (c *K8sClient) ListPods(opt metav1.ListOptions) (result *apiv1.PodList, err error) {
+	defer observeAPICall("list", "pods", time.Now(), &err)
 	return c.clientset.CoreV1().Pods(c.globalConfig.Namespace).List(context.TODO(), opt)
 }
 
-func (c *K8sClient) DeletePod(name string) error {
+func (c *K8sClient) DeletePod(name string) (err error) {
+	defer observeAPICall("delete", "pods", time.Now(), &err)
 	return c.clientset.CoreV1().Pods(c.globalConfig.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
 }
 
+// Ask the API server to validate a deletion of the pod without carrying it out,
+// so that errors such as missing permissions show before the deletion is started in the background
+func (c *K8sClient) CheckDeletePod(name string) (err error) {
+	defer observeAPICall("delete_dry_run", "pods", time.Now(), &err)
+	return c.clientset.CoreV1().Pods(c.globalConfig.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{DryRun: []string{metav1.DryRunAll}})
+}
+
 func (c *K8sClient) WatchDeletePod(name string, finished *util.ReadyChannel) {
 	c.WatchFor(name, "Pod", signalDeleted, finished)
 }
 
-func (c *K8sClient) CreatePod(target *apiv1.Pod) (*apiv1.Pod, error) {
+func (c *K8sClient) CreatePod(target *apiv1.Pod) (result *apiv1.Pod, err error) {
+	defer observeAPICall("create", "pods", time.Now(), &err)
 	return c.clientset.CoreV1().Pods(c.globalConfig.Namespace).Create(context.TODO(), target, metav1.CreateOptions{})
 }
 
@@ -155,11 +199,13 @@ func (c *K8sClient) WatchCreatePod(name string, ready *util.ReadyChannel) {
 	c.WatchFor(name, "Pod", signalPodReady, ready)
 }
 
-func (c *K8sClient) ListPVC(opt metav1.ListOptions) (*apiv1.PersistentVolumeClaimList, error) {
+func (c *K8sClient) ListPVC(opt metav1.ListOptions) (result *apiv1.PersistentVolumeClaimList, err error) {
+	defer observeAPICall("list", "persistentvolumeclaims", time.Now(), &err)
 	return c.clientset.CoreV1().PersistentVolumeClaims(c.globalConfig.Namespace).List(context.TODO(), opt)
 }
 
-func (c *K8sClient) DeletePVC(name string) error {
+func (c *K8sClient) DeletePVC(name string) (err error) {
+	defer observeAPICall("delete", "persistentvolumeclaims", time.Now(), &err)
 	return c.clientset.CoreV1().PersistentVolumeClaims(c.globalConfig.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
 }
 
@@ -167,19 +213,34 @@ func (c *K8sClient) WatchDeletePVC(name string, finished *util.ReadyChannel) {
 	c.WatchFor(name, "PVC", signalDeleted, finished)
 }
 
-func (c *K8sClient) CreatePVC(target *apiv1.PersistentVolumeClaim) (*apiv1.PersistentVolumeClaim, error) {
+func (c *K8sClient) CreatePVC(target *apiv1.PersistentVolumeClaim) (result *apiv1.PersistentVolumeClaim, err error) {
+	defer observeAPICall("create", "persistentvolumeclaims", time.Now(), &err)
 	return c.clientset.CoreV1().PersistentVolumeClaims(c.globalConfig.Namespace).Create(context.TODO(), target, metav1.CreateOptions{})
 }
 
+// Apply a json merge patch to the PVC, e.g. to change its annotations
+func (c *K8sClient) PatchPVC(name string, patch []byte) (result *apiv1.PersistentVolumeClaim, err error) {
+	defer observeAPICall("patch", "persistentvolumeclaims", time.Now(), &err)
+	return c.clientset.CoreV1().PersistentVolumeClaims(c.globalConfig.Namespace).Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+}
+
 func (c *K8sClient) WatchCreatePVC(name string, ready *util.ReadyChannel) {
 	c.WatchFor(name, "PVC", signalPVCReady, ready)
 }
 
-func (c *K8sClient) ListPV(opt metav1.ListOptions) (*apiv1.PersistentVolumeList, error) {
+func (c *K8sClient) ListPV(opt metav1.ListOptions) (result *apiv1.PersistentVolumeList, err error) {
+	defer observeAPICall("list", "persistentvolumes", time.Now(), &err)
 	return c.clientset.CoreV1().PersistentVolumes().List(context.TODO(), opt)
 }
 
-func (c *K8sClient) DeletePV(name string) error {
+// Apply a json merge patch to the PV, e.g. to change its reclaim policy
+func (c *K8sClient) PatchPV(name string, patch []byte) (result *apiv1.PersistentVolume, err error) {
+	defer observeAPICall("patch", "persistentvolumes", time.Now(), &err)
+	return c.clientset.CoreV1().PersistentVolumes().Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+}
+
+func (c *K8sClient) DeletePV(name string) (err error) {
+	defer observeAPICall("delete", "persistentvolumes", time.Now(), &err)
 	return c.clientset.CoreV1().PersistentVolumes().Delete(context.TODO(), name, metav1.DeleteOptions{})
 }
 
@@ -187,7 +248,8 @@ func (c *K8sClient) WatchDeletePV(name string, finished *util.ReadyChannel) {
 	c.WatchFor(name, "PV", signalDeleted, finished)
 }
 
-func (c *K8sClient) CreatePV(target *apiv1.PersistentVolume) (*apiv1.PersistentVolume, error) {
+func (c *K8sClient) CreatePV(target *apiv1.PersistentVolume) (result *apiv1.PersistentVolume, err error) {
+	defer observeAPICall("create", "persistentvolumes", time.Now(), &err)
 	return c.clientset.CoreV1().PersistentVolumes().Create(context.TODO(), target, metav1.CreateOptions{})
 }
 
@@ -195,15 +257,18 @@ func (c *K8sClient) WatchCreatePV(name string, ready *util.ReadyChannel) {
 	c.WatchFor(name, "PV", signalPVReady, ready)
 }
 
-func (c *K8sClient) ListServices(opt metav1.ListOptions) (*apiv1.ServiceList, error) {
+func (c *K8sClient) ListServices(opt metav1.ListOptions) (result *apiv1.ServiceList, err error) {
+	defer observeAPICall("list", "services", time.Now(), &err)
 	return c.clientset.CoreV1().Services(c.globalConfig.Namespace).List(context.TODO(), opt)
 }
 
-func (c *K8sClient) CreateService(target *apiv1.Service) (*apiv1.Service, error) {
+func (c *K8sClient) CreateService(target *apiv1.Service) (result *apiv1.Service, err error) {
+	defer observeAPICall("create", "services", time.Now(), &err)
 	return c.clientset.CoreV1().Services(c.globalConfig.Namespace).Create(context.TODO(), target, metav1.CreateOptions{})
 }
 
-func (c *K8sClient) DeleteService(name string) error {
+func (c *K8sClient) DeleteService(name string) (err error) {
+	defer observeAPICall("delete", "services", time.Now(), &err)
 	return c.clientset.CoreV1().Services(c.globalConfig.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
 }
 
@@ -211,9 +276,109 @@ func (c *K8sClient) WatchDeleteService(name string, finished *util.ReadyChannel)
 	c.WatchFor(name, "SVC", signalDeleted, finished)
 }
 
+func (c *K8sClient) ListConfigMaps(opt metav1.ListOptions) (result *apiv1.ConfigMapList, err error) {
+	defer observeAPICall("list", "configmaps", time.Now(), &err)
+	return c.clientset.CoreV1().ConfigMaps(c.globalConfig.Namespace).List(context.TODO(), opt)
+}
+
+func (c *K8sClient) CreateConfigMap(target *apiv1.ConfigMap) (result *apiv1.ConfigMap, err error) {
+	defer observeAPICall("create", "configmaps", time.Now(), &err)
+	return c.clientset.CoreV1().ConfigMaps(c.globalConfig.Namespace).Create(context.TODO(), target, metav1.CreateOptions{})
+}
+
+// Apply a json merge patch to the ConfigMap, e.g. to change its data
+func (c *K8sClient) PatchConfigMap(name string, patch []byte) (result *apiv1.ConfigMap, err error) {
+	defer observeAPICall("patch", "configmaps", time.Now(), &err)
+	return c.clientset.CoreV1().ConfigMaps(c.globalConfig.Namespace).Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+}
+
+func (c *K8sClient) DeleteConfigMap(name string) (err error) {
+	defer observeAPICall("delete", "configmaps", time.Now(), &err)
+	return c.clientset.CoreV1().ConfigMaps(c.globalConfig.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+}
+
+func (c *K8sClient) WatchDeleteConfigMap(name string, finished *util.ReadyChannel) {
+	c.WatchFor(name, "CM", signalDeleted, finished)
+}
+
+func (c *K8sClient) ListSecrets(opt metav1.ListOptions) (result *apiv1.SecretList, err error) {
+	defer observeAPICall("list", "secrets", time.Now(), &err)
+	return c.clientset.CoreV1().Secrets(c.globalConfig.Namespace).List(context.TODO(), opt)
+}
+
+func (c *K8sClient) CreateSecret(target *apiv1.Secret) (result *apiv1.Secret, err error) {
+	defer observeAPICall("create", "secrets", time.Now(), &err)
+	return c.clientset.CoreV1().Secrets(c.globalConfig.Namespace).Create(context.TODO(), target, metav1.CreateOptions{})
+}
+
+func (c *K8sClient) DeleteSecret(name string) (err error) {
+	defer observeAPICall("delete", "secrets", time.Now(), &err)
+	return c.clientset.CoreV1().Secrets(c.globalConfig.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+}
+
+func (c *K8sClient) WatchDeleteSecret(name string, finished *util.ReadyChannel) {
+	c.WatchFor(name, "Secret", signalDeleted, finished)
+}
+
+func (c *K8sClient) ListIngresses(opt metav1.ListOptions) (result *networkingv1.IngressList, err error) {
+	defer observeAPICall("list", "ingresses", time.Now(), &err)
+	return c.clientset.NetworkingV1().Ingresses(c.globalConfig.Namespace).List(context.TODO(), opt)
+}
+
+func (c *K8sClient) CreateIngress(target *networkingv1.Ingress) (result *networkingv1.Ingress, err error) {
+	defer observeAPICall("create", "ingresses", time.Now(), &err)
+	return c.clientset.NetworkingV1().Ingresses(c.globalConfig.Namespace).Create(context.TODO(), target, metav1.CreateOptions{})
+}
+
+func (c *K8sClient) DeleteIngress(name string) (err error) {
+	defer observeAPICall("delete", "ingresses", time.Now(), &err)
+	return c.clientset.NetworkingV1().Ingresses(c.globalConfig.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+}
+
+func (c *K8sClient) WatchDeleteIngress(name string, finished *util.ReadyChannel) {
+	c.WatchFor(name, "Ingress", signalDeleted, finished)
+}
+
+// Return the version of the API server, which is a cheap way to check that it's reachable
+func (c *K8sClient) ServerVersion() (version string, err error) {
+	defer observeAPICall("get", "version", time.Now(), &err)
+	info, err := c.clientset.Discovery().ServerVersion()
+	if err != nil {
+		return "", err
+	}
+	return info.GitVersion, nil
+}
+
+// Return true if the backend's service account may perform verb on the resource in the API group,
+// which is "" for the core group.
+// Namespaced resources are checked in the configured namespace, others cluster-wide.
+func (c *K8sClient) CanI(verb string, group string, resource string, subresource string, namespaced bool) (allowed bool, err error) {
+	defer observeAPICall("create", "selfsubjectaccessreviews", time.Now(), &err)
+	attributes := &authorizationv1.ResourceAttributes{
+		Verb:        verb,
+		Group:       group,
+		Resource:    resource,
+		Subresource: subresource,
+	}
+	if namespaced {
+		attributes.Namespace = c.globalConfig.Namespace
+	}
+	review, err := c.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(
+		context.TODO(),
+		&authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attributes},
+		},
+		metav1.CreateOptions{},
+	)
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
+
 // call a bash command inside of a pod, with the command given as a []string of bash words
-func (c *K8sClient) PodExec(command []string, pod *apiv1.Pod, nContainer int) (bytes.Buffer, bytes.Buffer, error) {
-	var stdout, stderr bytes.Buffer
+func (c *K8sClient) PodExec(command []string, pod *apiv1.Pod, nContainer int) (stdout bytes.Buffer, stderr bytes.Buffer, err error) {
+	defer observeAPICall("exec", "pods", time.Now(), &err)
 	restRequest := c.clientset.CoreV1().RESTClient().Post().
 		Resource("pods").
 		Name(pod.Name).
@@ -0,0 +1,235 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// Parse a level name as used in the config, defaulting to info for an empty string
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %s", name)
+}
+
+// Value logged in place of anything that looks secret
+const Redacted = "[REDACTED]"
+
+// Field keys and env var names that hold secrets
+var secretKeyRegex = regexp.MustCompile(`(?i)(pass|secret|token|key|credential|auth|cookie)`)
+
+// Values that look like keys or tokens, whatever they are called
+var secretValueRegex = regexp.MustCompile(`^(ssh-[a-z0-9]+ |ecdsa-sha2-|-----BEGIN |eyJ[A-Za-z0-9_-]+\.)`)
+
+// Return true if a value stored under name should be kept out of the logs
+func IsSecret(name string, value string) bool {
+	return secretKeyRegex.MatchString(name) || secretValueRegex.MatchString(value)
+}
+
+// Return a copy of the settings map from a create_pod request with secret-looking values redacted
+func RedactSettings(settings map[string]map[string]string) map[string]map[string]string {
+	redacted := make(map[string]map[string]string, len(settings))
+	for container, envVars := range settings {
+		redacted[container] = make(map[string]string, len(envVars))
+		for name, value := range envVars {
+			if IsSecret(name, value) {
+				value = Redacted
+			}
+			redacted[container][name] = value
+		}
+	}
+	return redacted
+}
+
+// Return a random id to tie together the log lines of one request
+func NewRequestID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Where log lines are written and the minimum level that is written, shared by all loggers
+type output struct {
+	writer io.Writer
+	level  Level
+	mutex  *sync.Mutex
+}
+
+var defaultOutputWriter io.Writer = os.Stdout
+
+var defaultOutput = &output{writer: defaultOutputWriter, level: LevelInfo, mutex: &sync.Mutex{}}
+
+// Set the minimum level of lines written by every logger
+func SetLevel(level Level) {
+	defaultOutput.mutex.Lock()
+	defer defaultOutput.mutex.Unlock()
+	defaultOutput.level = level
+}
+
+// Set where every logger writes its lines
+func SetOutput(w io.Writer) {
+	defaultOutput.mutex.Lock()
+	defer defaultOutput.mutex.Unlock()
+	defaultOutput.writer = w
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// A logger that writes one json object per line, with a fixed set of fields on every line.
+// Loggers are immutable, so they can be shared between goroutines. A nil *Logger logs like Default().
+type Logger struct {
+	fields []field
+}
+
+var defaultLogger = &Logger{}
+
+// Return the logger without any fields
+func Default() *Logger {
+	return defaultLogger
+}
+
+// Return a logger that adds the key-value pairs to every line, replacing fields with the same key
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	if l == nil {
+		l = defaultLogger
+	}
+	fields := append([]field{}, l.fields...)
+	for _, newField := range pairsToFields(keysAndValues) {
+		replaced := false
+		for i := range fields {
+			if fields[i].key == newField.key {
+				fields[i] = newField
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			fields = append(fields, newField)
+		}
+	}
+	return &Logger{fields: fields}
+}
+
+func pairsToFields(keysAndValues []interface{}) []field {
+	fields := make([]field, 0, (len(keysAndValues)+1)/2)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		fields = append(fields, field{key: key, value: value})
+	}
+	return fields
+}
+
+func (l *Logger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(LevelDebug, msg, keysAndValues)
+}
+
+func (l *Logger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(LevelInfo, msg, keysAndValues)
+}
+
+func (l *Logger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(LevelWarn, msg, keysAndValues)
+}
+
+func (l *Logger) Error(msg string, keysAndValues ...interface{}) {
+	l.log(LevelError, msg, keysAndValues)
+}
+
+func (l *Logger) log(level Level, msg string, keysAndValues []interface{}) {
+	if l == nil {
+		l = defaultLogger
+	}
+	defaultOutput.mutex.Lock()
+	defer defaultOutput.mutex.Unlock()
+	if level < defaultOutput.level {
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString("{")
+	writeField(&b, "time", time.Now().UTC().Format(time.RFC3339Nano), false)
+	writeField(&b, "level", level.String(), true)
+	writeField(&b, "msg", msg, true)
+	for _, f := range l.fields {
+		writeField(&b, f.key, f.value, true)
+	}
+	for _, f := range pairsToFields(keysAndValues) {
+		writeField(&b, f.key, f.value, true)
+	}
+	b.WriteString("}\n")
+	defaultOutput.writer.Write(b.Bytes())
+}
+
+func writeField(b *bytes.Buffer, key string, value interface{}, comma bool) {
+	if comma {
+		b.WriteString(",")
+	}
+	encodedKey, _ := json.Marshal(key)
+	b.Write(encodedKey)
+	b.WriteString(":")
+
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	if s, isString := value.(string); isString && IsSecret(key, s) {
+		value = Redacted
+	}
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		encodedValue, _ = json.Marshal(fmt.Sprintf("%+v", value))
+	}
+	b.Write(encodedValue)
+}
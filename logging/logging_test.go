@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func captureOutput(t *testing.T, level Level) *bytes.Buffer {
+	var b bytes.Buffer
+	SetOutput(&b)
+	SetLevel(level)
+	t.Cleanup(func() {
+		SetOutput(defaultOutputWriter)
+		SetLevel(LevelInfo)
+	})
+	return &b
+}
+
+func decodeLines(t *testing.T, b *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var decoded map[string]interface{}
+		err := json.Unmarshal([]byte(line), &decoded)
+		if err != nil {
+			t.Fatalf("Line %s isn't valid json: %s", line, err.Error())
+		}
+		lines = append(lines, decoded)
+	}
+	return lines
+}
+
+func TestLoggerFields(t *testing.T) {
+	b := captureOutput(t, LevelInfo)
+	log := Default().With("request_id", "abc", "user_id", "foo@bar")
+	log.With("user_id", "baz").Info("Created pod", "pod_name", "jupyter-baz", "error", errors.New("oops"))
+	log.Debug("Not written")
+
+	lines := decodeLines(t, b)
+	if len(lines) != 1 {
+		t.Fatalf("Expected one line, got %d: %s", len(lines), b.String())
+	}
+	expected := map[string]string{
+		"level":      "info",
+		"msg":        "Created pod",
+		"request_id": "abc",
+		"user_id":    "baz",
+		"pod_name":   "jupyter-baz",
+		"error":      "oops",
+	}
+	for key, value := range expected {
+		if lines[0][key] != value {
+			t.Fatalf("Expected %s=%s, got %v", key, value, lines[0][key])
+		}
+	}
+	if _, hasTime := lines[0]["time"]; !hasTime {
+		t.Fatal("Line is missing the time")
+	}
+	if !strings.Contains(b.String(), `"user_id":"baz"`) || strings.Count(b.String(), "user_id") != 1 {
+		t.Fatalf("Expected a single user_id field, got %s", b.String())
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	b := captureOutput(t, LevelDebug)
+	var nilLogger *Logger
+	nilLogger.Info("Settings", "ssh_token", "hunter2", "public", "ssh-ed25519 AAAAC3Nz foo@bar", "file", "notebook.ipynb")
+	if strings.Contains(b.String(), "hunter2") || strings.Contains(b.String(), "AAAAC3Nz") {
+		t.Fatalf("Secret values were logged: %s", b.String())
+	}
+	if !strings.Contains(b.String(), "notebook.ipynb") {
+		t.Fatalf("Ordinary value was redacted: %s", b.String())
+	}
+
+	settings := map[string]map[string]string{
+		"jupyter": {"FILE": "notebook.ipynb", "JUPYTER_PASSWORD": "hunter2"},
+	}
+	redacted := RedactSettings(settings)
+	if redacted["jupyter"]["FILE"] != "notebook.ipynb" || redacted["jupyter"]["JUPYTER_PASSWORD"] != Redacted {
+		t.Fatalf("Unexpected redacted settings %+v", redacted)
+	}
+	if settings["jupyter"]["JUPYTER_PASSWORD"] != "hunter2" {
+		t.Fatal("RedactSettings modified its input")
+	}
+}
@@ -1,18 +1,61 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/deic.dk/user_pods_k8s_backend/audit"
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
+	"github.com/deic.dk/user_pods_k8s_backend/podcreator"
 	"github.com/deic.dk/user_pods_k8s_backend/server"
+	"github.com/deic.dk/user_pods_k8s_backend/tlsconfig"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 )
 
 func main() {
 	globalConfig := util.MustLoadGlobalConfig()
+	logLevel, err := logging.ParseLevel(globalConfig.LogLevel)
+	if err != nil {
+		logging.Default().Warn("Invalid log level in config, using info", "error", err)
+	}
+	logging.SetLevel(logLevel)
+	if _, err := manifest.ParsePublicKeys(globalConfig.TrustedManifestKeys); err != nil {
+		panic(err.Error())
+	}
+	manifest.SetDefault(manifest.NewCache(manifest.Options{
+		TTL:          globalConfig.ManifestCacheTTL,
+		FetchTimeout: globalConfig.ManifestFetchTimeout,
+		MaxBytes:     globalConfig.ManifestMaxBytes,
+		MaxEntries:   globalConfig.ManifestCacheMaxEntries,
+		AllowedURLs:  globalConfig.ManifestWhitelist(),
+	}))
+	manifest.SetDefaultCatalog(manifest.NewCatalog(manifest.CatalogOptions{
+		Dirs:            globalConfig.ManifestCatalogDirs,
+		URLs:            globalConfig.ManifestCatalogURLs,
+		ReservedEnvVars: podcreator.ReservedEnvVars,
+	}, manifest.Default()))
 	k8sClient := k8sclient.NewK8sClient(globalConfig)
 	server := server.New(k8sClient, globalConfig)
+	if globalConfig.AuditLogFile != "" {
+		auditLog, err := audit.Open(globalConfig.AuditLogFile)
+		if err != nil {
+			panic(fmt.Sprintf("Couldn't open audit log: %s", err.Error()))
+		}
+		if valid, err := auditLog.Verify(); err != nil {
+			logging.Default().Warn("Audit log hash chain is broken", "valid_records", valid, "error", err)
+		}
+		server.Audit = auditLog
+	} else {
+		logging.Default().Warn("AuditLogFile not set, pod and storage actions won't be audited")
+	}
 
 	http.HandleFunc("/get_pods", server.ServeGetPods)
 	http.HandleFunc("/create_pod", server.ServeCreatePod)
@@ -21,10 +64,81 @@ func main() {
 	http.HandleFunc("/watch_delete_pod", server.ServeWatchDeletePod)
 	http.HandleFunc("/delete_all_user", server.ServeDeleteAllUserPods)
 	http.HandleFunc("/clean_all_unused", server.ServeCleanAllUnused)
+	http.HandleFunc("/manifests", server.ServeManifests)
+	http.HandleFunc("/storage_usage", server.ServeStorageUsage)
+	http.HandleFunc("/create_project", server.ServeCreateProject)
+	http.HandleFunc("/project_members", server.ServeProjectMembers)
+	http.HandleFunc("/delete_project", server.ServeDeleteProject)
+	http.HandleFunc("/admin/audit", server.ServeAudit)
+	http.HandleFunc("/admin/manifest_cache", server.ServeManifestCache)
+	http.HandleFunc("/healthz", server.ServeHealthz)
+	http.HandleFunc("/readyz", server.ServeReadyz)
+	http.Handle("/metrics", metrics.Handler())
+
+	// Not ready until the podcaches of existing pods have been written.
+	// Then pick up whatever the previous server didn't finish before it shut down.
+	go func() {
+		server.ReloadPodCachesUntilSuccess(30 * time.Second)
+		err := server.ResumeUnfinished(globalConfig.ShutdownStateFile)
+		if err != nil {
+			logging.Default().Error("Couldn't resume unfinished operations", "error", err)
+		}
+	}()
 
-	fmt.Printf("Listening\n")
-	err := http.ListenAndServe(":80", nil)
+	// Delete user storage that has been kept past StorageRetention
+	go server.RunStorageSweeper()
+
+	httpServer := &http.Server{Addr: globalConfig.ListenAddress}
+	if httpServer.Addr == "" {
+		httpServer.Addr = ":80"
+	}
+	if globalConfig.TLSCertFile != "" {
+		httpServer.TLSConfig, err = tlsconfig.NewServerConfig(tlsconfig.Options{
+			CertFile:          globalConfig.TLSCertFile,
+			KeyFile:           globalConfig.TLSKeyFile,
+			ClientCAFile:      globalConfig.TLSClientCAFile,
+			RequireClientCert: globalConfig.TLSRequireClientCert,
+		})
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	go func() {
+		var err error
+		if httpServer.TLSConfig != nil {
+			logging.Default().Info("Listening", "address", httpServer.Addr, "tls", true,
+				"client_certs", globalConfig.TLSClientCAFile != "")
+			// The certificate comes from TLSConfig.GetCertificate
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			logging.Default().Info("Listening", "address", httpServer.Addr, "tls", false)
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			panic(fmt.Sprintf("Error running http server: %s\n", err.Error()))
+		}
+	}()
+
+	// On SIGTERM, stop taking new work, give in-flight creations and deletions time to finish,
+	// and save the rest for the next server
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	received := <-signals
+	logging.Default().Info("Shutting down", "signal", received.String(), "timeout", server.ShutdownTimeout().String())
+	server.StartDraining()
+	if !server.WaitForWatchMaps(server.ShutdownTimeout()) {
+		err := server.SaveUnfinished(globalConfig.ShutdownStateFile)
+		if err != nil {
+			logging.Default().Error("Couldn't save unfinished operations", "error", err)
+		}
+	}
+	// Watch requests for entries that were saved may still be open, so only give them a moment
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = httpServer.Shutdown(ctx)
 	if err != nil {
-		panic(fmt.Sprintf("Error running http server: %s\n", err.Error()))
+		logging.Default().Warn("Some connections were still open at shutdown", "error", err)
 	}
+	server.Audit.Close()
+	logging.Default().Info("Shut down")
 }
@@ -0,0 +1,183 @@
+package managed
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Label on every object that was created for a pod, whose value is the pod's name
+const CreatedForPodLabel = "createdForPod"
+
+// Longest name a pod may have, so that the names and labels of what's created for it,
+// like its <pod>-ssh Service, fit in a 63 character DNS label
+const MaxPodNameLength = validation.DNS1035LabelMaxLength - len("-ssh")
+
+// An object that was created for a pod, e.g. the ssh service or a companion object from the manifest
+type CreatedObject struct {
+	Kind        string
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// How to find and delete the objects of one kind that can be created for a pod
+type createdKind struct {
+	kind        string
+	list        func(client k8sclient.K8sClient, opt metav1.ListOptions) ([]metav1.ObjectMeta, error)
+	delete      func(client k8sclient.K8sClient, name string) error
+	watchDelete func(client k8sclient.K8sClient, name string, finished *util.ReadyChannel)
+}
+
+var createdKinds = []createdKind{
+	{
+		kind: "Service",
+		list: func(client k8sclient.K8sClient, opt metav1.ListOptions) ([]metav1.ObjectMeta, error) {
+			list, err := client.ListServices(opt)
+			if err != nil {
+				return nil, err
+			}
+			metas := make([]metav1.ObjectMeta, len(list.Items))
+			for i, item := range list.Items {
+				metas[i] = item.ObjectMeta
+			}
+			return metas, nil
+		},
+		delete: func(client k8sclient.K8sClient, name string) error { return client.DeleteService(name) },
+		watchDelete: func(client k8sclient.K8sClient, name string, ch *util.ReadyChannel) {
+			client.WatchDeleteService(name, ch)
+		},
+	},
+	{
+		kind: "ConfigMap",
+		list: func(client k8sclient.K8sClient, opt metav1.ListOptions) ([]metav1.ObjectMeta, error) {
+			list, err := client.ListConfigMaps(opt)
+			if err != nil {
+				return nil, err
+			}
+			metas := make([]metav1.ObjectMeta, len(list.Items))
+			for i, item := range list.Items {
+				metas[i] = item.ObjectMeta
+			}
+			return metas, nil
+		},
+		delete: func(client k8sclient.K8sClient, name string) error { return client.DeleteConfigMap(name) },
+		watchDelete: func(client k8sclient.K8sClient, name string, ch *util.ReadyChannel) {
+			client.WatchDeleteConfigMap(name, ch)
+		},
+	},
+	{
+		kind: "Secret",
+		list: func(client k8sclient.K8sClient, opt metav1.ListOptions) ([]metav1.ObjectMeta, error) {
+			list, err := client.ListSecrets(opt)
+			if err != nil {
+				return nil, err
+			}
+			metas := make([]metav1.ObjectMeta, len(list.Items))
+			for i, item := range list.Items {
+				metas[i] = item.ObjectMeta
+			}
+			return metas, nil
+		},
+		delete: func(client k8sclient.K8sClient, name string) error { return client.DeleteSecret(name) },
+		watchDelete: func(client k8sclient.K8sClient, name string, ch *util.ReadyChannel) {
+			client.WatchDeleteSecret(name, ch)
+		},
+	},
+	{
+		kind: "Ingress",
+		list: func(client k8sclient.K8sClient, opt metav1.ListOptions) ([]metav1.ObjectMeta, error) {
+			list, err := client.ListIngresses(opt)
+			if err != nil {
+				return nil, err
+			}
+			metas := make([]metav1.ObjectMeta, len(list.Items))
+			for i, item := range list.Items {
+				metas[i] = item.ObjectMeta
+			}
+			return metas, nil
+		},
+		delete: func(client k8sclient.K8sClient, name string) error { return client.DeleteIngress(name) },
+		watchDelete: func(client k8sclient.K8sClient, name string, ch *util.ReadyChannel) {
+			client.WatchDeleteIngress(name, ch)
+		},
+	},
+}
+
+func getCreatedKind(kind string) (createdKind, error) {
+	for _, k := range createdKinds {
+		if k.kind == kind {
+			return k, nil
+		}
+	}
+	return createdKind{}, errors.New(fmt.Sprintf("Objects of kind %s aren't created for pods", kind))
+}
+
+// List the objects of every kind that is created for pods, whose labels match selector
+func ListCreatedObjects(client k8sclient.K8sClient, selector string) ([]CreatedObject, error) {
+	var objects []CreatedObject
+	for _, k := range createdKinds {
+		metas, err := k.list(client, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't list %s objects: %s", k.kind, err.Error()))
+		}
+		for _, meta := range metas {
+			objects = append(objects, CreatedObject{Kind: k.kind, Name: meta.Name, Labels: meta.Labels, Annotations: meta.Annotations})
+		}
+	}
+	return objects, nil
+}
+
+// Call for deletion of object, and send true to finished once it's gone
+func DeleteCreatedObject(object CreatedObject, client k8sclient.K8sClient, finished *util.ReadyChannel) error {
+	k, err := getCreatedKind(object.Kind)
+	if err != nil {
+		return err
+	}
+	go k.watchDelete(client, object.Name, finished)
+	return k.delete(client, object.Name)
+}
+
+// Delete every object created for the pod named podName, sending true to finished once they are all gone
+func DeleteCreatedForPod(
+	podName string,
+	client k8sclient.K8sClient,
+	globalConfig util.GlobalConfig,
+	log *logging.Logger,
+	finished *util.ReadyChannel,
+) error {
+	objects, err := ListCreatedObjects(client, fmt.Sprintf("%s=%s", CreatedForPodLabel, podName))
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		finished.Send(true)
+		return nil
+	}
+	deleteChannels := make([]*util.ReadyChannel, len(objects))
+	for i, object := range objects {
+		ch := util.NewReadyChannel(globalConfig.TimeoutDelete)
+		deleteChannels[i] = ch
+		object := object
+		go func() {
+			if ch.Receive() {
+				log.Info("Deleted object created for pod", "kind", object.Kind, "name", object.Name)
+			} else {
+				log.Warn("Failed to delete object created for pod", "kind", object.Kind, "name", object.Name, "reason", ch.Reason())
+			}
+		}()
+		err := DeleteCreatedObject(object, client, ch)
+		if err != nil {
+			log.Error("Couldn't call for deletion of object created for pod", "kind", object.Kind, "name", object.Name, "error", err)
+			ch.Fail("delete_call")
+		}
+	}
+	// Then only signal finished when each object has been deleted successfully
+	util.CombineReadyChannels(deleteChannels, finished)
+	return nil
+}
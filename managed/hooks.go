@@ -0,0 +1,122 @@
+package managed
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// How long to wait before running a hook again after it failed
+var hookRetryDelay = 2 * time.Second
+
+// How long before the deadline of the pod's start jobs its post-start hooks must finish,
+// so that a slow hook fails the creation as post_start_hook rather than timeout, and the pod cache can still be saved
+const postStartHookMargin = 5 * time.Second
+
+// Run the command in the container of the pod through the exec api, replaced in tests
+var podExec = func(p *Pod, command []string, nContainer int) (bytes.Buffer, bytes.Buffer, error) {
+	return p.Client.PodExec(command, p.Object, nContainer)
+}
+
+type execResult struct {
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+	err    error
+}
+
+// Return the index of the pod's container with the given name
+func containerIndex(pod *apiv1.Pod, name string) (int, error) {
+	for i, container := range pod.Spec.Containers {
+		if container.Name == name {
+			return i, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("pod %s doesn't have container %s", pod.Name, name))
+}
+
+// Run the command in the container through PodExec, giving up after timeout.
+// The exec api can't be cancelled, so a command that times out keeps running until it finishes or the pod is deleted.
+func (p *Pod) execWithTimeout(command []string, nContainer int, timeout time.Duration) error {
+	done := make(chan execResult, 1)
+	go func() {
+		stdout, stderr, err := podExec(p, command, nContainer)
+		done <- execResult{stdout: stdout, stderr: stderr, err: err}
+	}()
+	select {
+	case result := <-done:
+		if result.err != nil {
+			return errors.New(fmt.Sprintf("%s %s", result.err.Error(), strings.TrimSpace(result.stderr.String())))
+		}
+		return nil
+	case <-time.After(timeout):
+		return errors.New(fmt.Sprintf("timed out after %s", timeout.String()))
+	}
+}
+
+// Run the hook until it succeeds or has failed 1 + hook.Retries times, returning the last error.
+// No attempt runs past the deadline, so an attempt may get less than the hook's timeout.
+func (p *Pod) runHook(hook manifest.Hook, deadline time.Time) error {
+	nContainer, err := containerIndex(p.Object, hook.Container)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt <= hook.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(hookRetryDelay)
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			err = errors.New(fmt.Sprintf("no time left for attempt %d", attempt+1))
+			break
+		}
+		timeout := hook.Timeout()
+		if remaining < timeout {
+			timeout = remaining
+		}
+		err = p.execWithTimeout(hook.Command, nContainer, timeout)
+		if err == nil {
+			p.Log.Info("Ran hook", "hook", hook.Name, "attempt", attempt+1)
+			return nil
+		}
+		p.Log.Warn("Hook failed", "hook", hook.Name, "attempt", attempt+1, "error", err)
+	}
+	return errors.New(fmt.Sprintf("hook %s failed: %s", hook.Name, err.Error()))
+}
+
+// Run the pod's post-start hooks in order before the deadline, stopping at the first that fails
+func (p *Pod) runPostStartHooks(deadline time.Time) error {
+	hooks, err := manifest.PodHooks(p.Object)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks.PostStart {
+		if err := p.runHook(hook, deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run the pod's pre-stop hooks in order if it's running, e.g. to flush data to its storage before it's deleted.
+// Every hook is run until the deadline even if one fails, and failures are only logged,
+// so that they can't keep the pod from being deleted.
+func (p *Pod) RunPreStopHooks(deadline time.Time) {
+	if p.Object.Status.Phase != apiv1.PodRunning {
+		return
+	}
+	hooks, err := manifest.PodHooks(p.Object)
+	if err != nil {
+		p.Log.Error("Couldn't read pre-stop hooks", "error", err)
+		return
+	}
+	for _, hook := range hooks.PreStop {
+		if err := p.runHook(hook, deadline); err != nil {
+			p.Log.Error("Pre-stop hook failed, deleting the pod anyway", "error", err)
+		}
+	}
+}
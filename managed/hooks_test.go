@@ -0,0 +1,84 @@
+package managed
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Replace podExec with exec for the rest of the test, and count the attempts
+func fakePodExec(t *testing.T, exec func(attempt int32) error) *int32 {
+	var attempts int32
+	realExec, realDelay := podExec, hookRetryDelay
+	podExec = func(p *Pod, command []string, nContainer int) (bytes.Buffer, bytes.Buffer, error) {
+		return bytes.Buffer{}, bytes.Buffer{}, exec(atomic.AddInt32(&attempts, 1))
+	}
+	hookRetryDelay = time.Millisecond
+	t.Cleanup(func() {
+		podExec, hookRetryDelay = realExec, realDelay
+	})
+	return &attempts
+}
+
+func TestRunHook(t *testing.T) {
+	pod := NewPod(&apiv1.Pod{Spec: apiv1.PodSpec{Containers: []apiv1.Container{{Name: "jupyter"}}}}, k8sclient.K8sClient{}, util.GlobalConfig{})
+	hook := manifest.Hook{Name: "seed", Container: "jupyter", Command: []string{"true"}, Retries: 2, TimeoutSeconds: 1}
+	deadline := time.Now().Add(time.Minute)
+
+	// A hook is retried until it succeeds
+	attempts := fakePodExec(t, func(attempt int32) error {
+		if attempt < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	if err := pod.runHook(hook, deadline); err != nil || atomic.LoadInt32(attempts) != 3 {
+		t.Fatalf("Expected success on the third attempt, got %v after %d", err, atomic.LoadInt32(attempts))
+	}
+
+	// and fails once it has no retries left
+	attempts = fakePodExec(t, func(attempt int32) error { return errors.New("failed") })
+	if err := pod.runHook(hook, deadline); err == nil || atomic.LoadInt32(attempts) != 3 {
+		t.Fatalf("Expected failure after 3 attempts, got %v after %d", err, atomic.LoadInt32(attempts))
+	}
+
+	// An attempt that takes longer than the timeout fails
+	release := make(chan struct{})
+	exited := make(chan struct{}, 10)
+	attempts = fakePodExec(t, func(attempt int32) error {
+		<-release
+		exited <- struct{}{}
+		return nil
+	})
+	hook.Retries = 0
+	start := time.Now()
+	if err := pod.runHook(hook, deadline); err == nil || time.Since(start) > 5*time.Second {
+		t.Fatalf("Expected the attempt to time out after 1s, got %v after %s", err, time.Since(start))
+	}
+
+	// Attempts don't run past the deadline
+	hook.Retries, hook.TimeoutSeconds = 5, 60
+	start = time.Now()
+	if err := pod.runHook(hook, time.Now().Add(100*time.Millisecond)); err == nil || time.Since(start) > 5*time.Second {
+		t.Fatalf("Expected the hook to stop at the deadline, got %v after %s", err, time.Since(start))
+	}
+	if atomic.LoadInt32(attempts) != 2 {
+		t.Fatalf("Expected no attempts after the deadline, got %d", atomic.LoadInt32(attempts))
+	}
+	// Let the attempts that timed out finish before podExec is restored
+	close(release)
+	<-exited
+	<-exited
+
+	hook.Container = "missing"
+	if err := pod.runHook(hook, deadline); err == nil {
+		t.Fatal("Expected an error for a container the pod doesn't have")
+	}
+}
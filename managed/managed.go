@@ -12,9 +12,10 @@ import (
 	"time"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	apiv1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
@@ -25,6 +26,7 @@ type User struct {
 	Domain       string
 	Client       k8sclient.K8sClient
 	GlobalConfig util.GlobalConfig
+	Log          *logging.Logger
 }
 
 func NewUser(userID string, client k8sclient.K8sClient, globalConfig util.GlobalConfig) User {
@@ -39,12 +41,36 @@ func NewUser(userID string, client k8sclient.K8sClient, globalConfig util.Global
 		Domain:       domain,
 		Client:       client,
 		GlobalConfig: globalConfig,
+		Log:          logging.Default().With("user_id", userID),
 	}
 }
 
+// Log with the fields of log, e.g. a request ID, from now on
+func (u *User) SetLogger(log *logging.Logger) {
+	u.Log = log.With("user_id", u.UserID)
+}
+
+// Return the labels that mark an object as belonging to the user.
+// The user and domain labels are shortened if they don't fit in a label value, the full userID is in GetAnnotations.
+func (u *User) GetLabels() map[string]string {
+	return map[string]string{
+		"user":             util.LabelValue(u.Name),
+		"domain":           util.LabelValue(u.Domain),
+		util.UserHashLabel: util.HashUserID(u.UserID),
+	}
+}
+
+// Return the annotations that mark an object as belonging to the user
+func (u *User) GetAnnotations() map[string]string {
+	return map[string]string{util.UserIDAnnotation: u.UserID}
+}
+
+// Return list options for finding the user's objects.
+// These also match objects made before the userHash label was added,
+// and may match other users whose shortened labels are the same, so the owner must be checked.
 func (u *User) GetListOptions() metav1.ListOptions {
 	opt := metav1.ListOptions{}
-	opt.LabelSelector = fmt.Sprintf("user=%s,domain=%s", u.Name, u.Domain)
+	opt.LabelSelector = fmt.Sprintf("user=%s,domain=%s", util.LabelValue(u.Name), util.LabelValue(u.Domain))
 	return opt
 }
 
@@ -54,13 +80,17 @@ func (u *User) ListPods() ([]Pod, error) {
 	if err != nil {
 		return pods, err
 	}
-	pods = make([]Pod, len(podList.Items))
+	pods = make([]Pod, 0, len(podList.Items))
 	for i := 0; i < len(podList.Items); i++ {
+		// The helper pods that measure storage usage aren't the user's pods
+		if _, isStorageUsage := podList.Items[i].Labels[StorageUsagePodLabel]; isStorageUsage {
+			continue
+		}
 		pod := NewPod(&podList.Items[i], u.Client, u.GlobalConfig)
 		if pod.Owner.UserID == u.UserID {
-			pods[i] = pod
+			pods = append(pods, pod)
 		} else {
-			fmt.Printf("Warning: pod %s has labels matching userID %s, but userID %s was expected\n", pod.Object.Name, pod.Owner.UserID, u.UserID)
+			u.Log.Debug("Pod has labels matching a different userID", "pod_name", pod.Object.Name, "pod_owner", pod.Owner.UserID)
 		}
 	}
 	return pods, nil
@@ -73,11 +103,27 @@ func (u *User) OwnsPod(podName string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return (len(podList.Items) > 0), nil
+	for _, pod := range podList.Items {
+		if util.GetUserIDFromMeta(pod.ObjectMeta) == u.UserID {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-// Make a unique string to identify userID in api objects
+// Longest part of the user string that's taken from the userID
+const userSlugLength = 20
+
+// Make a unique string to identify userID in api object names, e.g. foo-bar-dk-1a2b3c4d5e for foo@bar.dk.
+// The readable part is shortened so names stay within DNS limits, and the hash keeps IDs that
+// shorten to the same string, like a.b@x and a-b@x, apart.
 func (u *User) GetUserString() string {
+	return fmt.Sprintf("%s-%s", util.NameSlug(u.UserID, userSlugLength), util.HashUserID(u.UserID))
+}
+
+// Return the user string used before GetUserString included a hash, which objects
+// created back then are still named with
+func (u *User) getLegacyUserString() string {
 	userString := strings.Replace(u.UserID, "@", "-", -1)
 	userString = strings.Replace(userString, ".", "-", -1)
 	return userString
@@ -88,154 +134,183 @@ func (u *User) GetStoragePVName() string {
 	return fmt.Sprintf("user-storage-%s", u.GetUserString())
 }
 
+// Return the name the user's storage had before GetUserString included a hash.
+// Other users may share it, so a PV or PVC with this name isn't necessarily the user's.
+func (u *User) getLegacyStoragePVName() string {
+	return fmt.Sprintf("user-storage-%s", u.getLegacyUserString())
+}
+
 // Return list options for finding the user's PV and PVC (since they have the same name)
 func (u *User) GetStorageListOptions() metav1.ListOptions {
 	return metav1.ListOptions{LabelSelector: fmt.Sprintf("name=%s", u.GetStoragePVName())}
 }
 
-func (u *User) getNfsStoragePath() string {
-	return fmt.Sprintf("%s/%s", u.GlobalConfig.NfsStorageRoot, u.UserID)
+// Return the names of the user's storage PVs and PVCs: the current name,
+// and the legacy name if the PVC with that name belongs to the user
+func (u *User) getStoragePVNames() ([]string, error) {
+	names := []string{u.GetStoragePVName()}
+	legacyName := u.getLegacyStoragePVName()
+	pvcList, err := u.Client.ListPVC(metav1.ListOptions{LabelSelector: fmt.Sprintf("name=%s", legacyName)})
+	if err != nil {
+		return nil, err
+	}
+	for _, pvc := range pvcList.Items {
+		if util.GetUserIDFromMeta(pvc.ObjectMeta) == u.UserID {
+			names = append(names, legacyName)
+			break
+		}
+	}
+	return names, nil
 }
 
-// Generate an api object for the PV to attempt to create for the user's nfs storage
-func (u *User) GetTargetStoragePV(nfsIP string) *apiv1.PersistentVolume {
-	return &apiv1.PersistentVolume{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: u.GetStoragePVName(),
-			Labels: map[string]string{
-				"name":   u.GetStoragePVName(),
-				"user":   u.Name,
-				"domain": u.Domain,
-				"server": nfsIP,
-			},
-		},
-		Spec: apiv1.PersistentVolumeSpec{
-			AccessModes: []apiv1.PersistentVolumeAccessMode{
-				"ReadWriteMany",
-			},
-			PersistentVolumeReclaimPolicy: apiv1.PersistentVolumeReclaimRetain,
-			StorageClassName:              "nfs",
-			MountOptions: []string{
-				"hard",
-				"nfsvers=4.1",
-			},
-			PersistentVolumeSource: apiv1.PersistentVolumeSource{
-				NFS: &apiv1.NFSVolumeSource{
-					Server: nfsIP,
-					Path:   u.getNfsStoragePath(),
-				},
-			},
-			ClaimRef: &apiv1.ObjectReference{
-				Namespace: u.GlobalConfig.Namespace,
-				Name:      u.GetStoragePVName(),
-				Kind:      "PersistentVolumeClaim",
-			},
-			Capacity: apiv1.ResourceList{
-				apiv1.ResourceStorage: resource.MustParse("10Gi"),
-			},
-		},
+func (u *User) getStorageLabels(nfsIP string) map[string]string {
+	labels := u.GetLabels()
+	labels["name"] = u.GetStoragePVName()
+	labels["server"] = nfsIP
+	return labels
+}
+
+// Return the provisioner of the user's storage, chosen by the user's silo and domain
+func (u *User) GetStorageProvisioner(nfsIP string) (StorageProvisioner, error) {
+	return NewStorageProvisioner(u.GlobalConfig.StorageConfigFor(nfsIP, u.Domain), u.GlobalConfig.NfsStorageRoot)
+}
+
+func (u *User) getStorageTarget(nfsIP string) StorageTarget {
+	return StorageTarget{
+		Name:        u.GetStoragePVName(),
+		Namespace:   u.GlobalConfig.Namespace,
+		Labels:      u.getStorageLabels(nfsIP),
+		Annotations: u.GetAnnotations(),
+		UserID:      u.UserID,
+		Directory:   u.UserID,
+		SiloIP:      nfsIP,
 	}
 }
 
-// Generate an api object for the PVC to attempt to create for the user's nfs storage
-func (u *User) GetTargetStoragePVC(nfsIP string) *apiv1.PersistentVolumeClaim {
-	return &apiv1.PersistentVolumeClaim{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: u.GlobalConfig.Namespace,
-			Name:      u.GetStoragePVName(),
-			Labels: map[string]string{
-				"name":   u.GetStoragePVName(),
-				"user":   u.Name,
-				"domain": u.Domain,
-				"server": nfsIP,
-			},
-		},
-		Spec: apiv1.PersistentVolumeClaimSpec{
-			//			StorageClassName: "nfs",
-			AccessModes: []apiv1.PersistentVolumeAccessMode{
-				"ReadWriteMany",
-			},
-			VolumeName: u.GetStoragePVName(),
-			Resources: apiv1.ResourceRequirements{
-				Requests: apiv1.ResourceList{
-					apiv1.ResourceStorage: resource.MustParse("10Gi"),
-				},
-			},
-		},
+// Generate an api object for the PV to attempt to create for the user's storage,
+// or nil if the storage's PV is provisioned dynamically
+func (u *User) GetTargetStoragePV(nfsIP string) (*apiv1.PersistentVolume, error) {
+	provisioner, err := u.GetStorageProvisioner(nfsIP)
+	if err != nil {
+		return nil, err
 	}
+	return provisioner.TargetPV(u.getStorageTarget(nfsIP)), nil
 }
 
-// Delete the user's storage PV and PVC
+// Generate an api object for the PVC to attempt to create for the user's storage
+func (u *User) GetTargetStoragePVC(nfsIP string) (*apiv1.PersistentVolumeClaim, error) {
+	provisioner, err := u.GetStorageProvisioner(nfsIP)
+	if err != nil {
+		return nil, err
+	}
+	return provisioner.TargetPVC(u.getStorageTarget(nfsIP)), nil
+}
+
+// Delete the user's storage PV and PVC, including ones with the legacy name
 func (u *User) DeleteUserStorage(finished *util.ReadyChannel) error {
-	pvName := u.GetStoragePVName()
+	pvNames, err := u.getStoragePVNames()
+	if err != nil {
+		return err
+	}
+	var channels []*util.ReadyChannel
+	for _, pvName := range pvNames {
+		pvChan, pvcChan, err := u.deleteStorage(pvName)
+		if err != nil {
+			return err
+		}
+		channels = append(channels, pvChan, pvcChan)
+	}
+	// Then combine the channels so `finished` will see when every PV and PVC is deleted
+	util.CombineReadyChannels(channels, finished)
+	return nil
+}
+
+// Delete the PV and PVC named pvName, returning channels that receive true once each is gone
+func (u *User) deleteStorage(pvName string) (*util.ReadyChannel, *util.ReadyChannel, error) {
+	return deleteStorageObjects(u.Client, u.GlobalConfig, u.Log, pvName)
+}
+
+// Delete the PV and PVC named pvName, returning channels that receive true once each is gone
+func deleteStorageObjects(client k8sclient.K8sClient, globalConfig util.GlobalConfig, log *logging.Logger, pvName string) (*util.ReadyChannel, *util.ReadyChannel, error) {
 	// Start a watcher for PV deletion,
-	pvChan := util.NewReadyChannel(u.GlobalConfig.TimeoutDelete)
+	pvChan := util.NewReadyChannel(globalConfig.TimeoutDelete)
 	// Then try to delete the PV.
-	err := u.Client.DeletePV(pvName)
+	err := client.DeletePV(pvName)
 	// If there is an error,
 	if err != nil {
 		// If the error message is that the PV is not found, that's okay. Signal that the PV is in the desired state.
 		if regexp.MustCompile(fmt.Sprintf("\"%s\" not found", pvName)).MatchString(err.Error()) {
 			pvChan.Send(true)
 		} else { // If the error message is something else, there's a problem that should be handled.
-			return err
+			return nil, nil, err
 		}
 	} else { // if the delete request was issued successfully, then listen log the result
 		go func() {
-			u.Client.WatchDeletePV(pvName, pvChan)
+			client.WatchDeletePV(pvName, pvChan)
 			if pvChan.Receive() {
-				fmt.Printf("Deleted PV %s\n", pvName)
+				log.Info("Deleted PV", "pv", pvName)
 			} else {
-				fmt.Printf("Warning: failed to delete PV %s\n", pvName)
+				log.Warn("Failed to delete PV", "pv", pvName, "reason", pvChan.Reason())
 			}
 		}()
 	}
 
 	// Repeat for the PVC
-	pvcChan := util.NewReadyChannel(u.GlobalConfig.TimeoutDelete)
-	err = u.Client.DeletePVC(pvName)
+	pvcChan := util.NewReadyChannel(globalConfig.TimeoutDelete)
+	err = client.DeletePVC(pvName)
 	if err != nil {
 		if regexp.MustCompile(fmt.Sprintf("\"%s\" not found", pvName)).MatchString(err.Error()) {
 			pvcChan.Send(true)
 		} else {
-			return err
+			return nil, nil, err
 		}
 	} else {
 		go func() {
-			u.Client.WatchDeletePVC(pvName, pvcChan)
+			client.WatchDeletePVC(pvName, pvcChan)
 			if pvcChan.Receive() {
-				fmt.Printf("Deleted PVC %s\n", pvName)
+				log.Info("Deleted PVC", "pvc", pvName)
 			} else {
-				fmt.Printf("Warning: failed to delete PVC %s\n", pvName)
+				log.Warn("Failed to delete PVC", "pvc", pvName, "reason", pvcChan.Reason())
 			}
 		}()
 	}
-
-	// Then combine the channels so `finished` will see when both PV and PVC are deleted
-	util.CombineReadyChannels([]*util.ReadyChannel{pvChan, pvcChan}, finished)
-	return nil
+	return pvChan, pvcChan, nil
 }
 
-// Check that the PV and PVC for the user's nfs storage exist and create them if not
+// Check that the PV and PVC for the user's storage exist and create them if not, as ensureStorage does
 func (u *User) CreateUserStorageIfNotExist(ready *util.ReadyChannel, nfsIP string) error {
-	listOptions := u.GetStorageListOptions()
-	PVready := util.NewReadyChannel(u.GlobalConfig.TimeoutCreate)
-	PVCready := util.NewReadyChannel(u.GlobalConfig.TimeoutCreate)
-	PVList, err := u.Client.ListPV(listOptions)
+	provisioner, err := u.GetStorageProvisioner(nfsIP)
 	if err != nil {
 		return err
 	}
-	if len(PVList.Items) == 0 {
-		targetPV := u.GetTargetStoragePV(nfsIP)
+	return ensureStorage(u.Client, u.GlobalConfig, u.Log, provisioner, u.getStorageTarget(nfsIP), u.KeepUserStorage, ready)
+}
+
+// Create targetPV unless it exists or is nil, and targetPVC unless it exists,
+// sending true to ready once both are ready. If targetPV is nil, the PV that the PVC is bound to
+// is patched to Retain first, which also covers storage made before that was done.
+func createStorageObjects(
+	client k8sclient.K8sClient,
+	globalConfig util.GlobalConfig,
+	log *logging.Logger,
+	targetPV *apiv1.PersistentVolume,
+	targetPVC *apiv1.PersistentVolumeClaim,
+	pvExists bool,
+	pvcExists bool,
+	ready *util.ReadyChannel,
+) error {
+	PVready := util.NewReadyChannel(globalConfig.TimeoutCreate)
+	PVCready := util.NewReadyChannel(globalConfig.TimeoutCreate)
+	if !pvExists && targetPV != nil {
 		go func() {
-			u.Client.WatchCreatePV(targetPV.Name, PVready)
+			client.WatchCreatePV(targetPV.Name, PVready)
 			if PVready.Receive() {
-				fmt.Printf("Ready PV %s\n", targetPV.Name)
+				log.Info("PV ready", "pv", targetPV.Name)
 			} else {
-				fmt.Printf("Warning PV %s didn't reach ready state\n", targetPV.Name)
+				log.Warn("PV didn't reach ready state", "pv", targetPV.Name, "reason", PVready.Reason())
 			}
 		}()
-		_, err := u.Client.CreatePV(targetPV)
+		_, err := client.CreatePV(targetPV)
 		if err != nil {
 			return err
 		}
@@ -243,28 +318,41 @@ func (u *User) CreateUserStorageIfNotExist(ready *util.ReadyChannel, nfsIP strin
 		PVready.Send(true)
 	}
 
-	PVCList, err := u.Client.ListPVC(listOptions)
-	if err != nil {
-		return err
-	}
-	if len(PVCList.Items) == 0 {
-		targetPVC := u.GetTargetStoragePVC(nfsIP)
+	if !pvcExists {
 		go func() {
-			u.Client.WatchCreatePVC(targetPVC.Name, PVCready)
+			client.WatchCreatePVC(targetPVC.Name, PVCready)
 			if PVCready.Receive() {
-				fmt.Printf("Ready PVC %s\n", targetPVC.Name)
+				log.Info("PVC ready", "pvc", targetPVC.Name)
 			} else {
-				fmt.Printf("Warning PVC %s didn't reach ready state\n", targetPVC.Name)
+				log.Warn("PVC didn't reach ready state", "pvc", targetPVC.Name, "reason", PVCready.Reason())
 			}
 		}()
-		_, err := u.Client.CreatePVC(targetPVC)
+		_, err := client.CreatePVC(targetPVC)
 		if err != nil {
 			return err
 		}
 	} else {
 		PVCready.Send(true)
 	}
-	go util.CombineReadyChannels([]*util.ReadyChannel{PVready, PVCready}, ready)
+	channels := []*util.ReadyChannel{PVready, PVCready}
+	if targetPV == nil {
+		retained := util.NewReadyChannel(globalConfig.TimeoutCreate)
+		go func() {
+			if !PVCready.Receive() {
+				retained.Fail(PVCready.Reason())
+				return
+			}
+			err := retainBoundPV(client, targetPVC.Name)
+			if err != nil {
+				log.Error("Couldn't keep the data of dynamically provisioned storage", "pvc", targetPVC.Name, "error", err)
+				retained.Fail("retain_pv")
+				return
+			}
+			retained.Send(true)
+		}()
+		channels = append(channels, retained)
+	}
+	go util.CombineReadyChannels(channels, ready)
 	return nil
 }
 
@@ -288,17 +376,29 @@ type PodInfo struct {
 	Url               string            `json:"url"`
 	Tokens            map[string]string `json:"tokens"`
 	OtherResourceInfo map[string]string `json:"k8s_pod_info"`
+	// Requests and limits of each container by name
+	Resources map[string]apiv1.ResourceRequirements `json:"resources"`
 }
 
+// Reasons that start and delete jobs can fail with, reported through their finished ReadyChannel
+const (
+	ReasonNotReady       = "not_ready"
+	ReasonPodCache       = "pod_cache"
+	ReasonNotDeleted     = "not_deleted"
+	ReasonCreatedObjects = "created_objects"
+	ReasonPostStartHook  = "post_start_hook"
+)
+
 type Pod struct {
 	Object       *apiv1.Pod
 	Owner        User
 	Client       k8sclient.K8sClient
 	GlobalConfig util.GlobalConfig
+	Log          *logging.Logger
 }
 
 func NewPod(existingPod *apiv1.Pod, client k8sclient.K8sClient, globalConfig util.GlobalConfig) Pod {
-	userID := util.GetUserIDFromLabels(existingPod.ObjectMeta.Labels)
+	userID := util.GetUserIDFromMeta(existingPod.ObjectMeta)
 	var owner User
 	if userID != "" {
 		owner = NewUser(userID, client, globalConfig)
@@ -308,9 +408,27 @@ func NewPod(existingPod *apiv1.Pod, client k8sclient.K8sClient, globalConfig uti
 		Client:       client,
 		Owner:        owner,
 		GlobalConfig: globalConfig,
+		Log:          logging.Default().With("user_id", userID, "pod_name", existingPod.Name),
+	}
+}
+
+// Log with the fields of log, e.g. a request ID, from now on, including in the pod's start and delete jobs
+func (p *Pod) SetLogger(log *logging.Logger) {
+	p.Log = log.With("user_id", p.Owner.UserID, "pod_name", p.Object.Name)
+	if p.Owner.UserID != "" {
+		p.Owner.SetLogger(log)
 	}
 }
 
+// Return the name of the manifest the pod was created from, or "unknown" for pods without the label
+func (p *Pod) GetManifestName() string {
+	manifest, exists := p.Object.ObjectMeta.Labels["manifest"]
+	if !exists || manifest == "" {
+		return "unknown"
+	}
+	return manifest
+}
+
 func (p *Pod) GetCacheFilename() string {
 	return fmt.Sprintf("%s/%s", p.GlobalConfig.TokenDir, p.Object.Name)
 }
@@ -335,6 +453,10 @@ func (p *Pod) GetPodInfo() PodInfo {
 	podInfo.PodIP = p.Object.Status.PodIP
 	podInfo.PodName = p.Object.Name
 	podInfo.Status = fmt.Sprintf("%s:%s", p.Object.Status.Phase, startTimeStr)
+	podInfo.Resources = make(map[string]apiv1.ResourceRequirements)
+	for _, container := range p.Object.Spec.Containers {
+		podInfo.Resources[container.Name] = container.Resources
+	}
 
 	cache, err := p.loadPodCache()
 	if err == nil {
@@ -361,7 +483,7 @@ func (p *Pod) NeedsSshService() bool {
 
 func (p *Pod) ListServices() (*apiv1.ServiceList, error) {
 	opt := metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("createdForPod=%s", p.Object.Name),
+		LabelSelector: fmt.Sprintf("%s=%s", CreatedForPodLabel, p.Object.Name),
 	}
 	return p.Client.ListServices(opt)
 }
@@ -399,7 +521,7 @@ func (p *Pod) getOtherResourceInfo() map[string]string {
 	if p.NeedsSshService() {
 		sshPort, err := p.getSshPort()
 		if err != nil {
-			fmt.Printf("Error while copying ssh port for pod %s: %s\n", p.Object.Name, err.Error())
+			p.Log.Error("Couldn't copy ssh port", "error", err)
 		} else {
 			otherResourceInfo["sshPort"] = sshPort
 		}
@@ -454,31 +576,11 @@ func (p *Pod) loadPodCache() (podCache, error) {
 	return cache, nil
 }
 
-func (p *Pod) DeleteAllServices(finished *util.ReadyChannel) error {
-	serviceList, err := p.ListServices()
+// Delete the services and companion objects that were created for the pod
+func (p *Pod) DeleteCreatedObjects(finished *util.ReadyChannel) error {
+	err := DeleteCreatedForPod(p.Object.Name, p.Client, p.GlobalConfig, p.Log, finished)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't list services for pod %s", err.Error()))
-	}
-	if len(serviceList.Items) > 0 {
-		deleteChannels := make([]*util.ReadyChannel, len(serviceList.Items))
-		// For each service, call for deletion and add a watcher channel to the list of deleteChannels
-		for i, service := range serviceList.Items {
-			ch := util.NewReadyChannel(p.GlobalConfig.TimeoutDelete)
-			deleteChannels[i] = ch
-			go func() {
-				p.Client.WatchDeleteService(service.Name, ch)
-				if ch.Receive() {
-					fmt.Printf("Deleted SVC %s\n", service.Name)
-				} else {
-					fmt.Printf("Warning: failed to delete SVC %s\n", service.Name)
-				}
-			}()
-			p.Client.DeleteService(service.Name)
-		}
-		// Then only signal finished when each service has been deleted successfully
-		util.CombineReadyChannels(deleteChannels, finished)
-	} else {
-		finished.Send(true)
+		return errors.New(fmt.Sprintf("Couldn't delete objects created for pod: %s", err.Error()))
 	}
 	return nil
 }
@@ -488,7 +590,11 @@ func (p *Pod) RunDeleteJobsWhenReady(ready *util.ReadyChannel, finished *util.Re
 	// If ready.Receive() is false (due to timeout or failure),
 	// then signal false on finished channel, and do not attempt delete jobs
 	if !ready.Receive() {
-		finished.Send(false)
+		reason := ready.Reason()
+		if reason == "" {
+			reason = ReasonNotDeleted
+		}
+		finished.Fail(reason)
 		return
 	}
 
@@ -497,15 +603,15 @@ func (p *Pod) RunDeleteJobsWhenReady(ready *util.ReadyChannel, finished *util.Re
 	if err != nil {
 		// if there was an error other than that the file didn't exist, log it
 		if !os.IsNotExist(err) {
-			fmt.Printf("Error while deleting cache for pod %s: %s\n", p.Object.Name, err.Error())
+			p.Log.Error("Couldn't delete pod cache", "error", err)
 		}
 	}
 
-	// Delete all of the pod's related services
-	err = p.DeleteAllServices(finished)
+	// Delete all of the pod's related services and companion objects
+	err = p.DeleteCreatedObjects(finished)
 	if err != nil {
-		fmt.Printf("Error deleting services: %s", err.Error())
-		finished.Send(false)
+		p.Log.Error("Couldn't delete objects created for pod", "error", err)
+		finished.Fail(ReasonCreatedObjects)
 	}
 }
 
@@ -515,36 +621,40 @@ func (p *Pod) RunDeleteJobsWhenReady(ready *util.ReadyChannel, finished *util.Re
 // or send false if any step fails
 func (p *Pod) RunStartJobsWhenReady(requiredToStartJobs []*util.ReadyChannel, finishedStartJobs *util.ReadyChannel) {
 	// block this function until a result is read from each channel in requiredToStartJobs
-	ready := util.ReceiveReadyChannels(requiredToStartJobs)
-	if !ready {
-		fmt.Printf("Warning: Pod %s and/or user storage didn't reach ready state. Start jobs not attempted.\n", p.Object.Name)
-		finishedStartJobs.Send(false)
+	ready := util.NewReadyChannel(p.GlobalConfig.TimeoutCreate)
+	util.CombineReadyChannels(requiredToStartJobs, ready)
+	if !ready.Receive() {
+		p.Log.Warn("Pod and/or user storage didn't reach ready state, start jobs not attempted", "reason", ready.Reason())
+		reason := ready.Reason()
+		if reason == "" {
+			reason = ReasonNotReady
+		}
+		finishedStartJobs.Fail(reason)
 		return
 	}
 
-	// Ensure no orphaned services for deleted pods with this pod's name
-	cleanedOrphanedServices := util.NewReadyChannel(p.GlobalConfig.TimeoutDelete)
-	err := p.DeleteAllServices(cleanedOrphanedServices)
-	if err != nil {
-		fmt.Printf("Error cleaning up orphaned services %s", err.Error())
-		finishedStartJobs.Send(false)
-		return
-	}
-	if !cleanedOrphanedServices.Receive() {
-		fmt.Printf("Couldn't ensure orphaned services were removed for pod %s, didn't continue start jobs", p.Object.Name)
-		finishedStartJobs.Send(false)
-		return
-	}
+	// Orphaned objects from deleted pods with this pod's name were removed before the pod was created,
+	// so everything labelled createdForPod now belongs to this pod
 
 	// Perform start jobs here
 
 	if p.NeedsSshService() {
-		p.startSshService()
+		err := p.startSshService()
+		if err != nil {
+			p.Log.Error("Couldn't start ssh service", "error", err)
+		}
+	}
+	// Run the manifest's hooks before caching, since they may write the pod's tokens
+	err := p.runPostStartHooks(finishedStartJobs.Deadline().Add(-postStartHookMargin))
+	if err != nil {
+		p.Log.Error("Post-start hooks failed", "error", err)
+		finishedStartJobs.Fail(ReasonPostStartHook)
+		return
 	}
 	err = p.CreateAndSavePodCache(false)
 	if err != nil {
-		fmt.Printf("Failed to save pod cache for pod %s: %s\n", p.Object.Name, err.Error())
-		finishedStartJobs.Send(false)
+		p.Log.Error("Couldn't save pod cache", "error", err)
+		finishedStartJobs.Fail(ReasonPodCache)
 		return
 	}
 
@@ -583,11 +693,14 @@ func (p *Pod) getAllTokens(reload bool) map[string]string {
 			// if reloading tokens of pods that should already have created /tmp/key
 			token, err = p.GetToken(key)
 			if err != nil {
-				fmt.Printf("Error while refreshing token %s for pod %s: %s\n", key, p.Object.Name, err.Error())
+				p.Log.Error("Couldn't refresh token", "annotation", key, "error", err)
 			}
 		} else {
 			// give a new pod up to 10s to create /tmp/key before giving up
 			for i := 0; i < 10; i++ {
+				if i > 0 {
+					metrics.TokenCopyRetries.Inc()
+				}
 				token, err = p.GetToken(key)
 				if err != nil {
 					time.Sleep(1 * time.Second)
@@ -598,7 +711,7 @@ func (p *Pod) getAllTokens(reload bool) map[string]string {
 		}
 		// if it never succeeded, log the last error message
 		if err != nil {
-			fmt.Printf("Error while copying token %s for pod %s: %s\n", key, p.Object.Name, err.Error())
+			p.Log.Error("Couldn't copy token", "annotation", key, "error", err)
 		} else {
 			// If it got the token successfully, add it to the tokenMap
 			tokenMap[key] = token
@@ -631,24 +744,39 @@ func (p *Pod) GetToken(key string) (string, error) {
 
 // Start the ssh service required by this pod
 func (p *Pod) startSshService() error {
-	// TODO could add a check here to delete an orphaned service with the name that will be created here
 	targetService := p.getTargetSshService()
-	_, err := p.Client.CreateService(targetService)
+	// The manifest may bring its own ssh service, e.g. with a fixed port
+	serviceList, err := p.ListServices()
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Created SVC %s\n", targetService.Name)
+	for _, service := range serviceList.Items {
+		if service.Name == targetService.Name {
+			return nil
+		}
+	}
+	_, err = p.Client.CreateService(targetService)
+	if err != nil {
+		return err
+	}
+	p.Log.Info("Created SVC", "service", targetService.Name)
 	return nil
 }
 
+// Return the labels of an object created for the pod
+func (p *Pod) getCreatedForLabels() map[string]string {
+	labels := p.Owner.GetLabels()
+	labels[CreatedForPodLabel] = p.Object.Name
+	return labels
+}
+
 // Get a target service object that will provide ssh port forwarding for this pod
 func (p *Pod) getTargetSshService() *apiv1.Service {
 	return &apiv1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: fmt.Sprintf("%s-ssh", p.Object.Name),
-			Labels: map[string]string{
-				"createdForPod": p.Object.Name,
-			},
+			Name:        fmt.Sprintf("%s-ssh", p.Object.Name),
+			Labels:      p.getCreatedForLabels(),
+			Annotations: p.Owner.GetAnnotations(),
 		},
 		Spec: apiv1.ServiceSpec{
 			Ports: []apiv1.ServicePort{
@@ -13,6 +13,7 @@ import (
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 const (
@@ -175,22 +176,48 @@ func TestOwnership(t *testing.T) {
 }
 
 func TestUserString(t *testing.T) {
+	userWithoutCluster := func(uid string) User {
+		return NewUser(uid, k8sclient.K8sClient{}, util.GlobalConfig{})
+	}
 	tests := []struct {
 		input User
 		want  string
 	}{
-		{newUser("foo"), "foo"},
-		{newUser("foo@bar"), "foo-bar"},
-		{newUser("Foo@Bar"), "Foo-Bar"},
-		{newUser("foo@bar.baz"), "foo-bar-baz"},
-		{newUser("foo@bar.baz-baz"), "foo-bar-baz-baz"},
-		{newUser("foo.bar@bar.baz"), "foo-bar-bar-baz"},
+		{userWithoutCluster("foo"), "foo-" + util.HashUserID("foo")},
+		{userWithoutCluster("foo@bar"), "foo-bar-" + util.HashUserID("foo@bar")},
+		{userWithoutCluster("Foo@Bar"), "foo-bar-" + util.HashUserID("Foo@Bar")},
+		{userWithoutCluster("foo@bar.baz"), "foo-bar-baz-" + util.HashUserID("foo@bar.baz")},
+		{userWithoutCluster("foo.bar@bar.baz"), "foo-bar-bar-baz-" + util.HashUserID("foo.bar@bar.baz")},
+		{userWithoutCluster("a.very.long.name@some.university.example.com"), "a-very-long-name-som-" + util.HashUserID("a.very.long.name@some.university.example.com")},
 	}
 	for _, test := range tests {
 		if test.input.GetUserString() != test.want {
-			t.Fatalf("Bad list options for userID %s. Got %s, wanted %s", test.input.UserID, test.input.GetUserString(), test.want)
+			t.Fatalf("Bad user string for userID %s. Got %s, wanted %s", test.input.UserID, test.input.GetUserString(), test.want)
 		}
 	}
+
+	// IDs that only differ in punctuation must not share names
+	first, second := userWithoutCluster("a.b@x"), userWithoutCluster("a-b@x")
+	if first.GetUserString() == second.GetUserString() || first.GetStoragePVName() == second.GetStoragePVName() {
+		t.Fatalf("%s and %s have the same user string %s", first.UserID, second.UserID, first.GetUserString())
+	}
+	if first.getLegacyStoragePVName() != second.getLegacyStoragePVName() {
+		t.Fatal("Expected the legacy names to collide")
+	}
+
+	// Names and labels stay within their limits
+	long := userWithoutCluster(strings.Repeat("a", 70) + "@" + strings.Repeat("b", 70) + ".dk")
+	for _, problem := range validation.IsDNS1123Label(long.GetStoragePVName()) {
+		t.Fatalf("Invalid storage name %s: %s", long.GetStoragePVName(), problem)
+	}
+	for key, value := range long.GetLabels() {
+		for _, problem := range validation.IsValidLabelValue(value) {
+			t.Fatalf("Invalid value %s for label %s: %s", value, key, problem)
+		}
+	}
+	if util.GetUserIDFromMeta(metav1.ObjectMeta{Labels: long.GetLabels(), Annotations: long.GetAnnotations()}) != long.UserID {
+		t.Fatal("The userID should be recoverable from the annotations")
+	}
 }
 
 func TestCreateDeleteUserStorage(t *testing.T) {
@@ -223,7 +250,7 @@ func TestCreateDeleteUserStorage(t *testing.T) {
 	if len(pvcList.Items) != 1 {
 		t.Fatalf("There should be exactly 1 pvc listed by the user's storageListOptions, but there are %d", len(pvcList.Items))
 	}
-	if pvcList.Items[0].Name != "user-storage-foo-bar-baz" {
+	if pvcList.Items[0].Name != u.GetStoragePVName() {
 		t.Fatalf("User PVC has incorrect name: %s", pvcList.Items[0].Name)
 	}
 	if pvcList.Items[0].Status.Phase != v1.ClaimBound {
@@ -237,7 +264,7 @@ func TestCreateDeleteUserStorage(t *testing.T) {
 	if len(pvList.Items) != 1 {
 		t.Fatalf("There should be exactly 1 pv listed by the user's storageListOptions, but there are %d", len(pvList.Items))
 	}
-	if pvList.Items[0].Name != "user-storage-foo-bar-baz" {
+	if pvList.Items[0].Name != u.GetStoragePVName() {
 		t.Fatalf("User PVC has incorrect name: %s", pvList.Items[0].Name)
 	}
 	if pvList.Items[0].Status.Phase != v1.VolumeBound {
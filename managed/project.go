@@ -0,0 +1,285 @@
+package managed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Label with the project ID on a project's ConfigMap, PV and PVC
+const ProjectLabel = "project"
+
+// Annotation on a project's ConfigMap with the IP of the silo whose nfs server has the project's storage
+const ProjectSiloAnnotation = "sciencedata.dk/project-silo"
+
+// Key of the project's ConfigMap with its members' user IDs, one per line
+const projectMembersKey = "members"
+
+// Prefix of the names of project storage PVs and PVCs, followed by the project ID
+const ProjectStoragePrefix = "project-storage-"
+
+// Longest project ID, so that the names of the project's objects fit in a label value
+const MaxProjectIDLength = 40
+
+// Directory for project storage under the storage root if ProjectStorageDirectory isn't set
+const defaultProjectStorageDirectory = "projects"
+
+var (
+	ErrProjectExists         = errors.New("Project already exists")
+	ErrProjectStorageInUse   = errors.New("Project storage is in use by pods")
+	ErrProjectOwnerNotMember = errors.New("The owner of a project can't be removed from it")
+)
+
+// Storage shared by the members of a research group.
+// The members are kept in a ConfigMap, and the storage is made when a member's pod first mounts it.
+type Project struct {
+	ID           string
+	Client       k8sclient.K8sClient
+	GlobalConfig util.GlobalConfig
+	Log          *logging.Logger
+}
+
+type ProjectInfo struct {
+	ID      string   `json:"project_id"`
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+	// IP of the silo whose nfs server has the project's storage
+	SiloIP string `json:"-"`
+}
+
+func NewProject(projectID string, client k8sclient.K8sClient, globalConfig util.GlobalConfig) Project {
+	return Project{
+		ID:           projectID,
+		Client:       client,
+		GlobalConfig: globalConfig,
+		Log:          logging.Default().With("project_id", projectID),
+	}
+}
+
+// Log with the fields of log, e.g. a request ID, from now on
+func (p *Project) SetLogger(log *logging.Logger) {
+	p.Log = log.With("project_id", p.ID)
+}
+
+// Return whether userID is one of the project's members
+func (info ProjectInfo) HasMember(userID string) bool {
+	for _, member := range info.Members {
+		if member == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the project ID of a project storage PV or PVC, and whether name is one
+func ProjectIDFromStorageName(name string) (string, bool) {
+	if !strings.HasPrefix(name, ProjectStoragePrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, ProjectStoragePrefix), true
+}
+
+// Return the members sorted, without duplicates and with the owner
+func normalizeProjectMembers(owner string, members []string) []string {
+	seen := map[string]bool{owner: true}
+	normalized := []string{owner}
+	for _, member := range members {
+		if !seen[member] {
+			seen[member] = true
+			normalized = append(normalized, member)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+func parseProjectMembers(data string) []string {
+	var members []string
+	for _, member := range strings.Split(data, "\n") {
+		if member = strings.TrimSpace(member); member != "" {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+func (p *Project) GetConfigMapName() string {
+	return fmt.Sprintf("project-%s", p.ID)
+}
+
+// Return the name of the project's storage PV and PVC (same name used for both)
+func (p *Project) GetStoragePVName() string {
+	return ProjectStoragePrefix + p.ID
+}
+
+func (p *Project) getLabels() map[string]string {
+	return map[string]string{ProjectLabel: p.ID}
+}
+
+// Return the project's members and owner, and whether the project exists
+func (p *Project) Get() (ProjectInfo, bool, error) {
+	info := ProjectInfo{ID: p.ID}
+	list, err := p.Client.ListConfigMaps(metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("metadata.name=%s", p.GetConfigMapName()),
+		LabelSelector: fmt.Sprintf("%s=%s", ProjectLabel, p.ID),
+	})
+	if err != nil {
+		return info, false, err
+	}
+	if len(list.Items) == 0 {
+		return info, false, nil
+	}
+	configMap := list.Items[0]
+	info.Owner = util.GetUserIDFromMeta(configMap.ObjectMeta)
+	info.SiloIP = configMap.Annotations[ProjectSiloAnnotation]
+	info.Members = parseProjectMembers(configMap.Data[projectMembersKey])
+	return info, true, nil
+}
+
+// Create the project with owner as a member along with members.
+// Its storage will be on the nfs server of the silo at siloIP once a member's pod mounts it.
+func (p *Project) Create(owner string, siloIP string, members []string) (ProjectInfo, error) {
+	info := ProjectInfo{ID: p.ID, Owner: owner, Members: normalizeProjectMembers(owner, members), SiloIP: siloIP}
+	annotations := map[string]string{
+		util.UserIDAnnotation: owner,
+		ProjectSiloAnnotation: siloIP,
+	}
+	_, err := p.Client.CreateConfigMap(&apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        p.GetConfigMapName(),
+			Namespace:   p.GlobalConfig.Namespace,
+			Labels:      p.getLabels(),
+			Annotations: annotations,
+		},
+		Data: map[string]string{projectMembersKey: strings.Join(info.Members, "\n")},
+	})
+	if k8serrors.IsAlreadyExists(err) {
+		return info, ErrProjectExists
+	}
+	return info, err
+}
+
+// Add and remove members of the project, returning the updated project
+func (p *Project) UpdateMembers(info ProjectInfo, add []string, remove []string) (ProjectInfo, error) {
+	removed := make(map[string]bool)
+	for _, member := range remove {
+		if member == info.Owner {
+			return info, ErrProjectOwnerNotMember
+		}
+		removed[member] = true
+	}
+	var members []string
+	for _, member := range append(append([]string{}, info.Members...), add...) {
+		if !removed[member] {
+			members = append(members, member)
+		}
+	}
+	updated := info
+	updated.Members = normalizeProjectMembers(info.Owner, members)
+	patch, err := json.Marshal(map[string]interface{}{
+		"data": map[string]string{projectMembersKey: strings.Join(updated.Members, "\n")},
+	})
+	if err != nil {
+		return info, err
+	}
+	_, err = p.Client.PatchConfigMap(p.GetConfigMapName(), patch)
+	if err != nil {
+		return info, err
+	}
+	return updated, nil
+}
+
+// Delete the project's storage and membership, unless pods are using its storage.
+// Its data isn't deleted, since the PVs of project storage have the Retain policy like those of user storage.
+func (p *Project) Delete(finished *util.ReadyChannel) error {
+	podNames, err := p.PodsUsingStorage()
+	if err != nil {
+		return err
+	}
+	if len(podNames) > 0 {
+		return ErrProjectStorageInUse
+	}
+	pvChan, pvcChan, err := deleteStorageObjects(p.Client, p.GlobalConfig, p.Log, p.GetStoragePVName())
+	if err != nil {
+		return err
+	}
+	configMapChan := util.NewReadyChannel(p.GlobalConfig.TimeoutDelete)
+	err = p.Client.DeleteConfigMap(p.GetConfigMapName())
+	if k8serrors.IsNotFound(err) {
+		configMapChan.Send(true)
+	} else if err != nil {
+		return err
+	} else {
+		go p.Client.WatchDeleteConfigMap(p.GetConfigMapName(), configMapChan)
+	}
+	go util.CombineReadyChannels([]*util.ReadyChannel{pvChan, pvcChan, configMapChan}, finished)
+	return nil
+}
+
+// Return the names of the pods that mount the project's storage
+func (p *Project) PodsUsingStorage() ([]string, error) {
+	return podsUsingPVC(p.Client, p.GetStoragePVName())
+}
+
+// Return the provisioner of the project's storage, chosen by the silo whose nfs server has it
+func (p *Project) GetStorageProvisioner(siloIP string) (StorageProvisioner, error) {
+	return NewStorageProvisioner(p.GlobalConfig.StorageConfigFor(siloIP, ""), p.GlobalConfig.NfsStorageRoot)
+}
+
+func (p *Project) getStorageTarget(siloIP string) StorageTarget {
+	directory := p.GlobalConfig.ProjectStorageDirectory
+	if directory == "" {
+		directory = defaultProjectStorageDirectory
+	}
+	labels := p.getLabels()
+	labels["name"] = p.GetStoragePVName()
+	labels["server"] = siloIP
+	return StorageTarget{
+		Name:      p.GetStoragePVName(),
+		Namespace: p.GlobalConfig.Namespace,
+		Labels:    labels,
+		Directory: path.Join(directory, p.ID),
+		SiloIP:    siloIP,
+	}
+}
+
+// Check that the PV and PVC for the project's storage exist and create them if not, as ensureStorage does
+func (p *Project) CreateStorageIfNotExist(ready *util.ReadyChannel, siloIP string) error {
+	provisioner, err := p.GetStorageProvisioner(siloIP)
+	if err != nil {
+		return err
+	}
+	return ensureStorage(p.Client, p.GlobalConfig, p.Log, provisioner, p.getStorageTarget(siloIP), p.KeepStorage, ready)
+}
+
+// Mark the project's storage as unused since the given time, so that it's deleted once StorageRetention has passed
+func (p *Project) MarkStorageUnused(since time.Time) error {
+	value := since.UTC().Format(time.RFC3339)
+	return annotateStoragePVCs(p.Client, []string{p.GetStoragePVName()}, &value)
+}
+
+// Remove the mark made by MarkStorageUnused, so that the storage is kept
+func (p *Project) KeepStorage() error {
+	return annotateStoragePVCs(p.Client, []string{p.GetStoragePVName()}, nil)
+}
+
+// Delete the project's storage PV and PVC, keeping its members
+func (p *Project) DeleteStorage(finished *util.ReadyChannel) error {
+	pvChan, pvcChan, err := deleteStorageObjects(p.Client, p.GlobalConfig, p.Log, p.GetStoragePVName())
+	if err != nil {
+		return err
+	}
+	go util.CombineReadyChannels([]*util.ReadyChannel{pvChan, pvcChan}, finished)
+	return nil
+}
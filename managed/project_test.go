@@ -0,0 +1,47 @@
+package managed
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+)
+
+func TestProjectMembers(t *testing.T) {
+	members := normalizeProjectMembers("owner@example.com", []string{"b@example.com", "a@example.com", "b@example.com", "owner@example.com"})
+	expected := []string{"a@example.com", "b@example.com", "owner@example.com"}
+	if !reflect.DeepEqual(members, expected) {
+		t.Fatalf("Expected members %v, got %v", expected, members)
+	}
+	parsed := parseProjectMembers("a@example.com\n b@example.com \n\nowner@example.com\n")
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Fatalf("Expected parsed members %v, got %v", expected, parsed)
+	}
+	info := ProjectInfo{Owner: "owner@example.com", Members: parsed}
+	if !info.HasMember("b@example.com") || info.HasMember("c@example.com") {
+		t.Fatal("HasMember doesn't match the members")
+	}
+}
+
+func TestProjectStorage(t *testing.T) {
+	project := NewProject("genomics", k8sclient.K8sClient{}, util.GlobalConfig{Namespace: "sciencedata"})
+	projectID, isProject := ProjectIDFromStorageName(project.GetStoragePVName())
+	if !isProject || projectID != "genomics" {
+		t.Fatalf("Couldn't get the project ID back from %s", project.GetStoragePVName())
+	}
+	if _, isProject := ProjectIDFromStorageName("user-storage-someone"); isProject {
+		t.Fatal("User storage isn't project storage")
+	}
+
+	provisioner, _ := NewStorageProvisioner(util.StorageConfig{}, "/tank/storage")
+	pv := provisioner.TargetPV(project.getStorageTarget("10.0.0.20"))
+	if pv.Spec.NFS.Path != "/tank/storage/projects/genomics" || pv.Labels[ProjectLabel] != "genomics" || pv.Labels["server"] != "10.0.0.20" {
+		t.Fatalf("Unexpected project storage PV %+v", pv)
+	}
+	project.GlobalConfig.ProjectStorageDirectory = "shared/groups"
+	pv = provisioner.TargetPV(project.getStorageTarget("10.0.0.20"))
+	if pv.Spec.NFS.Path != "/tank/storage/shared/groups/genomics" {
+		t.Fatalf("ProjectStorageDirectory wasn't used, got path %s", pv.Spec.NFS.Path)
+	}
+}
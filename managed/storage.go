@@ -0,0 +1,456 @@
+package managed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Size of a user's storage when the StorageConfig doesn't set one
+const defaultStorageCapacity = "10Gi"
+
+// Mount options of nfs storage when the StorageConfig doesn't set them
+var defaultNfsMountOptions = []string{"hard", "nfsvers=4.1"}
+
+// What a StorageProvisioner needs to know about the storage to make
+type StorageTarget struct {
+	// Name of both the PV and PVC
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+	UserID      string
+	// Directory of the storage under the provisioner's root, the user ID for a user's storage
+	Directory string
+	// IP of the user's silo, which serves its nfs storage
+	SiloIP string
+}
+
+// Makes the api objects for a user's storage
+type StorageProvisioner interface {
+	// Return the PV to create, or nil if the PVC is provisioned dynamically
+	TargetPV(target StorageTarget) *apiv1.PersistentVolume
+	// Return the PVC to create
+	TargetPVC(target StorageTarget) *apiv1.PersistentVolumeClaim
+}
+
+// Return the provisioner described by config. config should have been validated when the global config was loaded.
+func NewStorageProvisioner(config util.StorageConfig, nfsStorageRoot string) (StorageProvisioner, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	capacityString := config.Capacity
+	if capacityString == "" {
+		capacityString = defaultStorageCapacity
+	}
+	capacity := resource.MustParse(capacityString)
+	reclaimPolicy := apiv1.PersistentVolumeReclaimPolicy(config.ReclaimPolicy)
+	if reclaimPolicy == "" {
+		reclaimPolicy = apiv1.PersistentVolumeReclaimRetain
+	}
+
+	switch config.Provisioner {
+	case util.StorageProvisionerNFS, "":
+		mountOptions := config.MountOptions
+		if len(mountOptions) == 0 {
+			mountOptions = defaultNfsMountOptions
+		}
+		storageClass := config.StorageClass
+		if storageClass == "" {
+			storageClass = "nfs"
+		}
+		return nfsProvisioner{
+			root:          nfsStorageRoot,
+			capacity:      capacity,
+			mountOptions:  mountOptions,
+			reclaimPolicy: reclaimPolicy,
+			storageClass:  storageClass,
+		}, nil
+	case util.StorageProvisionerStorageClass:
+		return storageClassProvisioner{capacity: capacity, storageClass: config.StorageClass}, nil
+	case util.StorageProvisionerHostPath:
+		return hostPathProvisioner{
+			root:          config.HostPathRoot,
+			capacity:      capacity,
+			reclaimPolicy: reclaimPolicy,
+			storageClass:  config.StorageClass,
+		}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown storage provisioner %s", config.Provisioner))
+	}
+}
+
+// Return a PV of the given source that's reserved for the target's PVC
+func newTargetPV(
+	target StorageTarget,
+	source apiv1.PersistentVolumeSource,
+	capacity resource.Quantity,
+	mountOptions []string,
+	reclaimPolicy apiv1.PersistentVolumeReclaimPolicy,
+	storageClass string,
+) *apiv1.PersistentVolume {
+	return &apiv1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        target.Name,
+			Labels:      target.Labels,
+			Annotations: target.Annotations,
+		},
+		Spec: apiv1.PersistentVolumeSpec{
+			AccessModes: []apiv1.PersistentVolumeAccessMode{
+				"ReadWriteMany",
+			},
+			PersistentVolumeReclaimPolicy: reclaimPolicy,
+			StorageClassName:              storageClass,
+			MountOptions:                  mountOptions,
+			PersistentVolumeSource:        source,
+			ClaimRef: &apiv1.ObjectReference{
+				Namespace: target.Namespace,
+				Name:      target.Name,
+				Kind:      "PersistentVolumeClaim",
+			},
+			Capacity: apiv1.ResourceList{
+				apiv1.ResourceStorage: capacity,
+			},
+		},
+	}
+}
+
+// Return a PVC for the target. If volumeName is set, it binds to that PV.
+func newTargetPVC(target StorageTarget, capacity resource.Quantity, storageClass *string, volumeName string) *apiv1.PersistentVolumeClaim {
+	return &apiv1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   target.Namespace,
+			Name:        target.Name,
+			Labels:      target.Labels,
+			Annotations: target.Annotations,
+		},
+		Spec: apiv1.PersistentVolumeClaimSpec{
+			StorageClassName: storageClass,
+			AccessModes: []apiv1.PersistentVolumeAccessMode{
+				"ReadWriteMany",
+			},
+			VolumeName: volumeName,
+			Resources: apiv1.ResourceRequirements{
+				Requests: apiv1.ResourceList{
+					apiv1.ResourceStorage: capacity,
+				},
+			},
+		},
+	}
+}
+
+// Storage in a directory, named after the user for a user's storage, under root on the silo's nfs server
+type nfsProvisioner struct {
+	root          string
+	capacity      resource.Quantity
+	mountOptions  []string
+	reclaimPolicy apiv1.PersistentVolumeReclaimPolicy
+	storageClass  string
+}
+
+func (p nfsProvisioner) TargetPV(target StorageTarget) *apiv1.PersistentVolume {
+	source := apiv1.PersistentVolumeSource{
+		NFS: &apiv1.NFSVolumeSource{
+			Server: target.SiloIP,
+			Path:   fmt.Sprintf("%s/%s", p.root, target.Directory),
+		},
+	}
+	return newTargetPV(target, source, p.capacity, p.mountOptions, p.reclaimPolicy, p.storageClass)
+}
+
+func (p nfsProvisioner) TargetPVC(target StorageTarget) *apiv1.PersistentVolumeClaim {
+	// The storage class is left to binding to the PV
+	return newTargetPVC(target, p.capacity, nil, target.Name)
+}
+
+// Storage provisioned dynamically by a StorageClass, whose mount options and reclaim policy the volume gets.
+// The PV is patched to Retain once the PVC is bound, so that deleting the storage doesn't delete its data.
+type storageClassProvisioner struct {
+	capacity resource.Quantity
+	// The cluster's default StorageClass is used if empty
+	storageClass string
+}
+
+func (p storageClassProvisioner) TargetPV(target StorageTarget) *apiv1.PersistentVolume {
+	return nil
+}
+
+func (p storageClassProvisioner) TargetPVC(target StorageTarget) *apiv1.PersistentVolumeClaim {
+	var storageClass *string
+	if p.storageClass != "" {
+		storageClass = &p.storageClass
+	}
+	return newTargetPVC(target, p.capacity, storageClass, "")
+}
+
+// Storage in a directory, named after the user for a user's storage, under root on whichever node the pod runs on.
+// Only suitable for development on a single node cluster.
+type hostPathProvisioner struct {
+	root          string
+	capacity      resource.Quantity
+	reclaimPolicy apiv1.PersistentVolumeReclaimPolicy
+	storageClass  string
+}
+
+func (p hostPathProvisioner) TargetPV(target StorageTarget) *apiv1.PersistentVolume {
+	hostPathType := apiv1.HostPathDirectoryOrCreate
+	source := apiv1.PersistentVolumeSource{
+		HostPath: &apiv1.HostPathVolumeSource{
+			Path: path.Join(p.root, target.Directory),
+			Type: &hostPathType,
+		},
+	}
+	return newTargetPV(target, source, p.capacity, nil, p.reclaimPolicy, p.storageClass)
+}
+
+func (p hostPathProvisioner) TargetPVC(target StorageTarget) *apiv1.PersistentVolumeClaim {
+	// Set explicitly so that the cluster's default StorageClass isn't used instead of binding to the PV
+	storageClass := p.storageClass
+	return newTargetPVC(target, p.capacity, &storageClass, target.Name)
+}
+
+// Annotation on a user's storage PVC with the time, in RFC 3339, that the user's last pod was deleted.
+// The storage is kept until GlobalConfig.StorageRetention after then, unless the user creates another pod.
+const StorageUnusedSinceAnnotation = "sciencedata.dk/unused-since"
+
+// Return when the PVC was marked as unused, and whether it is
+func StorageUnusedSince(pvc apiv1.PersistentVolumeClaim) (time.Time, bool) {
+	value, marked := pvc.Annotations[StorageUnusedSinceAnnotation]
+	if !marked {
+		return time.Time{}, false
+	}
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		// Treat an unreadable mark as just made, so the storage isn't deleted early
+		return time.Now(), true
+	}
+	return since, true
+}
+
+// Set or, if value is nil, remove StorageUnusedSinceAnnotation on each of the user's storage PVCs that exists
+func (u *User) annotateStorage(value *string) error {
+	pvNames, err := u.getStoragePVNames()
+	if err != nil {
+		return err
+	}
+	return annotateStoragePVCs(u.Client, pvNames, value)
+}
+
+// Set or, if value is nil, remove StorageUnusedSinceAnnotation on each of the named PVCs that exists
+func annotateStoragePVCs(client k8sclient.K8sClient, pvcNames []string, value *string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{StorageUnusedSinceAnnotation: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, pvcName := range pvcNames {
+		_, err := client.PatchPVC(pvcName, patch)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.New(fmt.Sprintf("Couldn't annotate PVC %s: %s", pvcName, err.Error()))
+		}
+	}
+	return nil
+}
+
+// Mark the user's storage as unused since the given time, so that it's deleted once StorageRetention has passed
+func (u *User) MarkUserStorageUnused(since time.Time) error {
+	value := since.UTC().Format(time.RFC3339)
+	return u.annotateStorage(&value)
+}
+
+// Remove the mark made by MarkUserStorageUnused, so that the storage is kept
+func (u *User) KeepUserStorage() error {
+	return u.annotateStorage(nil)
+}
+
+// Return why the existing PV of a user's storage can't be used in place of target, or an empty string if it can.
+// target is nil if the PV is provisioned dynamically, so any bound PV will do.
+func storagePVProblem(existing apiv1.PersistentVolume, target *apiv1.PersistentVolume) string {
+	switch existing.Status.Phase {
+	case apiv1.VolumeReleased, apiv1.VolumeFailed:
+		// A Released PV with the Retain policy is never bound again
+		return fmt.Sprintf("is %s", existing.Status.Phase)
+	}
+	if existing.DeletionTimestamp != nil {
+		return "is being deleted"
+	}
+	if target == nil {
+		return ""
+	}
+	if target.Spec.NFS != nil {
+		if existing.Spec.NFS == nil {
+			return "isn't nfs"
+		}
+		if existing.Spec.NFS.Server != target.Spec.NFS.Server || existing.Spec.NFS.Path != target.Spec.NFS.Path {
+			return fmt.Sprintf("exports %s:%s instead of %s:%s",
+				existing.Spec.NFS.Server, existing.Spec.NFS.Path, target.Spec.NFS.Server, target.Spec.NFS.Path)
+		}
+	}
+	if target.Spec.HostPath != nil {
+		if existing.Spec.HostPath == nil {
+			return "isn't a hostPath"
+		}
+		if existing.Spec.HostPath.Path != target.Spec.HostPath.Path {
+			return fmt.Sprintf("is at %s instead of %s", existing.Spec.HostPath.Path, target.Spec.HostPath.Path)
+		}
+	}
+	if server, exists := existing.Labels["server"]; exists && server != target.Labels["server"] {
+		return fmt.Sprintf("is labelled for server %s instead of %s", server, target.Labels["server"])
+	}
+	return ""
+}
+
+// Return why the existing PVC of a user's storage can't be used in place of target, or an empty string if it can
+func storagePVCProblem(existing apiv1.PersistentVolumeClaim, target *apiv1.PersistentVolumeClaim) string {
+	if existing.Status.Phase == apiv1.ClaimLost {
+		return "has lost its PV"
+	}
+	if existing.DeletionTimestamp != nil {
+		return "is being deleted"
+	}
+	if target.Spec.VolumeName != "" && existing.Spec.VolumeName != "" && existing.Spec.VolumeName != target.Spec.VolumeName {
+		return fmt.Sprintf("is bound to PV %s instead of %s", existing.Spec.VolumeName, target.Spec.VolumeName)
+	}
+	return ""
+}
+
+// Patch the PV that the named PVC is bound to with the Retain policy. A dynamically provisioned PV gets
+// its StorageClass's reclaim policy, and with Delete, deleting the storage would delete its data.
+func retainBoundPV(client k8sclient.K8sClient, pvcName string) error {
+	pvcList, err := client.ListPVC(metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", pvcName)})
+	if err != nil {
+		return err
+	}
+	if len(pvcList.Items) == 0 || pvcList.Items[0].Spec.VolumeName == "" {
+		return errors.New(fmt.Sprintf("PVC %s isn't bound to a PV", pvcName))
+	}
+	pvName := pvcList.Items[0].Spec.VolumeName
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{"persistentVolumeReclaimPolicy": apiv1.PersistentVolumeReclaimRetain},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.PatchPV(pvName, patch)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't set the Retain policy on PV %s: %s", pvName, err.Error()))
+	}
+	return nil
+}
+
+// Return the names of the pods in the namespace that mount the PVC
+func podsUsingPVC(client k8sclient.K8sClient, pvcName string) ([]string, error) {
+	podList, err := client.ListPods(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var podNames []string
+	for _, pod := range podList.Items {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvcName {
+				podNames = append(podNames, pod.Name)
+				break
+			}
+		}
+	}
+	return podNames, nil
+}
+
+// Make sure the storage for target exists as provisioner makes it, creating what's missing and sending true to ready
+// once it's ready. The PV is left to the StorageClass if the storage is provisioned dynamically.
+// Existing storage that doesn't match what would be created, e.g. because the silo moved,
+// is deleted and created again if no pods are using it. If it was marked as unused, keep is called to keep it.
+func ensureStorage(
+	client k8sclient.K8sClient,
+	globalConfig util.GlobalConfig,
+	log *logging.Logger,
+	provisioner StorageProvisioner,
+	target StorageTarget,
+	keep func() error,
+	ready *util.ReadyChannel,
+) error {
+	targetPV := provisioner.TargetPV(target)
+	targetPVC := provisioner.TargetPVC(target)
+	listOptions := metav1.ListOptions{LabelSelector: fmt.Sprintf("name=%s", target.Name)}
+	PVList, err := client.ListPV(listOptions)
+	if err != nil {
+		return err
+	}
+	PVCList, err := client.ListPVC(listOptions)
+	if err != nil {
+		return err
+	}
+	pvExists := len(PVList.Items) > 0
+	pvcExists := len(PVCList.Items) > 0
+
+	// Check that the existing storage is what would be created now
+	var problems []string
+	for _, pv := range PVList.Items {
+		if problem := storagePVProblem(pv, targetPV); problem != "" {
+			problems = append(problems, fmt.Sprintf("PV %s %s", pv.Name, problem))
+		}
+	}
+	for _, pvc := range PVCList.Items {
+		if problem := storagePVCProblem(pvc, targetPVC); problem != "" {
+			problems = append(problems, fmt.Sprintf("PVC %s %s", pvc.Name, problem))
+		}
+	}
+	if len(problems) > 0 {
+		err := recreateStorage(client, globalConfig, log, target.Name, strings.Join(problems, ", "))
+		if err != nil {
+			return err
+		}
+		pvExists = false
+		pvcExists = false
+	}
+
+	// If the storage was going to be deleted after the last pod using it, keep it for this one
+	for _, pvc := range PVCList.Items {
+		if _, unused := StorageUnusedSince(pvc); unused && pvcExists {
+			err := keep()
+			if err != nil {
+				return err
+			}
+			log.Info("Kept storage that was marked as unused", "pvc", pvc.Name)
+			break
+		}
+	}
+	return createStorageObjects(client, globalConfig, log, targetPV, targetPVC, pvExists, pvcExists, ready)
+}
+
+// Delete the storage named name because of problem and wait until it's gone, so that it can be created again.
+// Storage that pods are using isn't deleted, since they would lose it. Its data isn't deleted, since the PVs
+// of user and project storage are made with the Retain policy, or patched to it by retainBoundPV.
+func recreateStorage(client k8sclient.K8sClient, globalConfig util.GlobalConfig, log *logging.Logger, name string, problem string) error {
+	podNames, err := podsUsingPVC(client, name)
+	if err != nil {
+		return err
+	}
+	if len(podNames) > 0 {
+		return errors.New(fmt.Sprintf("Storage %s needs to be recreated because %s, but it's in use by %s",
+			name, problem, strings.Join(podNames, ", ")))
+	}
+	log.Warn("Recreating storage that doesn't match its spec", "pvc", name, "problem", problem)
+	pvChan, pvcChan, err := deleteStorageObjects(client, globalConfig, log, name)
+	if err != nil {
+		return err
+	}
+	if !util.ReceiveReadyChannels([]*util.ReadyChannel{pvChan, pvcChan}) {
+		return errors.New(fmt.Sprintf("Couldn't delete storage %s to recreate it because %s", name, problem))
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package managed
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestStorageProvisioner(t *testing.T) {
+	target := StorageTarget{
+		Name:      "user-storage-someone",
+		Namespace: "sciencedata",
+		UserID:    "someone@example.com",
+		Directory: "someone@example.com",
+		SiloIP:    "10.0.0.20",
+	}
+
+	// The default is nfs as it was before provisioners were configurable
+	provisioner, err := NewStorageProvisioner(util.StorageConfig{}, "/tank/storage")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pv := provisioner.TargetPV(target)
+	if pv.Spec.NFS == nil || pv.Spec.NFS.Server != "10.0.0.20" || pv.Spec.NFS.Path != "/tank/storage/someone@example.com" {
+		t.Fatalf("Unexpected nfs source %+v", pv.Spec.PersistentVolumeSource)
+	}
+	capacity := pv.Spec.Capacity[apiv1.ResourceStorage]
+	if capacity.String() != "10Gi" || pv.Spec.StorageClassName != "nfs" || len(pv.Spec.MountOptions) != 2 ||
+		pv.Spec.PersistentVolumeReclaimPolicy != apiv1.PersistentVolumeReclaimRetain {
+		t.Fatalf("Unexpected nfs PV spec %+v", pv.Spec)
+	}
+	if pv.Spec.ClaimRef.Name != target.Name || pv.Spec.ClaimRef.Namespace != target.Namespace {
+		t.Fatalf("PV isn't reserved for the PVC: %+v", pv.Spec.ClaimRef)
+	}
+	pvc := provisioner.TargetPVC(target)
+	if pvc.Spec.VolumeName != target.Name || pvc.Spec.StorageClassName != nil {
+		t.Fatalf("Unexpected nfs PVC spec %+v", pvc.Spec)
+	}
+
+	provisioner, err = NewStorageProvisioner(util.StorageConfig{
+		Provisioner:  util.StorageProvisionerStorageClass,
+		Capacity:     "50Gi",
+		StorageClass: "cephfs",
+	}, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if provisioner.TargetPV(target) != nil {
+		t.Fatal("A dynamically provisioned PVC shouldn't have a PV made for it")
+	}
+	pvc = provisioner.TargetPVC(target)
+	request := pvc.Spec.Resources.Requests[apiv1.ResourceStorage]
+	if pvc.Spec.VolumeName != "" || *pvc.Spec.StorageClassName != "cephfs" || request.String() != "50Gi" {
+		t.Fatalf("Unexpected storageclass PVC spec %+v", pvc.Spec)
+	}
+
+	provisioner, err = NewStorageProvisioner(util.StorageConfig{
+		Provisioner:  util.StorageProvisionerHostPath,
+		HostPathRoot: "/var/lib/user_pods",
+	}, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pv = provisioner.TargetPV(target)
+	if pv.Spec.HostPath == nil || pv.Spec.HostPath.Path != "/var/lib/user_pods/someone@example.com" ||
+		pv.Spec.PersistentVolumeReclaimPolicy != apiv1.PersistentVolumeReclaimRetain {
+		t.Fatalf("Unexpected hostpath PV spec %+v", pv.Spec)
+	}
+	pvc = provisioner.TargetPVC(target)
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != pv.Spec.StorageClassName {
+		t.Fatal("hostpath PVC's storage class should match its PV's")
+	}
+
+	for _, invalid := range []util.StorageConfig{
+		{Provisioner: "ceph"},
+		{Capacity: "lots"},
+		{ReclaimPolicy: "Recycle"},
+		// Deleting the storage would delete the user's data
+		{ReclaimPolicy: "Delete"},
+		{Provisioner: util.StorageProvisionerHostPath, HostPathRoot: "/var/lib/user_pods", ReclaimPolicy: "Delete"},
+		{Provisioner: util.StorageProvisionerHostPath},
+		{Provisioner: util.StorageProvisionerStorageClass, MountOptions: []string{"hard"}},
+	} {
+		if _, err := NewStorageProvisioner(invalid, ""); err == nil {
+			t.Fatalf("Storage config %+v should be invalid", invalid)
+		}
+	}
+}
+
+func TestStorageUnusedSince(t *testing.T) {
+	var pvc apiv1.PersistentVolumeClaim
+	if _, marked := StorageUnusedSince(pvc); marked {
+		t.Fatal("PVC without the annotation shouldn't be marked")
+	}
+	pvc.Annotations = map[string]string{StorageUnusedSinceAnnotation: "2024-03-01T12:00:00Z"}
+	since, marked := StorageUnusedSince(pvc)
+	if !marked || !since.Equal(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected unused since %s, %t", since, marked)
+	}
+	pvc.Annotations[StorageUnusedSinceAnnotation] = "yesterday"
+	since, marked = StorageUnusedSince(pvc)
+	if !marked || time.Since(since) > time.Minute {
+		t.Fatal("An unreadable mark should count as just made")
+	}
+}
+
+func TestStorageProblems(t *testing.T) {
+	target := StorageTarget{
+		Name:      "user-storage-someone",
+		Labels:    map[string]string{"server": "10.0.0.20"},
+		UserID:    "someone@example.com",
+		Directory: "someone@example.com",
+		SiloIP:    "10.0.0.20",
+	}
+	provisioner, _ := NewStorageProvisioner(util.StorageConfig{}, "/tank/storage")
+	targetPV := provisioner.TargetPV(target)
+	targetPVC := provisioner.TargetPVC(target)
+
+	existingPV := *provisioner.TargetPV(target)
+	existingPV.Status.Phase = apiv1.VolumeBound
+	if problem := storagePVProblem(existingPV, targetPV); problem != "" {
+		t.Fatalf("Matching PV has problem %s", problem)
+	}
+	existingPV.Status.Phase = apiv1.VolumeReleased
+	if storagePVProblem(existingPV, targetPV) == "" {
+		t.Fatal("Released PV should be a problem")
+	}
+	if storagePVProblem(existingPV, nil) == "" {
+		t.Fatal("Released PV should be a problem even if PVs are provisioned dynamically")
+	}
+
+	// The user's silo moved
+	target.SiloIP = "10.0.0.21"
+	target.Labels = map[string]string{"server": "10.0.0.21"}
+	existingPV.Status.Phase = apiv1.VolumeBound
+	if storagePVProblem(existingPV, provisioner.TargetPV(target)) == "" {
+		t.Fatal("PV on the old nfs server should be a problem")
+	}
+	existingPV.Spec.NFS.Server = "10.0.0.21"
+	if storagePVProblem(existingPV, provisioner.TargetPV(target)) == "" {
+		t.Fatal("PV labelled for the old nfs server should be a problem")
+	}
+
+	existingPVC := *targetPVC
+	existingPVC.Status.Phase = apiv1.ClaimBound
+	if problem := storagePVCProblem(existingPVC, targetPVC); problem != "" {
+		t.Fatalf("Matching PVC has problem %s", problem)
+	}
+	existingPVC.Spec.VolumeName = "pvc-1234"
+	if storagePVCProblem(existingPVC, targetPVC) == "" {
+		t.Fatal("PVC bound to another PV should be a problem")
+	}
+	existingPVC.Spec.VolumeName = targetPVC.Spec.VolumeName
+	existingPVC.Status.Phase = apiv1.ClaimLost
+	if storagePVCProblem(existingPVC, targetPVC) == "" {
+		t.Fatal("Lost PVC should be a problem")
+	}
+}
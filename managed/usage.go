@@ -0,0 +1,183 @@
+package managed
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/policy"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Label on the helper pods that measure a user's storage, which aren't listed among the user's pods
+const StorageUsagePodLabel = "storageUsage"
+
+// Where the helper pod mounts the user's storage
+const storageUsageMountPath = "/storage"
+
+// How long the helper pod may run before kubernetes stops it, in case it isn't deleted
+const storageUsagePodDeadlineSeconds = 600
+
+// Return the bytes used according to the output of du -sk
+func parseDuOutput(output string) (int64, error) {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return 0, errors.New("du didn't output anything")
+	}
+	kilobytes, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Couldn't parse du output %q: %s", output, err.Error()))
+	}
+	return kilobytes * 1024, nil
+}
+
+// Run du in the container of the pod, and return the bytes used under mountPath
+func (u *User) duInPod(pod *apiv1.Pod, nContainer int, mountPath string) (int64, error) {
+	stdout, stderr, err := u.Client.PodExec([]string{"du", "-sk", mountPath}, pod, nContainer)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Couldn't run du in pod %s: %s %s", pod.Name, err.Error(), stderr.String()))
+	}
+	return parseDuOutput(stdout.String())
+}
+
+// Return the helper pod that mounts the user's storage read-only for du to run in.
+// It has the user's labels, so that it's deleted with the user's objects, and follows the policy like the user's pods.
+func (u *User) getStorageUsagePod() (*apiv1.Pod, error) {
+	if u.GlobalConfig.StorageUsageImage == "" {
+		return nil, errors.New("StorageUsageImage isn't set, so storage usage can't be measured")
+	}
+	labels := u.GetLabels()
+	labels[StorageUsagePodLabel] = "true"
+	deadline := int64(storageUsagePodDeadlineSeconds)
+	allowPrivilegeEscalation := false
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("storage-usage-%s", u.GetUserString()),
+			Namespace:   u.GlobalConfig.Namespace,
+			Labels:      labels,
+			Annotations: u.GetAnnotations(),
+		},
+		Spec: apiv1.PodSpec{
+			RestartPolicy:         apiv1.RestartPolicyNever,
+			ActiveDeadlineSeconds: &deadline,
+			Containers: []apiv1.Container{
+				{
+					Name:    "du",
+					Image:   u.GlobalConfig.StorageUsageImage,
+					Command: []string{"sleep", strconv.Itoa(storageUsagePodDeadlineSeconds)},
+					SecurityContext: &apiv1.SecurityContext{
+						AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+					},
+					VolumeMounts: []apiv1.VolumeMount{
+						{Name: "storage", MountPath: storageUsageMountPath, ReadOnly: true},
+					},
+				},
+			},
+			Volumes: []apiv1.Volume{
+				{
+					Name: "storage",
+					VolumeSource: apiv1.VolumeSource{
+						PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+							ClaimName: u.GetStoragePVName(),
+							ReadOnly:  true,
+						},
+					},
+				},
+			},
+		},
+	}
+	if u.GlobalConfig.StorageUsageRunAsUser != 0 {
+		runAsNonRoot := true
+		runAsUser := u.GlobalConfig.StorageUsageRunAsUser
+		pod.Spec.SecurityContext = &apiv1.PodSecurityContext{RunAsNonRoot: &runAsNonRoot, RunAsUser: &runAsUser}
+	}
+	if _, err := policy.NewPolicy(u.GlobalConfig).Apply(pod, nil); err != nil {
+		return nil, errors.New(fmt.Sprintf("Storage usage pod %s doesn't follow the policy: %s", pod.Name, err.Error()))
+	}
+	return pod, nil
+}
+
+// Delete the helper pod if it was left behind by an earlier measurement, e.g. if the backend stopped during it
+func (u *User) deleteStaleStorageUsagePod(name string) error {
+	podList, err := u.Client.ListPods(metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", name)})
+	if err != nil {
+		return err
+	}
+	if len(podList.Items) == 0 {
+		return nil
+	}
+	u.Log.Info("Deleting stale storage usage pod", "pod_name", name)
+	deleted := util.NewReadyChannel(u.GlobalConfig.TimeoutDelete)
+	go u.Client.WatchDeletePod(name, deleted)
+	if err := u.Client.DeletePod(name); err != nil {
+		deleted.Fail("delete_call")
+		return errors.New(fmt.Sprintf("Couldn't delete stale storage usage pod %s: %s", name, err.Error()))
+	}
+	if !deleted.Receive() {
+		return errors.New(fmt.Sprintf("Stale storage usage pod %s wasn't deleted: %s", name, deleted.Reason()))
+	}
+	return nil
+}
+
+// Start a helper pod with the user's storage, measure the storage in it, and delete it
+func (u *User) measureWithHelperPod() (int64, error) {
+	target, err := u.getStorageUsagePod()
+	if err != nil {
+		return 0, err
+	}
+	if err := u.deleteStaleStorageUsagePod(target.Name); err != nil {
+		return 0, err
+	}
+	ready := util.NewReadyChannel(u.GlobalConfig.TimeoutCreate)
+	go u.Client.WatchCreatePod(target.Name, ready)
+	created, err := u.Client.CreatePod(target)
+	if err != nil {
+		ready.Fail("create_call")
+		return 0, errors.New(fmt.Sprintf("Couldn't create storage usage pod %s: %s", target.Name, err.Error()))
+	}
+	defer func() {
+		if err := u.Client.DeletePod(created.Name); err != nil {
+			u.Log.Error("Couldn't delete storage usage pod", "pod_name", created.Name, "error", err)
+		}
+	}()
+	if !ready.Receive() {
+		return 0, errors.New(fmt.Sprintf("Storage usage pod %s didn't become ready: %s", created.Name, ready.Reason()))
+	}
+	return u.duInPod(created, 0, storageUsageMountPath)
+}
+
+// Return the bytes used in the user's storage, measured with du in a short-lived helper pod.
+// The user's own pods aren't used, since the user controls what du outputs in them.
+// Storage that doesn't exist uses 0 bytes.
+func (u *User) MeasureStorageUsage() (int64, error) {
+	pvcList, err := u.Client.ListPVC(metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", u.GetStoragePVName())})
+	if err != nil {
+		return 0, err
+	}
+	if len(pvcList.Items) == 0 {
+		return 0, nil
+	}
+	return u.measureWithHelperPod()
+}
+
+// Return the helper pods that measure storage usage and are finished or past their deadline,
+// which were left behind by measurements that didn't delete them
+func ListStaleStorageUsagePods(client k8sclient.K8sClient) ([]apiv1.Pod, error) {
+	podList, err := client.ListPods(metav1.ListOptions{LabelSelector: StorageUsagePodLabel})
+	if err != nil {
+		return nil, err
+	}
+	var stale []apiv1.Pod
+	for _, pod := range podList.Items {
+		finished := pod.Status.Phase == apiv1.PodSucceeded || pod.Status.Phase == apiv1.PodFailed
+		if finished || time.Since(pod.CreationTimestamp.Time) > storageUsagePodDeadlineSeconds*time.Second {
+			stale = append(stale, pod)
+		}
+	}
+	return stale, nil
+}
@@ -0,0 +1,56 @@
+package managed
+
+import (
+	"testing"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+)
+
+func TestParseDuOutput(t *testing.T) {
+	used, err := parseDuOutput("2048\t/home/user/sciencedata\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if used != 2048*1024 {
+		t.Fatalf("Expected %d bytes, got %d", 2048*1024, used)
+	}
+	for _, invalid := range []string{"", "du: cannot access '/storage'"} {
+		if _, err := parseDuOutput(invalid); err == nil {
+			t.Fatalf("Output %q should be invalid", invalid)
+		}
+	}
+}
+
+func TestStorageUsagePod(t *testing.T) {
+	user := NewUser("someone@example.com", k8sclient.K8sClient{}, util.GlobalConfig{})
+	if _, err := user.getStorageUsagePod(); err == nil {
+		t.Fatal("Expected an error when StorageUsageImage isn't set")
+	}
+	image := "docker.io/library/busybox@sha256:0123456789abcdef"
+	user = NewUser("someone@example.com", k8sclient.K8sClient{}, util.GlobalConfig{
+		StorageUsageImage:         image,
+		StorageUsageRunAsUser:     1000,
+		PolicyRequireRunAsNonRoot: true,
+	})
+	pod, err := user.getStorageUsagePod()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// It's deleted with the user's objects, but isn't one of the user's pods
+	if util.GetUserIDFromMeta(pod.ObjectMeta) != user.UserID || pod.Labels[StorageUsagePodLabel] == "" {
+		t.Fatalf("Unexpected labels %+v", pod.Labels)
+	}
+	context := pod.Spec.SecurityContext
+	if context == nil || *context.RunAsUser != 1000 || !*context.RunAsNonRoot {
+		t.Fatalf("Storage usage pod should run as a non-root user, got %+v", context)
+	}
+	if pod.Spec.Containers[0].Image != image || !pod.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly {
+		t.Fatalf("Unexpected storage usage pod %+v", pod.Spec)
+	}
+
+	user.GlobalConfig.PolicyAllowedRegistries = []string{"registry.example.com"}
+	if _, err := user.getStorageUsagePod(); err == nil {
+		t.Fatal("Expected an error for an image the policy doesn't allow")
+	}
+}
@@ -0,0 +1,105 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// Kinds that may be bundled with the Pod in a manifest,
+// which are created with the pod and deleted with it
+var CompanionKinds = []string{"Service", "ConfigMap", "Secret", "Ingress"}
+
+// The objects in a manifest: exactly one Pod and any number of companion objects
+type Bundle struct {
+	Pod *apiv1.Pod
+	// Each is an *apiv1.Service, *apiv1.ConfigMap, *apiv1.Secret or *networkingv1.Ingress
+	Companions []runtime.Object
+}
+
+// Return the kind and name of a companion object, e.g. for logging
+func CompanionKindAndName(object runtime.Object) (string, string) {
+	switch typed := object.(type) {
+	case *apiv1.Service:
+		return "Service", typed.Name
+	case *apiv1.ConfigMap:
+		return "ConfigMap", typed.Name
+	case *apiv1.Secret:
+		return "Secret", typed.Name
+	case *networkingv1.Ingress:
+		return "Ingress", typed.Name
+	}
+	return fmt.Sprintf("%T", object), ""
+}
+
+// Split a manifest into its yaml documents, leaving out empty ones
+func splitDocuments(yaml []byte) ([][]byte, error) {
+	var documents [][]byte
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(yaml)))
+	for {
+		document, err := reader.Read()
+		if err == io.EOF {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// A document with only comments or whitespace converts to null
+		asJSON, err := utilyaml.ToJSON(document)
+		if err != nil {
+			return nil, err
+		}
+		if string(bytes.TrimSpace(asJSON)) == "null" {
+			continue
+		}
+		documents = append(documents, document)
+	}
+}
+
+// Decode every document in a manifest, which must be one Pod and otherwise only CompanionKinds
+func DecodeBundle(yaml []byte) (*Bundle, error) {
+	documents, err := splitDocuments(yaml)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't split manifest into documents: %s", err.Error()))
+	}
+	var bundle Bundle
+	deserializer := scheme.Codecs.UniversalDeserializer()
+	for i, document := range documents {
+		object, kind, err := deserializer.Decode(document, nil, nil)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't deserialize manifest document %d: %s", i+1, err.Error()))
+		}
+		switch typed := object.(type) {
+		case *apiv1.Pod:
+			if bundle.Pod != nil {
+				return nil, errors.New("Manifest has more than one Pod")
+			}
+			bundle.Pod = typed
+		case *apiv1.Service, *apiv1.ConfigMap, *apiv1.Secret, *networkingv1.Ingress:
+			bundle.Companions = append(bundle.Companions, object)
+		default:
+			return nil, errors.New(fmt.Sprintf("Manifest document %d is a %s, which can't be bundled with a Pod", i+1, kind.String()))
+		}
+	}
+	if bundle.Pod == nil {
+		return nil, errors.New("Manifest doesn't have a Pod")
+	}
+	return &bundle, nil
+}
+
+// Decode a manifest and return its pod
+func DecodePod(yaml []byte) (*apiv1.Pod, error) {
+	bundle, err := DecodeBundle(yaml)
+	if err != nil {
+		return nil, err
+	}
+	return bundle.Pod, nil
+}
@@ -0,0 +1,53 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestDecodeBundle(t *testing.T) {
+	// Our own deployment manifest is a Pod and a Service
+	yaml, err := ioutil.ReadFile("../manifests/pod.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bundle, err := DecodeBundle(yaml)
+	if err != nil {
+		t.Fatalf("Couldn't decode manifests/pod.yaml: %s", err.Error())
+	}
+	if bundle.Pod.Name != "user-pods-backend-testing" || len(bundle.Companions) != 1 {
+		t.Fatalf("Unexpected bundle %+v", bundle)
+	}
+	service, ok := bundle.Companions[0].(*apiv1.Service)
+	if !ok || service.Name != "user-pods-backend-testing-ssh" {
+		t.Fatalf("Expected the ssh Service as a companion, got %+v", bundle.Companions[0])
+	}
+
+	pod := "apiVersion: v1\nkind: Pod\nmetadata:\n  name: jupyter\n"
+	configMap := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\n"
+	ingress := "apiVersion: networking.k8s.io/v1\nkind: Ingress\nmetadata:\n  name: web\n"
+	deployment := "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: jupyter\n"
+	tests := []struct {
+		yaml       string
+		companions int
+		valid      bool
+	}{
+		{pod, 0, true},
+		{"# comment\n---\n" + pod + "---\n" + configMap + "---\n" + ingress + "---\n", 2, true},
+		{configMap, 0, false},
+		{pod + "---\n" + pod, 0, false},
+		{pod + "---\n" + deployment, 0, false},
+		{"kind: [", 0, false},
+	}
+	for _, test := range tests {
+		bundle, err := DecodeBundle([]byte(test.yaml))
+		if (err == nil) != test.valid {
+			t.Fatalf("Manifest %q should be valid: %t, got error %v", test.yaml, test.valid, err)
+		}
+		if err == nil && len(bundle.Companions) != test.companions {
+			t.Fatalf("Expected %d companions in %q, got %d", test.companions, test.yaml, len(bundle.Companions))
+		}
+	}
+}
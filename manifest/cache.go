@@ -0,0 +1,329 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
+)
+
+// Used for Options that aren't set
+const (
+	defaultTTL          = 5 * time.Minute
+	defaultFetchTimeout = 10 * time.Second
+	defaultMaxBytes     = 1 << 20
+	defaultMaxEntries   = 500
+	// Most redirects followed by a fetch, as in net/http
+	maxRedirects = 10
+)
+
+// Results counted in metrics.ManifestFetches
+const (
+	resultHit         = "hit"
+	resultFetched     = "fetched"
+	resultRevalidated = "revalidated"
+	resultStale       = "stale"
+	resultError       = "error"
+)
+
+type Options struct {
+	// How long a fetched manifest is used before checking upstream for changes
+	TTL time.Duration
+	// Longest time a single fetch may take
+	FetchTimeout time.Duration
+	// Largest manifest that will be accepted, in bytes
+	MaxBytes int64
+	// Most manifests kept, beyond which the least recently validated are evicted
+	MaxEntries int
+	// Urls that fetches may be redirected to, e.g. the manifest whitelist. Redirects aren't followed if nil.
+	AllowedURLs *regexp.Regexp
+}
+
+type entry struct {
+	body         []byte
+	etag         string
+	lastModified string
+	// When upstream last confirmed body was current
+	validatedAt time.Time
+}
+
+// Information about a cached manifest for the admin endpoint
+type EntryInfo struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ValidatedAt  time.Time `json:"validated_at"`
+	Bytes        int       `json:"bytes"`
+}
+
+// Manifests fetched over http, keyed by url.
+// Entries older than the TTL are revalidated with If-None-Match/If-Modified-Since,
+// and if upstream can't be reached, the last good copy is used instead.
+type Cache struct {
+	options Options
+	client  *http.Client
+	entries map[string]*entry
+	// fetchLocks[url] is held while url is being fetched, so concurrent requests share one fetch
+	fetchLocks map[string]*fetchLock
+	mutex      *sync.Mutex
+}
+
+// A fetch lock is removed from fetchLocks once no request holds or waits for it
+type fetchLock struct {
+	mutex *sync.Mutex
+	users int
+}
+
+func NewCache(options Options) *Cache {
+	if options.TTL <= 0 {
+		options.TTL = defaultTTL
+	}
+	if options.FetchTimeout <= 0 {
+		options.FetchTimeout = defaultFetchTimeout
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = defaultMaxBytes
+	}
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = defaultMaxEntries
+	}
+	var m sync.Mutex
+	c := &Cache{
+		options:    options,
+		entries:    make(map[string]*entry),
+		fetchLocks: make(map[string]*fetchLock),
+		mutex:      &m,
+	}
+	c.client = &http.Client{Timeout: options.FetchTimeout, CheckRedirect: c.checkRedirect}
+	return c
+}
+
+// Only follow redirects to allowed urls, so a whitelisted host can't send the fetch anywhere else
+func (c *Cache) checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New(fmt.Sprintf("stopped after %d redirects", maxRedirects))
+	}
+	if c.options.AllowedURLs == nil || !c.options.AllowedURLs.MatchString(request.URL.String()) {
+		return errors.New(fmt.Sprintf("redirect to %s isn't matched to the whitelist", request.URL.String()))
+	}
+	return nil
+}
+
+var defaultCache = NewCache(Options{})
+
+// Return the cache that pod creation fetches manifests through
+func Default() *Cache {
+	return defaultCache
+}
+
+// Replace the default cache, e.g. with one using the configured options
+func SetDefault(c *Cache) {
+	defaultCache = c
+}
+
+func (c *Cache) getEntry(url string) *entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.entries[url]
+}
+
+// Lock the fetch lock of url, creating it if no other request is using it
+func (c *Cache) lockFetch(url string) {
+	c.mutex.Lock()
+	lock, exists := c.fetchLocks[url]
+	if !exists {
+		var m sync.Mutex
+		lock = &fetchLock{mutex: &m}
+		c.fetchLocks[url] = lock
+	}
+	lock.users++
+	c.mutex.Unlock()
+	lock.mutex.Lock()
+}
+
+// Unlock the fetch lock of url, removing it if no other request is waiting for it
+func (c *Cache) unlockFetch(url string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lock := c.fetchLocks[url]
+	lock.mutex.Unlock()
+	lock.users--
+	if lock.users == 0 {
+		delete(c.fetchLocks, url)
+	}
+}
+
+// Store the entry for url, evicting the least recently validated entries beyond MaxEntries.
+// Must be called with c.mutex held.
+func (c *Cache) store(url string, cached *entry) {
+	c.entries[url] = cached
+	for len(c.entries) > c.options.MaxEntries {
+		oldestURL := ""
+		for entryURL, candidate := range c.entries {
+			if oldestURL == "" || candidate.validatedAt.Before(c.entries[oldestURL].validatedAt) {
+				oldestURL = entryURL
+			}
+		}
+		delete(c.entries, oldestURL)
+	}
+}
+
+// Return the manifest at url, from the cache if it's fresh
+func (c *Cache) Get(url string) ([]byte, error) {
+	cached := c.getEntry(url)
+	if cached != nil && time.Since(cached.validatedAt) < c.options.TTL {
+		metrics.ManifestFetches.Inc(resultHit)
+		return cached.body, nil
+	}
+	return c.refresh(url, false)
+}
+
+// Fetch url into the cache now, even if the cached copy is fresh
+func (c *Cache) Prefetch(url string) error {
+	_, err := c.refresh(url, true)
+	return err
+}
+
+// Revalidate or fetch url. Unless force is set, a copy that another request
+// refreshed while this one waited for the fetch lock is used as is.
+func (c *Cache) refresh(url string, force bool) ([]byte, error) {
+	c.lockFetch(url)
+	defer c.unlockFetch(url)
+
+	cached := c.getEntry(url)
+	if !force && cached != nil && time.Since(cached.validatedAt) < c.options.TTL {
+		metrics.ManifestFetches.Inc(resultHit)
+		return cached.body, nil
+	}
+
+	fetched, notModified, err := c.fetch(url, cached)
+	if err != nil {
+		var notFound *notFoundError
+		if errors.As(err, &notFound) {
+			// The manifest was removed upstream, so it shouldn't be used any more
+			c.Purge(url)
+		} else if cached != nil {
+			// Upstream is down or rate limiting, so keep using what we had
+			logging.Default().Warn("Couldn't refresh manifest, using cached copy",
+				"yaml_url", url, "cached_at", cached.validatedAt, "error", err)
+			metrics.ManifestFetches.Inc(resultStale)
+			return cached.body, nil
+		}
+		metrics.ManifestFetches.Inc(resultError)
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if notModified {
+		updated := *cached
+		updated.validatedAt = time.Now()
+		c.store(url, &updated)
+		metrics.ManifestFetches.Inc(resultRevalidated)
+		return updated.body, nil
+	}
+	c.store(url, fetched)
+	metrics.ManifestFetches.Inc(resultFetched)
+	return fetched.body, nil
+}
+
+// Returned when upstream says the manifest doesn't exist, in which case the cached copy shouldn't be used
+type notFoundError struct {
+	url string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("Didn't find a file at the given url: %s", e.url)
+}
+
+// GET url, conditional on cached if it isn't nil.
+// Returns notModified true if upstream answered 304.
+func (c *Cache) fetch(url string, cached *entry) (*entry, bool, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			request.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			request.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, false, errors.New(fmt.Sprintf("Could not fetch manifest from given url %s: %s", url, err.Error()))
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotModified && cached != nil:
+		return nil, true, nil
+	case response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone:
+		return nil, false, &notFoundError{url: url}
+	case response.StatusCode != http.StatusOK:
+		return nil, false, errors.New(fmt.Sprintf("Fetching manifest %s returned status %s", url, response.Status))
+	}
+
+	if response.ContentLength > c.options.MaxBytes {
+		return nil, false, errors.New(fmt.Sprintf("Manifest %s is larger than %d bytes", url, c.options.MaxBytes))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, c.options.MaxBytes+1))
+	if err != nil {
+		return nil, false, errors.New(fmt.Sprintf("Could not read manifest from given url %s: %s", url, err.Error()))
+	}
+	if int64(len(body)) > c.options.MaxBytes {
+		return nil, false, errors.New(fmt.Sprintf("Manifest %s is larger than %d bytes", url, c.options.MaxBytes))
+	}
+	return &entry{
+		body:         body,
+		etag:         response.Header.Get("ETag"),
+		lastModified: response.Header.Get("Last-Modified"),
+		validatedAt:  time.Now(),
+	}, false, nil
+}
+
+// Remove url from the cache, returning true if it was cached
+func (c *Cache) Purge(url string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, exists := c.entries[url]
+	delete(c.entries, url)
+	return exists
+}
+
+// Remove every entry from the cache, returning how many there were
+func (c *Cache) PurgeAll() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[string]*entry)
+	return n
+}
+
+// List the cached manifests, sorted by url
+func (c *Cache) Entries() []EntryInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	infos := make([]EntryInfo, 0, len(c.entries))
+	for url, cached := range c.entries {
+		infos = append(infos, EntryInfo{
+			URL:          url,
+			ETag:         cached.etag,
+			LastModified: cached.lastModified,
+			ValidatedAt:  cached.validatedAt,
+			Bytes:        len(cached.body),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].URL < infos[j].URL })
+	return infos
+}
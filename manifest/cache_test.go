@@ -0,0 +1,182 @@
+package manifest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// An upstream that serves body with an ETag and counts the requests it gets
+type fakeUpstream struct {
+	body        string
+	etag        string
+	status      int
+	requests    int32
+	notModified int32
+}
+
+func (f *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&f.requests, 1)
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+	if r.Header.Get("If-None-Match") == f.etag {
+		atomic.AddInt32(&f.notModified, 1)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", f.etag)
+	w.Write([]byte(f.body))
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	upstream := &fakeUpstream{body: "kind: Pod", etag: `"v1"`}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	cache := NewCache(Options{TTL: time.Hour})
+	url := server.URL + "/pod.yaml"
+
+	for i := 0; i < 3; i++ {
+		body, err := cache.Get(url)
+		if err != nil || string(body) != "kind: Pod" {
+			t.Fatalf("Unexpected manifest %q, %v", body, err)
+		}
+	}
+	if upstream.requests != 1 {
+		t.Fatalf("Expected one upstream request within the TTL, got %d", upstream.requests)
+	}
+
+	// After the TTL, the cached copy is revalidated with its ETag
+	cache.options.TTL = 0
+	if _, err := cache.Get(url); err != nil {
+		t.Fatal(err.Error())
+	}
+	if upstream.notModified != 1 {
+		t.Fatalf("Expected a conditional request answered with 304, got %d", upstream.notModified)
+	}
+
+	// A changed manifest is picked up
+	upstream.body, upstream.etag = "kind: Pod\nv: 2", `"v2"`
+	body, _ := cache.Get(url)
+	if string(body) != "kind: Pod\nv: 2" {
+		t.Fatalf("Expected the new manifest, got %q", body)
+	}
+}
+
+func TestCacheFallback(t *testing.T) {
+	upstream := &fakeUpstream{body: "kind: Pod", etag: `"v1"`}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	cache := NewCache(Options{TTL: time.Hour})
+	url := server.URL + "/pod.yaml"
+	if _, err := cache.Get(url); err != nil {
+		t.Fatal(err.Error())
+	}
+	cache.options.TTL = 0
+
+	// Upstream errors use the last good copy
+	upstream.status = http.StatusTooManyRequests
+	body, err := cache.Get(url)
+	if err != nil || string(body) != "kind: Pod" {
+		t.Fatalf("Expected the cached manifest while upstream fails, got %q, %v", body, err)
+	}
+
+	// But a manifest that was removed upstream isn't used any more
+	upstream.status = http.StatusNotFound
+	if _, err := cache.Get(url); err == nil {
+		t.Fatal("Expected an error for a manifest removed upstream")
+	}
+	if len(cache.Entries()) != 0 {
+		t.Fatal("Removed manifest should be purged from the cache")
+	}
+}
+
+func TestCacheLimits(t *testing.T) {
+	upstream := &fakeUpstream{body: strings.Repeat("a", 100), etag: `"big"`}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	cache := NewCache(Options{MaxBytes: 99})
+	if _, err := cache.Get(server.URL); err == nil {
+		t.Fatal("Expected an error for a manifest over MaxBytes")
+	}
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	cache = NewCache(Options{FetchTimeout: 50 * time.Millisecond})
+	if _, err := cache.Get(slow.URL); err == nil {
+		t.Fatal("Expected an error for a fetch over FetchTimeout")
+	}
+}
+
+func TestCachePurgeAndPrefetch(t *testing.T) {
+	upstream := &fakeUpstream{body: "kind: Pod", etag: `"v1"`}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	cache := NewCache(Options{TTL: time.Hour})
+
+	if err := cache.Prefetch(server.URL + "/a.yaml"); err != nil {
+		t.Fatal(err.Error())
+	}
+	cache.Prefetch(server.URL + "/b.yaml")
+	entries := cache.Entries()
+	if len(entries) != 2 || entries[0].URL != server.URL+"/a.yaml" || entries[0].ETag != `"v1"` {
+		t.Fatalf("Unexpected entries %+v", entries)
+	}
+	if !cache.Purge(server.URL+"/a.yaml") || cache.Purge(server.URL+"/a.yaml") {
+		t.Fatal("Purge should report whether the entry was cached")
+	}
+	if cache.PurgeAll() != 1 || len(cache.Entries()) != 0 {
+		t.Fatal("PurgeAll should remove the remaining entry")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	upstream := &fakeUpstream{body: "kind: Pod", etag: `"v1"`}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	cache := NewCache(Options{TTL: time.Hour, MaxEntries: 2})
+	for i := 0; i < 3; i++ {
+		if err := cache.Prefetch(fmt.Sprintf("%s/%d.yaml", server.URL, i)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	entries := cache.Entries()
+	if len(entries) != 2 || entries[0].URL != server.URL+"/1.yaml" || entries[1].URL != server.URL+"/2.yaml" {
+		t.Fatalf("The oldest entry should have been evicted: %+v", entries)
+	}
+	if len(cache.fetchLocks) != 0 {
+		t.Fatalf("Fetch locks should be removed after fetches: %d left", len(cache.fetchLocks))
+	}
+}
+
+func TestCacheRedirects(t *testing.T) {
+	upstream := &fakeUpstream{body: "kind: Pod", etag: `"v1"`}
+	target := httptest.NewServer(upstream)
+	defer target.Close()
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer redirecting.Close()
+
+	cache := NewCache(Options{AllowedURLs: regexp.MustCompile("^" + regexp.QuoteMeta(redirecting.URL))})
+	if _, err := cache.Get(redirecting.URL + "/a.yaml"); err == nil {
+		t.Fatal("Redirect to a url outside AllowedURLs should fail the fetch")
+	}
+	if atomic.LoadInt32(&upstream.requests) != 0 {
+		t.Fatal("Redirect outside AllowedURLs shouldn't be followed")
+	}
+
+	cache = NewCache(Options{AllowedURLs: regexp.MustCompile("^http://127[.]0[.]0[.]1:")})
+	body, err := cache.Get(redirecting.URL + "/a.yaml")
+	if err != nil || string(body) != "kind: Pod" {
+		t.Fatalf("Redirect to an allowed url should be followed: %s %v", body, err)
+	}
+}
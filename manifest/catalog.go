@@ -0,0 +1,332 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Annotations in a manifest's metadata that describe it in the catalog
+const (
+	AnnotationTitle       = "catalog.sciencedata.dk/title"
+	AnnotationDescription = "catalog.sciencedata.dk/description"
+	AnnotationIcon        = "catalog.sciencedata.dk/icon"
+)
+
+// Annotation in a manifest's pod metadata with the most pods a user may run from it at once
+const AnnotationMaxInstances = "catalog.sciencedata.dk/max-instances"
+
+// Return the limit the manifest sets in AnnotationMaxInstances, or 0 if there isn't one
+func PodMaxInstances(pod *apiv1.Pod) (int, error) {
+	declared, isDeclared := pod.Annotations[AnnotationMaxInstances]
+	if !isDeclared {
+		return 0, nil
+	}
+	maxInstances, err := strconv.Atoi(strings.TrimSpace(declared))
+	if err != nil || maxInstances < 1 {
+		return 0, errors.New(fmt.Sprintf("Invalid %s annotation %q, must be a positive integer", AnnotationMaxInstances, declared))
+	}
+	return maxInstances, nil
+}
+
+// How long the catalog is used before its sources are read again
+const defaultCatalogRefresh = time.Minute
+
+// Catalog IDs are taken from file names, and must be safe to put in a url
+var catalogIDRegex = regexp.MustCompile(`^[a-zA-Z0-9][-a-zA-Z0-9_.]*$`)
+
+func ValidCatalogID(id string) bool {
+	return catalogIDRegex.MatchString(id)
+}
+
+type Port struct {
+	Name          string `json:"name,omitempty"`
+	ContainerPort int32  `json:"container_port"`
+	Protocol      string `json:"protocol"`
+}
+
+type CatalogContainer struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	Ports []Port `json:"ports"`
+}
+
+// A manifest that pods can be created from, as described to the frontend
+type CatalogEntry struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Icon        string `json:"icon,omitempty"`
+	// The http(s) url the manifest was fetched from, empty for manifests in the catalog's directories
+	Source     string             `json:"source,omitempty"`
+	Containers []CatalogContainer `json:"containers"`
+	// What the settings of a create_pod request may set
+	Parameters []Parameter `json:"parameters"`
+	// Objects created along with the pod, as kind/name
+	Companions []string `json:"companions"`
+	// The most pods a user may run from the manifest at once, 0 if there's no limit
+	MaxInstances int `json:"max_instances,omitempty"`
+	// The file:// or http(s) url the manifest was read from, which isn't shown to keep the server's paths private
+	location string
+	yaml     []byte
+	// Detached signature read from the manifest's file with SignatureExtension appended, nil if there isn't one
+	signature []byte
+}
+
+type CatalogOptions struct {
+	// Directories, e.g. git checkouts, whose *.yaml and *.yml files are added to the catalog
+	Dirs []string
+	// Manifests fetched through the cache and added to the catalog
+	URLs []string
+	// Env vars that are set by the backend, and so aren't offered as settings
+	ReservedEnvVars []string
+	// How long the catalog is used before its sources are read again
+	Refresh time.Duration
+}
+
+type Catalog struct {
+	options  CatalogOptions
+	cache    *Cache
+	entries  map[string]*CatalogEntry
+	loadedAt time.Time
+	mutex    *sync.Mutex
+	// Held while the sources are read, outside of mutex, so only one request reads them at a time
+	loadMutex *sync.Mutex
+}
+
+func NewCatalog(options CatalogOptions, cache *Cache) *Catalog {
+	if options.Refresh <= 0 {
+		options.Refresh = defaultCatalogRefresh
+	}
+	var m, loadMutex sync.Mutex
+	return &Catalog{options: options, cache: cache, entries: make(map[string]*CatalogEntry), mutex: &m, loadMutex: &loadMutex}
+}
+
+var defaultCatalog = NewCatalog(CatalogOptions{}, defaultCache)
+
+// Return the catalog that create_pod looks manifest IDs up in
+func DefaultCatalog() *Catalog {
+	return defaultCatalog
+}
+
+func SetDefaultCatalog(c *Catalog) {
+	defaultCatalog = c
+}
+
+// Return the loaded entries if they are newer than the refresh interval, and whether they have been loaded at all
+func (c *Catalog) loaded() (map[string]*CatalogEntry, bool, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.entries, time.Since(c.loadedAt) < c.options.Refresh, !c.loadedAt.IsZero()
+}
+
+// Return the loaded entries, reading the sources again if they are older than the refresh interval.
+// While another request reads them, the entries it's replacing are returned instead of waiting for it.
+func (c *Catalog) current() map[string]*CatalogEntry {
+	entries, fresh, loadedBefore := c.loaded()
+	if fresh {
+		return entries
+	}
+	if !c.loadMutex.TryLock() {
+		if loadedBefore {
+			return entries
+		}
+		c.loadMutex.Lock()
+	}
+	defer c.loadMutex.Unlock()
+	// The sources may have been read while this request waited
+	entries, fresh, _ = c.loaded()
+	if fresh {
+		return entries
+	}
+	entries = c.load()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = entries
+	c.loadedAt = time.Now()
+	return entries
+}
+
+// Return the file:// or http(s) url the manifest was read from, which create_pod reads it from again
+func (e CatalogEntry) Location() string {
+	return e.location
+}
+
+// List every entry in the catalog, sorted by ID
+func (c *Catalog) Entries() []CatalogEntry {
+	entries := c.current()
+	list := make([]CatalogEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Return the entry with the given ID
+func (c *Catalog) Get(id string) (CatalogEntry, bool) {
+	entry, exists := c.current()[id]
+	if !exists {
+		return CatalogEntry{}, false
+	}
+	return *entry, true
+}
+
+// Return the manifest of the local entry whose Location is fileURL, and its signature or nil if it isn't signed.
+// Only files that are in the catalog can be read this way.
+func (c *Catalog) ReadLocal(fileURL string) ([]byte, []byte, error) {
+	for _, entry := range c.current() {
+		if entry.location == fileURL {
+			return entry.yaml, entry.signature, nil
+		}
+	}
+	return nil, nil, errors.New(fmt.Sprintf("%s isn't a manifest in the catalog", fileURL))
+}
+
+// Read every source, skipping manifests that can't be parsed and IDs that were already found
+func (c *Catalog) load() map[string]*CatalogEntry {
+	entries := make(map[string]*CatalogEntry)
+	add := func(id string, source string, yaml []byte, signature []byte) {
+		log := logging.Default().With("source", source, "manifest_id", id)
+		if !ValidCatalogID(id) {
+			log.Warn("Skipped manifest with a name that can't be a catalog ID")
+			return
+		}
+		if existing, exists := entries[id]; exists {
+			log.Warn("Skipped manifest with a catalog ID that is already used", "used_by", existing.location)
+			return
+		}
+		entry, err := parseCatalogEntry(id, source, yaml, c.options.ReservedEnvVars)
+		if err != nil {
+			log.Warn("Skipped manifest that couldn't be parsed", "error", err)
+			return
+		}
+		entry.signature = signature
+		entries[id] = entry
+	}
+
+	for _, dir := range c.options.Dirs {
+		err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if info.Name() == ".git" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			ext := filepath.Ext(filePath)
+			if ext != ".yaml" && ext != ".yml" {
+				return nil
+			}
+			yaml, err := ioutil.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			signature, err := ioutil.ReadFile(filePath + SignatureExtension)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			absolute, err := filepath.Abs(filePath)
+			if err != nil {
+				return err
+			}
+			add(strings.TrimSuffix(info.Name(), ext), (&url.URL{Scheme: "file", Path: absolute}).String(), yaml, signature)
+			return nil
+		})
+		if err != nil {
+			logging.Default().Error("Couldn't read manifest catalog directory", "dir", dir, "error", err)
+		}
+	}
+
+	for _, manifestURL := range c.options.URLs {
+		yaml, err := c.cache.Get(manifestURL)
+		if err != nil {
+			logging.Default().Warn("Couldn't fetch manifest for the catalog", "yaml_url", manifestURL, "error", err)
+			continue
+		}
+		parsed, err := url.Parse(manifestURL)
+		if err != nil {
+			continue
+		}
+		base := path.Base(parsed.Path)
+		// The signature of a fetched manifest is checked when a pod is created from it
+		add(strings.TrimSuffix(base, path.Ext(base)), manifestURL, yaml, nil)
+	}
+	return entries
+}
+
+func parseCatalogEntry(id string, source string, yaml []byte, reservedEnvVars []string) (*CatalogEntry, error) {
+	bundle, parameters, err := RenderDefaults(yaml, reservedEnvVars, 0)
+	if err != nil {
+		return nil, err
+	}
+	pod := bundle.Pod
+	maxInstances, err := PodMaxInstances(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &CatalogEntry{
+		ID:           id,
+		Title:        pod.Annotations[AnnotationTitle],
+		Description:  pod.Annotations[AnnotationDescription],
+		Icon:         pod.Annotations[AnnotationIcon],
+		location:     source,
+		Containers:   []CatalogContainer{},
+		Parameters:   []Parameter{},
+		Companions:   []string{},
+		MaxInstances: maxInstances,
+		yaml:         yaml,
+	}
+	if !strings.HasPrefix(source, "file://") {
+		entry.Source = source
+	}
+	for _, parameter := range parameters {
+		if parameter.Secret {
+			parameter.Default = ""
+		}
+		entry.Parameters = append(entry.Parameters, parameter)
+	}
+	for _, companion := range bundle.Companions {
+		kind, name := CompanionKindAndName(companion)
+		entry.Companions = append(entry.Companions, fmt.Sprintf("%s/%s", kind, name))
+	}
+	if entry.Title == "" {
+		entry.Title = pod.Name
+	}
+	for _, container := range pod.Spec.Containers {
+		catalogContainer := CatalogContainer{
+			Name:  container.Name,
+			Image: container.Image,
+			Ports: []Port{},
+		}
+		for _, port := range container.Ports {
+			protocol := string(port.Protocol)
+			if protocol == "" {
+				protocol = string(apiv1.ProtocolTCP)
+			}
+			catalogContainer.Ports = append(catalogContainer.Ports, Port{
+				Name:          port.Name,
+				ContainerPort: port.ContainerPort,
+				Protocol:      protocol,
+			})
+		}
+		entry.Containers = append(entry.Containers, catalogContainer)
+	}
+	return entry, nil
+}
@@ -0,0 +1,111 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const jupyterManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: jupyter
+  annotations:
+    catalog.sciencedata.dk/title: Jupyter notebook
+    catalog.sciencedata.dk/description: Python notebooks with your ScienceData files
+spec:
+  containers:
+  - name: jupyter
+    image: sciencedata/jupyter
+    env:
+    - name: FILE
+      value: ""
+    - name: WORKING_DIRECTORY
+      value: jupyter
+    - name: HOME_SERVER
+    ports:
+    - containerPort: 8888
+`
+
+func writeManifest(t *testing.T, dir string, name string, contents string) {
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestCatalogEntries(t *testing.T) {
+	dir := t.TempDir()
+	writeManifest(t, dir, "jupyter.yaml", jupyterManifest)
+	writeManifest(t, dir, "README.md", "not a manifest")
+	writeManifest(t, dir, "broken.yaml", "kind: [")
+	writeManifest(t, dir, ".git/objects/x.yaml", jupyterManifest)
+	// A second manifest with the same ID is skipped
+	writeManifest(t, dir, "zz/jupyter.yml", "apiVersion: v1\nkind: Pod\nmetadata:\n  name: other\n")
+	upstream := &fakeUpstream{body: "apiVersion: v1\nkind: Pod\nmetadata:\n  name: ubuntu\n", etag: `"v1"`}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	catalog := NewCatalog(CatalogOptions{
+		Dirs:            []string{dir},
+		URLs:            []string{server.URL + "/ubuntu_sciencedata.yaml"},
+		ReservedEnvVars: []string{"HOME_SERVER"},
+	}, NewCache(Options{}))
+	entries := catalog.Entries()
+	if len(entries) != 2 || entries[0].ID != "jupyter" || entries[1].ID != "ubuntu_sciencedata" {
+		t.Fatalf("Unexpected catalog entries %+v", entries)
+	}
+
+	jupyter := entries[0]
+	if jupyter.Title != "Jupyter notebook" || jupyter.Description == "" {
+		t.Fatalf("Annotations weren't read: %+v", jupyter)
+	}
+	if len(jupyter.Containers) != 1 || jupyter.Containers[0].Image != "sciencedata/jupyter" {
+		t.Fatalf("Unexpected containers %+v", jupyter.Containers)
+	}
+	parameters := jupyter.Parameters
+	if len(parameters) != 2 || parameters[1].Name != "WORKING_DIRECTORY" || parameters[1].Default != "jupyter" {
+		t.Fatalf("Expected the manifest's env vars without reserved ones, got %+v", parameters)
+	}
+	ports := jupyter.Containers[0].Ports
+	if len(ports) != 1 || ports[0].ContainerPort != 8888 || ports[0].Protocol != "TCP" {
+		t.Fatalf("Unexpected ports %+v", ports)
+	}
+	if entries[1].Title != "ubuntu" || entries[1].Source != server.URL+"/ubuntu_sciencedata.yaml" {
+		t.Fatalf("Unexpected entry from url %+v", entries[1])
+	}
+	if jupyter.Source != "" || jupyter.Location() != "file://"+filepath.Join(dir, "jupyter.yaml") {
+		t.Fatalf("Local manifest's path should only be in its location: %+v", jupyter)
+	}
+
+	// Local manifests can be read by their location, other files can't
+	yaml, signature, err := catalog.ReadLocal(jupyter.Location())
+	if err != nil || string(yaml) != jupyterManifest || signature != nil {
+		t.Fatalf("Couldn't read local manifest: %v", err)
+	}
+	if _, _, err := catalog.ReadLocal("file://" + filepath.Join(dir, "broken.yaml")); err == nil {
+		t.Fatal("Files that aren't catalog entries shouldn't be readable")
+	}
+}
+
+func TestCatalogRefresh(t *testing.T) {
+	dir := t.TempDir()
+	catalog := NewCatalog(CatalogOptions{Dirs: []string{dir}, Refresh: time.Hour}, NewCache(Options{}))
+	if _, exists := catalog.Get("jupyter"); exists {
+		t.Fatal("Empty catalog shouldn't have entries")
+	}
+
+	writeManifest(t, dir, "jupyter.yaml", jupyterManifest)
+	if _, exists := catalog.Get("jupyter"); exists {
+		t.Fatal("Catalog shouldn't be read again before the refresh interval")
+	}
+	catalog.options.Refresh = 0
+	if _, exists := catalog.Get("jupyter"); !exists {
+		t.Fatal("Expected the new manifest after the refresh interval")
+	}
+}
@@ -0,0 +1,125 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Annotations in a manifest's pod metadata with a yaml (or json) list of Hooks, e.g.
+// - {name: seed-config, container: jupyter, command: [sh, -c, "cp -n /defaults/* ~/.jupyter/"], retries: 2}
+const (
+	// Hooks run once the pod is ready, which fail the creation if they fail
+	AnnotationPostStart = "catalog.sciencedata.dk/post-start"
+	// Hooks run before the pod is deleted, which don't stop the deletion if they fail
+	AnnotationPreStop = "catalog.sciencedata.dk/pre-stop"
+)
+
+const (
+	defaultHookTimeoutSeconds = 60
+	maxHookTimeoutSeconds     = 600
+	maxHookRetries            = 5
+)
+
+// A command run in one of the pod's containers through the exec api
+type Hook struct {
+	// Name used in logs, the annotation and index of the hook if empty
+	Name string `json:"name"`
+	// Container the command runs in, which may be left out if the pod has only one
+	Container string `json:"container"`
+	// The command and its arguments, which aren't run in a shell unless the command is one
+	Command []string `json:"command"`
+	// How long each attempt may take, 60 seconds if 0
+	TimeoutSeconds int `json:"timeout_seconds" yaml:"timeout_seconds"`
+	// How many more times the command is run if it fails
+	Retries int `json:"retries"`
+}
+
+// The hooks a manifest declares
+type Hooks struct {
+	PostStart []Hook
+	PreStop   []Hook
+}
+
+// Return the attempt timeout of the hook
+func (h Hook) Timeout() time.Duration {
+	if h.TimeoutSeconds == 0 {
+		return defaultHookTimeoutSeconds * time.Second
+	}
+	return time.Duration(h.TimeoutSeconds) * time.Second
+}
+
+// Return the longest the post-start hooks can take, if every attempt of each times out
+func (h Hooks) PostStartDuration() time.Duration {
+	var total time.Duration
+	for _, hook := range h.PostStart {
+		total += hook.Timeout() * time.Duration(hook.Retries+1)
+	}
+	return total
+}
+
+// Fill in the container and name of the hook, and return an error if it's invalid
+func (h *Hook) normalize(pod *apiv1.Pod, annotation string, index int) error {
+	if h.Name == "" {
+		h.Name = fmt.Sprintf("%s[%d]", annotation, index)
+	}
+	if len(h.Command) == 0 {
+		return errors.New(fmt.Sprintf("hook %s has no command", h.Name))
+	}
+	if h.Container == "" {
+		if len(pod.Spec.Containers) != 1 {
+			return errors.New(fmt.Sprintf("hook %s must set its container, since the pod has more than one", h.Name))
+		}
+		h.Container = pod.Spec.Containers[0].Name
+	}
+	found := false
+	for _, container := range pod.Spec.Containers {
+		if container.Name == h.Container {
+			found = true
+		}
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("hook %s runs in container %s, which the pod doesn't have", h.Name, h.Container))
+	}
+	if h.TimeoutSeconds < 0 || h.TimeoutSeconds > maxHookTimeoutSeconds {
+		return errors.New(fmt.Sprintf("hook %s must have a timeout_seconds between 0 and %d", h.Name, maxHookTimeoutSeconds))
+	}
+	if h.Retries < 0 || h.Retries > maxHookRetries {
+		return errors.New(fmt.Sprintf("hook %s must have between 0 and %d retries", h.Name, maxHookRetries))
+	}
+	return nil
+}
+
+func podHooksFrom(pod *apiv1.Pod, annotation string) ([]Hook, error) {
+	declared, isDeclared := pod.Annotations[annotation]
+	if !isDeclared {
+		return nil, nil
+	}
+	var hooks []Hook
+	err := yaml.Unmarshal([]byte(declared), &hooks)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't parse %s annotation: %s", annotation, err.Error()))
+	}
+	for i := range hooks {
+		err := hooks[i].normalize(pod, annotation, i)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid %s annotation: %s", annotation, err.Error()))
+		}
+	}
+	return hooks, nil
+}
+
+// Return the hooks the pod declares in AnnotationPostStart and AnnotationPreStop
+func PodHooks(pod *apiv1.Pod) (Hooks, error) {
+	var hooks Hooks
+	var err error
+	hooks.PostStart, err = podHooksFrom(pod, AnnotationPostStart)
+	if err != nil {
+		return hooks, err
+	}
+	hooks.PreStop, err = podHooksFrom(pod, AnnotationPreStop)
+	return hooks, err
+}
@@ -0,0 +1,59 @@
+package manifest
+
+import (
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func podWithHooks(annotations map[string]string, containers ...string) *apiv1.Pod {
+	pod := &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+	for _, name := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, apiv1.Container{Name: name})
+	}
+	return pod
+}
+
+func TestPodHooks(t *testing.T) {
+	pod := podWithHooks(map[string]string{
+		AnnotationPostStart: `[{name: seed-config, command: [sh, -c, "cp -n /defaults/* ~/"], retries: 2, timeout_seconds: 30}]`,
+		AnnotationPreStop:   `[{command: [sync]}]`,
+	}, "jupyter")
+	hooks, err := PodHooks(pod)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(hooks.PostStart) != 1 || len(hooks.PreStop) != 1 {
+		t.Fatalf("Unexpected hooks %+v", hooks)
+	}
+	seed := hooks.PostStart[0]
+	if seed.Container != "jupyter" || seed.Retries != 2 || seed.Timeout() != 30*time.Second || len(seed.Command) != 3 {
+		t.Fatalf("Unexpected post-start hook %+v", seed)
+	}
+	if hooks.PostStartDuration() != 90*time.Second {
+		t.Fatalf("Expected the post-start hooks to take up to 90s, got %s", hooks.PostStartDuration())
+	}
+	sync := hooks.PreStop[0]
+	if sync.Name != AnnotationPreStop+"[0]" || sync.Timeout() != defaultHookTimeoutSeconds*time.Second {
+		t.Fatalf("Defaults weren't filled in for pre-stop hook %+v", sync)
+	}
+
+	if hooks, err := PodHooks(podWithHooks(nil, "jupyter")); err != nil || len(hooks.PostStart)+len(hooks.PreStop) > 0 {
+		t.Fatalf("Expected no hooks, got %+v, %v", hooks, err)
+	}
+	for _, invalid := range []string{
+		`[{command: []}]`,
+		`[{command: [sync]}]`,
+		`[{command: [sync], container: missing}]`,
+		`[{command: [sync], container: jupyter, timeout_seconds: 3600}]`,
+		`[{command: [sync], container: jupyter, retries: -1}]`,
+		`not a list`,
+	} {
+		pod := podWithHooks(map[string]string{AnnotationPreStop: invalid}, "jupyter", "sidecar")
+		if _, err := PodHooks(pod); err == nil {
+			t.Fatalf("Hooks %s should be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Annotation in a manifest's pod metadata with a yaml (or json) list of Parameters
+const AnnotationParameters = "catalog.sciencedata.dk/parameters"
+
+// Types of Parameter values
+const (
+	ParameterString = "string"
+	ParameterInt    = "int"
+	ParameterBool   = "bool"
+	ParameterEnum   = "enum"
+)
+
+// An env var that may be set through the settings of a create_pod request
+type Parameter struct {
+	// Name of the env var
+	Name string `json:"name"`
+	// Container the env var is set in, which may be left out if the pod has only one
+	Container string `json:"container"`
+	// One of the Parameter* types, string if empty
+	Type string `json:"type"`
+	// Value used when the request doesn't set one
+	Default string `json:"default,omitempty"`
+	// Regex that string values must match
+	Pattern string `json:"pattern,omitempty"`
+	// Inclusive bounds on int values
+	Min *int64 `json:"min,omitempty"`
+	Max *int64 `json:"max,omitempty"`
+	// Allowed values of an enum
+	Values []string `json:"values,omitempty"`
+	// Secret values are kept in a Secret rather than in the pod spec, and defaults aren't shown
+	Secret bool `json:"secret,omitempty"`
+	// Only used in the manifest template as .Params.Name, rather than also set as an env var
+	TemplateOnly bool `json:"template_only,omitempty" yaml:"template_only"`
+}
+
+// A problem with one entry of a create_pod request's settings
+type SettingError struct {
+	Field   string
+	Message string
+}
+
+// Every problem found while checking a create_pod request's settings against the manifest's parameters
+type SettingsErrors []SettingError
+
+func (e SettingsErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, settingError := range e {
+		messages[i] = fmt.Sprintf("%s: %s", settingError.Field, settingError.Message)
+	}
+	return fmt.Sprintf("invalid settings: %s", strings.Join(messages, "; "))
+}
+
+func settingField(container string, name string) string {
+	return fmt.Sprintf("settings.%s.%s", container, name)
+}
+
+// Return an error if value isn't allowed for the parameter
+func (p Parameter) Check(value string) error {
+	// Values may be rendered into the manifest, where a line break could add to its structure
+	if strings.ContainsAny(value, "\r\n") {
+		return errors.New("must be a single line")
+	}
+	switch p.Type {
+	case ParameterString:
+		if p.Pattern != "" && !regexp.MustCompile(p.Pattern).MatchString(value) {
+			return errors.New(fmt.Sprintf("must match %s", p.Pattern))
+		}
+	case ParameterInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		if p.Min != nil && n < *p.Min {
+			return errors.New(fmt.Sprintf("must be at least %d", *p.Min))
+		}
+		if p.Max != nil && n > *p.Max {
+			return errors.New(fmt.Sprintf("must be at most %d", *p.Max))
+		}
+	case ParameterBool:
+		if value != "true" && value != "false" {
+			return errors.New("must be true or false")
+		}
+	case ParameterEnum:
+		for _, allowed := range p.Values {
+			if value == allowed {
+				return nil
+			}
+		}
+		return errors.New(fmt.Sprintf("must be one of %s", strings.Join(p.Values, ", ")))
+	}
+	return nil
+}
+
+// Check that the declaration itself makes sense, filling in the type and container if they were left out
+func (p *Parameter) normalize(pod *apiv1.Pod, reserved map[string]bool) error {
+	if p.Name == "" {
+		return errors.New("parameter without a name")
+	}
+	if reserved[p.Name] {
+		return errors.New(fmt.Sprintf("parameter %s is set by the backend", p.Name))
+	}
+	if p.Container == "" {
+		if len(pod.Spec.Containers) != 1 {
+			return errors.New(fmt.Sprintf("parameter %s must name its container, since the pod has several", p.Name))
+		}
+		p.Container = pod.Spec.Containers[0].Name
+	}
+	found := false
+	for _, container := range pod.Spec.Containers {
+		if container.Name == p.Container {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("parameter %s is for container %s, which isn't in the pod", p.Name, p.Container))
+	}
+	if p.Type == "" {
+		p.Type = ParameterString
+	}
+	switch p.Type {
+	case ParameterString:
+		if _, err := regexp.Compile(p.Pattern); err != nil {
+			return errors.New(fmt.Sprintf("parameter %s has an invalid pattern: %s", p.Name, err.Error()))
+		}
+	case ParameterInt:
+		if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+			return errors.New(fmt.Sprintf("parameter %s has min above max", p.Name))
+		}
+	case ParameterBool:
+	case ParameterEnum:
+		if len(p.Values) == 0 {
+			return errors.New(fmt.Sprintf("enum parameter %s has no values", p.Name))
+		}
+	default:
+		return errors.New(fmt.Sprintf("parameter %s has unknown type %s", p.Name, p.Type))
+	}
+	if p.Default != "" {
+		if err := p.Check(p.Default); err != nil {
+			return errors.New(fmt.Sprintf("parameter %s has an invalid default: %s", p.Name, err.Error()))
+		}
+	}
+	return nil
+}
+
+// Return the parameters that create_pod requests may set for pod.
+// If the manifest doesn't declare any in AnnotationParameters, every plain env var in its containers
+// is a string parameter defaulting to its value in the manifest.
+func PodParameters(pod *apiv1.Pod, reservedEnvVars []string) ([]Parameter, error) {
+	reserved := make(map[string]bool)
+	for _, name := range reservedEnvVars {
+		reserved[name] = true
+	}
+	var parameters []Parameter
+	declared, isDeclared := pod.Annotations[AnnotationParameters]
+	if !isDeclared {
+		for _, container := range pod.Spec.Containers {
+			for _, env := range container.Env {
+				if env.ValueFrom != nil || reserved[env.Name] {
+					continue
+				}
+				parameters = append(parameters, Parameter{
+					Name:      env.Name,
+					Container: container.Name,
+					Type:      ParameterString,
+					Default:   env.Value,
+				})
+			}
+		}
+		return parameters, nil
+	}
+
+	err := yaml.Unmarshal([]byte(declared), &parameters)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't parse %s annotation: %s", AnnotationParameters, err.Error()))
+	}
+	seen := make(map[string]bool)
+	for i := range parameters {
+		err := parameters[i].normalize(pod, reserved)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid %s annotation: %s", AnnotationParameters, err.Error()))
+		}
+		field := settingField(parameters[i].Container, parameters[i].Name)
+		if seen[field] {
+			return nil, errors.New(fmt.Sprintf("Invalid %s annotation: %s is declared twice", AnnotationParameters, field))
+		}
+		seen[field] = true
+	}
+	return parameters, nil
+}
+
+// Check settings[container_name][env_var_name] against parameters, and return the value of every parameter,
+// using defaults for the ones that weren't set, as values[container_name][env_var_name].
+// Parameters without a value or default are left out.
+func ResolveSettings(parameters []Parameter, settings map[string]map[string]string) (map[string]map[string]string, error) {
+	var errs SettingsErrors
+	known := make(map[string]bool)
+	values := make(map[string]map[string]string)
+	for _, parameter := range parameters {
+		known[settingField(parameter.Container, parameter.Name)] = true
+		value, isSet := settings[parameter.Container][parameter.Name]
+		if !isSet {
+			value = parameter.Default
+			if value == "" {
+				continue
+			}
+		} else if err := parameter.Check(value); err != nil {
+			errs = append(errs, SettingError{Field: settingField(parameter.Container, parameter.Name), Message: err.Error()})
+			continue
+		}
+		if values[parameter.Container] == nil {
+			values[parameter.Container] = make(map[string]string)
+		}
+		values[parameter.Container][parameter.Name] = value
+	}
+	for container, envVars := range settings {
+		for name := range envVars {
+			if !known[settingField(container, name)] {
+				errs = append(errs, SettingError{Field: settingField(container, name), Message: "not a parameter of this manifest"})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return nil, errs
+	}
+	return values, nil
+}
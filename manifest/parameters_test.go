@@ -0,0 +1,125 @@
+package manifest
+
+import (
+	"testing"
+)
+
+const parametersManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: jupyter
+  annotations:
+    catalog.sciencedata.dk/parameters: |
+      - name: WORKING_DIRECTORY
+        default: jupyter
+        pattern: "^[a-z_/]*$"
+      - name: PORT
+        type: int
+        default: "8888"
+        min: 1024
+        max: 65535
+      - name: DEBUG
+        type: bool
+      - name: MODE
+        type: enum
+        values: [lab, notebook]
+        default: lab
+      - name: PASSWORD
+        secret: true
+spec:
+  containers:
+  - name: jupyter
+    image: sciencedata/jupyter
+    env:
+    - name: FILE
+`
+
+func TestPodParameters(t *testing.T) {
+	pod, err := DecodePod([]byte(parametersManifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	parameters, err := PodParameters(pod, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(parameters) != 5 || parameters[0].Container != "jupyter" || parameters[0].Type != ParameterString {
+		t.Fatalf("Unexpected parameters %+v", parameters)
+	}
+	if *parameters[1].Min != 1024 || !parameters[4].Secret {
+		t.Fatalf("Unexpected parameters %+v", parameters)
+	}
+
+	// Without the annotation, the manifest's env vars are string parameters
+	delete(pod.Annotations, AnnotationParameters)
+	parameters, err = PodParameters(pod, nil)
+	if err != nil || len(parameters) != 1 || parameters[0].Name != "FILE" {
+		t.Fatalf("Unexpected parameters %+v, %v", parameters, err)
+	}
+	if parameters, _ = PodParameters(pod, []string{"FILE"}); len(parameters) != 0 {
+		t.Fatal("Reserved env vars shouldn't be parameters")
+	}
+
+	for _, invalid := range []string{
+		"- name: X\n  type: float",
+		"- name: X\n  type: enum",
+		"- name: X\n  container: other",
+		"- name: X\n  pattern: \"[\"",
+		"- name: X\n  type: int\n  default: abc",
+		"- name: X\n- name: X",
+		"- name: HOME_SERVER",
+		"name: X",
+	} {
+		pod.Annotations[AnnotationParameters] = invalid
+		if _, err := PodParameters(pod, []string{"HOME_SERVER"}); err == nil {
+			t.Fatalf("Declaration %q should be invalid", invalid)
+		}
+	}
+}
+
+func TestResolveSettings(t *testing.T) {
+	pod, _ := DecodePod([]byte(parametersManifest))
+	parameters, err := PodParameters(pod, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	values, err := ResolveSettings(parameters, map[string]map[string]string{"jupyter": {"PORT": "9000", "DEBUG": "true"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{"WORKING_DIRECTORY": "jupyter", "PORT": "9000", "DEBUG": "true", "MODE": "lab"}
+	if len(values["jupyter"]) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, values["jupyter"])
+	}
+	for name, value := range expected {
+		if values["jupyter"][name] != value {
+			t.Fatalf("Expected %v, got %v", expected, values["jupyter"])
+		}
+	}
+
+	_, err = ResolveSettings(parameters, map[string]map[string]string{
+		"jupyter": {"PORT": "80", "DEBUG": "yes", "MODE": "shell", "WORKING_DIRECTORY": "../x", "FILE": "a"},
+		"other":   {"PORT": "9000"},
+	})
+	settingsErrors, ok := err.(SettingsErrors)
+	if !ok {
+		t.Fatalf("Expected SettingsErrors, got %v", err)
+	}
+	fields := []string{
+		"settings.jupyter.DEBUG",
+		"settings.jupyter.FILE",
+		"settings.jupyter.MODE",
+		"settings.jupyter.PORT",
+		"settings.jupyter.WORKING_DIRECTORY",
+		"settings.other.PORT",
+	}
+	if len(settingsErrors) != len(fields) {
+		t.Fatalf("Expected errors for %v, got %v", fields, settingsErrors)
+	}
+	for i, field := range fields {
+		if settingsErrors[i].Field != field {
+			t.Fatalf("Expected errors for %v, got %v", fields, settingsErrors)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	"gopkg.in/yaml.v3"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Annotation in a manifest's pod metadata with yaml util.ResourceBounds for each of its containers, e.g.
+// max: {cpu: "4", memory: 8Gi}
+const AnnotationResources = "catalog.sciencedata.dk/resources"
+
+// util.ResourceBounds with the quantities parsed
+type resourceBounds struct {
+	min            apiv1.ResourceList
+	max            apiv1.ResourceList
+	defaultLimit   apiv1.ResourceList
+	defaultRequest apiv1.ResourceList
+}
+
+func parseResourceList(quantities map[string]string) (apiv1.ResourceList, error) {
+	list := make(apiv1.ResourceList)
+	for name, value := range quantities {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid quantity %s for %s: %s", value, name, err.Error()))
+		}
+		list[apiv1.ResourceName(name)] = quantity
+	}
+	return list, nil
+}
+
+func parseResourceBounds(bounds util.ResourceBounds) (resourceBounds, error) {
+	var parsed resourceBounds
+	if err := bounds.Validate(); err != nil {
+		return parsed, err
+	}
+	parsed.min, _ = parseResourceList(bounds.Min)
+	parsed.max, _ = parseResourceList(bounds.Max)
+	parsed.defaultLimit, _ = parseResourceList(bounds.Default)
+	parsed.defaultRequest, _ = parseResourceList(bounds.DefaultRequest)
+	return parsed, nil
+}
+
+// Return the bounds the manifest declares in AnnotationResources
+func PodResourceBounds(pod *apiv1.Pod) (util.ResourceBounds, error) {
+	var bounds util.ResourceBounds
+	declared, isDeclared := pod.Annotations[AnnotationResources]
+	if !isDeclared {
+		return bounds, nil
+	}
+	err := yaml.Unmarshal([]byte(declared), &bounds)
+	if err != nil {
+		return bounds, errors.New(fmt.Sprintf("Couldn't parse %s annotation: %s", AnnotationResources, err.Error()))
+	}
+	if err := bounds.Validate(); err != nil {
+		return bounds, errors.New(fmt.Sprintf("Invalid %s annotation: %s", AnnotationResources, err.Error()))
+	}
+	return bounds, nil
+}
+
+// Combine the user's bounds with the manifest's, using the tighter min and max of the two,
+// and the manifest's defaults before the user's. As in a LimitRange, the default limit is the max
+// if neither sets one, and the default request is the default limit. Defaults are kept within the bounds.
+func combineResourceBounds(user util.ResourceBounds, fromManifest util.ResourceBounds) (resourceBounds, error) {
+	userBounds, err := parseResourceBounds(user)
+	if err != nil {
+		return resourceBounds{}, err
+	}
+	manifestBounds, err := parseResourceBounds(fromManifest)
+	if err != nil {
+		return resourceBounds{}, err
+	}
+	combined := resourceBounds{
+		min:            userBounds.min,
+		max:            userBounds.max,
+		defaultLimit:   userBounds.defaultLimit,
+		defaultRequest: userBounds.defaultRequest,
+	}
+	for name, quantity := range manifestBounds.min {
+		if current, exists := combined.min[name]; !exists || quantity.Cmp(current) > 0 {
+			combined.min[name] = quantity
+		}
+	}
+	for name, quantity := range manifestBounds.max {
+		if current, exists := combined.max[name]; !exists || quantity.Cmp(current) < 0 {
+			combined.max[name] = quantity
+		}
+	}
+	for name, quantity := range manifestBounds.defaultLimit {
+		combined.defaultLimit[name] = quantity
+	}
+	for name, quantity := range manifestBounds.defaultRequest {
+		combined.defaultRequest[name] = quantity
+	}
+
+	for _, bounded := range util.BoundedResources {
+		name := apiv1.ResourceName(bounded)
+		min, hasMin := combined.min[name]
+		max, hasMax := combined.max[name]
+		if hasMin && hasMax && min.Cmp(max) > 0 {
+			return resourceBounds{}, errors.New(fmt.Sprintf("No amount of %s is within the bounds, the min %s is above the max %s", name, min.String(), max.String()))
+		}
+		if _, exists := combined.defaultLimit[name]; !exists && hasMax {
+			combined.defaultLimit[name] = max
+		}
+		if _, exists := combined.defaultRequest[name]; !exists {
+			if limit, hasLimit := combined.defaultLimit[name]; hasLimit {
+				combined.defaultRequest[name] = limit
+			}
+		}
+		for _, defaults := range []apiv1.ResourceList{combined.defaultLimit, combined.defaultRequest} {
+			if quantity, exists := defaults[name]; exists {
+				if hasMin && quantity.Cmp(min) < 0 {
+					defaults[name] = min
+				}
+				if hasMax && quantity.Cmp(max) > 0 {
+					defaults[name] = max
+				}
+			}
+		}
+	}
+	return combined, nil
+}
+
+// Return why quantity of the named resource is out of bounds, or an empty string if it isn't
+func (b resourceBounds) check(name apiv1.ResourceName, quantity resource.Quantity) string {
+	if min, exists := b.min[name]; exists && quantity.Cmp(min) < 0 {
+		return fmt.Sprintf("must be at least %s", min.String())
+	}
+	if max, exists := b.max[name]; exists && quantity.Cmp(max) > 0 {
+		return fmt.Sprintf("must be at most %s", max.String())
+	}
+	return ""
+}
+
+func resourceField(container string, name string) string {
+	return fmt.Sprintf("resources.%s.%s", container, name)
+}
+
+// Set the requests and limits of the pod's containers and init containers. A resource set in
+// settings[container_name][resource_name] is used as both the request and limit, and must be within
+// the bounds of the user and the manifest's AnnotationResources. Resources the manifest doesn't set get the defaults.
+// Every problem with the settings, and every amount in the manifest that's out of bounds, is returned as SettingsErrors.
+func ApplyResources(pod *apiv1.Pod, settings map[string]map[string]string, userBounds util.ResourceBounds) error {
+	manifestBounds, err := PodResourceBounds(pod)
+	if err != nil {
+		return err
+	}
+	bounds, err := combineResourceBounds(userBounds, manifestBounds)
+	if err != nil {
+		return err
+	}
+
+	var errs SettingsErrors
+	containers := make(map[string]bool)
+	for _, container := range pod.Spec.Containers {
+		containers[container.Name] = true
+	}
+	for containerName, quantities := range settings {
+		if !containers[containerName] {
+			errs = append(errs, SettingError{Field: fmt.Sprintf("resources.%s", containerName), Message: "not a container of this manifest"})
+			continue
+		}
+		for name := range quantities {
+			if !util.IsBoundedResource(name) {
+				errs = append(errs, SettingError{Field: resourceField(containerName, name), Message: "not a resource that can be set"})
+			}
+		}
+	}
+
+	// Init containers get the defaults and are held to the bounds too, but settings only apply to containers
+	var allContainers []*apiv1.Container
+	for i := range pod.Spec.InitContainers {
+		allContainers = append(allContainers, &pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		allContainers = append(allContainers, &pod.Spec.Containers[i])
+	}
+	for _, container := range allContainers {
+		if container.Resources.Limits == nil {
+			container.Resources.Limits = make(apiv1.ResourceList)
+		}
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = make(apiv1.ResourceList)
+		}
+		limits := container.Resources.Limits
+		requests := container.Resources.Requests
+		for _, bounded := range util.BoundedResources {
+			name := apiv1.ResourceName(bounded)
+			field := resourceField(container.Name, bounded)
+			if value, isSet := settings[container.Name][bounded]; isSet {
+				quantity, err := resource.ParseQuantity(value)
+				if err != nil {
+					errs = append(errs, SettingError{Field: field, Message: "must be a quantity such as 500m or 2Gi"})
+					continue
+				}
+				if message := bounds.check(name, quantity); message != "" {
+					errs = append(errs, SettingError{Field: field, Message: message})
+					continue
+				}
+				limits[name] = quantity
+				requests[name] = quantity
+				continue
+			}
+
+			if _, exists := limits[name]; !exists {
+				if quantity, hasDefault := bounds.defaultLimit[name]; hasDefault {
+					limits[name] = quantity
+				}
+			}
+			if _, exists := requests[name]; !exists {
+				if quantity, hasDefault := bounds.defaultRequest[name]; hasDefault {
+					requests[name] = quantity
+				} else if limit, hasLimit := limits[name]; hasLimit {
+					requests[name] = limit
+				}
+			}
+			if limit, hasLimit := limits[name]; hasLimit {
+				if request, hasRequest := requests[name]; hasRequest && request.Cmp(limit) > 0 {
+					requests[name] = limit
+				}
+			}
+			// What the manifest sets must also be within bounds, and can be overridden by the request
+			for _, list := range []apiv1.ResourceList{requests, limits} {
+				if quantity, exists := list[name]; exists {
+					if message := bounds.check(name, quantity); message != "" {
+						errs = append(errs, SettingError{Field: field, Message: fmt.Sprintf("%s in the manifest %s", quantity.String(), message)})
+						break
+					}
+				}
+			}
+		}
+		if len(limits) == 0 {
+			container.Resources.Limits = nil
+		}
+		if len(requests) == 0 {
+			container.Resources.Requests = nil
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package manifest
+
+import (
+	"testing"
+
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const resourcesManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: jupyter
+  annotations:
+    catalog.sciencedata.dk/resources: |
+      min: {memory: 512Mi}
+      max: {cpu: "8"}
+      default: {memory: 2Gi}
+spec:
+  containers:
+  - name: jupyter
+    image: sciencedata/jupyter
+  - name: sidecar
+    image: sciencedata/sidecar
+    resources:
+      limits:
+        cpu: 100m
+        memory: 1Gi
+`
+
+func TestApplyResources(t *testing.T) {
+	userBounds := util.ResourceBounds{
+		Min:            map[string]string{"memory": "256Mi"},
+		Max:            map[string]string{"cpu": "4", "memory": "8Gi"},
+		DefaultRequest: map[string]string{"cpu": "250m"},
+	}
+	pod, err := DecodePod([]byte(resourcesManifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = ApplyResources(pod, map[string]map[string]string{"jupyter": {"cpu": "2"}}, userBounds)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	jupyter := pod.Spec.Containers[0].Resources
+	expected := map[string]string{
+		"limits.cpu":      "2",
+		"requests.cpu":    "2",
+		"limits.memory":   "2Gi",
+		"requests.memory": "2Gi",
+	}
+	actual := map[string]string{
+		"limits.cpu":      jupyter.Limits.Cpu().String(),
+		"requests.cpu":    jupyter.Requests.Cpu().String(),
+		"limits.memory":   jupyter.Limits.Memory().String(),
+		"requests.memory": jupyter.Requests.Memory().String(),
+	}
+	for key, value := range expected {
+		if actual[key] != value {
+			t.Fatalf("Expected %v, got %v", expected, actual)
+		}
+	}
+	if _, exists := jupyter.Limits[apiv1.ResourceEphemeralStorage]; exists {
+		t.Fatal("Unbounded resources without defaults shouldn't be set")
+	}
+	// The manifest's own limits are kept, with requests no higher than them
+	sidecar := pod.Spec.Containers[1].Resources
+	if sidecar.Limits.Cpu().String() != "100m" || sidecar.Requests.Cpu().String() != "100m" || sidecar.Requests.Memory().String() != "1Gi" {
+		t.Fatalf("Unexpected sidecar resources %+v", sidecar)
+	}
+
+	pod, _ = DecodePod([]byte(resourcesManifest))
+	err = ApplyResources(pod, map[string]map[string]string{
+		"jupyter": {"cpu": "5", "memory": "128Mi"},
+		"other":   {"cpu": "1"},
+	}, userBounds)
+	settingsErrors, ok := err.(SettingsErrors)
+	if !ok {
+		t.Fatalf("Expected SettingsErrors, got %v", err)
+	}
+	fields := []string{"resources.jupyter.cpu", "resources.jupyter.memory", "resources.other"}
+	if len(settingsErrors) != len(fields) {
+		t.Fatalf("Expected errors for %v, got %v", fields, settingsErrors)
+	}
+	for i, field := range fields {
+		if settingsErrors[i].Field != field {
+			t.Fatalf("Expected errors for %v, got %v", fields, settingsErrors)
+		}
+	}
+
+	// Manifest amounts outside the bounds are reported, so the request can override them
+	userBounds.Max["cpu"] = "50m"
+	pod, _ = DecodePod([]byte(resourcesManifest))
+	err = ApplyResources(pod, nil, userBounds)
+	if settingsErrors, ok := err.(SettingsErrors); !ok || len(settingsErrors) != 1 || settingsErrors[0].Field != "resources.sidecar.cpu" {
+		t.Fatalf("Expected an error for the sidecar's cpu, got %v", err)
+	}
+
+	// Init containers get the defaults and must be within the bounds too
+	pod, _ = DecodePod([]byte(resourcesManifest))
+	pod.Spec.InitContainers = []apiv1.Container{{Name: "init", Image: "sciencedata/init"}}
+	if err := ApplyResources(pod, nil, util.ResourceBounds{DefaultRequest: map[string]string{"cpu": "250m"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if init := pod.Spec.InitContainers[0].Resources; init.Requests.Cpu().String() != "250m" || init.Requests.Memory().String() != "2Gi" {
+		t.Fatalf("Init container should get the defaults, got %+v", init)
+	}
+	pod.Spec.InitContainers[0].Resources.Limits[apiv1.ResourceCPU] = resource.MustParse("16")
+	err = ApplyResources(pod, nil, util.ResourceBounds{})
+	if settingsErrors, ok := err.(SettingsErrors); !ok || len(settingsErrors) != 1 || settingsErrors[0].Field != "resources.init.cpu" {
+		t.Fatalf("Expected an error for the init container's cpu, got %v", err)
+	}
+
+	userBounds.Min["memory"] = "16Gi"
+	if err := ApplyResources(pod, nil, userBounds); err == nil {
+		t.Fatal("Expected an error when min is above max")
+	}
+}
@@ -0,0 +1,97 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Values of GlobalConfig.ManifestSignatureMode
+const (
+	// Manifests without a valid signature are rejected
+	SignatureRequire = "require"
+	// Manifests without a signature are used with a warning, but invalid signatures are still rejected
+	SignatureWarn = "warn"
+	// Signatures aren't checked
+	SignatureSkip = "skip"
+)
+
+// Extension of a manifest's detached signature, which is fetched from the manifest's url with this appended
+const SignatureExtension = ".sig"
+
+// Return the url of the detached signature of the manifest at manifestURL
+func SignatureURL(manifestURL string) string {
+	return manifestURL + SignatureExtension
+}
+
+// Return whether err means that the requested manifest or signature doesn't exist upstream
+func IsNotFound(err error) bool {
+	var notFound *notFoundError
+	return errors.As(err, &notFound)
+}
+
+// Parse a trusted public key, either as a PEM "PUBLIC KEY" block as written by openssl pkey -pubout,
+// or as the base64 encoded 32 byte key
+func ParsePublicKey(key string) (ed25519.PublicKey, error) {
+	key = strings.TrimSpace(key)
+	if strings.HasPrefix(key, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(key))
+		if block == nil {
+			return nil, errors.New("couldn't decode PEM block")
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, isEd25519 := parsed.(ed25519.PublicKey)
+		if !isEd25519 {
+			return nil, errors.New(fmt.Sprintf("key is %T, not ed25519", parsed))
+		}
+		return publicKey, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != ed25519.PublicKeySize {
+		return nil, errors.New(fmt.Sprintf("key is %d bytes, not %d", len(decoded), ed25519.PublicKeySize))
+	}
+	return ed25519.PublicKey(decoded), nil
+}
+
+// Parse every trusted public key, see ParsePublicKey
+func ParsePublicKeys(keys []string) ([]ed25519.PublicKey, error) {
+	publicKeys := make([]ed25519.PublicKey, len(keys))
+	for i, key := range keys {
+		publicKey, err := ParsePublicKey(key)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid trusted manifest key %d: %s", i, err.Error()))
+		}
+		publicKeys[i] = publicKey
+	}
+	return publicKeys, nil
+}
+
+// Return nil if signature is a valid ed25519 signature of the exact bytes of manifestYaml by one of the trusted keys.
+// The signature may be the raw 64 bytes or base64 encoded, e.g. as written by
+// openssl pkeyutl -sign -rawin -inkey key.pem -in pod.yaml | base64 > pod.yaml.sig
+func VerifySignature(manifestYaml []byte, signature []byte, trustedKeys []ed25519.PublicKey) error {
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+		if err != nil || len(decoded) != ed25519.SignatureSize {
+			return errors.New("Manifest signature isn't a base64 encoded ed25519 signature")
+		}
+		signature = decoded
+	}
+	for _, key := range trustedKeys {
+		if ed25519.Verify(key, manifestYaml, signature) {
+			return nil
+		}
+	}
+	return errors.New("Manifest signature doesn't match any trusted key")
+}
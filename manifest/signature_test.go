@@ -0,0 +1,61 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+)
+
+func TestVerifySignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	manifestYaml := []byte(jupyterManifest)
+	signature := ed25519.Sign(privateKey, manifestYaml)
+	encoded := []byte(base64.StdEncoding.EncodeToString(signature) + "\n")
+
+	trusted := []ed25519.PublicKey{otherKey, publicKey}
+	if err := VerifySignature(manifestYaml, signature, trusted); err != nil {
+		t.Fatalf("Raw signature should verify: %s", err.Error())
+	}
+	if err := VerifySignature(manifestYaml, encoded, trusted); err != nil {
+		t.Fatalf("Base64 signature should verify: %s", err.Error())
+	}
+	if err := VerifySignature(manifestYaml, encoded, []ed25519.PublicKey{otherKey}); err == nil {
+		t.Fatal("Signature by an untrusted key shouldn't verify")
+	}
+	tampered := append([]byte{}, manifestYaml...)
+	tampered[0] = 'b'
+	if err := VerifySignature(tampered, encoded, trusted); err == nil {
+		t.Fatal("Signature of a different manifest shouldn't verify")
+	}
+	if err := VerifySignature(manifestYaml, []byte("not a signature"), trusted); err == nil {
+		t.Fatal("Malformed signature shouldn't verify")
+	}
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	keys, err := ParsePublicKeys([]string{base64.StdEncoding.EncodeToString(publicKey), pemKey})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !keys[0].Equal(publicKey) || !keys[1].Equal(publicKey) {
+		t.Fatal("Parsed keys don't match")
+	}
+	for _, invalid := range []string{"abc", base64.StdEncoding.EncodeToString([]byte("short")), "-----BEGIN PUBLIC KEY-----"} {
+		if _, err := ParsePublicKeys([]string{invalid}); err == nil {
+			t.Fatalf("Key %q should be invalid", invalid)
+		}
+	}
+}
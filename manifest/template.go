@@ -0,0 +1,249 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"text/template"
+	"text/template/parse"
+
+	"gopkg.in/yaml.v3"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// What a manifest template can see when it's rendered
+type TemplateData struct {
+	// Value of each parameter by name, after defaults are applied
+	Params map[string]string
+	// The user string, e.g. foo-bar-dk for foo@bar.dk
+	User string
+	// Name the pod will be created with
+	PodName string
+	// The silo's IP in the subnet where pods can reach the user's data
+	SiloIP string
+}
+
+// Functions available in templates besides text/template's built-ins
+var templateFuncs = template.FuncMap{
+	// Quote a value as a yaml string, so it can't change the structure of the manifest
+	"quote": func(value string) string {
+		quoted, _ := json.Marshal(value)
+		return string(quoted)
+	},
+}
+
+// Fails writes once more than limit bytes have been written
+type limitedWriter struct {
+	buffer bytes.Buffer
+	limit  int64
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if int64(w.buffer.Len()+len(p)) > w.limit {
+		return 0, errors.New(fmt.Sprintf("rendered manifest is larger than %d bytes", w.limit))
+	}
+	return w.buffer.Write(p)
+}
+
+func parseTemplate(manifestYaml []byte) (*template.Template, error) {
+	tmpl, err := template.New("manifest").Option("missingkey=error").Funcs(templateFuncs).Parse(string(manifestYaml))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't parse manifest template: %s", err.Error()))
+	}
+	return tmpl, nil
+}
+
+func renderTemplate(tmpl *template.Template, data TemplateData, maxBytes int64) ([]byte, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBytes
+	}
+	output := &limitedWriter{limit: maxBytes}
+	err := tmpl.Execute(output, data)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't render manifest template: %s", err.Error()))
+	}
+	return output.buffer.Bytes(), nil
+}
+
+// Render the manifest as a text/template with data.
+// Referring to a parameter that isn't in data.Params is an error.
+func Render(manifestYaml []byte, data TemplateData, maxBytes int64) ([]byte, error) {
+	tmpl, err := parseTemplate(manifestYaml)
+	if err != nil {
+		return nil, err
+	}
+	return renderTemplate(tmpl, data, maxBytes)
+}
+
+// Return the name of every parameter the template refers to as .Params.NAME or $.Params.NAME
+func templateParamNames(tmpl *template.Template) []string {
+	var names []string
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch typed := node.(type) {
+		case *parse.ListNode:
+			if typed == nil {
+				return
+			}
+			for _, child := range typed.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(typed.Pipe)
+		case *parse.PipeNode:
+			if typed == nil {
+				return
+			}
+			for _, command := range typed.Cmds {
+				walk(command)
+			}
+		case *parse.CommandNode:
+			for _, arg := range typed.Args {
+				walk(arg)
+			}
+		case *parse.ChainNode:
+			walk(typed.Node)
+		case *parse.IfNode:
+			walk(typed.Pipe)
+			walk(typed.List)
+			walk(typed.ElseList)
+		case *parse.RangeNode:
+			walk(typed.Pipe)
+			walk(typed.List)
+			walk(typed.ElseList)
+		case *parse.WithNode:
+			walk(typed.Pipe)
+			walk(typed.List)
+			walk(typed.ElseList)
+		case *parse.TemplateNode:
+			walk(typed.Pipe)
+		case *parse.FieldNode:
+			if len(typed.Ident) > 1 && typed.Ident[0] == "Params" {
+				names = append(names, typed.Ident[1])
+			}
+		case *parse.VariableNode:
+			if len(typed.Ident) > 2 && typed.Ident[0] == "$" && typed.Ident[1] == "Params" {
+				names = append(names, typed.Ident[2])
+			}
+		}
+	}
+	for _, defined := range tmpl.Templates() {
+		if defined.Tree != nil {
+			walk(defined.Tree.Root)
+		}
+	}
+	return names
+}
+
+// The parts of a manifest's Pod that are needed before it can be rendered
+type declaredPod struct {
+	Kind     string
+	Metadata struct {
+		Name        string
+		Annotations map[string]string
+	}
+	Spec struct {
+		Containers []struct {
+			Name string
+			Env  []struct {
+				Name      string
+				Value     string
+				ValueFrom interface{} `yaml:"valueFrom"`
+			}
+		}
+	}
+}
+
+// Return the Pod of a manifest template as declared, with only its name, annotations, and its containers' names
+// and env vars, which is what's needed to find its parameters and name before rendering it.
+// The template is rendered with a placeholder for every parameter to read these, so they shouldn't depend on parameters.
+func DeclaredPod(manifestYaml []byte, maxBytes int64) (*apiv1.Pod, error) {
+	tmpl, err := parseTemplate(manifestYaml)
+	if err != nil {
+		return nil, err
+	}
+	// A non-empty placeholder, since e.g. "image: repo:{{ .Params.TAG }}" isn't valid yaml with an empty tag
+	placeholders := make(map[string]string)
+	for _, name := range templateParamNames(tmpl) {
+		placeholders[name] = "0"
+	}
+	rendered, err := renderTemplate(tmpl, TemplateData{Params: placeholders}, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(rendered))
+	for {
+		var declared declaredPod
+		err := decoder.Decode(&declared)
+		if err == io.EOF {
+			return nil, errors.New("Manifest doesn't have a Pod")
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't read manifest: %s", err.Error()))
+		}
+		if declared.Kind != "Pod" {
+			continue
+		}
+		pod := &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        declared.Metadata.Name,
+				Annotations: declared.Metadata.Annotations,
+			},
+		}
+		for _, declaredContainer := range declared.Spec.Containers {
+			container := apiv1.Container{Name: declaredContainer.Name}
+			for _, env := range declaredContainer.Env {
+				envVar := apiv1.EnvVar{Name: env.Name, Value: env.Value}
+				if env.ValueFrom != nil {
+					// Only whether it's set matters here
+					envVar.ValueFrom = &apiv1.EnvVarSource{}
+				}
+				container.Env = append(container.Env, envVar)
+			}
+			pod.Spec.Containers = append(pod.Spec.Containers, container)
+		}
+		return pod, nil
+	}
+}
+
+// Return the value of every parameter by name, as templates see them in .Params.
+// A name used in several containers gets its value from the first of them.
+func TemplateParams(parameters []Parameter, values map[string]map[string]string) map[string]string {
+	params := make(map[string]string)
+	for _, parameter := range parameters {
+		if _, exists := params[parameter.Name]; exists {
+			continue
+		}
+		params[parameter.Name] = values[parameter.Container][parameter.Name]
+	}
+	return params
+}
+
+// Render a manifest template with the defaults of its parameters and decode it,
+// which is how it's described in the catalog
+func RenderDefaults(manifestYaml []byte, reservedEnvVars []string, maxBytes int64) (*Bundle, []Parameter, error) {
+	declared, err := DeclaredPod(manifestYaml, maxBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	parameters, err := PodParameters(declared, reservedEnvVars)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := ResolveSettings(parameters, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	rendered, err := Render(manifestYaml, TemplateData{Params: TemplateParams(parameters, values), PodName: declared.Name}, maxBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	bundle, err := DecodeBundle(rendered)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bundle, parameters, nil
+}
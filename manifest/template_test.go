@@ -0,0 +1,100 @@
+package manifest
+
+import (
+	"strings"
+	"testing"
+)
+
+const templateManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: jupyter
+  annotations:
+    catalog.sciencedata.dk/parameters: |
+      - name: TAG
+        default: latest
+        pattern: "^[a-z0-9.]+$"
+        template_only: true
+      - name: MODE
+        type: enum
+        values: [lab, notebook]
+        default: lab
+spec:
+  containers:
+  - name: jupyter
+    image: sciencedata/jupyter:{{ .Params.TAG }}
+    args: [{{ quote .Params.MODE }}, {{ quote .PodName }}]
+    env:
+    - name: HOME_SERVER
+      value: {{ .SiloIP }}
+`
+
+func TestRender(t *testing.T) {
+	declared, err := DeclaredPod([]byte(templateManifest), 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if declared.Name != "jupyter" || len(declared.Spec.Containers) != 1 {
+		t.Fatalf("Unexpected declared pod %+v", declared)
+	}
+	parameters, err := PodParameters(declared, []string{"HOME_SERVER"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	values, err := ResolveSettings(parameters, map[string]map[string]string{"jupyter": {"TAG": "1.2"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rendered, err := Render([]byte(templateManifest), TemplateData{
+		Params:  TemplateParams(parameters, values),
+		PodName: "jupyter-foo-bar",
+		SiloIP:  "10.2.0.1",
+	}, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pod, err := DecodePod(rendered)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	container := pod.Spec.Containers[0]
+	if container.Image != "sciencedata/jupyter:1.2" {
+		t.Fatalf("Expected the image tag to be rendered, got %s", container.Image)
+	}
+	if len(container.Args) != 2 || container.Args[0] != "lab" || container.Args[1] != "jupyter-foo-bar" {
+		t.Fatalf("Unexpected args %v", container.Args)
+	}
+	if container.Env[0].Value != "10.2.0.1" {
+		t.Fatalf("Expected the silo IP to be rendered, got %+v", container.Env[0])
+	}
+
+	// Values can't add lines to the manifest
+	_, err = ResolveSettings(parameters, map[string]map[string]string{"jupyter": {"MODE": "lab\n    privileged: true"}})
+	if _, ok := err.(SettingsErrors); !ok {
+		t.Fatalf("Expected a multi-line value to be rejected, got %v", err)
+	}
+
+	// Only declared parameters can be used
+	_, err = Render([]byte("image: {{ .Params.UNDECLARED }}"), TemplateData{Params: map[string]string{}}, 0)
+	if err == nil {
+		t.Fatal("Expected an error for an undeclared parameter")
+	}
+
+	_, err = Render([]byte(`{{ range .Params }}{{ . }}{{ end }}`), TemplateData{Params: map[string]string{"X": strings.Repeat("a", 100)}}, 50)
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("Expected output over the limit to fail, got %v", err)
+	}
+}
+
+func TestRenderDefaults(t *testing.T) {
+	bundle, parameters, err := RenderDefaults([]byte(templateManifest), []string{"HOME_SERVER"}, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(parameters) != 2 || !parameters[0].TemplateOnly {
+		t.Fatalf("Unexpected parameters %+v", parameters)
+	}
+	if bundle.Pod.Spec.Containers[0].Image != "sciencedata/jupyter:latest" {
+		t.Fatalf("Expected defaults to be rendered, got %s", bundle.Pod.Spec.Containers[0].Image)
+	}
+}
@@ -0,0 +1,324 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets in seconds for histograms of pod creation and deletion, which take seconds to minutes
+var LifecycleBuckets = []float64{1, 2.5, 5, 10, 20, 30, 45, 60, 90, 120, 180, 300}
+
+// Buckets in seconds for histograms of single calls to the kubernetes API
+var APIBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A collection of metrics that can be written in the prometheus text exposition format
+type Registry struct {
+	metrics map[string]metric
+	mutex   *sync.Mutex
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func NewRegistry() *Registry {
+	var m sync.Mutex
+	return &Registry{metrics: make(map[string]metric), mutex: &m}
+}
+
+// The registry that the package-level metrics are registered in and that Handler serves
+var DefaultRegistry = NewRegistry()
+
+// Add m to the registry under name, replacing any metric already registered with that name
+func (r *Registry) register(name string, m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics[name] = m
+}
+
+// Write every registered metric, sorted by name
+func (r *Registry) Write(w io.Writer) {
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	toWrite := make([]metric, len(names))
+	for i, name := range names {
+		toWrite[i] = r.metrics[name]
+	}
+	r.mutex.Unlock()
+	for _, m := range toWrite {
+		m.write(w)
+	}
+}
+
+// Return an http handler that serves the metrics in r
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.Write(w)
+	})
+}
+
+// Return an http handler that serves the metrics in DefaultRegistry
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+// The fields common to each metric type
+type desc struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.ReplaceAll(d.help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.metricType)
+}
+
+// Join the label values into a key for the map of series
+func (d *desc) seriesKey(labelValues []string) string {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", d.name, d.labelNames, labelValues))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// Format label pairs as {name="value",...}, with extra pairs appended
+func formatLabels(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], escapeLabelValue(extra[i+1])))
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ","))
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, "\"", "\\\"")
+	return strings.ReplaceAll(value, "\n", "\\n")
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", value)
+}
+
+// A counter partitioned by label values
+type CounterVec struct {
+	desc
+	series map[string]*counterSeries
+	mutex  *sync.Mutex
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// Create a counter and register it in the DefaultRegistry
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return DefaultRegistry.NewCounterVec(name, help, labelNames...)
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	var m sync.Mutex
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, metricType: "counter", labelNames: labelNames},
+		series: make(map[string]*counterSeries),
+		mutex:  &m,
+	}
+	r.register(name, c)
+	return c
+}
+
+// Add value to the counter for the given label values
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", c.name))
+	}
+	key := c.seriesKey(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	series, exists := c.series[key]
+	if !exists {
+		series = &counterSeries{labelValues: append([]string{}, labelValues...)}
+		c.series[key] = series
+	}
+	series.value += value
+}
+
+// Add one to the counter for the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Return the current value of the counter for the given label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := c.seriesKey(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	series, exists := c.series[key]
+	if !exists {
+		return 0
+	}
+	return series.value
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.writeHeader(w)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labelNames, series.labelValues), formatFloat(series.value))
+	}
+}
+
+// A gauge whose value is read from a function each time the metrics are written
+type GaugeFunc struct {
+	desc
+	function func() float64
+}
+
+// Create a gauge and register it in the DefaultRegistry,
+// replacing any gauge that was already registered with the same name
+func NewGaugeFunc(name string, help string, function func() float64) *GaugeFunc {
+	return DefaultRegistry.NewGaugeFunc(name, help, function)
+}
+
+func (r *Registry) NewGaugeFunc(name string, help string, function func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		desc:     desc{name: name, help: help, metricType: "gauge"},
+		function: function,
+	}
+	r.register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.function()))
+}
+
+// A histogram partitioned by label values
+type HistogramVec struct {
+	desc
+	buckets []float64
+	series  map[string]*histogramSeries
+	mutex   *sync.Mutex
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// counts[i] is the number of observations in (buckets[i-1], buckets[i]], so they aren't cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Create a histogram and register it in the DefaultRegistry
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogramVec(name, help, buckets, labelNames...)
+}
+
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	var m sync.Mutex
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, metricType: "histogram", labelNames: labelNames},
+		buckets: sorted,
+		series:  make(map[string]*histogramSeries),
+		mutex:   &m,
+	}
+	r.register(name, h)
+	return h
+}
+
+// Record value in the histogram for the given label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.seriesKey(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	series, exists := h.series[key]
+	if !exists {
+		series = &histogramSeries{
+			labelValues: append([]string{}, labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = series
+	}
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// Record the time elapsed since start in seconds
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Return the number of observations recorded for the given label values
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	key := h.seriesKey(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	series, exists := h.series[key]
+	if !exists {
+		return 0
+	}
+	return series.count
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.writeHeader(w)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		var cumulative uint64
+		for i, upperBound := range h.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(h.labelNames, series.labelValues, "le", formatFloat(upperBound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(h.labelNames, series.labelValues, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, series.labelValues), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, series.labelValues), series.count)
+	}
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounterVec("test_total", "A test counter", "manifest", "outcome")
+	counter.Inc("jupyter", "success")
+	counter.Add(2, "jupyter", "success")
+	counter.Inc("ubuntu\"\n", "failure")
+	histogram := r.NewHistogramVec("test_seconds", "A test histogram", []float64{10, 1, 5}, "manifest")
+	histogram.Observe(0.5, "jupyter")
+	histogram.Observe(3, "jupyter")
+	histogram.Observe(30, "jupyter")
+	size := 4
+	r.NewGaugeFunc("test_gauge", "A test gauge", func() float64 { return float64(size) })
+
+	var b bytes.Buffer
+	r.Write(&b)
+	output := b.String()
+	expectedLines := []string{
+		"# TYPE test_total counter",
+		`test_total{manifest="jupyter",outcome="success"} 3`,
+		`test_total{manifest="ubuntu\"\n",outcome="failure"} 1`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{manifest="jupyter",le="1"} 1`,
+		`test_seconds_bucket{manifest="jupyter",le="5"} 2`,
+		`test_seconds_bucket{manifest="jupyter",le="10"} 2`,
+		`test_seconds_bucket{manifest="jupyter",le="+Inf"} 3`,
+		`test_seconds_sum{manifest="jupyter"} 33.5`,
+		`test_seconds_count{manifest="jupyter"} 3`,
+		"# TYPE test_gauge gauge",
+		"test_gauge 4",
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Fatalf("Output doesn't contain line %s:\n%s", line, output)
+		}
+	}
+	// Metrics should be sorted by name
+	if strings.Index(output, "test_gauge") > strings.Index(output, "test_seconds") {
+		t.Fatalf("Metrics weren't sorted by name:\n%s", output)
+	}
+}
+
+func TestCounterValues(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounterVec("test_total", "A test counter", "kind")
+	if counter.Value("service") != 0 {
+		t.Fatal("New counter should start at 0")
+	}
+	counter.Inc("service")
+	counter.Inc("service")
+	if counter.Value("service") != 2 {
+		t.Fatalf("Counter should be 2, got %f", counter.Value("service"))
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Using the wrong number of label values should panic")
+		}
+	}()
+	counter.Inc("service", "extra")
+}
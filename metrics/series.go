@@ -0,0 +1,63 @@
+package metrics
+
+// Metrics describing the lifecycle of user pods and the backend's use of the kubernetes API.
+// Label values for `manifest` are the metadata.name of the manifest a pod was created from.
+var (
+	PodCreationSeconds = NewHistogramVec(
+		"user_pods_creation_duration_seconds",
+		"Time from a create_pod request until the pod's start jobs finished successfully",
+		LifecycleBuckets,
+		"manifest",
+	)
+	PodDeletionSeconds = NewHistogramVec(
+		"user_pods_deletion_duration_seconds",
+		"Time from a delete request until the pod and its services were deleted",
+		LifecycleBuckets,
+		"manifest",
+	)
+	PodCreations = NewCounterVec(
+		"user_pods_creations_total",
+		"Pod creations by outcome, with the reason for failures",
+		"manifest", "outcome", "reason",
+	)
+	PodDeletions = NewCounterVec(
+		"user_pods_deletions_total",
+		"Pod deletions by outcome, with the reason for failures",
+		"manifest", "outcome", "reason",
+	)
+	WatchTimeouts = NewCounterVec(
+		"user_pods_watch_timeouts_total",
+		"Watches on kubernetes objects that timed out before the desired event",
+		"resource",
+	)
+	TokenCopyRetries = NewCounterVec(
+		"user_pods_token_copy_retries_total",
+		"Retries of PodExec while copying tokens out of newly started pods",
+	)
+	OrphansFound = NewCounterVec(
+		"user_pods_orphans_found_total",
+		"Orphaned objects found by clean_all_unused",
+		"kind",
+	)
+	APICallSeconds = NewHistogramVec(
+		"user_pods_k8s_api_call_duration_seconds",
+		"Latency of calls from K8sClient to the kubernetes API server",
+		APIBuckets,
+		"verb", "resource",
+	)
+	APICallErrors = NewCounterVec(
+		"user_pods_k8s_api_call_errors_total",
+		"Calls from K8sClient to the kubernetes API server that returned an error",
+		"verb", "resource",
+	)
+	ManifestFetches = NewCounterVec(
+		"user_pods_manifest_fetches_total",
+		"Manifest lookups by result: hit, fetched, revalidated, stale or error",
+		"result",
+	)
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
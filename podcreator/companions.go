@@ -0,0 +1,256 @@
+package podcreator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Return the name of a companion object for the pod podName.
+// Names that start with the manifest's pod name get the new pod name in its place,
+// e.g. jupyter-ssh becomes jupyter-foo-bar-ssh, other names get the pod name as a prefix.
+func companionName(name string, manifestPodName string, podName string) string {
+	if strings.HasPrefix(name, manifestPodName) {
+		return podName + strings.TrimPrefix(name, manifestPodName)
+	}
+	return fmt.Sprintf("%s-%s", podName, name)
+}
+
+// Return the labels of an object created for the pod podName
+func (pc *PodCreator) createdForLabels(podName string) map[string]string {
+	labels := pc.user.GetLabels()
+	labels[managed.CreatedForPodLabel] = podName
+	return labels
+}
+
+// Return annotations with extra added, replacing any that are already set
+func mergeAnnotations(annotations map[string]string, extra map[string]string) map[string]string {
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	for key, value := range extra {
+		annotations[key] = value
+	}
+	return annotations
+}
+
+// Types that Secrets in manifests may have. Others, e.g. service account tokens, would have
+// the cluster fill them with credentials the user shouldn't get.
+var allowedSecretTypes = map[apiv1.SecretType]bool{
+	"":                               true,
+	apiv1.SecretTypeOpaque:           true,
+	apiv1.SecretTypeTLS:              true,
+	apiv1.SecretTypeDockerConfigJson: true,
+	apiv1.SecretTypeDockercfg:        true,
+	apiv1.SecretTypeBasicAuth:        true,
+	apiv1.SecretTypeSSHAuth:          true,
+}
+
+// Annotations that would tie a Secret to a service account
+const serviceAccountAnnotationPrefix = "kubernetes.io/service-account."
+
+// Return an error if the Secret in a manifest could be used to get credentials from the cluster
+func checkCompanionSecret(secret *apiv1.Secret) error {
+	if !allowedSecretTypes[secret.Type] {
+		return errors.New(fmt.Sprintf("Secret %s can't have type %s", secret.Name, secret.Type))
+	}
+	for key := range secret.Annotations {
+		if strings.HasPrefix(key, serviceAccountAnnotationPrefix) {
+			return errors.New(fmt.Sprintf("Secret %s can't have the annotation %s", secret.Name, key))
+		}
+	}
+	return nil
+}
+
+// Rename the companion objects after the target pod, label them as created for it,
+// and update the references between them and the pod to use the new names.
+// manifestPodName is the name of the pod in the manifest, before applyCreatePodName.
+func (pc *PodCreator) applyCompanionSettings(manifestPodName string, targetPodObject *apiv1.Pod) error {
+	// renamed[kind][name in the manifest] = name to create
+	renamed := make(map[string]map[string]string)
+	for _, kind := range manifest.CompanionKinds {
+		renamed[kind] = make(map[string]string)
+	}
+	for _, companion := range pc.companions {
+		kind, name := manifest.CompanionKindAndName(companion)
+		if _, exists := renamed[kind][name]; exists {
+			return errors.New(fmt.Sprintf("Manifest has more than one %s named %s", kind, name))
+		}
+		if secret, isSecret := companion.(*apiv1.Secret); isSecret {
+			if err := checkCompanionSecret(secret); err != nil {
+				return err
+			}
+		}
+		newName := companionName(name, manifestPodName, targetPodObject.Name)
+		var problems []string
+		if kind == "Service" {
+			problems = validation.IsDNS1035Label(newName)
+		} else {
+			problems = validation.IsDNS1123Subdomain(newName)
+		}
+		if len(problems) > 0 {
+			return errors.New(fmt.Sprintf("%s %s can't be named %s: %s", kind, name, newName, strings.Join(problems, ", ")))
+		}
+		renamed[kind][name] = newName
+	}
+	rename := func(kind string, name *string) {
+		if newName, exists := renamed[kind][*name]; exists {
+			*name = newName
+		}
+	}
+
+	setMeta := func(meta *metav1.ObjectMeta, kind string) {
+		rename(kind, &meta.Name)
+		meta.Namespace = ""
+		meta.Labels = pc.createdForLabels(targetPodObject.Name)
+		meta.Annotations = mergeAnnotations(meta.Annotations, pc.user.GetAnnotations())
+	}
+	for _, companion := range pc.companions {
+		switch typed := companion.(type) {
+		case *apiv1.Service:
+			setMeta(&typed.ObjectMeta, "Service")
+			// Only select the pod it was created for
+			typed.Spec.Selector = map[string]string{"podName": targetPodObject.Name}
+		case *apiv1.ConfigMap:
+			setMeta(&typed.ObjectMeta, "ConfigMap")
+		case *apiv1.Secret:
+			setMeta(&typed.ObjectMeta, "Secret")
+		case *networkingv1.Ingress:
+			setMeta(&typed.ObjectMeta, "Ingress")
+			renameIngressReferences(typed, rename)
+		}
+	}
+	renamePodReferences(targetPodObject, rename)
+	return nil
+}
+
+// Point the pod's references to ConfigMaps and Secrets at their renamed versions
+func renamePodReferences(pod *apiv1.Pod, rename func(kind string, name *string)) {
+	for i := range pod.Spec.Volumes {
+		source := &pod.Spec.Volumes[i].VolumeSource
+		if source.ConfigMap != nil {
+			rename("ConfigMap", &source.ConfigMap.Name)
+		}
+		if source.Secret != nil {
+			rename("Secret", &source.Secret.SecretName)
+		}
+		if source.Projected != nil {
+			for _, projection := range source.Projected.Sources {
+				if projection.ConfigMap != nil {
+					rename("ConfigMap", &projection.ConfigMap.Name)
+				}
+				if projection.Secret != nil {
+					rename("Secret", &projection.Secret.Name)
+				}
+			}
+		}
+	}
+	for i := range pod.Spec.ImagePullSecrets {
+		rename("Secret", &pod.Spec.ImagePullSecrets[i].Name)
+	}
+	containers := []*[]apiv1.Container{&pod.Spec.InitContainers, &pod.Spec.Containers}
+	for _, list := range containers {
+		for i := range *list {
+			container := &(*list)[i]
+			for _, env := range container.Env {
+				if env.ValueFrom == nil {
+					continue
+				}
+				if env.ValueFrom.ConfigMapKeyRef != nil {
+					rename("ConfigMap", &env.ValueFrom.ConfigMapKeyRef.Name)
+				}
+				if env.ValueFrom.SecretKeyRef != nil {
+					rename("Secret", &env.ValueFrom.SecretKeyRef.Name)
+				}
+			}
+			for _, envFrom := range container.EnvFrom {
+				if envFrom.ConfigMapRef != nil {
+					rename("ConfigMap", &envFrom.ConfigMapRef.Name)
+				}
+				if envFrom.SecretRef != nil {
+					rename("Secret", &envFrom.SecretRef.Name)
+				}
+			}
+		}
+	}
+}
+
+// Point the ingress's backends and TLS secrets at their renamed versions
+func renameIngressReferences(ingress *networkingv1.Ingress, rename func(kind string, name *string)) {
+	if ingress.Spec.DefaultBackend != nil && ingress.Spec.DefaultBackend.Service != nil {
+		rename("Service", &ingress.Spec.DefaultBackend.Service.Name)
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service != nil {
+				rename("Service", &path.Backend.Service.Name)
+			}
+		}
+	}
+	for i := range ingress.Spec.TLS {
+		rename("Secret", &ingress.Spec.TLS[i].SecretName)
+	}
+}
+
+// Call the kubernetes API for creation of a companion object
+func (pc *PodCreator) createCompanion(companion runtime.Object) error {
+	var err error
+	switch typed := companion.(type) {
+	case *apiv1.Service:
+		_, err = pc.client.CreateService(typed)
+	case *apiv1.ConfigMap:
+		_, err = pc.client.CreateConfigMap(typed)
+	case *apiv1.Secret:
+		_, err = pc.client.CreateSecret(typed)
+	case *networkingv1.Ingress:
+		_, err = pc.client.CreateIngress(typed)
+	default:
+		err = errors.New(fmt.Sprintf("Unsupported companion object %T", companion))
+	}
+	return err
+}
+
+// Remove objects left by a deleted pod with the target pod's name, then create the companion objects.
+// If any can't be created, the ones that were are deleted again.
+func (pc *PodCreator) createCompanions() error {
+	cleaned := util.NewReadyChannel(pc.globalConfig.TimeoutDelete)
+	err := managed.DeleteCreatedForPod(pc.targetPod.Name, pc.client, pc.globalConfig, pc.log, cleaned)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't clean up orphaned objects: %s", err.Error()))
+	}
+	if !cleaned.Receive() {
+		return errors.New(fmt.Sprintf("Couldn't ensure orphaned objects were removed: %s", cleaned.Reason()))
+	}
+
+	for _, companion := range pc.companions {
+		kind, name := manifest.CompanionKindAndName(companion)
+		err := pc.createCompanion(companion)
+		if err != nil {
+			pc.deleteCompanions()
+			return errors.New(fmt.Sprintf("Call to create %s %s failed: %s", kind, name, err.Error()))
+		}
+		pc.log.Info("Created companion object", "kind", kind, "name", name)
+	}
+	return nil
+}
+
+// Delete whatever was created for the target pod, without waiting for it to be gone
+func (pc *PodCreator) deleteCompanions() {
+	deleted := util.NewReadyChannel(pc.globalConfig.TimeoutDelete)
+	err := managed.DeleteCreatedForPod(pc.targetPod.Name, pc.client, pc.globalConfig, pc.log, deleted)
+	if err != nil {
+		pc.log.Error("Couldn't delete companion objects", "error", err)
+	}
+}
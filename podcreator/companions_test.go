@@ -0,0 +1,237 @@
+package podcreator
+
+import (
+	"testing"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const bundledManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: jupyter
+  namespace: other
+spec:
+  containers:
+  - name: jupyter
+    image: sciencedata/jupyter
+    envFrom:
+    - configMapRef:
+        name: settings
+    env:
+    - name: PASSWORD
+      valueFrom:
+        secretKeyRef:
+          name: jupyter-password
+          key: password
+  volumes:
+  - name: settings
+    configMap:
+      name: settings
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  namespace: other
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: jupyter-password
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: jupyter-web
+spec:
+  selector:
+    app: jupyter
+---
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: web
+spec:
+  rules:
+  - http:
+      paths:
+      - path: /
+        pathType: Prefix
+        backend:
+          service:
+            name: jupyter-web
+            port:
+              number: 80
+`
+
+func TestApplyCompanionSettings(t *testing.T) {
+	bundle, err := manifest.DecodeBundle([]byte(bundledManifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pc := PodCreator{
+		user:       managed.NewUser("foo@bar", k8sclient.K8sClient{}, util.GlobalConfig{}),
+		companions: bundle.Companions,
+	}
+	pod := bundle.Pod
+	pod.Name = "jupyter-foo-bar"
+	if err := pc.applyCompanionSettings("jupyter", pod); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	configMap := pc.companions[0].(*apiv1.ConfigMap)
+	secret := pc.companions[1].(*apiv1.Secret)
+	service := pc.companions[2].(*apiv1.Service)
+	ingress := pc.companions[3].(*networkingv1.Ingress)
+	if configMap.Name != "jupyter-foo-bar-settings" || configMap.Namespace != "" {
+		t.Fatalf("ConfigMap wasn't renamed for the pod: %s/%s", configMap.Namespace, configMap.Name)
+	}
+	if secret.Name != "jupyter-foo-bar-password" || service.Name != "jupyter-foo-bar-web" {
+		t.Fatalf("Names starting with the manifest's pod name should have it replaced, got %s and %s", secret.Name, service.Name)
+	}
+	if secret.Labels[managed.CreatedForPodLabel] != "jupyter-foo-bar" || util.GetUserIDFromLabels(secret.Labels) != "foo@bar" {
+		t.Fatalf("Unexpected labels %v", secret.Labels)
+	}
+	if len(service.Spec.Selector) != 1 || service.Spec.Selector["podName"] != "jupyter-foo-bar" {
+		t.Fatalf("Service should only select its pod, got %v", service.Spec.Selector)
+	}
+	if ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name != "jupyter-foo-bar-web" {
+		t.Fatal("Ingress backend should point at the renamed service")
+	}
+
+	container := pod.Spec.Containers[0]
+	if container.EnvFrom[0].ConfigMapRef.Name != configMap.Name ||
+		container.Env[0].ValueFrom.SecretKeyRef.Name != secret.Name ||
+		pod.Spec.Volumes[0].ConfigMap.Name != configMap.Name {
+		t.Fatalf("Pod references weren't renamed: %+v", pod.Spec)
+	}
+}
+
+func TestApplyNewPodName(t *testing.T) {
+	bundle, err := manifest.DecodeBundle([]byte(bundledManifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pc := PodCreator{
+		user:            managed.NewUser("foo@bar", k8sclient.K8sClient{}, util.GlobalConfig{}),
+		companions:      bundle.Companions,
+		targetPod:       bundle.Pod,
+		manifestPodName: "jupyter",
+	}
+	pc.applyCreatePodName(pc.targetPod, "jupyter-foo-bar-aaaaa")
+	if err := pc.applyCompanionSettings("jupyter", pc.targetPod); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := pc.applyNewPodName("jupyter-foo-bar-bbbbb"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pod := pc.targetPod
+	if pod.Name != "jupyter-foo-bar-bbbbb" || pod.Labels["podName"] != pod.Name || pod.Labels["manifest"] != "jupyter" {
+		t.Fatalf("Pod wasn't renamed: %s %v", pod.Name, pod.Labels)
+	}
+	configMap := pc.companions[0].(*apiv1.ConfigMap)
+	secret := pc.companions[1].(*apiv1.Secret)
+	service := pc.companions[2].(*apiv1.Service)
+	ingress := pc.companions[3].(*networkingv1.Ingress)
+	if configMap.Name != "jupyter-foo-bar-bbbbb-settings" || secret.Name != "jupyter-foo-bar-bbbbb-password" ||
+		service.Name != "jupyter-foo-bar-bbbbb-web" || ingress.Name != "jupyter-foo-bar-bbbbb-web" {
+		t.Fatalf("Companions weren't renamed: %s %s %s %s", configMap.Name, secret.Name, service.Name, ingress.Name)
+	}
+	if secret.Labels[managed.CreatedForPodLabel] != pod.Name || service.Spec.Selector["podName"] != pod.Name {
+		t.Fatalf("Companions should be for the renamed pod: %v %v", secret.Labels, service.Spec.Selector)
+	}
+	if ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name != service.Name ||
+		pod.Spec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Name != secret.Name ||
+		pod.Spec.Volumes[0].ConfigMap.Name != configMap.Name {
+		t.Fatal("References weren't renamed")
+	}
+
+	pc.podNameRendered = true
+	if err := pc.renameTargetPod(); err == nil {
+		t.Fatal("Pods whose manifest renders their name shouldn't be renamed")
+	}
+}
+
+func TestCheckCompanionSecret(t *testing.T) {
+	tests := []struct {
+		secret  apiv1.Secret
+		allowed bool
+	}{
+		{apiv1.Secret{}, true},
+		{apiv1.Secret{Type: apiv1.SecretTypeOpaque}, true},
+		{apiv1.Secret{Type: apiv1.SecretTypeTLS}, true},
+		{apiv1.Secret{Type: apiv1.SecretTypeServiceAccountToken}, false},
+		{apiv1.Secret{Type: apiv1.SecretTypeBootstrapToken}, false},
+		{apiv1.Secret{Type: "example.com/custom"}, false},
+		{apiv1.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{apiv1.ServiceAccountNameKey: "default"}}}, false},
+		{apiv1.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{apiv1.ServiceAccountUIDKey: "1234"}}}, false},
+	}
+	for _, test := range tests {
+		err := checkCompanionSecret(&test.secret)
+		if (err == nil) != test.allowed {
+			t.Fatalf("Secret %+v should be allowed: %t, got %v", test.secret, test.allowed, err)
+		}
+	}
+}
+
+func TestSecretSettings(t *testing.T) {
+	bundle, err := manifest.DecodeBundle([]byte(`apiVersion: v1
+kind: Pod
+metadata:
+  name: jupyter-foo-bar
+  annotations:
+    catalog.sciencedata.dk/parameters: |
+      - name: PASSWORD
+        secret: true
+      - name: MODE
+        default: lab
+spec:
+  containers:
+  - name: jupyter
+    env:
+    - name: MODE
+      value: notebook
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pc := PodCreator{
+		user:             managed.NewUser("foo@bar", k8sclient.K8sClient{}, util.GlobalConfig{}),
+		containerEnvVars: map[string]map[string]string{"jupyter": {"PASSWORD": "hunter2"}},
+	}
+	pod := bundle.Pod
+	parameters, err := manifest.PodParameters(pod, ReservedEnvVars)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	values, err := manifest.ResolveSettings(parameters, pc.containerEnvVars)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := pc.applyCreatePodSettings(pod, parameters, values); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	env := pod.Spec.Containers[0].Env
+	if len(env) != 2 || env[0].Name != "MODE" || env[0].Value != "lab" {
+		t.Fatalf("Expected MODE to be set to its default, got %+v", env)
+	}
+	if env[1].Value != "" || env[1].ValueFrom.SecretKeyRef.Name != "jupyter-foo-bar-settings" {
+		t.Fatalf("Secret setting should come from the settings Secret, got %+v", env[1])
+	}
+	if len(pc.companions) != 1 {
+		t.Fatal("Expected a Secret companion for the secret setting")
+	}
+	secret := pc.companions[0].(*apiv1.Secret)
+	if secret.StringData[env[1].ValueFrom.SecretKeyRef.Key] != "hunter2" || secret.Labels[managed.CreatedForPodLabel] != "jupyter-foo-bar" {
+		t.Fatalf("Unexpected settings Secret %+v", secret)
+	}
+}
@@ -1,29 +1,50 @@
 package podcreator
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
 	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/policy"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/kubernetes/scheme"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
 )
 
 type PodCreator struct {
-	targetPod        *apiv1.Pod
+	targetPod *apiv1.Pod
+	// Objects from the manifest that are created along with targetPod
+	companions       []runtime.Object
 	yamlURL          string
 	user             managed.User
 	siloIP           string
 	containerEnvVars map[string]map[string]string
-	client           k8sclient.K8sClient
-	globalConfig     util.GlobalConfig
+	// resources[container_name][resource_name] = quantity
+	containerResources map[string]map[string]string
+	client             k8sclient.K8sClient
+	globalConfig       util.GlobalConfig
+	log                *logging.Logger
+	// The most pods the user may run from the manifest at once, 0 if there's no limit
+	maxInstances int
+	// volumeSubPaths[volume_name] = directory of the volume to mount, for wellKnownVolumes that take one
+	volumeSubPaths map[string]string
+	// How the user's storage is mounted wherever the pod mounts it
+	storageMount StorageMount
+	// The projects whose storage the pod mounts
+	projects []managed.ProjectInfo
+	// The pod's metadata.name in the manifest, which pod names are made from
+	manifestPodName string
+	// Whether the manifest renders the pod name into its objects, in which case the pod can't be renamed
+	podNameRendered bool
 }
 
 // Initialization functions
@@ -37,21 +58,31 @@ func NewPodCreator(
 	userID string,
 	siloIP string,
 	containerEnvVars map[string]map[string]string,
+	containerResources map[string]map[string]string,
+	volumeSubPaths map[string]string,
+	storageMount StorageMount,
 	client k8sclient.K8sClient,
 	globalConfig util.GlobalConfig,
+	log *logging.Logger,
 ) (PodCreator, error) {
 	creator := PodCreator{
-		yamlURL:          yamlURL,
-		user:             managed.NewUser(userID, client, globalConfig),
-		siloIP:           siloIP,
-		containerEnvVars: containerEnvVars,
-		client:           client,
-		globalConfig:     globalConfig,
-		targetPod:        nil,
+		yamlURL:            yamlURL,
+		user:               managed.NewUser(userID, client, globalConfig),
+		siloIP:             siloIP,
+		containerEnvVars:   containerEnvVars,
+		containerResources: containerResources,
+		volumeSubPaths:     volumeSubPaths,
+		storageMount:       storageMount,
+		client:             client,
+		globalConfig:       globalConfig,
+		targetPod:          nil,
+		log:                log,
 	}
+	creator.user.SetLogger(log)
 	err := creator.initTargetPod()
 	if err != nil {
-		return creator, errors.New(fmt.Sprintf("Couldn't initialize PodCreator with a valid targetPod: %s", err.Error()))
+		// Wrapped so that invalid settings can be told apart from other errors
+		return creator, fmt.Errorf("Couldn't initialize PodCreator with a valid targetPod: %w", err)
 	}
 	return creator, nil
 }
@@ -61,6 +92,9 @@ func (pc *PodCreator) getSiloIPDataNet() string {
 	return strings.Replace(pc.siloIP, "10.0.", "10.2.", 1)
 }
 
+// Env vars that getMandatoryEnvVars sets in every container, so requests can't set them
+var ReservedEnvVars = []string{"HOME_SERVER", "SD_UID"}
+
 // Return the map of environment variables that should be set in each container of
 // the target pod, so that pods can know how to reach the user's data
 func (pc *PodCreator) getMandatoryEnvVars() map[string]string {
@@ -75,78 +109,198 @@ func (pc *PodCreator) initTargetPod() error {
 	if pc.targetPod != nil {
 		return errors.New("PodCreator already initialized with a targetPod")
 	}
-	var targetPod apiv1.Pod
 
 	// Get the manifest
 	yaml, err := pc.getYaml()
 	if err != nil {
 		return errors.New(fmt.Sprintf("Couldn't get manifest: %s", err.Error()))
 	}
+	// Read the parameters and name the manifest declares, which are needed to render it
+	declared, err := manifest.DeclaredPod([]byte(yaml), pc.globalConfig.ManifestMaxBytes)
+	if err != nil {
+		return err
+	}
+	parameters, err := manifest.PodParameters(declared, ReservedEnvVars)
+	if err != nil {
+		return err
+	}
+	values, err := manifest.ResolveSettings(parameters, pc.containerEnvVars)
+	if err != nil {
+		return err
+	}
+	pc.maxInstances, err = manifest.PodMaxInstances(declared)
+	if err != nil {
+		return err
+	}
+	// Find a unique podName in the format pod.metadata.name-userString-xxxxx
+	podName, err := pc.getUniquePodName(declared.Name)
+	if err != nil {
+		return err
+	}
 
-	// Convert it from []byte -> runtime.Object -> unstructured -> apiv1.Pod
-	deserializer := scheme.Codecs.UniversalDeserializer()
-	object, _, err := deserializer.Decode([]byte(yaml), nil, nil)
+	// Render the manifest with only the declared parameters and built-ins, then decode it.
+	// Everything after this works on the rendered objects, so templating can't get around it.
+	rendered, err := manifest.Render([]byte(yaml), manifest.TemplateData{
+		Params:  manifest.TemplateParams(parameters, values),
+		User:    pc.user.GetUserString(),
+		PodName: podName,
+		SiloIP:  pc.getSiloIPDataNet(),
+	}, pc.globalConfig.ManifestMaxBytes)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't deserialize manifest: %s", err.Error()))
+		return err
 	}
-	unstructuredPod, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	bundle, err := manifest.DecodeBundle(rendered)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't convert runtime.Object: %s", err.Error()))
+		return err
 	}
-	// Fill out targetPodObject with the data from the manifest
-	err = runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredPod, &targetPod)
+	targetPod := bundle.Pod
+	if targetPod.Name != declared.Name {
+		return errors.New("The pod's metadata.name can't depend on parameters")
+	}
+	pc.companions = bundle.Companions
+	pc.manifestPodName = declared.Name
+	// The name has a random suffix, so it's only in the rendered manifest if a template put it there
+	pc.podNameRendered = bytes.Contains(rendered, []byte(podName))
+	// Hooks are only run once the pod exists, so check them now
+	hooks, err := manifest.PodHooks(targetPod)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't parse manifest as apiv1.Pod: %s", err.Error()))
+		return err
+	}
+	// The post-start hooks run within the creation timeout, which the pod also needs to start in
+	if timeout := pc.globalConfig.TimeoutCreate; timeout > 0 && hooks.PostStartDuration() >= timeout {
+		return errors.New(fmt.Sprintf("The post-start hooks can take up to %s, which isn't within the creation timeout of %s",
+			hooks.PostStartDuration().String(), timeout.String()))
 	}
 
+	pc.applyCreatePodName(targetPod, podName)
+	err = pc.applyCompanionSettings(declared.Name, targetPod)
+	if err != nil {
+		return err
+	}
 	// Fill in values in targetPodObject according to the request
-	pc.applyCreatePodSettings(&targetPod)
+	err = pc.applyCreatePodSettings(targetPod, parameters, values)
+	if err != nil {
+		return err
+	}
+	err = manifest.ApplyResources(targetPod, pc.containerResources, pc.globalConfig.ResourceBoundsFor(pc.user.UserID))
+	if err != nil {
+		return err
+	}
 	// Fill in values in targetPodObject that are independent of the request
-	pc.applyMandatorySettings(&targetPod)
-	// Find and set a unique podName in the format pod.metadata.name-user-domain-x
-	err = pc.applyCreatePodName(&targetPod)
+	pc.applyMandatorySettings(targetPod)
+	err = pc.applyCreatePodVolumes(targetPod)
 	if err != nil {
 		return err
 	}
-	err = pc.applyCreatePodVolumes(&targetPod)
+	// Check the final pod and companions against the policy, so neither the manifest nor the request can get around it
+	mutations, err := policy.NewPolicy(pc.globalConfig).Apply(targetPod, pc.companions)
+	for _, mutation := range mutations {
+		pc.log.Warn("Changed manifest to follow policy", "change", mutation)
+	}
 	if err != nil {
 		return err
 	}
 
-	pc.targetPod = &targetPod
+	pc.targetPod = targetPod
 	return nil
 }
 
-// Retrieve the yaml manifest from a URL matching the whitelist
+// Retrieve the yaml manifest from a URL matching the whitelist,
+// or from disk if it's a local manifest in the catalog, and check its signature
 func (pc *PodCreator) getYaml() (string, error) {
-	allowed, err := regexp.MatchString(pc.globalConfig.WhitelistManifestRegex, pc.yamlURL)
+	if strings.HasPrefix(pc.yamlURL, "file://") {
+		body, signature, err := manifest.DefaultCatalog().ReadLocal(pc.yamlURL)
+		if err != nil {
+			return "", err
+		}
+		err = pc.checkSignature(body, signature)
+		if err != nil {
+			return "", err
+		}
+		return string(body), nil
+	}
+	if !pc.globalConfig.ManifestWhitelist().MatchString(pc.yamlURL) {
+		return "", errors.New(fmt.Sprintf("YamlURL %s not matched to whitelist", pc.yamlURL))
+	}
+	body, err := manifest.Default().Get(pc.yamlURL)
 	if err != nil {
 		return "", err
 	}
-	if !allowed {
-		return "", errors.New(fmt.Sprintf("YamlURL %s not matched to whitelist", pc.yamlURL))
+	if pc.signatureMode() == manifest.SignatureSkip {
+		return string(body), nil
 	}
-	response, err := http.Get(pc.yamlURL)
+	signature, err := pc.getSignature()
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("Could not fetch manifest from given url: %s", pc.yamlURL))
+		return "", err
+	}
+	err = pc.checkSignature(body, signature)
+	if err != nil && signature != nil {
+		// The manifest or signature may have changed upstream since one of them was cached, so fetch both again
+		if manifest.Default().Prefetch(pc.yamlURL) == nil {
+			body, _ = manifest.Default().Get(pc.yamlURL)
+			if signature, err = pc.getSignature(); err != nil {
+				return "", err
+			}
+			err = pc.checkSignature(body, signature)
+		}
 	}
-	defer response.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
 
-	// if the GET status isn't "200 OK"
-	if response.StatusCode != 200 {
-		return "", errors.New(fmt.Sprintf("Didn't find a file at the given url: %s", pc.yamlURL))
+// Return the configured ManifestSignatureMode, defaulting to skip
+func (pc *PodCreator) signatureMode() string {
+	if pc.globalConfig.ManifestSignatureMode == "" {
+		return manifest.SignatureSkip
 	}
+	return pc.globalConfig.ManifestSignatureMode
+}
 
-	body, err := ioutil.ReadAll(response.Body)
+// Fetch the manifest's detached signature, returning nil if it doesn't have one.
+// In warn mode, a signature that can't be fetched is treated as missing.
+func (pc *PodCreator) getSignature() ([]byte, error) {
+	signatureURL := manifest.SignatureURL(pc.yamlURL)
+	signature, err := manifest.Default().Get(signatureURL)
+	if manifest.IsNotFound(err) {
+		return nil, nil
+	}
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("Could not parse manifest from given url: %s", pc.yamlURL))
+		if pc.signatureMode() == manifest.SignatureWarn {
+			pc.log.Warn("Couldn't fetch manifest signature", "signature_url", signatureURL, "error", err)
+			return nil, nil
+		}
+		return nil, errors.New(fmt.Sprintf("Couldn't fetch manifest signature: %s", err.Error()))
 	}
+	return signature, nil
+}
 
-	return string(body), nil
+// Check the manifest's signature against the trusted keys according to the ManifestSignatureMode.
+// signature is nil if the manifest isn't signed.
+func (pc *PodCreator) checkSignature(body []byte, signature []byte) error {
+	mode := pc.signatureMode()
+	if mode == manifest.SignatureSkip {
+		return nil
+	}
+	if signature == nil {
+		if mode == manifest.SignatureWarn {
+			pc.log.Warn("Using manifest without a signature", "yaml_url", pc.yamlURL)
+			return nil
+		}
+		return errors.New(fmt.Sprintf("Manifest %s isn't signed", pc.yamlURL))
+	}
+	keys, err := manifest.ParsePublicKeys(pc.globalConfig.TrustedManifestKeys)
+	if err != nil {
+		return err
+	}
+	return manifest.VerifySignature(body, signature, keys)
 }
 
 // Apply all settings that are mandatory for each pod, independent of the request or manifest
 func (pc *PodCreator) applyMandatorySettings(targetPodObject *apiv1.Pod) {
+	// The pod is created in the configured namespace, whatever the manifest says
+	targetPodObject.Namespace = ""
 	// Set the restart policy from the global config
 	targetPodObject.Spec.RestartPolicy = pc.globalConfig.RestartPolicy
 
@@ -172,113 +326,263 @@ func (pc *PodCreator) applyMandatorySettings(targetPodObject *apiv1.Pod) {
 	}
 }
 
-func (pc *PodCreator) applyCreatePodSettings(targetPodObject *apiv1.Pod) {
+// Set the values of the manifest's parameters, checked against their declarations by ResolveSettings,
+// as env vars. Values of secret parameters are put in a Secret created with the pod.
+func (pc *PodCreator) applyCreatePodSettings(
+	targetPodObject *apiv1.Pod,
+	parameters []manifest.Parameter,
+	values map[string]map[string]string,
+) error {
+	secretName := fmt.Sprintf("%s-settings", targetPodObject.Name)
+	secretData := make(map[string]string)
+	for _, parameter := range parameters {
+		value, isSet := values[parameter.Container][parameter.Name]
+		if !isSet || parameter.TemplateOnly {
+			continue
+		}
+		env := apiv1.EnvVar{Name: parameter.Name, Value: value}
+		if parameter.Secret {
+			secretKey := fmt.Sprintf("%s.%s", parameter.Container, parameter.Name)
+			secretData[secretKey] = value
+			env = apiv1.EnvVar{
+				Name: parameter.Name,
+				ValueFrom: &apiv1.EnvVarSource{
+					SecretKeyRef: &apiv1.SecretKeySelector{
+						LocalObjectReference: apiv1.LocalObjectReference{Name: secretName},
+						Key:                  secretKey,
+					},
+				},
+			}
+		}
+		setContainerEnv(targetPodObject, parameter.Container, env)
+	}
+
+	if len(secretData) > 0 {
+		for _, companion := range pc.companions {
+			if kind, name := manifest.CompanionKindAndName(companion); kind == "Secret" && name == secretName {
+				return errors.New(fmt.Sprintf("Manifest has a Secret that would be named %s, which is used for secret settings", secretName))
+			}
+		}
+		pc.companions = append(pc.companions, &apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   secretName,
+				Labels: pc.createdForLabels(targetPodObject.Name),
+			},
+			StringData: secretData,
+		})
+	}
+	return nil
+}
+
+// Set env in the named container, replacing the var if the manifest already has it
+func setContainerEnv(targetPodObject *apiv1.Pod, containerName string, env apiv1.EnvVar) {
 	for i, container := range targetPodObject.Spec.Containers {
-		envVars, exist := pc.containerEnvVars[container.Name]
-		// if there are settings for this container (if container.Name is a key in request.ContainerEnvVars)
-		if exist {
-			// then for each setting,
-			for name, value := range envVars {
-				// find the env entry with a matching name, and set the value
-				for ii, env := range container.Env {
-					if env.Name == name {
-						targetPodObject.Spec.Containers[i].Env[ii].Value = value
-					}
-				}
+		if container.Name != containerName {
+			continue
+		}
+		for ii, existing := range container.Env {
+			if existing.Name == env.Name {
+				targetPodObject.Spec.Containers[i].Env[ii] = env
+				return
 			}
 		}
+		targetPodObject.Spec.Containers[i].Env = append(targetPodObject.Spec.Containers[i].Env, env)
+		return
 	}
 }
 
-func (pc *PodCreator) applyCreatePodName(targetPodObject *apiv1.Pod) error {
-	basePodName := fmt.Sprintf("%s-%s", targetPodObject.Name, pc.user.GetUserString())
-	existingPodList, err := pc.user.ListPods()
+// Return a label value identifying the manifest, from its metadata.name
+func getManifestLabel(targetPodObject *apiv1.Pod) string {
+	return util.LabelValue(targetPodObject.Name)
+}
+
+// Length of the random suffix that makes pod names unique, as with metadata.generateName
+const podNameSuffixLength = 5
+
+// How many names are tried before giving up on creating a pod
+const maxPodNameAttempts = 10
+
+// Returned, wrapped, by CreatePod when the user already runs as many pods from the manifest as it allows
+var ErrMaxInstances = errors.New("Too many pods from this manifest")
+
+// Return a name in the format manifestPodName-userString-xxxxx that none of the user's pods have,
+// where xxxxx is random. The name is only checked again and used while the user's lock is held in CreatePod.
+func (pc *PodCreator) getUniquePodName(manifestPodName string) (string, error) {
+	existingPods, err := pc.user.ListPods()
 	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't list pods to find a unique pod name: %s", err.Error()))
-	}
-	podName := basePodName
-	var nameInUse bool
-	for i := 1; i < 11; i++ {
-		nameInUse = false
-		for _, existingPod := range existingPodList {
-			if existingPod.Object.Name == podName {
-				nameInUse = true
-				break
-			}
+		return "", errors.New(fmt.Sprintf("Couldn't list pods to find a unique pod name: %s", err.Error()))
+	}
+	return newPodName(manifestPodName, pc.user.GetUserString(), existingPods)
+}
+
+// Return a random name for a pod from the manifest that isn't in existingPods.
+// The manifest's pod name is shortened so that the name fits in managed.MaxPodNameLength.
+func newPodName(manifestPodName string, userString string, existingPods []managed.Pod) (string, error) {
+	manifestLength := managed.MaxPodNameLength - len(userString) - podNameSuffixLength - len("--")
+	basePodName := fmt.Sprintf("%s-%s", util.NameSlug(manifestPodName, manifestLength), userString)
+	for i := 0; i < maxPodNameAttempts; i++ {
+		podName := fmt.Sprintf("%s-%s", basePodName, utilrand.String(podNameSuffixLength))
+		if !podNameInUse(podName, existingPods) {
+			return podName, nil
 		}
-		// if a pod with the name podName doesn't exist yet
-		if !nameInUse {
-			// then set the target pod's name and labels, then finish
-			targetPodObject.Name = podName
-			targetPodObject.ObjectMeta.Labels = map[string]string{
-				"user":    pc.user.Name,
-				"domain":  pc.user.Domain,
-				"podName": podName,
-			}
-			return nil
+	}
+	return "", errors.New(fmt.Sprintf("Couldn't find a unique name for %s in %d attempts", basePodName, maxPodNameAttempts))
+}
+
+func podNameInUse(podName string, existingPods []managed.Pod) bool {
+	for _, existingPod := range existingPods {
+		if existingPod.Object.Name == podName {
+			return true
 		}
-		// otherwise try again with the next name
-		podName = fmt.Sprintf("%s-%d", basePodName, i)
 	}
-	// if all 10 names are in use,
-	return errors.New(fmt.Sprintf("Couldn't find a unique name for %s-(1-9), all are in use", basePodName))
+	return false
 }
 
-// Dynamically generate the pod.Spec.Volume entry for an unsatisfied pod.Spec.Container[].VolumeMount
-func (pc *PodCreator) getCreatePodSpecVolume(volumeMount apiv1.VolumeMount) (apiv1.Volume, error) {
-	switch volumeMount.Name {
-	case "local":
-		return apiv1.Volume{
-			Name: "local",
-			VolumeSource: apiv1.VolumeSource{
-				PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
-					ClaimName: fmt.Sprintf("local-claim-%s", strings.ReplaceAll(volumeMount.MountPath, "/", "-")),
-				},
-			},
-		}, nil
-	case "sciencedata":
-		return apiv1.Volume{
-			Name: "sciencedata",
-			VolumeSource: apiv1.VolumeSource{
-				PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
-					ClaimName: pc.user.GetStoragePVName(),
-				},
-			},
-		}, nil
-	default:
-		return apiv1.Volume{}, errors.New(
-			fmt.Sprintf("Not known how to dynamically create an entry for this volume mount %+v", volumeMount),
-		)
+// Set the target pod's name and labels
+func (pc *PodCreator) applyCreatePodName(targetPodObject *apiv1.Pod, podName string) {
+	manifest := getManifestLabel(targetPodObject)
+	targetPodObject.Name = podName
+	targetPodObject.ObjectMeta.Labels = pc.user.GetLabels()
+	targetPodObject.ObjectMeta.Labels["podName"] = podName
+	targetPodObject.ObjectMeta.Labels["manifest"] = manifest
+	targetPodObject.ObjectMeta.Annotations = mergeAnnotations(targetPodObject.ObjectMeta.Annotations, pc.user.GetAnnotations())
+}
+
+// Functions for pod creation
+
+// A lock for each user who has pods being created, removed when nobody holds or waits for it
+type userLock struct {
+	mutex   *sync.Mutex
+	holders int
+}
+
+var userLocks = make(map[string]*userLock)
+var userLocksMutex = &sync.Mutex{}
+
+// Block until no other pod is being created for the user in this process, then return the function that releases the lock.
+// This only serialises the requests handled by one backend, so CreatePod still handles names taken by another.
+func lockUser(userID string) func() {
+	userLocksMutex.Lock()
+	lock, exists := userLocks[userID]
+	if !exists {
+		var m sync.Mutex
+		lock = &userLock{mutex: &m}
+		userLocks[userID] = lock
+	}
+	lock.holders++
+	userLocksMutex.Unlock()
+
+	lock.mutex.Lock()
+	return func() {
+		lock.mutex.Unlock()
+		userLocksMutex.Lock()
+		defer userLocksMutex.Unlock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(userLocks, userID)
+		}
 	}
 }
 
-// Make sure that any VolumeMounts that aren't specified in Spec.Volumes get added.
-// This should be used for e.g. the user's storage, which should be generated at runtime
-// for the given user.
-func (pc *PodCreator) applyCreatePodVolumes(targetPodObject *apiv1.Pod) error {
-	for _, container := range targetPodObject.Spec.Containers {
-		for _, volumeMount := range container.VolumeMounts {
-			// For each volume mount, first check whether the volume is specified in pod.Spec.Volumes
-			satisfied := false
-			for _, volume := range targetPodObject.Spec.Volumes {
-				if volume.Name == volumeMount.Name {
-					satisfied = true
-					break
-				}
-			}
-			if !satisfied {
-				targetVolumeSpec, err := pc.getCreatePodSpecVolume(volumeMount)
-				if err != nil {
-					return err
-				}
-				targetPodObject.Spec.Volumes = append(targetPodObject.Spec.Volumes, targetVolumeSpec)
-			}
+// Return whether a pod is being created for the user in this process, e.g. so that their storage isn't swept meanwhile
+func UserLocked(userID string) bool {
+	userLocksMutex.Lock()
+	defer userLocksMutex.Unlock()
+	_, exists := userLocks[userID]
+	return exists
+}
+
+// Return an error wrapping ErrMaxInstances if the user already runs as many pods from the manifest as it allows
+func (pc *PodCreator) checkMaxInstances(existingPods []managed.Pod) error {
+	if pc.maxInstances == 0 {
+		return nil
+	}
+	manifestLabel := pc.targetPod.Labels["manifest"]
+	instances := 0
+	for _, existingPod := range existingPods {
+		if existingPod.GetManifestName() == manifestLabel {
+			instances++
 		}
 	}
+	if instances >= pc.maxInstances {
+		return fmt.Errorf("%w: %s allows %d per user", ErrMaxInstances, manifestLabel, pc.maxInstances)
+	}
 	return nil
 }
 
-// Functions for pod creation
+// Give the targetPod and its companions a new unique name
+func (pc *PodCreator) renameTargetPod() error {
+	// What templates rendered from the name can't be changed without rendering the manifest again
+	if pc.podNameRendered {
+		return errors.New(fmt.Sprintf("Pod name %s was taken, and the manifest's templates use it", pc.targetPod.Name))
+	}
+	podName, err := pc.getUniquePodName(pc.manifestPodName)
+	if err != nil {
+		return err
+	}
+	return pc.applyNewPodName(podName)
+}
+
+// Set the targetPod's name to podName, and rename its companions and the references to them to match
+func (pc *PodCreator) applyNewPodName(podName string) error {
+	oldPodName := pc.targetPod.Name
+	// The manifest label is taken from the name, so put back the manifest's
+	pc.targetPod.Name = pc.manifestPodName
+	pc.applyCreatePodName(pc.targetPod, podName)
+	// Every companion's name starts with the old pod name, so this replaces it with the new one
+	return pc.applyCompanionSettings(oldPodName, pc.targetPod)
+}
+
+// Create the companion objects and the targetPod, and return the created pod with a ReadyChannel for it becoming ready.
+// If the targetPod's name was taken after it was chosen, it's created with a new name instead.
+// Must be called with the user's lock held.
+func (pc *PodCreator) createUniquePod() (*apiv1.Pod, *util.ReadyChannel, error) {
+	for attempt := 1; ; attempt++ {
+		existingPods, err := pc.user.ListPods()
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Couldn't list pods: %s", err.Error()))
+		}
+		err = pc.checkMaxInstances(existingPods)
+		if err != nil {
+			return nil, nil, err
+		}
+		if podNameInUse(pc.targetPod.Name, existingPods) {
+			if attempt == maxPodNameAttempts {
+				return nil, nil, errors.New(fmt.Sprintf("Couldn't find a unique pod name in %d attempts", maxPodNameAttempts))
+			}
+			pc.log.Info("Pod name was taken before creation, choosing another", "pod_name", pc.targetPod.Name)
+			err = pc.renameTargetPod()
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		// Create the companion objects first, since the pod may need its ConfigMaps and Secrets to start
+		err = pc.createCompanions()
+		if err != nil {
+			return nil, nil, err
+		}
+		podReady := util.NewReadyChannel(pc.globalConfig.TimeoutCreate)
+		go pc.client.WatchCreatePod(pc.targetPod.Name, podReady)
+		createdPod, err := pc.client.CreatePod(pc.targetPod)
+		if err == nil {
+			return createdPod, podReady, nil
+		}
+		// Stop watching the pod that wasn't created
+		podReady.Fail("create call failed")
+		pc.deleteCompanions()
+		if !k8serrors.IsAlreadyExists(err) || attempt == maxPodNameAttempts {
+			return nil, nil, errors.New(fmt.Sprintf("Call to create pod %s failed: %s", pc.targetPod.Name, err.Error()))
+		}
+		// Another backend created a pod with the same name since the pods were listed
+		pc.log.Warn("Pod name already exists, choosing another", "pod_name", pc.targetPod.Name)
+		err = pc.renameTargetPod()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
 
 // Call the kubernetes API for creation of the PodCreator's targetPod
 // Create and return a managed.Pod object corresponding to the created pod
@@ -288,33 +592,61 @@ func (pc *PodCreator) CreatePod(ready *util.ReadyChannel) (managed.Pod, error) {
 	if pc.targetPod == nil {
 		return pod, errors.New("PodCreater wasn't initialized with a targetPod, cannot create empty target.")
 	}
-
+	// Hold the user's lock from preparing the storage until the pod exists,
+	// so that the storage sweeper doesn't delete the storage in between
+	unlock := lockUser(pc.user.UserID)
+	defer unlock()
+	// Check the limit before preparing storage for a pod that can't be created.
+	// It's checked again before each attempt in createUniquePod.
+	if pc.maxInstances > 0 {
+		existingPods, err := pc.user.ListPods()
+		if err != nil {
+			return pod, errors.New(fmt.Sprintf("Couldn't list pods: %s", err.Error()))
+		}
+		err = pc.checkMaxInstances(existingPods)
+		if err != nil {
+			return pod, err
+		}
+	}
+	// Prepare the storage before the pod exists, since storage that has to be recreated can't be in use
 	storageReady := util.NewReadyChannel(pc.globalConfig.TimeoutCreate)
 	if pc.requiresUserStorage() {
-		pc.user.CreateUserStorageIfNotExist(storageReady, pc.siloIP)
+		err := pc.user.CreateUserStorageIfNotExist(storageReady, pc.siloIP)
+		if err != nil {
+			return pod, errors.New(fmt.Sprintf("Couldn't prepare user storage: %s", err.Error()))
+		}
 	} else {
 		storageReady.Send(true)
 	}
+	startJobWaitChans := []*util.ReadyChannel{storageReady}
+	for _, info := range pc.projects {
+		project := managed.NewProject(info.ID, pc.client, pc.globalConfig)
+		project.SetLogger(pc.log)
+		projectStorageReady := util.NewReadyChannel(pc.globalConfig.TimeoutCreate)
+		err := project.CreateStorageIfNotExist(projectStorageReady, info.SiloIP)
+		if err != nil {
+			return pod, errors.New(fmt.Sprintf("Couldn't prepare storage of project %s: %s", info.ID, err.Error()))
+		}
+		startJobWaitChans = append(startJobWaitChans, projectStorageReady)
+	}
 
-	podReady := util.NewReadyChannel(pc.globalConfig.TimeoutCreate)
+	createdPod, podReady, err := pc.createUniquePod()
+	if err != nil {
+		return pod, err
+	}
+	log := pc.log.With("pod_name", createdPod.Name)
 	go func() {
-		pc.client.WatchCreatePod(pc.targetPod.Name, podReady)
 		if podReady.Receive() {
-			fmt.Printf("Ready pod %s\n", pc.targetPod.Name)
+			log.Info("Pod ready")
 		} else {
-			fmt.Printf("Warning: pod %s didn't reach ready state\n", pc.targetPod.Name)
+			log.Warn("Pod didn't reach ready state", "reason", podReady.Reason())
 		}
 	}()
 
-	createdPod, err := pc.client.CreatePod(pc.targetPod)
-	if err != nil {
-		return pod, errors.New(fmt.Sprintf("Call to create pod %s failed: %s", pc.targetPod.Name, err.Error()))
-	}
 	pod = managed.NewPod(createdPod, pc.client, pc.globalConfig)
+	pod.SetLogger(pc.log)
 
-	startJobWaitChans := make([]*util.ReadyChannel, 2)
-	startJobWaitChans[0] = storageReady
-	startJobWaitChans[1] = podReady
+	startJobWaitChans = append(startJobWaitChans, podReady)
 
 	go pod.RunStartJobsWhenReady(startJobWaitChans, ready)
 	return pod, nil
@@ -324,7 +656,7 @@ func (pc *PodCreator) CreatePod(ready *util.ReadyChannel) (managed.Pod, error) {
 func (pc *PodCreator) requiresUserStorage() bool {
 	req := false
 	for _, volume := range pc.targetPod.Spec.Volumes {
-		if volume.Name == "sciencedata" {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pc.user.GetStoragePVName() {
 			req = true
 		}
 	}
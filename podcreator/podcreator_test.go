@@ -5,11 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
 	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
 	"github.com/deic.dk/user_pods_k8s_backend/testingutil"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	v1 "k8s.io/api/core/v1"
@@ -110,7 +114,7 @@ func TestPodCreation(t *testing.T) {
 				}
 			}
 
-			pc, err := NewPodCreator(request.YamlURL, u.UserID, testingutil.RemoteIP, request.Settings, u.Client, u.GlobalConfig)
+			pc, err := NewPodCreator(request.YamlURL, u.UserID, testingutil.RemoteIP, request.Settings, nil, nil, StorageMount{}, u.Client, u.GlobalConfig, logging.Default())
 			if err != nil {
 				t.Fatalf("Could't initialize podcreator for %s", err.Error())
 			}
@@ -124,7 +128,7 @@ func TestPodCreation(t *testing.T) {
 			}
 
 			// check targetPod name
-			podNameRegex := regexp.MustCompile(fmt.Sprintf("[a-z]+-%s(-\\d)?", u.GetUserString()))
+			podNameRegex := regexp.MustCompile(fmt.Sprintf("^[a-z]+-%s-[a-z0-9]{5}$", u.GetUserString()))
 			if !podNameRegex.MatchString(pc.targetPod.Name) {
 				t.Fatalf("targetPod name %s doesn't match regex", pc.targetPod.Name)
 			}
@@ -170,3 +174,96 @@ func TestPodCreation(t *testing.T) {
 		}
 	}
 }
+
+func TestNewPodName(t *testing.T) {
+	u := managed.NewUser("someone@example.com", k8sclient.K8sClient{}, util.GlobalConfig{})
+	userString := u.GetUserString()
+	existing := []managed.Pod{}
+	for i := 0; i < 100; i++ {
+		podName, err := newPodName("jupyter", userString, existing)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if podNameInUse(podName, existing) {
+			t.Fatalf("Name %s is already in use", podName)
+		}
+		if !regexp.MustCompile(fmt.Sprintf("^jupyter-%s-[a-z0-9]{5}$", userString)).MatchString(podName) {
+			t.Fatalf("Unexpected pod name %s", podName)
+		}
+		existing = append(existing, managed.Pod{Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: podName}}})
+	}
+
+	podName, err := newPodName(strings.Repeat("long-manifest-name", 10), userString, existing)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(podName) > managed.MaxPodNameLength {
+		t.Fatalf("Pod name %s is longer than %d", podName, managed.MaxPodNameLength)
+	}
+}
+
+func TestLockUser(t *testing.T) {
+	var wg sync.WaitGroup
+	holding := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := lockUser("someone@example.com")
+			holding++
+			if holding != 1 {
+				t.Errorf("%d goroutines hold the same user's lock", holding)
+			}
+			time.Sleep(time.Millisecond)
+			holding--
+			unlock()
+		}()
+	}
+	// Another user's lock isn't blocked by them
+	unlock := lockUser("other@example.com")
+	if !UserLocked("other@example.com") {
+		t.Fatal("UserLocked should be true while the lock is held")
+	}
+	unlock()
+	wg.Wait()
+	if UserLocked("someone@example.com") || UserLocked("other@example.com") {
+		t.Fatal("UserLocked should be false once the locks are released")
+	}
+	userLocksMutex.Lock()
+	defer userLocksMutex.Unlock()
+	if len(userLocks) != 0 {
+		t.Fatalf("Released locks weren't removed: %v", userLocks)
+	}
+}
+
+func TestCheckMaxInstances(t *testing.T) {
+	bundle, err := manifest.DecodeBundle([]byte(bundledManifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bundle.Pod.Annotations = map[string]string{manifest.AnnotationMaxInstances: "2"}
+	maxInstances, err := manifest.PodMaxInstances(bundle.Pod)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bundle.Pod.Labels = map[string]string{"manifest": "jupyter"}
+	pc := PodCreator{targetPod: bundle.Pod, maxInstances: maxInstances}
+	newPod := func(manifestLabel string) managed.Pod {
+		return managed.Pod{Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"manifest": manifestLabel}}}}
+	}
+	existing := []managed.Pod{newPod("jupyter"), newPod("rstudio")}
+	if err := pc.checkMaxInstances(existing); err != nil {
+		t.Fatalf("One instance should be allowed: %s", err.Error())
+	}
+	existing = append(existing, newPod("jupyter"))
+	if err := pc.checkMaxInstances(existing); !errors.Is(err, ErrMaxInstances) {
+		t.Fatalf("Expected ErrMaxInstances, got %v", err)
+	}
+
+	for _, invalid := range []string{"0", "-1", "many"} {
+		bundle.Pod.Annotations[manifest.AnnotationMaxInstances] = invalid
+		if _, err := manifest.PodMaxInstances(bundle.Pod); err == nil {
+			t.Fatalf("max-instances %s should be invalid", invalid)
+		}
+	}
+}
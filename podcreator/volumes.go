@@ -0,0 +1,366 @@
+package podcreator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/policy"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Size limit of the scratch volume when ScratchVolumeSizeLimit isn't set
+const defaultScratchSizeLimit = "1Gi"
+
+// How a create_pod request mounts the user's storage
+type StorageMount struct {
+	// Directory of the user's storage to mount instead of all of it
+	SubPath string `json:"subpath"`
+	// Mount the user's storage read-only
+	ReadOnly bool `json:"read_only"`
+}
+
+// Return whether the request changes how the user's storage is mounted
+func (s StorageMount) IsSet() bool {
+	return s.SubPath != "" || s.ReadOnly
+}
+
+// A volume that manifests can mount by name without declaring it in spec.volumes
+type wellKnownVolume struct {
+	// Return the volume to add to the pod for the first mount of it
+	volume func(pc *PodCreator, volumeMount apiv1.VolumeMount) (apiv1.Volume, error)
+	// Change each mount of the volume, e.g. to make it read-only, or nil to leave them as the manifest has them
+	mount func(pc *PodCreator, volumeMount *apiv1.VolumeMount) error
+	// Whether requests can choose the subPath of the volume that's mounted, in volume_subpaths
+	takesSubPath bool
+}
+
+// The volumes that are generated for the pod when a container mounts one of these names without declaring it
+var wellKnownVolumes = map[string]wellKnownVolume{
+	// A PVC named after the mount path
+	"local": {volume: localVolume},
+	// The user's storage, or the part of it chosen by the request's StorageMount
+	"sciencedata": {volume: userStorageVolume},
+	// A directory of the user's storage chosen by the request
+	"user-subdir": {volume: userStorageVolume, mount: requestSubPathMount, takesSubPath: true},
+	// An emptyDir with a size limit
+	"scratch": {volume: scratchVolume},
+	// The shared datasets PVC, always read-only
+	"datasets": {volume: datasetsVolume, mount: readOnlyMount},
+	// The user's ConfigMap and Secret, named after their user string
+	"user-config":  {volume: userConfigVolume, mount: readOnlyMount},
+	"user-secrets": {volume: userSecretsVolume, mount: readOnlyMount},
+}
+
+// Return the names of the well-known volumes, sorted
+func wellKnownVolumeNames() []string {
+	names := make([]string, 0, len(wellKnownVolumes))
+	for name := range wellKnownVolumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func localVolume(pc *PodCreator, volumeMount apiv1.VolumeMount) (apiv1.Volume, error) {
+	return apiv1.Volume{
+		Name: volumeMount.Name,
+		VolumeSource: apiv1.VolumeSource{
+			PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+				ClaimName: fmt.Sprintf("local-claim-%s", strings.ReplaceAll(volumeMount.MountPath, "/", "-")),
+			},
+		},
+	}, nil
+}
+
+func userStorageVolume(pc *PodCreator, volumeMount apiv1.VolumeMount) (apiv1.Volume, error) {
+	return apiv1.Volume{
+		Name: volumeMount.Name,
+		VolumeSource: apiv1.VolumeSource{
+			PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+				ClaimName: pc.user.GetStoragePVName(),
+			},
+		},
+	}, nil
+}
+
+func scratchVolume(pc *PodCreator, volumeMount apiv1.VolumeMount) (apiv1.Volume, error) {
+	sizeLimitString := pc.globalConfig.ScratchVolumeSizeLimit
+	if sizeLimitString == "" {
+		sizeLimitString = defaultScratchSizeLimit
+	}
+	sizeLimit, err := resource.ParseQuantity(sizeLimitString)
+	if err != nil {
+		return apiv1.Volume{}, errors.New(fmt.Sprintf("Invalid ScratchVolumeSizeLimit %s: %s", sizeLimitString, err.Error()))
+	}
+	emptyDir := &apiv1.EmptyDirVolumeSource{SizeLimit: &sizeLimit}
+	if pc.globalConfig.ScratchVolumeInMemory {
+		emptyDir.Medium = apiv1.StorageMediumMemory
+	}
+	return apiv1.Volume{
+		Name:         volumeMount.Name,
+		VolumeSource: apiv1.VolumeSource{EmptyDir: emptyDir},
+	}, nil
+}
+
+func datasetsVolume(pc *PodCreator, volumeMount apiv1.VolumeMount) (apiv1.Volume, error) {
+	if pc.globalConfig.DatasetsClaimName == "" {
+		return apiv1.Volume{}, errors.New("The datasets volume isn't available on this server")
+	}
+	return apiv1.Volume{
+		Name: volumeMount.Name,
+		VolumeSource: apiv1.VolumeSource{
+			PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+				ClaimName: pc.globalConfig.DatasetsClaimName,
+				ReadOnly:  true,
+			},
+		},
+	}, nil
+}
+
+// Return the name of the user's ConfigMap or Secret for the volume of the given name
+func (pc *PodCreator) userObjectName(volumeName string) string {
+	return fmt.Sprintf("%s-%s", volumeName, pc.user.GetUserString())
+}
+
+func userConfigVolume(pc *PodCreator, volumeMount apiv1.VolumeMount) (apiv1.Volume, error) {
+	name := pc.userObjectName(volumeMount.Name)
+	list, err := pc.client.ListConfigMaps(metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", name)})
+	if err != nil {
+		return apiv1.Volume{}, errors.New(fmt.Sprintf("Couldn't look for ConfigMap %s: %s", name, err.Error()))
+	}
+	if len(list.Items) == 0 || util.GetUserIDFromMeta(list.Items[0].ObjectMeta) != pc.user.UserID {
+		return apiv1.Volume{}, errors.New(fmt.Sprintf("The %s volume needs the user's ConfigMap %s, which doesn't exist", volumeMount.Name, name))
+	}
+	return apiv1.Volume{
+		Name: volumeMount.Name,
+		VolumeSource: apiv1.VolumeSource{
+			ConfigMap: &apiv1.ConfigMapVolumeSource{
+				LocalObjectReference: apiv1.LocalObjectReference{Name: name},
+			},
+		},
+	}, nil
+}
+
+func userSecretsVolume(pc *PodCreator, volumeMount apiv1.VolumeMount) (apiv1.Volume, error) {
+	name := pc.userObjectName(volumeMount.Name)
+	list, err := pc.client.ListSecrets(metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", name)})
+	if err != nil {
+		return apiv1.Volume{}, errors.New(fmt.Sprintf("Couldn't look for Secret %s: %s", name, err.Error()))
+	}
+	if len(list.Items) == 0 || util.GetUserIDFromMeta(list.Items[0].ObjectMeta) != pc.user.UserID {
+		return apiv1.Volume{}, errors.New(fmt.Sprintf("The %s volume needs the user's Secret %s, which doesn't exist", volumeMount.Name, name))
+	}
+	return apiv1.Volume{
+		Name: volumeMount.Name,
+		VolumeSource: apiv1.VolumeSource{
+			Secret: &apiv1.SecretVolumeSource{SecretName: name},
+		},
+	}, nil
+}
+
+func readOnlyMount(pc *PodCreator, volumeMount *apiv1.VolumeMount) error {
+	volumeMount.ReadOnly = true
+	return nil
+}
+
+// Apply the request's StorageMount to every mount of the user's storage, whether it's mounted as sciencedata,
+// user-subdir or a volume the manifest declares. A subPath the manifest or volume_subpaths mounts is kept
+// within the request's, so that the pod can't see more of the storage than the request allows.
+// Returns whether any container mounts the user's storage.
+func (pc *PodCreator) applyStorageMount(targetPodObject *apiv1.Pod) (bool, error) {
+	storageVolumes := make(map[string]bool)
+	for _, volume := range targetPodObject.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pc.user.GetStoragePVName() {
+			storageVolumes[volume.Name] = true
+		}
+	}
+	if pc.storageMount.SubPath != "" {
+		if err := util.ValidateSubPath(pc.storageMount.SubPath); err != nil {
+			return false, manifest.SettingsErrors{{Field: "storage.subpath", Message: err.Error()}}
+		}
+	}
+	mounted := false
+	for _, containers := range [][]apiv1.Container{targetPodObject.Spec.InitContainers, targetPodObject.Spec.Containers} {
+		for i := range containers {
+			for j := range containers[i].VolumeMounts {
+				volumeMount := &containers[i].VolumeMounts[j]
+				if !storageVolumes[volumeMount.Name] {
+					continue
+				}
+				mounted = true
+				if pc.storageMount.SubPath != "" {
+					if volumeMount.SubPath != "" {
+						volumeMount.SubPath = fmt.Sprintf("%s/%s", pc.storageMount.SubPath, volumeMount.SubPath)
+					} else {
+						volumeMount.SubPath = pc.storageMount.SubPath
+					}
+				}
+				if pc.storageMount.ReadOnly {
+					volumeMount.ReadOnly = true
+				}
+			}
+		}
+	}
+	return mounted, nil
+}
+
+// Mount the directory that the request chose in volume_subpaths, within whatever subPath the manifest mounts
+func requestSubPathMount(pc *PodCreator, volumeMount *apiv1.VolumeMount) error {
+	field := fmt.Sprintf("volume_subpaths.%s", volumeMount.Name)
+	subPath, isSet := pc.volumeSubPaths[volumeMount.Name]
+	if !isSet {
+		return manifest.SettingsErrors{{Field: field, Message: "required by the manifest"}}
+	}
+	if err := util.ValidateSubPath(subPath); err != nil {
+		return manifest.SettingsErrors{{Field: field, Message: err.Error()}}
+	}
+	if volumeMount.SubPath != "" {
+		subPath = fmt.Sprintf("%s/%s", volumeMount.SubPath, subPath)
+	}
+	volumeMount.SubPath = subPath
+	return nil
+}
+
+// Prefix of the names of volume mounts for a project's storage, followed by the project ID
+const projectVolumePrefix = "project:"
+
+// Return the volume with the storage of the project, which the user must be a member of.
+// The volume's name, which the mounts are renamed to, is a valid volume name unlike project:<id>.
+func (pc *PodCreator) projectVolume(projectID string, field string) (apiv1.Volume, error) {
+	if len(projectID) > managed.MaxProjectIDLength || len(validation.IsDNS1123Label(projectID)) > 0 {
+		return apiv1.Volume{}, errors.New(fmt.Sprintf("Invalid project ID %s in volume %s%s", projectID, projectVolumePrefix, projectID))
+	}
+	project := managed.NewProject(projectID, pc.client, pc.globalConfig)
+	info, exists, err := project.Get()
+	if err != nil {
+		return apiv1.Volume{}, errors.New(fmt.Sprintf("Couldn't look for project %s: %s", projectID, err.Error()))
+	}
+	// Projects the user isn't a member of are treated as not existing, so that they can't be discovered
+	if !exists || !info.HasMember(pc.user.UserID) {
+		return apiv1.Volume{}, manifest.SettingsErrors{{Field: field, Message: fmt.Sprintf("not a member of project %s", projectID)}}
+	}
+	pc.projects = append(pc.projects, info)
+	return apiv1.Volume{
+		Name: fmt.Sprintf("project-%s", projectID),
+		VolumeSource: apiv1.VolumeSource{
+			PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+				ClaimName: project.GetStoragePVName(),
+			},
+		},
+	}, nil
+}
+
+// Return whether the policy lets manifests mount the well-known volume
+func (pc *PodCreator) volumeAllowed(name string) bool {
+	if len(pc.globalConfig.PolicyAllowedVolumeNames) == 0 {
+		return true
+	}
+	for _, allowed := range pc.globalConfig.PolicyAllowedVolumeNames {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the volumes for the VolumeMounts of the containers and init containers that aren't specified in Spec.Volumes, from wellKnownVolumes,
+// or the storage of a project for a VolumeMount named project:<id>.
+// This should be used for e.g. the user's storage, which should be generated at runtime
+// for the given user.
+func (pc *PodCreator) applyCreatePodVolumes(targetPodObject *apiv1.Pod) error {
+	declared := make(map[string]bool)
+	for _, volume := range targetPodObject.Spec.Volumes {
+		declared[volume.Name] = true
+	}
+	generated := make(map[string]bool)
+	// projectVolumes[projectID] is the name of the volume generated for the project's storage
+	projectVolumes := make(map[string]string)
+	pc.projects = nil
+	// Init containers need the volumes they mount as much as the containers do
+	for _, containers := range []struct {
+		field string
+		list  []apiv1.Container
+	}{
+		{"spec.initContainers", targetPodObject.Spec.InitContainers},
+		{"spec.containers", targetPodObject.Spec.Containers},
+	} {
+		for i := range containers.list {
+			container := &containers.list[i]
+			for j := range container.VolumeMounts {
+				volumeMount := &container.VolumeMounts[j]
+				// Volumes the manifest declares itself are used as they are
+				if declared[volumeMount.Name] {
+					continue
+				}
+				field := fmt.Sprintf("%s[%d].volumeMounts[%d]", containers.field, i, j)
+				if strings.HasPrefix(volumeMount.Name, projectVolumePrefix) {
+					if !pc.volumeAllowed("project") {
+						return policy.Violations{{Field: field, Message: "project volumes aren't allowed"}}
+					}
+					projectID := strings.TrimPrefix(volumeMount.Name, projectVolumePrefix)
+					if _, exists := projectVolumes[projectID]; !exists {
+						volume, err := pc.projectVolume(projectID, field)
+						if err != nil {
+							return err
+						}
+						targetPodObject.Spec.Volumes = append(targetPodObject.Spec.Volumes, volume)
+						projectVolumes[projectID] = volume.Name
+					}
+					volumeMount.Name = projectVolumes[projectID]
+					continue
+				}
+				wellKnown, exists := wellKnownVolumes[volumeMount.Name]
+				if !exists {
+					return errors.New(fmt.Sprintf("Volume %s isn't declared in the manifest, and isn't one of the volumes that can be mounted without declaring them: %s",
+						volumeMount.Name, strings.Join(wellKnownVolumeNames(), ", ")))
+				}
+				if !pc.volumeAllowed(volumeMount.Name) {
+					return policy.Violations{{Field: field, Message: fmt.Sprintf("volume %s isn't allowed", volumeMount.Name)}}
+				}
+				if !generated[volumeMount.Name] {
+					volume, err := wellKnown.volume(pc, *volumeMount)
+					if err != nil {
+						return err
+					}
+					targetPodObject.Spec.Volumes = append(targetPodObject.Spec.Volumes, volume)
+					generated[volumeMount.Name] = true
+				}
+				if wellKnown.mount != nil {
+					err := wellKnown.mount(pc, volumeMount)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	mounted, err := pc.applyStorageMount(targetPodObject)
+	if err != nil {
+		return err
+	}
+	if pc.storageMount.IsSet() && !mounted {
+		return manifest.SettingsErrors{{Field: "storage", Message: "the manifest doesn't mount the user's storage"}}
+	}
+
+	// Every subpath in the request must be used
+	var errs manifest.SettingsErrors
+	for name := range pc.volumeSubPaths {
+		if !generated[name] || !wellKnownVolumes[name].takesSubPath {
+			errs = append(errs, manifest.SettingError{Field: fmt.Sprintf("volume_subpaths.%s", name), Message: "not a volume of this manifest that takes a subpath"})
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return errs
+	}
+	return nil
+}
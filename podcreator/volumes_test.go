@@ -0,0 +1,183 @@
+package podcreator
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/policy"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func podMounting(mounts ...apiv1.VolumeMount) *apiv1.Pod {
+	return &apiv1.Pod{
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{Name: "first", VolumeMounts: append([]apiv1.VolumeMount{}, mounts...)},
+				{Name: "second", VolumeMounts: append([]apiv1.VolumeMount{}, mounts...)},
+			},
+		},
+	}
+}
+
+func newVolumeTestCreator(globalConfig util.GlobalConfig, volumeSubPaths map[string]string) *PodCreator {
+	return &PodCreator{
+		user:           managed.NewUser("someone@example.com", k8sclient.K8sClient{}, globalConfig),
+		globalConfig:   globalConfig,
+		volumeSubPaths: volumeSubPaths,
+	}
+}
+
+func TestApplyCreatePodVolumes(t *testing.T) {
+	globalConfig := util.GlobalConfig{ScratchVolumeSizeLimit: "2Gi", DatasetsClaimName: "datasets"}
+	pc := newVolumeTestCreator(globalConfig, map[string]string{"user-subdir": "projects/thesis"})
+	pod := podMounting(
+		apiv1.VolumeMount{Name: "scratch", MountPath: "/tmp/scratch"},
+		apiv1.VolumeMount{Name: "datasets", MountPath: "/datasets"},
+		apiv1.VolumeMount{Name: "user-subdir", MountPath: "/home/user/thesis"},
+	)
+	err := pc.applyCreatePodVolumes(pod)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Each volume is added once, however many containers mount it
+	if len(pod.Spec.Volumes) != 3 {
+		t.Fatalf("Expected 3 volumes, got %+v", pod.Spec.Volumes)
+	}
+	scratch := pod.Spec.Volumes[0]
+	if scratch.EmptyDir == nil || scratch.EmptyDir.SizeLimit.String() != "2Gi" {
+		t.Fatalf("Unexpected scratch volume %+v", scratch)
+	}
+	if !pod.Spec.Volumes[1].PersistentVolumeClaim.ReadOnly {
+		t.Fatal("The datasets volume should be read-only")
+	}
+	if pod.Spec.Volumes[2].PersistentVolumeClaim.ClaimName != pc.user.GetStoragePVName() {
+		t.Fatalf("user-subdir should mount the user's storage, got %+v", pod.Spec.Volumes[2])
+	}
+	for _, container := range pod.Spec.Containers {
+		if !container.VolumeMounts[1].ReadOnly || container.VolumeMounts[2].SubPath != "projects/thesis" {
+			t.Fatalf("Mounts weren't changed in container %s: %+v", container.Name, container.VolumeMounts)
+		}
+	}
+
+	// Volumes the manifest declares are left alone
+	pod = podMounting(apiv1.VolumeMount{Name: "scratch", MountPath: "/tmp/scratch"})
+	pod.Spec.Volumes = []apiv1.Volume{{Name: "scratch", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}}}
+	if err := pc.applyCreatePodVolumes(pod); err == nil {
+		t.Fatal("Expected an error for the unused subpath")
+	}
+	pc.volumeSubPaths = nil
+	if err := pc.applyCreatePodVolumes(pod); err != nil || len(pod.Spec.Volumes) != 1 || pod.Spec.Volumes[0].EmptyDir.SizeLimit != nil {
+		t.Fatalf("Declared volume was changed: %v, %+v", err, pod.Spec.Volumes)
+	}
+
+	var settingsErrors manifest.SettingsErrors
+	err = pc.applyCreatePodVolumes(podMounting(apiv1.VolumeMount{Name: "user-subdir", MountPath: "/home/user/thesis"}))
+	if !errors.As(err, &settingsErrors) || settingsErrors[0].Field != "volume_subpaths.user-subdir" {
+		t.Fatalf("Expected a settings error for the missing subpath, got %v", err)
+	}
+	if err := pc.applyCreatePodVolumes(podMounting(apiv1.VolumeMount{Name: "unknown", MountPath: "/unknown"})); err == nil {
+		t.Fatal("Expected an error for an undeclared volume that isn't well-known")
+	}
+	pc = newVolumeTestCreator(util.GlobalConfig{}, nil)
+	if err := pc.applyCreatePodVolumes(podMounting(apiv1.VolumeMount{Name: "datasets", MountPath: "/datasets"})); err == nil {
+		t.Fatal("Expected an error for datasets when it isn't configured")
+	}
+	pc = newVolumeTestCreator(util.GlobalConfig{PolicyAllowedVolumeNames: []string{"sciencedata"}}, nil)
+	var violations policy.Violations
+	err = pc.applyCreatePodVolumes(podMounting(apiv1.VolumeMount{Name: "scratch", MountPath: "/tmp/scratch"}))
+	if !errors.As(err, &violations) {
+		t.Fatalf("Expected a policy violation for a volume that isn't allowed, got %v", err)
+	}
+
+	// Init containers get the volumes they mount, with the same checks
+	pod = podMounting(apiv1.VolumeMount{Name: "sciencedata", MountPath: "/home/user/sciencedata"})
+	pod.Spec.InitContainers = []apiv1.Container{{Name: "init", VolumeMounts: []apiv1.VolumeMount{
+		{Name: "sciencedata", MountPath: "/storage"},
+		{Name: "scratch", MountPath: "/tmp/scratch"},
+	}}}
+	err = pc.applyCreatePodVolumes(pod)
+	if !errors.As(err, &violations) || violations[0].Field != "spec.initContainers[0].volumeMounts[1]" {
+		t.Fatalf("Expected a policy violation for the init container's scratch volume, got %v", err)
+	}
+	pod.Spec.InitContainers[0].VolumeMounts = pod.Spec.InitContainers[0].VolumeMounts[:1]
+	if err := pc.applyCreatePodVolumes(pod); err != nil || len(pod.Spec.Volumes) != 1 {
+		t.Fatalf("Expected the init container's volume to be added once, got %v, %+v", err, pod.Spec.Volumes)
+	}
+}
+
+func TestUserStorageMount(t *testing.T) {
+	pc := newVolumeTestCreator(util.GlobalConfig{}, nil)
+	pc.storageMount = StorageMount{SubPath: "shared/notebooks", ReadOnly: true}
+	pod := podMounting(
+		apiv1.VolumeMount{Name: "sciencedata", MountPath: "/home/user/sciencedata"},
+		apiv1.VolumeMount{Name: "sciencedata", MountPath: "/home/user/.config", SubPath: "config"},
+	)
+	if err := pc.applyCreatePodVolumes(pod); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, container := range pod.Spec.Containers {
+		mounts := container.VolumeMounts
+		if !mounts[0].ReadOnly || !mounts[1].ReadOnly {
+			t.Fatalf("Mounts of container %s should be read-only: %+v", container.Name, mounts)
+		}
+		// The manifest's subPath stays within the request's
+		if mounts[0].SubPath != "shared/notebooks" || mounts[1].SubPath != "shared/notebooks/config" {
+			t.Fatalf("Unexpected subPaths in container %s: %+v", container.Name, mounts)
+		}
+	}
+
+	// Every other mount of the user's storage is limited in the same way
+	pc.volumeSubPaths = map[string]string{"user-subdir": "thesis"}
+	pod = podMounting(
+		apiv1.VolumeMount{Name: "user-subdir", MountPath: "/home/user/thesis"},
+		apiv1.VolumeMount{Name: "own-storage", MountPath: "/home/user/storage"},
+	)
+	pod.Spec.InitContainers = []apiv1.Container{{Name: "init", VolumeMounts: []apiv1.VolumeMount{{Name: "own-storage", MountPath: "/storage"}}}}
+	pod.Spec.Volumes = []apiv1.Volume{{Name: "own-storage", VolumeSource: apiv1.VolumeSource{
+		PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{ClaimName: pc.user.GetStoragePVName()},
+	}}}
+	if err := pc.applyCreatePodVolumes(pod); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		for _, mount := range container.VolumeMounts {
+			if !mount.ReadOnly || !strings.HasPrefix(mount.SubPath, "shared/notebooks") {
+				t.Fatalf("Mount %s of container %s isn't limited by the storage settings: %+v", mount.Name, container.Name, mount)
+			}
+		}
+	}
+	if subPath := pod.Spec.Containers[0].VolumeMounts[0].SubPath; subPath != "shared/notebooks/thesis" {
+		t.Fatalf("Unexpected user-subdir subPath %s", subPath)
+	}
+	pc.volumeSubPaths = nil
+
+	var settingsErrors manifest.SettingsErrors
+	err := pc.applyCreatePodVolumes(podMounting(apiv1.VolumeMount{Name: "scratch", MountPath: "/tmp/scratch"}))
+	if !errors.As(err, &settingsErrors) || settingsErrors[0].Field != "storage" {
+		t.Fatalf("Expected a settings error when the manifest doesn't mount sciencedata, got %v", err)
+	}
+	pc.storageMount = StorageMount{SubPath: "../other-user"}
+	err = pc.applyCreatePodVolumes(podMounting(apiv1.VolumeMount{Name: "sciencedata", MountPath: "/home/user/sciencedata"}))
+	if !errors.As(err, &settingsErrors) || settingsErrors[0].Field != "storage.subpath" {
+		t.Fatalf("Expected a settings error for a subpath outside the storage, got %v", err)
+	}
+}
+
+func TestProjectVolumes(t *testing.T) {
+	var violations policy.Violations
+	pc := newVolumeTestCreator(util.GlobalConfig{PolicyAllowedVolumeNames: []string{"sciencedata"}}, nil)
+	err := pc.applyCreatePodVolumes(podMounting(apiv1.VolumeMount{Name: "project:genomics", MountPath: "/projects/genomics"}))
+	if !errors.As(err, &violations) {
+		t.Fatalf("Expected a policy violation when project volumes aren't allowed, got %v", err)
+	}
+	pc = newVolumeTestCreator(util.GlobalConfig{}, nil)
+	err = pc.applyCreatePodVolumes(podMounting(apiv1.VolumeMount{Name: "project:Not_A_Label", MountPath: "/projects/x"}))
+	if err == nil || errors.As(err, &violations) {
+		t.Fatalf("Expected an error for an invalid project ID, got %v", err)
+	}
+}
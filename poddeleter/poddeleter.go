@@ -3,8 +3,10 @@ package poddeleter
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
 	"github.com/deic.dk/user_pods_k8s_backend/managed"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -17,10 +19,11 @@ type PodDeleter struct {
 	client       k8sclient.K8sClient
 	globalConfig util.GlobalConfig
 	initialized  bool
+	log          *logging.Logger
 }
 
-func NewPodDeleter(podName string, userID string, client k8sclient.K8sClient, globalConfig util.GlobalConfig) (PodDeleter, error) {
-	deleter := PodDeleter{podName: podName, userID: userID, client: client, globalConfig: globalConfig, initialized: false}
+func NewPodDeleter(podName string, userID string, client k8sclient.K8sClient, globalConfig util.GlobalConfig, log *logging.Logger) (PodDeleter, error) {
+	deleter := PodDeleter{podName: podName, userID: userID, client: client, globalConfig: globalConfig, initialized: false, log: log}
 	err := deleter.initPodObject()
 	if err != nil {
 		return deleter, err
@@ -29,7 +32,7 @@ func NewPodDeleter(podName string, userID string, client k8sclient.K8sClient, gl
 }
 
 func NewFromPod(pod managed.Pod) PodDeleter {
-	return PodDeleter{podName: pod.Object.Name, userID: pod.Owner.UserID, client: pod.Client, Pod: pod, globalConfig: pod.GlobalConfig, initialized: true}
+	return PodDeleter{podName: pod.Object.Name, userID: pod.Owner.UserID, client: pod.Client, Pod: pod, globalConfig: pod.GlobalConfig, initialized: true, log: pod.Log}
 }
 
 func (pd *PodDeleter) initPodObject() error {
@@ -47,28 +50,44 @@ func (pd *PodDeleter) initPodObject() error {
 	if pod.Owner.UserID != pd.userID {
 		return errors.New(fmt.Sprintf("Pod %s not owned by user %s", pd.podName, pd.userID))
 	}
+	pod.SetLogger(pd.log)
 	pd.Pod = pod
+	pd.log = pod.Log
 	pd.initialized = true
 	return nil
 }
 
+// Call for deletion of the pod in the background, and run the delete jobs once it's gone.
+// The manifest's pre-stop hooks run first, within the first half of TimeoutDelete so that the deletion has the rest.
+// Since they can take a while, the pod should already be tracked as deleting when this is called.
+// The deletion is checked with a dry run first, so an error is returned if it can't be issued.
+// A delete call that still fails after the hooks fails finished with the reason delete_call.
 func (pd *PodDeleter) DeletePod(finished *util.ReadyChannel) error {
 	if !pd.initialized {
 		return errors.New("PodDeleter can't DeletePod, not initialized with a pod object")
 	}
-	podDeleted := util.NewReadyChannel(pd.globalConfig.TimeoutDelete)
-	go func() {
-		pd.client.WatchDeletePod(pd.podName, podDeleted)
-		if podDeleted.Receive() {
-			fmt.Printf("Deleted pod %s\n", pd.podName)
-		} else {
-			fmt.Printf("Warning: failed to delete pod %s\n", pd.podName)
-		}
-	}()
-	err := pd.client.DeletePod(pd.podName)
+	err := pd.client.CheckDeletePod(pd.podName)
 	if err != nil {
 		return err
 	}
-	go pd.Pod.RunDeleteJobsWhenReady(podDeleted, finished)
+	go func() {
+		pd.Pod.RunPreStopHooks(time.Now().Add(pd.globalConfig.TimeoutDelete / 2))
+		// The hooks have used part of finished's time, so the deletion gets only what's left
+		podDeleted := util.NewReadyChannel(time.Until(finished.Deadline()))
+		go func() {
+			pd.client.WatchDeletePod(pd.podName, podDeleted)
+			if podDeleted.Receive() {
+				pd.log.Info("Deleted pod")
+			} else {
+				pd.log.Warn("Failed to delete pod", "reason", podDeleted.Reason())
+			}
+		}()
+		err := pd.client.DeletePod(pd.podName)
+		if err != nil {
+			pd.log.Error("Couldn't call for deletion of pod", "error", err)
+			podDeleted.Fail("delete_call")
+		}
+		pd.Pod.RunDeleteJobsWhenReady(podDeleted, finished)
+	}()
 	return nil
 }
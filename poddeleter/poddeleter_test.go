@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
 	"github.com/deic.dk/user_pods_k8s_backend/managed"
 	"github.com/deic.dk/user_pods_k8s_backend/testingutil"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
@@ -89,7 +90,7 @@ func TestFailDeletePods(t *testing.T) {
 
 	tryUserIDs := []string{"fail@user", "", "fail", "fail@user.id"}
 	for _, tryUserID := range tryUserIDs {
-		failPodDeleter, err := NewPodDeleter(podToDelete.Object.Name, tryUserID, u.Client, u.GlobalConfig)
+		failPodDeleter, err := NewPodDeleter(podToDelete.Object.Name, tryUserID, u.Client, u.GlobalConfig, logging.Default())
 		if err == nil {
 			t.Fatalf("Initialized podDeleter without failure when using incorrect userID")
 		}
@@ -134,7 +135,7 @@ func TestDeletePod(t *testing.T) {
 
 	// Then delete them all
 	for _, pod := range podsToDelete {
-		pd, err := NewPodDeleter(pod.Object.Name, testingutil.TestUser, u.Client, u.GlobalConfig)
+		pd, err := NewPodDeleter(pod.Object.Name, testingutil.TestUser, u.Client, u.GlobalConfig, logging.Default())
 		if err != nil {
 			t.Fatalf("Couldn't initialize pod deleter %s", err.Error())
 		}
@@ -0,0 +1,391 @@
+package policy
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Volume types pods may use when PolicyAllowedVolumeTypes isn't set
+var DefaultVolumeTypes = []string{"persistentVolumeClaim", "configMap", "secret", "emptyDir", "projected", "downwardAPI"}
+
+// Service types companion Services may have when PolicyAllowedServiceTypes isn't set
+var DefaultServiceTypes = []string{string(apiv1.ServiceTypeClusterIP)}
+
+// Secret types companion Secrets may have when PolicyAllowedSecretTypes isn't set
+var DefaultSecretTypes = []string{string(apiv1.SecretTypeOpaque), string(apiv1.SecretTypeTLS), string(apiv1.SecretTypeDockerConfigJson)}
+
+// Ingress annotations that end with this inject configuration into the ingress controller, and are never allowed
+const snippetAnnotationSuffix = "-snippet"
+
+// A field of a pod or companion object that the policy doesn't allow
+type Violation struct {
+	Field   string
+	Message string
+}
+
+// Every violation found in a manifest
+type Violations []Violation
+
+func (v Violations) Error() string {
+	messages := make([]string, len(v))
+	for i, violation := range v {
+		messages[i] = fmt.Sprintf("%s: %s", violation.Field, violation.Message)
+	}
+	return fmt.Sprintf("manifest violates policy: %s", strings.Join(messages, "; "))
+}
+
+// Rules that the pods and companion objects created from manifests must follow
+type Policy struct {
+	// Registries, or registry/repository prefixes, that images may come from, e.g. docker.io/sciencedata.
+	// Any if empty.
+	allowedRegistries []string
+	// Capabilities containers may add, without the CAP_ prefix
+	allowedCapabilities map[string]bool
+	allowPrivileged     bool
+	requireRunAsNonRoot bool
+	allowedVolumeTypes  map[string]bool
+	allowHostNamespaces bool
+	// Service accounts pods may run as besides the namespace's default
+	allowedServiceAccounts map[string]bool
+	allowedServiceTypes    map[string]bool
+	allowExternalIPs       bool
+	// Hosts Ingresses may route, with *.domain allowing any subdomain. Any if empty.
+	allowedIngressHosts []string
+	// Annotations Ingresses may set, with prefix/ allowing any annotation with the prefix. Any if empty.
+	allowedIngressAnnotations []string
+	allowedSecretTypes        map[string]bool
+	// Fix fields that can be removed or set safely instead of rejecting the manifest
+	mutate bool
+}
+
+func toSet(values []string, normalize func(string) string) map[string]bool {
+	set := make(map[string]bool)
+	for _, value := range values {
+		set[normalize(value)] = true
+	}
+	return set
+}
+
+func identity(value string) string {
+	return value
+}
+
+func normalizeCapability(capability string) string {
+	return strings.TrimPrefix(strings.ToUpper(capability), "CAP_")
+}
+
+// Make a Policy from the Policy* settings of the global config
+func NewPolicy(globalConfig util.GlobalConfig) Policy {
+	volumeTypes := globalConfig.PolicyAllowedVolumeTypes
+	if len(volumeTypes) == 0 {
+		volumeTypes = DefaultVolumeTypes
+	}
+	serviceTypes := globalConfig.PolicyAllowedServiceTypes
+	if len(serviceTypes) == 0 {
+		serviceTypes = DefaultServiceTypes
+	}
+	secretTypes := globalConfig.PolicyAllowedSecretTypes
+	if len(secretTypes) == 0 {
+		secretTypes = DefaultSecretTypes
+	}
+	registries := make([]string, len(globalConfig.PolicyAllowedRegistries))
+	for i, registry := range globalConfig.PolicyAllowedRegistries {
+		registries[i] = strings.TrimSuffix(registry, "/")
+	}
+	return Policy{
+		allowedRegistries:         registries,
+		allowedCapabilities:       toSet(globalConfig.PolicyAllowedCapabilities, normalizeCapability),
+		allowPrivileged:           globalConfig.PolicyAllowPrivileged,
+		requireRunAsNonRoot:       globalConfig.PolicyRequireRunAsNonRoot,
+		allowedVolumeTypes:        toSet(volumeTypes, identity),
+		allowHostNamespaces:       globalConfig.PolicyAllowHostNamespaces,
+		allowedServiceAccounts:    toSet(globalConfig.PolicyAllowedServiceAccounts, identity),
+		allowedServiceTypes:       toSet(serviceTypes, identity),
+		allowExternalIPs:          globalConfig.PolicyAllowExternalIPs,
+		allowedIngressHosts:       globalConfig.PolicyAllowedIngressHosts,
+		allowedIngressAnnotations: globalConfig.PolicyAllowedIngressAnnotations,
+		allowedSecretTypes:        toSet(secretTypes, identity),
+		mutate:                    globalConfig.PolicyMutate,
+	}
+}
+
+// Collects the violations and changes made while applying a policy
+type checker struct {
+	mutate     bool
+	violations Violations
+	mutations  []string
+}
+
+// Record that field isn't allowed. If fix isn't nil and the policy mutates, call it instead.
+func (c *checker) violate(field string, fix func(), format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if c.mutate && fix != nil {
+		fix()
+		c.mutations = append(c.mutations, fmt.Sprintf("%s: %s, removed", field, message))
+		return
+	}
+	c.violations = append(c.violations, Violation{Field: field, Message: message})
+}
+
+// Check the pod and its companion objects against the policy, after every other change has been made to them.
+// Return a description of each change made to follow the policy,
+// and Violations if anything that couldn't be changed isn't allowed.
+func (p Policy) Apply(pod *apiv1.Pod, companions []runtime.Object) ([]string, error) {
+	c := &checker{mutate: p.mutate}
+	p.checkPodSpec(c, &pod.Spec)
+	// Ingresses may only use TLS Secrets created along with them
+	secretNames := make(map[string]bool)
+	for _, companion := range companions {
+		if secret, isSecret := companion.(*apiv1.Secret); isSecret {
+			secretNames[secret.Name] = true
+		}
+	}
+	for _, companion := range companions {
+		switch typed := companion.(type) {
+		case *apiv1.Service:
+			p.checkService(c, typed)
+		case *apiv1.Secret:
+			p.checkSecret(c, typed)
+		case *networkingv1.Ingress:
+			p.checkIngress(c, typed, secretNames)
+		}
+	}
+	if len(c.violations) > 0 {
+		return c.mutations, c.violations
+	}
+	return c.mutations, nil
+}
+
+func (p Policy) checkPodSpec(c *checker, spec *apiv1.PodSpec) {
+	if !p.allowHostNamespaces {
+		if spec.HostNetwork {
+			c.violate("spec.hostNetwork", func() { spec.HostNetwork = false }, "host namespaces aren't allowed")
+		}
+		if spec.HostPID {
+			c.violate("spec.hostPID", func() { spec.HostPID = false }, "host namespaces aren't allowed")
+		}
+		if spec.HostIPC {
+			c.violate("spec.hostIPC", func() { spec.HostIPC = false }, "host namespaces aren't allowed")
+		}
+	}
+
+	serviceAccount := spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = spec.DeprecatedServiceAccount
+	}
+	if serviceAccount != "" && serviceAccount != "default" && !p.allowedServiceAccounts[serviceAccount] {
+		c.violate("spec.serviceAccountName", func() {
+			spec.ServiceAccountName = ""
+			spec.DeprecatedServiceAccount = ""
+		}, "service account %s isn't allowed", serviceAccount)
+	}
+
+	for i, volume := range spec.Volumes {
+		volumeType := volumeSourceType(volume.VolumeSource)
+		if !p.allowedVolumeTypes[volumeType] {
+			c.violate(fmt.Sprintf("spec.volumes[%d]", i), nil, "volume type %s isn't allowed", volumeType)
+		}
+	}
+
+	if p.requireRunAsNonRoot {
+		if spec.SecurityContext == nil {
+			spec.SecurityContext = &apiv1.PodSecurityContext{}
+		}
+		podContext := spec.SecurityContext
+		if podContext.RunAsNonRoot != nil && !*podContext.RunAsNonRoot {
+			c.violate("spec.securityContext.runAsNonRoot", func() { podContext.RunAsNonRoot = nil }, "must not be false")
+		}
+		if podContext.RunAsUser != nil && *podContext.RunAsUser == 0 {
+			c.violate("spec.securityContext.runAsUser", func() { podContext.RunAsUser = nil }, "must not be 0")
+		}
+		if podContext.RunAsNonRoot == nil {
+			runAsNonRoot := true
+			podContext.RunAsNonRoot = &runAsNonRoot
+		}
+	}
+
+	for i := range spec.InitContainers {
+		p.checkContainer(c, fmt.Sprintf("spec.initContainers[%d]", i), &spec.InitContainers[i])
+	}
+	for i := range spec.Containers {
+		p.checkContainer(c, fmt.Sprintf("spec.containers[%d]", i), &spec.Containers[i])
+	}
+}
+
+func (p Policy) checkContainer(c *checker, field string, container *apiv1.Container) {
+	if !p.imageAllowed(container.Image) {
+		c.violate(field+".image", nil, "image %s isn't from an allowed registry", container.Image)
+	}
+
+	if !p.allowHostNamespaces {
+		for i := range container.Ports {
+			port := &container.Ports[i]
+			if port.HostPort != 0 {
+				c.violate(fmt.Sprintf("%s.ports[%d].hostPort", field, i), func() { port.HostPort = 0 }, "host ports aren't allowed")
+			}
+		}
+	}
+
+	securityContext := container.SecurityContext
+	if securityContext == nil {
+		return
+	}
+	if !p.allowPrivileged {
+		if securityContext.Privileged != nil && *securityContext.Privileged {
+			c.violate(field+".securityContext.privileged", func() { securityContext.Privileged = nil }, "privileged containers aren't allowed")
+		}
+		if securityContext.AllowPrivilegeEscalation != nil && *securityContext.AllowPrivilegeEscalation {
+			c.violate(field+".securityContext.allowPrivilegeEscalation", func() { securityContext.AllowPrivilegeEscalation = nil },
+				"privilege escalation isn't allowed")
+		}
+	}
+	if securityContext.Capabilities != nil {
+		var kept []apiv1.Capability
+		for _, capability := range securityContext.Capabilities.Add {
+			if p.allowedCapabilities[normalizeCapability(string(capability))] {
+				kept = append(kept, capability)
+				continue
+			}
+			c.violate(field+".securityContext.capabilities.add", func() {}, "capability %s isn't allowed", capability)
+		}
+		if c.mutate {
+			securityContext.Capabilities.Add = kept
+		}
+	}
+	if p.requireRunAsNonRoot {
+		if securityContext.RunAsNonRoot != nil && !*securityContext.RunAsNonRoot {
+			c.violate(field+".securityContext.runAsNonRoot", func() { securityContext.RunAsNonRoot = nil }, "must not be false")
+		}
+		if securityContext.RunAsUser != nil && *securityContext.RunAsUser == 0 {
+			c.violate(field+".securityContext.runAsUser", func() { securityContext.RunAsUser = nil }, "must not be 0")
+		}
+	}
+}
+
+func (p Policy) checkService(c *checker, service *apiv1.Service) {
+	field := fmt.Sprintf("Service/%s.spec", service.Name)
+	serviceType := string(service.Spec.Type)
+	if serviceType == "" {
+		serviceType = string(apiv1.ServiceTypeClusterIP)
+	}
+	if !p.allowedServiceTypes[serviceType] {
+		c.violate(field+".type", nil, "service type %s isn't allowed", serviceType)
+	}
+	if len(service.Spec.ExternalIPs) > 0 && !p.allowExternalIPs {
+		c.violate(field+".externalIPs", func() { service.Spec.ExternalIPs = nil }, "external IPs aren't allowed")
+	}
+}
+
+func (p Policy) checkSecret(c *checker, secret *apiv1.Secret) {
+	secretType := string(secret.Type)
+	if secretType == "" {
+		secretType = string(apiv1.SecretTypeOpaque)
+	}
+	if !p.allowedSecretTypes[secretType] {
+		c.violate(fmt.Sprintf("Secret/%s.type", secret.Name), nil, "secret type %s isn't allowed", secretType)
+	}
+}
+
+func (p Policy) checkIngress(c *checker, ingress *networkingv1.Ingress, secretNames map[string]bool) {
+	field := fmt.Sprintf("Ingress/%s", ingress.Name)
+	for key := range ingress.Annotations {
+		if !p.ingressAnnotationAllowed(key) {
+			key := key
+			c.violate(field+".metadata.annotations", func() { delete(ingress.Annotations, key) }, "annotation %s isn't allowed", key)
+		}
+	}
+	for i, rule := range ingress.Spec.Rules {
+		if !p.ingressHostAllowed(rule.Host) {
+			c.violate(fmt.Sprintf("%s.spec.rules[%d].host", field, i), nil, "host %q isn't allowed", rule.Host)
+		}
+	}
+	for i, tls := range ingress.Spec.TLS {
+		for _, host := range tls.Hosts {
+			if !p.ingressHostAllowed(host) {
+				c.violate(fmt.Sprintf("%s.spec.tls[%d].hosts", field, i), nil, "host %q isn't allowed", host)
+			}
+		}
+		// Without a secret the controller's default certificate is used, which is fine
+		if tls.SecretName != "" && !secretNames[tls.SecretName] {
+			c.violate(fmt.Sprintf("%s.spec.tls[%d].secretName", field, i), nil, "secret %s isn't created by the manifest", tls.SecretName)
+		}
+	}
+}
+
+// Return whether an Ingress may route host. Hosts with wildcards must be allowed exactly,
+// so *.sciencedata.dk doesn't let a manifest claim every subdomain.
+func (p Policy) ingressHostAllowed(host string) bool {
+	if len(p.allowedIngressHosts) == 0 {
+		return true
+	}
+	for _, allowed := range p.allowedIngressHosts {
+		if host == allowed {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && !strings.Contains(host, "*") &&
+			strings.HasSuffix(host, allowed[1:]) && len(host) > len(allowed)-1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Policy) ingressAnnotationAllowed(key string) bool {
+	if strings.HasSuffix(key, snippetAnnotationSuffix) {
+		return false
+	}
+	if len(p.allowedIngressAnnotations) == 0 {
+		return true
+	}
+	for _, allowed := range p.allowedIngressAnnotations {
+		if key == allowed || strings.HasSuffix(allowed, "/") && strings.HasPrefix(key, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the image with its registry made explicit, as docker does,
+// e.g. ubuntu becomes docker.io/library/ubuntu and sciencedata/jupyter becomes docker.io/sciencedata/jupyter
+func normalizeImage(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 {
+		return "docker.io/library/" + image
+	}
+	if !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost" {
+		return "docker.io/" + image
+	}
+	return image
+}
+
+// Return whether the image comes from one of the allowed registries.
+// An allowed entry matches whole path components, so docker.io/sciencedata doesn't allow docker.io/sciencedata-fake.
+func (p Policy) imageAllowed(image string) bool {
+	if len(p.allowedRegistries) == 0 {
+		return true
+	}
+	normalized := normalizeImage(image)
+	for _, registry := range p.allowedRegistries {
+		if strings.HasPrefix(normalized, registry+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the json name of the volume source that's set, e.g. hostPath
+func volumeSourceType(source apiv1.VolumeSource) string {
+	value := reflect.ValueOf(source)
+	for i := 0; i < value.NumField(); i++ {
+		if !value.Field(i).IsNil() {
+			return strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,202 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+const riskyManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: risky
+spec:
+  hostNetwork: true
+  serviceAccountName: admin
+  containers:
+  - name: risky
+    image: evil.example.com/miner
+    securityContext:
+      privileged: true
+      capabilities:
+        add: [SYS_CHROOT, SYS_ADMIN]
+  volumes:
+  - name: root
+    hostPath:
+      path: /
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: risky-ssh
+spec:
+  type: LoadBalancer
+  externalIPs: [130.226.137.130]
+`
+
+func violatedFields(err error) map[string]bool {
+	fields := make(map[string]bool)
+	if violations, ok := err.(Violations); ok {
+		for _, violation := range violations {
+			fields[violation.Field] = true
+		}
+	}
+	return fields
+}
+
+func TestApply(t *testing.T) {
+	bundle, err := manifest.DecodeBundle([]byte(riskyManifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	globalConfig := util.GlobalConfig{
+		PolicyAllowedRegistries:   []string{"docker.io/sciencedata", "kube.sciencedata.dk:5000"},
+		PolicyAllowedCapabilities: []string{"CAP_SYS_CHROOT"},
+	}
+	_, err = NewPolicy(globalConfig).Apply(bundle.Pod, bundle.Companions)
+	fields := violatedFields(err)
+	for _, field := range []string{
+		"spec.hostNetwork",
+		"spec.serviceAccountName",
+		"spec.volumes[0]",
+		"spec.containers[0].image",
+		"spec.containers[0].securityContext.privileged",
+		"spec.containers[0].securityContext.capabilities.add",
+		"Service/risky-ssh.spec.type",
+		"Service/risky-ssh.spec.externalIPs",
+	} {
+		if !fields[field] {
+			t.Fatalf("Expected a violation for %s, got %v", field, err)
+		}
+	}
+	if len(fields) != 8 {
+		t.Fatalf("Unexpected violations %v", err)
+	}
+
+	// Mutating removes what can be removed, leaving only what can't
+	globalConfig.PolicyMutate = true
+	globalConfig.PolicyRequireRunAsNonRoot = true
+	mutations, err := NewPolicy(globalConfig).Apply(bundle.Pod, bundle.Companions)
+	fields = violatedFields(err)
+	if len(fields) != 3 || !fields["spec.volumes[0]"] || !fields["spec.containers[0].image"] || !fields["Service/risky-ssh.spec.type"] {
+		t.Fatalf("Unexpected violations %v", err)
+	}
+	if len(mutations) != 5 {
+		t.Fatalf("Unexpected changes %v", mutations)
+	}
+	pod := bundle.Pod
+	securityContext := pod.Spec.Containers[0].SecurityContext
+	if pod.Spec.HostNetwork || pod.Spec.ServiceAccountName != "" || securityContext.Privileged != nil {
+		t.Fatalf("Disallowed fields weren't removed: %+v", pod.Spec)
+	}
+	if len(securityContext.Capabilities.Add) != 1 || securityContext.Capabilities.Add[0] != "SYS_CHROOT" {
+		t.Fatalf("Only the allowed capability should be kept, got %v", securityContext.Capabilities.Add)
+	}
+	if !*pod.Spec.SecurityContext.RunAsNonRoot {
+		t.Fatal("Expected runAsNonRoot to be set")
+	}
+	if bundle.Companions[0].(*apiv1.Service).Spec.ExternalIPs != nil {
+		t.Fatal("Expected externalIPs to be removed")
+	}
+}
+
+const ingressManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - name: web
+    image: sciencedata/web
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: web-tls
+type: kubernetes.io/tls
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: web-token
+type: kubernetes.io/service-account-token
+---
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: web
+  annotations:
+    nginx.ingress.kubernetes.io/rewrite-target: /
+    nginx.ingress.kubernetes.io/configuration-snippet: "more_set_headers X-Evil: 1;"
+spec:
+  tls:
+  - hosts: [web.pods.sciencedata.dk]
+    secretName: web-tls
+  - hosts: [sciencedata.dk]
+    secretName: wildcard-sciencedata-dk
+  rules:
+  - host: web.pods.sciencedata.dk
+  - host: "*.web.pods.sciencedata.dk"
+  - host: ""
+`
+
+func TestApplyIngressAndSecrets(t *testing.T) {
+	bundle, err := manifest.DecodeBundle([]byte(ingressManifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	globalConfig := util.GlobalConfig{
+		PolicyAllowedIngressHosts:       []string{"*.pods.sciencedata.dk"},
+		PolicyAllowedIngressAnnotations: []string{"nginx.ingress.kubernetes.io/"},
+	}
+	_, err = NewPolicy(globalConfig).Apply(bundle.Pod, bundle.Companions)
+	fields := violatedFields(err)
+	for _, field := range []string{
+		"Secret/web-token.type",
+		"Ingress/web.metadata.annotations",
+		"Ingress/web.spec.tls[1].hosts",
+		"Ingress/web.spec.tls[1].secretName",
+		"Ingress/web.spec.rules[1].host",
+		"Ingress/web.spec.rules[2].host",
+	} {
+		if !fields[field] {
+			t.Fatalf("Expected a violation for %s, got %v", field, err)
+		}
+	}
+	if len(fields) != 6 {
+		t.Fatalf("Unexpected violations %v", err)
+	}
+
+	// Only the snippet annotation can be removed
+	globalConfig.PolicyMutate = true
+	mutations, err := NewPolicy(globalConfig).Apply(bundle.Pod, bundle.Companions)
+	if len(mutations) != 1 || len(violatedFields(err)) != 5 {
+		t.Fatalf("Unexpected changes %v and violations %v", mutations, err)
+	}
+	annotations := bundle.Companions[2].(*networkingv1.Ingress).Annotations
+	if len(annotations) != 1 || annotations["nginx.ingress.kubernetes.io/rewrite-target"] != "/" {
+		t.Fatalf("Only the snippet annotation should be removed, got %v", annotations)
+	}
+}
+
+func TestImageAllowed(t *testing.T) {
+	p := NewPolicy(util.GlobalConfig{PolicyAllowedRegistries: []string{"docker.io/sciencedata", "kube.sciencedata.dk:5000/"}})
+	for image, allowed := range map[string]bool{
+		"sciencedata/jupyter":                         true,
+		"docker.io/sciencedata/jupyter:latest":        true,
+		"kube.sciencedata.dk:5000/user_pods_backend":  true,
+		"sciencedata-fake/jupyter":                    false,
+		"ubuntu":                                      false,
+		"kube.sciencedata.dk:50000/user_pods_backend": false,
+	} {
+		if p.imageAllowed(image) != allowed {
+			t.Fatalf("Expected imageAllowed(%s) to be %t", image, allowed)
+		}
+	}
+	if !NewPolicy(util.GlobalConfig{}).imageAllowed("ubuntu") {
+		t.Fatal("Any image should be allowed without PolicyAllowedRegistries")
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/audit"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+)
+
+type AuditQueryResponse struct {
+	Records    []audit.Record `json:"records"`
+	ChainValid bool           `json:"chain_valid"`
+	ChainError string         `json:"chain_error,omitempty"`
+}
+
+// Return true if ip is in one of the CIDR ranges
+func inCIDRs(ip net.IP, cidrs []string) bool {
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the IP of the client that made the request: the address the connection came from,
+// or the first address in X-Forwarded-For if the connection came from one of GlobalConfig.TrustedProxies
+func (s *Server) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if forwarded == "" || !inCIDRs(peer, s.GlobalConfig.TrustedProxies) {
+		return peer
+	}
+	return net.ParseIP(strings.TrimSpace(strings.Split(forwarded, ",")[0]))
+}
+
+// Return true if the request came from an address in GlobalConfig.AdminCIDRs.
+// Otherwise write a 403 response and return false.
+func (s *Server) checkAdmin(w http.ResponseWriter, r *http.Request, log *logging.Logger) bool {
+	if inCIDRs(s.clientIP(r), s.GlobalConfig.AdminCIDRs) {
+		return true
+	}
+	log.Warn("Rejected admin request from outside AdminCIDRs")
+	writeErrorResponse(w, &requestError{status: http.StatusForbidden, message: "forbidden"})
+	return false
+}
+
+// Parse the query parameters of an audit query into a filter
+func parseAuditFilter(r *http.Request) (audit.Filter, error) {
+	var errs validationErrors
+	query := r.URL.Query()
+	filter := audit.Filter{UserID: query.Get("user_id")}
+	if filter.UserID != "" && !validUserID(filter.UserID) {
+		errs.add("user_id", "must match %s", userIDregex)
+	}
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if query.Get(param.name) == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, query.Get(param.name))
+		if err != nil {
+			errs.add(param.name, "must be an RFC 3339 time")
+			continue
+		}
+		*param.value = parsed
+	}
+	if query.Get("limit") != "" {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 {
+			errs.add("limit", "must be a positive integer")
+		}
+		filter.Limit = limit
+	}
+	return filter, errs.orNil()
+}
+
+// Handles the http request to read the audit log, e.g. GET /admin/audit?user_id=foo@bar&since=2022-01-01T00:00:00Z
+func (s *Server) ServeAudit(w http.ResponseWriter, r *http.Request) {
+	log := s.newRequestLogger(w, r, "admin_audit")
+	if !s.checkAdmin(w, r, log) {
+		return
+	}
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	if s.Audit == nil {
+		writeErrorResponse(w, &requestError{status: http.StatusNotFound, message: "audit log is not configured"})
+		return
+	}
+
+	records, err := s.Audit.Query(filter)
+	if err != nil {
+		log.Error("Couldn't query audit log", "error", err)
+		writeErrorResponse(w, &requestError{status: http.StatusInternalServerError, message: "couldn't read audit log"})
+		return
+	}
+	response := AuditQueryResponse{Records: records, ChainValid: true}
+	if _, err := s.Audit.Verify(); err != nil {
+		response.ChainValid = false
+		response.ChainError = err.Error()
+	}
+	if response.Records == nil {
+		response.Records = []audit.Record{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Append record to the audit log with the outcome of the action that started at start.
+// An empty reason means success.
+func (s *Server) audit(record audit.Record, start time.Time, reason string) {
+	record.DurationSeconds = time.Since(start).Seconds()
+	record.Outcome = audit.OutcomeSuccess
+	if reason != "" {
+		record.Outcome = audit.OutcomeFailure
+		record.Reason = reason
+	}
+	err := s.Audit.Append(record)
+	if err != nil {
+		logging.Default().Error("Couldn't write audit record", "error", err, "action", record.Action, "user_id", record.UserID)
+	}
+}
+
+// Append record to the audit log once finished has a value
+func (s *Server) auditWhenFinished(record audit.Record, start time.Time, finished *util.ReadyChannel) {
+	reason := ""
+	if !finished.Receive() {
+		reason = finished.Reason()
+		if reason == "" {
+			reason = "failed"
+		}
+	}
+	s.audit(record, start, reason)
+}
+
+// Return a reason for an audit record from an error
+func auditReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	return fmt.Sprintf("error: %s", err.Error())
+}
+
+type ManifestCacheRequest struct {
+	// "purge" or "prefetch"
+	Action string `json:"action"`
+	// The manifest to act on, or every cached manifest if empty
+	YamlURL string `json:"yaml_url"`
+}
+
+type ManifestCacheResponse struct {
+	Entries []manifest.EntryInfo `json:"entries"`
+	// Manifests that couldn't be prefetched, with the reason
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+func (r ManifestCacheRequest) validate(globalConfig util.GlobalConfig) error {
+	var errs validationErrors
+	switch r.Action {
+	case "purge", "prefetch":
+	default:
+		errs.add("action", "must be purge or prefetch")
+	}
+	if r.YamlURL != "" {
+		validateYamlURLField(&errs, r.YamlURL, globalConfig)
+	}
+	return errs.orNil()
+}
+
+// Handles the http request to inspect the manifest cache (GET),
+// or to purge or prefetch one or all of its entries (POST)
+func (s *Server) ServeManifestCache(w http.ResponseWriter, r *http.Request) {
+	log := s.newRequestLogger(w, r, "admin_manifest_cache")
+	if !s.checkAdmin(w, r, log) {
+		return
+	}
+	cache := manifest.Default()
+	var response ManifestCacheResponse
+	if r.Method == http.MethodPost {
+		var request ManifestCacheRequest
+		err := s.decodeRequest(w, r, &request)
+		if err == nil {
+			err = request.validate(s.GlobalConfig)
+		}
+		if err != nil {
+			log.Warn("Rejected request", "error", err)
+			writeErrorResponse(w, err)
+			return
+		}
+		log.Info("Request received", "action", request.Action, "yaml_url", request.YamlURL)
+
+		switch request.Action {
+		case "purge":
+			if request.YamlURL == "" {
+				cache.PurgeAll()
+			} else {
+				cache.Purge(request.YamlURL)
+			}
+		case "prefetch":
+			urls := []string{request.YamlURL}
+			if request.YamlURL == "" {
+				urls = nil
+				for _, entry := range cache.Entries() {
+					urls = append(urls, entry.URL)
+				}
+			}
+			for _, url := range urls {
+				if err := cache.Prefetch(url); err != nil {
+					if response.Errors == nil {
+						response.Errors = make(map[string]string)
+					}
+					response.Errors[url] = err.Error()
+				}
+			}
+		}
+	} else if r.Method != http.MethodGet {
+		writeErrorResponse(w, &requestError{status: http.StatusMethodNotAllowed, message: "use GET or POST"})
+		return
+	}
+	response.Entries = cache.Entries()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+)
+
+func TestCheckAdmin(t *testing.T) {
+	s := &Server{GlobalConfig: util.GlobalConfig{
+		AdminCIDRs:     []string{"10.0.0.0/24", "fd00::/8"},
+		TrustedProxies: []string{"192.0.2.1/32"},
+	}}
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor string
+		allowed      bool
+	}{
+		{"10.0.0.20:41000", "", true},
+		{"10.0.1.20:41000", "", false},
+		{"[fd00::2]:41000", "", true},
+		{"", "", false},
+		// X-Forwarded-For is only used from trusted proxies
+		{"198.51.100.7:41000", "10.0.0.20", false},
+		{"10.0.1.20:41000", "10.0.0.20", false},
+		{"192.0.2.1:41000", "10.0.0.20", true},
+		{"192.0.2.1:41000", "10.0.0.20, 192.0.2.1", true},
+		{"192.0.2.1:41000", "10.0.1.20", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/admin/audit", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		allowed := s.checkAdmin(w, r, logging.Default())
+		if allowed != test.allowed {
+			t.Fatalf("Request from %s forwarded for %s should be allowed: %t", test.remoteAddr, test.forwardedFor, test.allowed)
+		}
+		if !allowed && w.Code != http.StatusForbidden {
+			t.Fatalf("Expected status %d for %s, got %d", http.StatusForbidden, test.remoteAddr, w.Code)
+		}
+	}
+}
+
+func TestRemoteIPOverTLS(t *testing.T) {
+	s := &Server{GlobalConfig: util.GlobalConfig{TestingHost: "10.0.0.1"}}
+	withCert := func(remoteAddr string, cert *x509.Certificate) *http.Request {
+		r := httptest.NewRequest("POST", "/create_pod", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Forwarded-For", "10.0.0.99")
+		r.TLS = &tls.ConnectionState{}
+		if cert != nil {
+			r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		return r
+	}
+	tests := []struct {
+		request *http.Request
+		output  string
+	}{
+		// X-Forwarded-For is ignored without a certificate too
+		{withCert("10.0.0.20:41000", nil), "10.0.0.20"},
+		{withCert("10.0.0.20:41000", &x509.Certificate{Subject: pkix.Name{CommonName: "silo1"}}), "10.0.0.20"},
+		{withCert("10.0.0.20:41000", &x509.Certificate{Subject: pkix.Name{CommonName: "10.0.0.30"}}), "10.0.0.30"},
+		{withCert("10.0.0.20:41000", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.30")}}), "10.0.0.30"},
+		{withCert("10.0.0.31:41000", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.30"), net.ParseIP("10.0.0.31")}}), "10.0.0.31"},
+	}
+	for _, test := range tests {
+		output := s.getRemoteIP(test.request)
+		if output != test.output {
+			t.Fatalf("Got %s for request from %s, expected %s", output, test.request.RemoteAddr, test.output)
+		}
+	}
+}
+
+func TestParseAuditFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/admin/audit?user_id=foo@bar&since=2022-01-01T00:00:00Z&limit=10", nil)
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if filter.UserID != "foo@bar" || filter.Since.Year() != 2022 || !filter.Until.IsZero() || filter.Limit != 10 {
+		t.Fatalf("Unexpected filter %+v", filter)
+	}
+
+	r = httptest.NewRequest("GET", "/admin/audit?until=yesterday&limit=-1", nil)
+	_, err = parseAuditFilter(r)
+	fieldErrors, ok := err.(validationErrors)
+	if !ok || len(fieldErrors) != 2 {
+		t.Fatalf("Expected errors for until and limit, got %v", err)
+	}
+}
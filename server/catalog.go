@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+)
+
+type ManifestsResponse []manifest.CatalogEntry
+
+// Look up where the manifest of the catalog entry the request's ManifestID refers to is read from.
+// YamlURL is set to the entry's public url, or left empty for a local file, so that local paths aren't logged.
+func (r *CreatePodRequest) resolveManifestID() error {
+	entry, exists := manifest.DefaultCatalog().Get(r.ManifestID)
+	if !exists {
+		var errs validationErrors
+		errs.add("manifest_id", "not in the manifest catalog")
+		return errs
+	}
+	r.YamlURL = entry.Source
+	r.location = entry.Location()
+	return nil
+}
+
+// Return where the manifest is read from
+func (r CreatePodRequest) manifestLocation() string {
+	if r.location != "" {
+		return r.location
+	}
+	return r.YamlURL
+}
+
+// Return the manifest url for the audit log, which is the catalog ID for manifests from local files
+func (r CreatePodRequest) auditManifestURL() string {
+	if r.YamlURL == "" && r.ManifestID != "" {
+		return fmt.Sprintf("catalog:%s", r.ManifestID)
+	}
+	return r.YamlURL
+}
+
+// Handles the http request to list the manifests in the catalog, e.g. GET /manifests or GET /manifests?id=jupyter
+func (s *Server) ServeManifests(w http.ResponseWriter, r *http.Request) {
+	log := s.newRequestLogger(w, r, "manifests")
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, &requestError{status: http.StatusMethodNotAllowed, message: "use GET"})
+		return
+	}
+	catalog := manifest.DefaultCatalog()
+	response := ManifestsResponse(catalog.Entries())
+	if id := r.URL.Query().Get("id"); id != "" {
+		entry, exists := catalog.Get(id)
+		if !exists {
+			log.Warn("Requested manifest not in the catalog", "manifest_id", id)
+			writeErrorResponse(w, &requestError{status: http.StatusNotFound, message: "manifest not in the catalog"})
+			return
+		}
+		response = ManifestsResponse{entry}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+)
+
+// How long the result of the RBAC check is reused, since it takes one API call per permission
+const rbacCheckInterval = time.Minute
+
+// How long the result of the API server check is reused, so frequent probes don't each make a call
+const apiServerCheckInterval = 5 * time.Second
+
+// A permission that the backend's service account needs, from a rule in manifests/role.yaml.
+// TestRequiredPermissionsInRole checks that role.yaml grants all of them.
+type requiredPermission struct {
+	// API group, "" for the core group
+	group       string
+	resource    string
+	subresource string
+	verbs       []string
+	namespaced  bool
+}
+
+var managedVerbs = []string{"get", "list", "delete", "create", "watch"}
+
+var requiredPermissions = []requiredPermission{
+	{resource: "pods", verbs: managedVerbs, namespaced: true},
+	{resource: "services", verbs: managedVerbs, namespaced: true},
+	{resource: "configmaps", verbs: append([]string{"patch"}, managedVerbs...), namespaced: true},
+	{resource: "secrets", verbs: managedVerbs, namespaced: true},
+	{group: "networking.k8s.io", resource: "ingresses", verbs: managedVerbs, namespaced: true},
+	{resource: "persistentvolumeclaims", verbs: append([]string{"patch"}, managedVerbs...), namespaced: true},
+	{resource: "pods", subresource: "exec", verbs: []string{"create"}, namespaced: true},
+	{resource: "persistentvolumes", verbs: append([]string{"patch"}, managedVerbs...), namespaced: false},
+}
+
+// State behind the health checks that is updated outside of the checks themselves
+type healthState struct {
+	podCachesLoaded    bool
+	rbacCheckedAt      time.Time
+	rbacErr            error
+	apiServerCheckedAt time.Time
+	apiServerErr       error
+	mutex              *sync.Mutex
+}
+
+func newHealthState() *healthState {
+	var m sync.Mutex
+	return &healthState{mutex: &m}
+}
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+	// Checks[name] is "ok" or the reason the check failed
+	Checks map[string]string `json:"checks"`
+}
+
+// Run every check, returning true if they all passed
+func runHealthChecks(checks []healthCheck) (bool, HealthResponse) {
+	healthy := true
+	response := HealthResponse{Status: "ok", Checks: make(map[string]string, len(checks))}
+	for _, c := range checks {
+		err := c.check()
+		if err != nil {
+			healthy = false
+			response.Status = "fail"
+			response.Checks[c.name] = err.Error()
+		} else {
+			response.Checks[c.name] = "ok"
+		}
+	}
+	return healthy, response
+}
+
+func writeHealthResponse(w http.ResponseWriter, checks []healthCheck) {
+	healthy, response := runHealthChecks(checks)
+	status := http.StatusOK
+	if !healthy {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Liveness only covers what a restart of the backend could fix,
+// so an unreachable API server doesn't put it in a restart loop
+func (s *Server) livenessChecks() []healthCheck {
+	return []healthCheck{
+		{"token_dir", s.checkTokenDir},
+	}
+}
+
+// Readiness covers everything the backend needs to serve requests.
+// The backend doesn't use informers, so there are no caches to wait for besides the podcaches.
+func (s *Server) readinessChecks() []healthCheck {
+	return []healthCheck{
+		{"api_server", s.checkAPIServer},
+		{"rbac", s.checkRBAC},
+		{"token_dir", s.checkTokenDir},
+		{"pod_caches", s.checkPodCachesLoaded},
+		{"not_draining", s.checkNotDraining},
+	}
+}
+
+func (s *Server) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, s.livenessChecks())
+}
+
+func (s *Server) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, s.readinessChecks())
+}
+
+// Check that a file can be created in TokenDir, where podcaches are written
+func (s *Server) checkTokenDir() error {
+	file, err := os.CreateTemp(s.GlobalConfig.TokenDir, ".healthcheck-")
+	if err != nil {
+		return errors.New(fmt.Sprintf("TokenDir %s isn't writable: %s", s.GlobalConfig.TokenDir, err.Error()))
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// Check that the API server answers, reusing the last result if it's less than apiServerCheckInterval old
+func (s *Server) checkAPIServer() error {
+	s.health.mutex.Lock()
+	if !s.health.apiServerCheckedAt.IsZero() && time.Since(s.health.apiServerCheckedAt) < apiServerCheckInterval {
+		err := s.health.apiServerErr
+		s.health.mutex.Unlock()
+		return err
+	}
+	s.health.mutex.Unlock()
+
+	_, err := s.Client.ServerVersion()
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Couldn't reach API server: %s", err.Error()))
+	}
+
+	s.health.mutex.Lock()
+	defer s.health.mutex.Unlock()
+	s.health.apiServerCheckedAt = time.Now()
+	s.health.apiServerErr = err
+	return err
+}
+
+// Check that the service account has every permission in requiredPermissions,
+// reusing the last result if it's less than rbacCheckInterval old
+func (s *Server) checkRBAC() error {
+	s.health.mutex.Lock()
+	if !s.health.rbacCheckedAt.IsZero() && time.Since(s.health.rbacCheckedAt) < rbacCheckInterval {
+		err := s.health.rbacErr
+		s.health.mutex.Unlock()
+		return err
+	}
+	s.health.mutex.Unlock()
+
+	var missing []string
+	var err error
+	for _, permission := range requiredPermissions {
+		resource := permission.resource
+		if permission.subresource != "" {
+			resource = fmt.Sprintf("%s/%s", resource, permission.subresource)
+		}
+		for _, verb := range permission.verbs {
+			allowed, checkErr := s.Client.CanI(verb, permission.group, permission.resource, permission.subresource, permission.namespaced)
+			if checkErr != nil {
+				err = errors.New(fmt.Sprintf("Couldn't check RBAC: %s", checkErr.Error()))
+				break
+			}
+			if !allowed {
+				missing = append(missing, fmt.Sprintf("%s %s", verb, resource))
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil && len(missing) > 0 {
+		err = errors.New(fmt.Sprintf("Missing permissions: %s", strings.Join(missing, ", ")))
+	}
+
+	s.health.mutex.Lock()
+	defer s.health.mutex.Unlock()
+	s.health.rbacCheckedAt = time.Now()
+	s.health.rbacErr = err
+	return err
+}
+
+func (s *Server) checkPodCachesLoaded() error {
+	s.health.mutex.Lock()
+	defer s.health.mutex.Unlock()
+	if !s.health.podCachesLoaded {
+		return errors.New("Podcaches haven't been reloaded since startup")
+	}
+	return nil
+}
+
+// Call ReloadPodCaches until it succeeds, waiting retryDelay between attempts,
+// so that the server becomes ready once the podcaches are in place
+func (s *Server) ReloadPodCachesUntilSuccess(retryDelay time.Duration) {
+	for {
+		err := s.ReloadPodCaches()
+		if err == nil {
+			return
+		}
+		logging.Default().Error("Couldn't reload podcaches", "error", err, "retry_in", retryDelay.String())
+		time.Sleep(retryDelay)
+	}
+}
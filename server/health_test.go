@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	"gopkg.in/yaml.v3"
+)
+
+func TestWriteHealthResponse(t *testing.T) {
+	passing := healthCheck{"passing", func() error { return nil }}
+	failing := healthCheck{"failing", func() error { return errors.New("broken") }}
+
+	w := httptest.NewRecorder()
+	writeHealthResponse(w, []healthCheck{passing})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	writeHealthResponse(w, []healthCheck{passing, failing})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	var response HealthResponse
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if response.Status != "fail" || response.Checks["passing"] != "ok" || response.Checks["failing"] != "broken" {
+		t.Fatalf("Unexpected response %+v", response)
+	}
+}
+
+func TestLocalHealthChecks(t *testing.T) {
+	s := &Server{GlobalConfig: util.GlobalConfig{TokenDir: t.TempDir()}, health: newHealthState()}
+	if err := s.checkTokenDir(); err != nil {
+		t.Fatalf("Temp dir should be writable: %s", err.Error())
+	}
+	s.GlobalConfig.TokenDir = filepath.Join(s.GlobalConfig.TokenDir, "missing")
+	if err := s.checkTokenDir(); err == nil {
+		t.Fatal("Missing TokenDir should fail the check")
+	}
+
+	if err := s.checkPodCachesLoaded(); err == nil {
+		t.Fatal("Podcaches shouldn't be loaded before ReloadPodCaches")
+	}
+	s.health.podCachesLoaded = true
+	if err := s.checkPodCachesLoaded(); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// The rules of a Role or ClusterRole in manifests/role.yaml
+type roleDocument struct {
+	Kind  string `yaml:"kind"`
+	Rules []struct {
+		APIGroups []string `yaml:"apiGroups"`
+		Resources []string `yaml:"resources"`
+		Verbs     []string `yaml:"verbs"`
+	} `yaml:"rules"`
+}
+
+// Check that manifests/role.yaml grants every permission that the RBAC check requires,
+// namespaced permissions through the Role and the others through the ClusterRole
+func TestRequiredPermissionsInRole(t *testing.T) {
+	file, err := os.Open(filepath.Join("..", "manifests", "role.yaml"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer file.Close()
+	// granted[kind]["group resource verb"]
+	granted := map[string]map[string]bool{"Role": {}, "ClusterRole": {}}
+	decoder := yaml.NewDecoder(file)
+	for {
+		var document roleDocument
+		if err := decoder.Decode(&document); err != nil {
+			break
+		}
+		if _, isRole := granted[document.Kind]; !isRole {
+			continue
+		}
+		for _, rule := range document.Rules {
+			for _, group := range rule.APIGroups {
+				for _, resource := range rule.Resources {
+					for _, verb := range rule.Verbs {
+						granted[document.Kind][fmt.Sprintf("%s %s %s", group, resource, verb)] = true
+					}
+				}
+			}
+		}
+	}
+
+	for _, permission := range requiredPermissions {
+		kind := "ClusterRole"
+		if permission.namespaced {
+			kind = "Role"
+		}
+		resource := permission.resource
+		if permission.subresource != "" {
+			resource = fmt.Sprintf("%s/%s", resource, permission.subresource)
+		}
+		for _, verb := range permission.verbs {
+			if !granted[kind][fmt.Sprintf("%s %s %s", permission.group, resource, verb)] {
+				t.Errorf("%s in role.yaml doesn't grant %s %s in group %q", kind, verb, resource, permission.group)
+			}
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/audit"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+type CreateProjectRequest struct {
+	ProjectID string `json:"project_id"`
+	// The owner of the project, who is always a member and the only one who can change the members
+	UserID string `json:"user_id"`
+	// User IDs of the other members
+	Members  []string        `json:"members"`
+	RemoteIP string          `json:"-"`
+	Log      *logging.Logger `json:"-"`
+}
+
+// Request for a project's members, which changes them if Add or Remove is set
+type ProjectMembersRequest struct {
+	ProjectID string          `json:"project_id"`
+	UserID    string          `json:"user_id"`
+	Add       []string        `json:"add"`
+	Remove    []string        `json:"remove"`
+	RemoteIP  string          `json:"-"`
+	Log       *logging.Logger `json:"-"`
+}
+
+type DeleteProjectRequest struct {
+	ProjectID string          `json:"project_id"`
+	UserID    string          `json:"user_id"`
+	RemoteIP  string          `json:"-"`
+	Log       *logging.Logger `json:"-"`
+}
+
+type ProjectResponse managed.ProjectInfo
+
+type DeleteProjectResponse struct {
+	Requested bool `json:"requested"`
+}
+
+// Returned for projects that don't exist and projects the user isn't a member of alike
+var errProjectNotFound = &requestError{status: http.StatusNotFound, message: "project not found"}
+
+// Return the project and its info, or errProjectNotFound if userID isn't a member
+func (s *Server) getProjectForMember(projectID string, userID string, log *logging.Logger) (managed.Project, managed.ProjectInfo, error) {
+	project := managed.NewProject(projectID, s.Client, s.GlobalConfig)
+	project.SetLogger(log)
+	info, exists, err := project.Get()
+	if err != nil {
+		return project, info, err
+	}
+	if !exists || !info.HasMember(userID) {
+		return project, info, errProjectNotFound
+	}
+	return project, info, nil
+}
+
+func (s *Server) createProject(request CreateProjectRequest) (ProjectResponse, error) {
+	start := time.Now()
+	record := audit.Record{
+		Action:   audit.ActionCreateProject,
+		Actor:    audit.ActorSilo,
+		RemoteIP: request.RemoteIP,
+		UserID:   request.UserID,
+		Resource: request.ProjectID,
+	}
+	project := managed.NewProject(request.ProjectID, s.Client, s.GlobalConfig)
+	project.SetLogger(request.Log)
+	info, err := project.Create(request.UserID, request.RemoteIP, request.Members)
+	if errors.Is(err, managed.ErrProjectExists) {
+		err = &requestError{status: http.StatusConflict, message: "project already exists"}
+	}
+	s.audit(record, start, auditReason(err))
+	return ProjectResponse(info), err
+}
+
+func (s *Server) projectMembers(request ProjectMembersRequest) (ProjectResponse, error) {
+	project, info, err := s.getProjectForMember(request.ProjectID, request.UserID, request.Log)
+	if err != nil {
+		return ProjectResponse{}, err
+	}
+	if len(request.Add) == 0 && len(request.Remove) == 0 {
+		return ProjectResponse(info), nil
+	}
+
+	start := time.Now()
+	record := audit.Record{
+		Action:   audit.ActionUpdateProject,
+		Actor:    audit.ActorSilo,
+		RemoteIP: request.RemoteIP,
+		UserID:   request.UserID,
+		Resource: request.ProjectID,
+	}
+	if info.Owner != request.UserID {
+		err = &requestError{status: http.StatusForbidden, message: "only the owner can change the project's members"}
+	} else {
+		info, err = project.UpdateMembers(info, request.Add, request.Remove)
+		if errors.Is(err, managed.ErrProjectOwnerNotMember) {
+			var errs validationErrors
+			errs.add("remove", "%s", err.Error())
+			err = errs
+		}
+	}
+	s.audit(record, start, auditReason(err))
+	return ProjectResponse(info), err
+}
+
+func (s *Server) deleteProject(request DeleteProjectRequest) (DeleteProjectResponse, error) {
+	response := DeleteProjectResponse{Requested: false}
+	project, info, err := s.getProjectForMember(request.ProjectID, request.UserID, request.Log)
+	if err != nil {
+		return response, err
+	}
+	start := time.Now()
+	record := audit.Record{
+		Action:   audit.ActionDeleteProject,
+		Actor:    audit.ActorSilo,
+		RemoteIP: request.RemoteIP,
+		UserID:   request.UserID,
+		Resource: request.ProjectID,
+	}
+	if info.Owner != request.UserID {
+		err := &requestError{status: http.StatusForbidden, message: "only the owner can delete the project"}
+		s.audit(record, start, auditReason(err))
+		return response, err
+	}
+	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
+	err = project.Delete(finished)
+	if errors.Is(err, managed.ErrProjectStorageInUse) {
+		err = &requestError{status: http.StatusConflict, message: "the project's storage is in use by pods"}
+	}
+	if err != nil {
+		s.audit(record, start, auditReason(err))
+		return response, err
+	}
+	go s.auditWhenFinished(record, start, finished)
+	response.Requested = true
+	return response, nil
+}
+
+// Handles the http request to create a project
+func (s *Server) ServeCreateProject(w http.ResponseWriter, r *http.Request) {
+	var request CreateProjectRequest
+	log := s.newRequestLogger(w, r, "create_project")
+	if s.rejectIfDraining(w, log) {
+		return
+	}
+	defer s.requestDone()
+	err := s.decodeRequest(w, r, &request)
+	if err == nil {
+		err = request.validate()
+	}
+	request.RemoteIP = s.getRemoteIP(r)
+	if err != nil {
+		log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	request.Log = log.With("user_id", request.UserID, "project_id", request.ProjectID)
+	request.Log.Info("Request received", "members", request.Members)
+
+	response, err := s.createProject(request)
+	if err != nil {
+		request.Log.Warn("Couldn't create project", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Handles the http request to list, add or remove the members of a project
+func (s *Server) ServeProjectMembers(w http.ResponseWriter, r *http.Request) {
+	var request ProjectMembersRequest
+	log := s.newRequestLogger(w, r, "project_members")
+	err := s.decodeRequest(w, r, &request)
+	if err == nil {
+		err = request.validate()
+	}
+	request.RemoteIP = s.getRemoteIP(r)
+	if err != nil {
+		log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	if len(request.Add) > 0 || len(request.Remove) > 0 {
+		if s.rejectIfDraining(w, log) {
+			return
+		}
+		defer s.requestDone()
+	}
+	request.Log = log.With("user_id", request.UserID, "project_id", request.ProjectID)
+	request.Log.Info("Request received", "add", request.Add, "remove", request.Remove)
+
+	response, err := s.projectMembers(request)
+	if err != nil {
+		request.Log.Warn("Couldn't get or change project members", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Handles the http request to delete a project and its storage
+func (s *Server) ServeDeleteProject(w http.ResponseWriter, r *http.Request) {
+	var request DeleteProjectRequest
+	log := s.newRequestLogger(w, r, "delete_project")
+	if s.rejectIfDraining(w, log) {
+		return
+	}
+	defer s.requestDone()
+	err := s.decodeRequest(w, r, &request)
+	if err == nil {
+		err = request.validate()
+	}
+	request.RemoteIP = s.getRemoteIP(r)
+	if err != nil {
+		log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	request.Log = log.With("user_id", request.UserID, "project_id", request.ProjectID)
+	request.Log.Info("Request received")
+
+	response, err := s.deleteProject(request)
+	if err != nil {
+		request.Log.Warn("Couldn't delete project", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Return whether pods that aren't being deleted use the project's storage
+func (s *Server) projectHasRemainingPods(project managed.Project) bool {
+	podNames, err := project.PodsUsingStorage()
+	if err != nil {
+		project.Log.Error("Couldn't list pods", "error", err)
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, podName := range podNames {
+		if _, inDeletingMap := s.DeletingPods[podName]; !inDeletingMap {
+			return true
+		}
+	}
+	return false
+}
+
+// Call for deletion of the project's storage, keeping its members.
+// Return the channel that receives true once it's deleted.
+func (s *Server) deleteProjectStorage(project managed.Project, actor string, remoteIP string) (*util.ReadyChannel, error) {
+	record := audit.Record{
+		Action:   audit.ActionDeleteProjectStorage,
+		Actor:    actor,
+		RemoteIP: remoteIP,
+		Resource: project.GetStoragePVName(),
+	}
+	start := time.Now()
+	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
+	err := project.DeleteStorage(finished)
+	if err != nil {
+		s.audit(record, start, auditReason(err))
+		return nil, err
+	}
+	go s.auditWhenFinished(record, start, finished)
+	return finished, nil
+}
+
+// Follow the same rules as user storage for the storage of each project that pod mounted:
+// once no other pods use it, it's marked as unused if there's a StorageRetention, and otherwise deleted
+func (s *Server) deleteProjectStorageIfUnused(pod *apiv1.Pod, actor string, remoteIP string, log *logging.Logger) {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		projectID, isProject := managed.ProjectIDFromStorageName(volume.PersistentVolumeClaim.ClaimName)
+		if !isProject {
+			continue
+		}
+		project := managed.NewProject(projectID, s.Client, s.GlobalConfig)
+		project.SetLogger(log)
+		if s.projectHasRemainingPods(project) {
+			continue
+		}
+		if s.GlobalConfig.StorageRetention > 0 {
+			err := project.MarkStorageUnused(time.Now())
+			if err != nil {
+				project.Log.Error("Couldn't mark project storage as unused", "error", err)
+				continue
+			}
+			project.Log.Info("Keeping project storage after the last pod", "retention", s.GlobalConfig.StorageRetention.String())
+			continue
+		}
+		_, err := s.deleteProjectStorage(project, actor, remoteIP)
+		if err != nil {
+			project.Log.Error("Couldn't call for deletion of project storage", "error", err)
+		}
+	}
+}
+
+// As sweepStorage for the storage of a project, which is in use while pods mount it
+func (s *Server) sweepProjectStoragePVC(pvc apiv1.PersistentVolumeClaim, remoteIP string, log *logging.Logger) (*util.ReadyChannel, error) {
+	projectID, _ := managed.ProjectIDFromStorageName(pvc.Name)
+	project := managed.NewProject(projectID, s.Client, s.GlobalConfig)
+	project.SetLogger(log)
+	creating, err := s.projectMembersCreatingPods(project)
+	if err != nil || creating {
+		return nil, err
+	}
+	return s.sweepStorage(pvc, sweptStorage{
+		kind:  "project_storage",
+		inUse: s.projectHasRemainingPods(project),
+		log:   project.Log,
+		keep:  project.KeepStorage,
+		mark:  project.MarkStorageUnused,
+		delete: func() (*util.ReadyChannel, error) {
+			return s.deleteProjectStorage(project, audit.ActorSystem, remoteIP)
+		},
+	})
+}
+
+// Return whether a member of the project is creating pods, which may mount the project's storage
+func (s *Server) projectMembersCreatingPods(project managed.Project) (bool, error) {
+	info, exists, err := project.Get()
+	if err != nil || !exists {
+		return false, err
+	}
+	for _, member := range info.Members {
+		if s.userIsCreatingPods(member) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -4,33 +4,56 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/deic.dk/user_pods_k8s_backend/audit"
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
 	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
 	"github.com/deic.dk/user_pods_k8s_backend/podcreator"
 	"github.com/deic.dk/user_pods_k8s_backend/poddeleter"
+	"github.com/deic.dk/user_pods_k8s_backend/policy"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type GetPodsRequest struct {
-	UserID   string `json:"user_id"`
-	RemoteIP string
+	UserID   string          `json:"user_id"`
+	RemoteIP string          `json:"-"`
+	Log      *logging.Logger `json:"-"`
 }
 
 type GetPodsResponse []managed.PodInfo
 
 type CreatePodRequest struct {
 	YamlURL string `json:"yaml_url"`
-	UserID  string `json:"user_id"`
+	// ID of a manifest in the catalog, which may be given instead of YamlURL
+	ManifestID string `json:"manifest_id"`
+	UserID     string `json:"user_id"`
 	//Settings[container_name][env_var_name] = env_var_value
 	ContainerEnvVars map[string]map[string]string `json:"settings"`
-	RemoteIP         string
+	// Resources[container_name][resource_name] = quantity, used as both the request and limit,
+	// e.g. {"jupyter": {"cpu": "2", "memory": "4Gi"}}
+	Resources map[string]map[string]string `json:"resources"`
+	// VolumeSubPaths[volume_name] = directory to mount, for volumes such as user-subdir that mount part of the user's storage,
+	// e.g. {"user-subdir": "projects/thesis"}
+	VolumeSubPaths map[string]string `json:"volume_subpaths"`
+	// How the user's storage is mounted wherever the pod mounts it,
+	// e.g. {"subpath": "shared/notebooks", "read_only": true}
+	Storage  podcreator.StorageMount `json:"storage"`
+	RemoteIP string                  `json:"-"`
+	Log      *logging.Logger         `json:"-"`
+	// Where the manifest of the catalog entry given by ManifestID is read from,
+	// which may be a file:// url that's kept out of logs and the audit log
+	location string
 }
 
 type CreatePodResponse struct {
@@ -38,18 +61,24 @@ type CreatePodResponse struct {
 }
 
 type WatchCreatePodRequest struct {
-	PodName string `json:"pod_name"`
-	UserID  string `json:"user_id"`
+	PodName string          `json:"pod_name"`
+	UserID  string          `json:"user_id"`
+	Log     *logging.Logger `json:"-"`
 }
 
 type WatchCreatePodResponse struct {
 	Ready bool `json:"ready"`
+	// Why creation failed, e.g. post_start_hook, if it isn't ready
+	Reason string `json:"reason,omitempty"`
 }
 
 type DeletePodRequest struct {
-	UserID   string `json:"user_id"`
-	PodName  string `json:"pod_name"`
-	RemoteIP string
+	UserID   string          `json:"user_id"`
+	PodName  string          `json:"pod_name"`
+	RemoteIP string          `json:"-"`
+	Log      *logging.Logger `json:"-"`
+	// Who is deleting the pod for the audit log, audit.ActorSilo if empty
+	Actor string `json:"-"`
 }
 
 type DeletePodResponse struct {
@@ -57,8 +86,9 @@ type DeletePodResponse struct {
 }
 
 type WatchDeletePodRequest struct {
-	PodName string `json:"pod_name"`
-	UserID  string `json:"user_id"`
+	PodName string          `json:"pod_name"`
+	UserID  string          `json:"user_id"`
+	Log     *logging.Logger `json:"-"`
 }
 
 type WatchDeletePodResponse struct {
@@ -66,8 +96,9 @@ type WatchDeletePodResponse struct {
 }
 
 type DeleteAllPodsRequest struct {
-	UserID   string `json:"user_id"`
-	RemoteIP string
+	UserID   string          `json:"user_id"`
+	RemoteIP string          `json:"-"`
+	Log      *logging.Logger `json:"-"`
 }
 
 type DeleteAllPodsResponse struct {
@@ -84,8 +115,17 @@ type Server struct {
 	GlobalConfig    util.GlobalConfig
 	CreatingPods    map[string]watchMapEntry
 	DeletingPods    map[string]watchMapEntry
-	DeletingStorage map[string]watchMapEntry
-	mutex           *sync.Mutex
+	DeletingStorage map[string]watchMapEntry // keyed by user ID, since user names are only unique within a domain
+	// Records every mutating action, or nil to skip auditing
+	Audit  *audit.Log
+	health *healthState
+	// Measurements of users' storage usage
+	storageUsage *storageUsageCache
+	// Set at shutdown, after which mutating requests are rejected
+	draining bool
+	// Number of mutating requests that got past rejectIfDraining and haven't returned
+	inFlight int
+	mutex    *sync.Mutex
 }
 
 type watchMapName int
@@ -97,16 +137,78 @@ const (
 	userIDregex                  = `^[a-z0-9][-a-z0-9._]*[@]?[-a-z0-9._]*[a-z0-9]$`
 )
 
+var requestIDRegex = regexp.MustCompile(`^[-a-zA-Z0-9_.]{1,64}$`)
+
 func New(client k8sclient.K8sClient, globalConfig util.GlobalConfig) *Server {
 	var m sync.Mutex
-	return &Server{
+	s := &Server{
 		Client:          client,
 		GlobalConfig:    globalConfig,
 		CreatingPods:    make(map[string]watchMapEntry),
 		DeletingPods:    make(map[string]watchMapEntry),
 		DeletingStorage: make(map[string]watchMapEntry),
+		health:          newHealthState(),
+		storageUsage:    newStorageUsageCache(),
 		mutex:           &m,
 	}
+	s.registerWatchMapGauges()
+	return s
+}
+
+// Expose the sizes of the watch maps as gauges
+func (s *Server) registerWatchMapGauges() {
+	gauges := []struct {
+		name    string
+		help    string
+		mapName watchMapName
+	}{
+		{"user_pods_creating", "Pods that are waiting to reach ready state and finish start jobs", CreatingPods},
+		{"user_pods_deleting", "Pods that are waiting to be deleted", DeletingPods},
+		{"user_pods_deleting_storage", "Users whose storage is waiting to be deleted", DeletingStorage},
+	}
+	for _, gauge := range gauges {
+		mapName := gauge.mapName
+		metrics.NewGaugeFunc(gauge.name, gauge.help, func() float64 {
+			return float64(s.watchMapSize(mapName))
+		})
+	}
+}
+
+// Thread-safe read of the number of entries in the specified watchMap
+func (s *Server) watchMapSize(mapName watchMapName) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch mapName {
+	case CreatingPods:
+		return len(s.CreatingPods)
+	case DeletingPods:
+		return len(s.DeletingPods)
+	case DeletingStorage:
+		return len(s.DeletingStorage)
+	}
+	return 0
+}
+
+// Wait for the result of a pod creation that was requested at start, and record it in the metrics and audit log
+func (s *Server) recordCreation(record audit.Record, start time.Time, finished *util.ReadyChannel) {
+	if finished.Receive() {
+		metrics.PodCreationSeconds.ObserveSince(start, record.Manifest)
+		metrics.PodCreations.Inc(record.Manifest, metrics.OutcomeSuccess, "")
+	} else {
+		metrics.PodCreations.Inc(record.Manifest, metrics.OutcomeFailure, finished.Reason())
+	}
+	s.auditWhenFinished(record, start, finished)
+}
+
+// Wait for the result of a pod deletion that was requested at start, and record it in the metrics and audit log
+func (s *Server) recordDeletion(record audit.Record, start time.Time, finished *util.ReadyChannel) {
+	if finished.Receive() {
+		metrics.PodDeletionSeconds.ObserveSince(start, record.Manifest)
+		metrics.PodDeletions.Inc(record.Manifest, metrics.OutcomeSuccess, "")
+	} else {
+		metrics.PodDeletions.Inc(record.Manifest, metrics.OutcomeFailure, finished.Reason())
+	}
+	s.auditWhenFinished(record, start, finished)
 }
 
 // Add an entry to the specified watchMap (e.g. `s.CreatingPods`) for the given key.
@@ -140,15 +242,73 @@ func (s *Server) addToWatchMaps(key string, entry watchMapEntry, mapName watchMa
 	}()
 }
 
+// Return a logger for a request to the given operation, with a request ID and the remote IP.
+// The ID is taken from the X-Request-ID header if the caller set a sensible one,
+// and is echoed back in the response so silos can match their logs to ours.
+func (s *Server) newRequestLogger(w http.ResponseWriter, r *http.Request, operation string) *logging.Logger {
+	requestID := r.Header.Get("X-Request-ID")
+	if !requestIDRegex.MatchString(requestID) {
+		requestID = logging.NewRequestID()
+	}
+	w.Header().Set("X-Request-ID", requestID)
+	log := logging.Default().With(
+		"request_id", requestID,
+		"operation", operation,
+		"remote_ip", s.getRemoteIP(r),
+	)
+	// With mutual TLS, the client certificate says which silo is calling
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		log = log.With("client_cert", r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}
+	return log
+}
+
+// Return the silo IP that the verified client certificate of the request names, in its IP SANs or as its CN,
+// preferring the address the connection came from if the certificate names several. Empty if there's none.
+func certificateSiloIP(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	ips := cert.IPAddresses
+	if len(ips) == 0 {
+		if ip := net.ParseIP(cert.Subject.CommonName); ip != nil {
+			ips = []net.IP{ip}
+		}
+	}
+	if len(ips) == 0 {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	for _, ip := range ips {
+		if ip.Equal(peer) {
+			return ip.String()
+		}
+	}
+	return ips[0].String()
+}
+
 // Gets the IP of the source that made the request, either r.RemoteAddr,
-// or if it was forwarded, the first address in the X-Forwarded-For header
+// or if it was forwarded, the first address in the X-Forwarded-For header.
+// When the server terminates TLS itself, the header is ignored and the silo is the one its client certificate names.
 func (s *Server) getRemoteIP(r *http.Request) string {
 	// When running this behind a manual reverse proxy, r.RemoteAddr is just the proxy's IP addr,
 	// and X-Forward-For header should contain the silo's IP address.
 	// This may be different with ingress.
 	var remoteAddr string
 	value, forwarded := r.Header["X-Forwarded-For"]
-	if forwarded {
+	if r.TLS != nil {
+		// There's no proxy in front whose header could be trusted, and the silo IP decides
+		// which NFS server the user's storage is on, so take it from the certificate when there is one
+		if siloIP := certificateSiloIP(r); siloIP != "" {
+			return siloIP
+		}
+		remoteAddr = r.RemoteAddr
+	} else if forwarded {
 		remoteAddr = value[0]
 	} else {
 		remoteAddr = r.RemoteAddr
@@ -226,24 +386,30 @@ func (s *Server) getPods(request GetPodsRequest) (GetPodsResponse, error) {
 func (s *Server) ServeGetPods(w http.ResponseWriter, r *http.Request) {
 	// parse the request
 	var request GetPodsRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(&request)
+	log := s.newRequestLogger(w, r, "get_pods")
+	err := s.decodeRequest(w, r, &request)
+	if err == nil {
+		err = request.validate()
+	}
 	request.RemoteIP = s.getRemoteIP(r)
-	fmt.Printf("getPods request: %+v\n", request)
+	if err != nil {
+		log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	request.Log = log.With("user_id", request.UserID)
+	request.Log.Debug("Request received")
 
 	// Default to an error status and empty response
 	status := http.StatusBadRequest
 	var response GetPodsResponse
-	// If the input is valid
-	if validUserID(request.UserID) {
-		// get the list of pod info
-		r, err := s.getPods(request)
-		if err != nil {
-			fmt.Printf("Error calling GetPods: %s", err.Error())
-		} else { // If it was successful, set the status and response
-			status = http.StatusOK
-			response = r
-		}
+	// get the list of pod info
+	podInfo, err := s.getPods(request)
+	if err != nil {
+		request.Log.Error("Couldn't get pods", "error", err)
+	} else { // If it was successful, set the status and response
+		status = http.StatusOK
+		response = podInfo
 	}
 
 	// write the response
@@ -257,24 +423,74 @@ func (s *Server) ServeGetPods(w http.ResponseWriter, r *http.Request) {
 // Then quietly waits for the pod to reach Ready state and runs start jobs.
 func (s *Server) createPod(request CreatePodRequest, finished *util.ReadyChannel) (CreatePodResponse, error) {
 	var response CreatePodResponse
+	start := time.Now()
+	record := audit.Record{
+		Action:      audit.ActionCreatePod,
+		Actor:       audit.ActorSilo,
+		RemoteIP:    request.RemoteIP,
+		UserID:      request.UserID,
+		ManifestURL: request.auditManifestURL(),
+	}
+	user := managed.NewUser(request.UserID, s.Client, s.GlobalConfig)
+	user.SetLogger(request.Log)
+	// A pod created now could lose its storage from under it
+	s.mutex.Lock()
+	_, deletingStorage := s.DeletingStorage[user.UserID]
+	s.mutex.Unlock()
+	if deletingStorage {
+		err := &requestError{status: http.StatusConflict, message: "The user's storage is being deleted, try again when it's finished"}
+		metrics.PodCreations.Inc("unknown", metrics.OutcomeFailure, "storage_deleting")
+		s.audit(record, start, auditReason(err))
+		return response, err
+	}
+	if err := s.checkStorageQuota(user); err != nil {
+		metrics.PodCreations.Inc("unknown", metrics.OutcomeFailure, "storage_quota")
+		s.audit(record, start, auditReason(err))
+		return response, err
+	}
+
 	// make podCreator
 	creator, err := podcreator.NewPodCreator(
-		request.YamlURL,
+		request.manifestLocation(),
 		request.UserID,
 		request.RemoteIP,
 		request.ContainerEnvVars,
+		request.Resources,
+		request.VolumeSubPaths,
+		request.Storage,
 		s.Client,
 		s.GlobalConfig,
+		request.Log,
 	)
 	if err != nil {
+		reason := "invalid_manifest"
+		var settingsErrors manifest.SettingsErrors
+		var violations policy.Violations
+		if errors.As(err, &settingsErrors) {
+			reason = "invalid_settings"
+		} else if errors.As(err, &violations) {
+			reason = "policy_violation"
+		}
+		metrics.PodCreations.Inc("unknown", metrics.OutcomeFailure, reason)
+		s.audit(record, start, auditReason(err))
 		return response, err
 	}
 
 	// create pod
 	pod, err := creator.CreatePod(finished)
 	if err != nil {
+		reason := "create_call"
+		if errors.Is(err, podcreator.ErrMaxInstances) {
+			reason = "max_instances"
+			err = &requestError{status: http.StatusConflict, message: err.Error()}
+		}
+		metrics.PodCreations.Inc("unknown", metrics.OutcomeFailure, reason)
+		s.audit(record, start, auditReason(err))
 		return response, err
 	}
+	record.PodName = pod.Object.Name
+	record.Manifest = pod.GetManifestName()
+	go s.recordCreation(record, start, finished)
 	// If creation was requested successfully, add the readyChannel to the server's watchMap
 	s.addToWatchMaps(
 		pod.Object.Name,
@@ -291,36 +507,65 @@ func (s *Server) createPod(request CreatePodRequest, finished *util.ReadyChannel
 func (s *Server) ServeCreatePod(w http.ResponseWriter, r *http.Request) {
 	// Parse the POSTed request JSON and log the request
 	var request CreatePodRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(&request)
+	log := s.newRequestLogger(w, r, "create_pod")
+	if s.rejectIfDraining(w, log) {
+		return
+	}
+	defer s.requestDone()
+	err := s.decodeRequest(w, r, &request)
+	if err == nil {
+		err = request.validate(s.GlobalConfig)
+	}
+	if err == nil && request.ManifestID != "" {
+		err = request.resolveManifestID()
+	}
 	request.RemoteIP = s.getRemoteIP(r)
-	fmt.Printf("createPod request: %+v\n", request)
+	if err != nil {
+		log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	request.Log = log.With("user_id", request.UserID)
+	request.Log.Info("Request received", "yaml_url", request.YamlURL, "manifest_id", request.ManifestID, "settings", logging.RedactSettings(request.ContainerEnvVars), "resources", request.Resources, "volume_subpaths", request.VolumeSubPaths, "storage", request.Storage)
 
 	// Default to an error status and empty response
 	status := http.StatusBadRequest
 	var response CreatePodResponse
-	// If the input is valid
-	if validUserID(request.UserID) {
-		// Call for pod creation
-		finished := util.NewReadyChannel(s.GlobalConfig.TimeoutCreate)
-		r, err := s.createPod(request, finished)
-		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-		} else {
-			// If the creation call was sucessful, set the response and status
-			status = http.StatusOK
-			response = r
-			// Wait for the result of creation, log the result, and call for deletion
-			// if something went wrong
-			go func() {
-				if finished.Receive() {
-					fmt.Printf("Completed start jobs for Pod %s\n", response.PodName)
-				} else {
-					fmt.Printf("Warning: failed to create pod %s or complete start jobs\n", response.PodName)
-					s.deletePodIfFailedCreate(response.PodName, request)
-				}
-			}()
-		}
+	// Call for pod creation
+	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutCreate)
+	created, err := s.createPod(request, finished)
+	var settingsErrors manifest.SettingsErrors
+	var violations policy.Violations
+	var reqErr *requestError
+	if errors.As(err, &settingsErrors) {
+		request.Log.Warn("Rejected settings", "error", err)
+		writeErrorResponse(w, err)
+		return
+	} else if errors.As(err, &violations) {
+		request.Log.Warn("Rejected manifest that violates policy", "error", err)
+		writeErrorResponse(w, err)
+		return
+	} else if errors.As(err, &reqErr) {
+		request.Log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	} else if err != nil {
+		request.Log.Error("Couldn't create pod", "error", err)
+	} else {
+		// If the creation call was sucessful, set the response and status
+		status = http.StatusOK
+		response = created
+		request.Log = request.Log.With("pod_name", response.PodName)
+		// Wait for the result of creation, log the result, and call for deletion
+		// if something went wrong
+		go func() {
+			if finished.Receive() {
+				request.Log.Info("Completed start jobs")
+			} else {
+				request.Log.Warn("Failed to create pod or complete start jobs", "reason", finished.Reason())
+				s.deletePodIfFailedCreate(response.PodName, request)
+			}
+		}()
 	}
 
 	// write the response
@@ -345,6 +590,9 @@ func (s *Server) watchCreatePod(request WatchCreatePodRequest) (WatchCreatePodRe
 		}
 		// Respond when there is a value in the ready channel
 		response.Ready = entry.readyChannel.Receive()
+		if !response.Ready {
+			response.Reason = entry.readyChannel.Reason()
+		}
 		return response, nil
 	}
 
@@ -360,15 +608,24 @@ func (s *Server) watchCreatePod(request WatchCreatePodRequest) (WatchCreatePodRe
 
 func (s *Server) ServeWatchCreatePod(w http.ResponseWriter, r *http.Request) {
 	var request WatchCreatePodRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(&request)
-	fmt.Printf("watchCreatePod request %+v\n", request)
+	log := s.newRequestLogger(w, r, "watch_create_pod")
+	err := s.decodeRequest(w, r, &request)
+	if err == nil {
+		err = request.validate()
+	}
+	if err != nil {
+		log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	request.Log = log.With("user_id", request.UserID, "pod_name", request.PodName)
+	request.Log.Debug("Request received")
 
 	response, err := s.watchCreatePod(request)
 	// If there is an error, it may be internal, or it may be a user requesting for a pod they don't own.
 	// To avoid giving the user information about pods they don't own, return `false` without error in either case.
 	if err != nil {
-		fmt.Printf("Error watching pod: %s\n", err.Error())
+		request.Log.Warn("Couldn't watch pod creation", "error", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -379,7 +636,7 @@ func (s *Server) ServeWatchCreatePod(w http.ResponseWriter, r *http.Request) {
 func (s *Server) userHasRemainingPods(u managed.User) bool {
 	podList, err := u.ListPods()
 	if err != nil {
-		fmt.Printf("Error, couldn't list pods for user %s: %s\n", u.UserID, err.Error())
+		u.Log.Error("Couldn't list pods", "error", err)
 		return false
 	}
 	s.mutex.Lock()
@@ -402,75 +659,105 @@ func (s *Server) deletePodIfFailedCreate(podName string, createRequest CreatePod
 		PodName:  podName,
 		UserID:   createRequest.UserID,
 		RemoteIP: createRequest.RemoteIP,
+		Log:      createRequest.Log.With("pod_name", podName, "operation", "delete_failed_pod"),
+		Actor:    audit.ActorSystem,
 	}
-	fmt.Printf("Attempting to delete pod %s because it didn't reach desired state", podName)
+	request.Log.Info("Deleting pod because it didn't reach desired state")
 
 	// Call for deletion
 	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
 	_, err := s.deletePod(request, finished)
 	if err != nil {
-		fmt.Printf("Error: Failed deleting pod %s after it failed creation: %s\n", podName, err.Error())
+		request.Log.Error("Couldn't delete pod after it failed creation", "error", err)
 		return err
 	}
 
 	// Wait and see whether it succeeded
 	if !finished.Receive() {
-		errorMessage := fmt.Sprintf("Error: Pod %s failed to reach deleted state. Deletion was triggered by failure to reach created state.\n", podName)
-		fmt.Print(errorMessage)
+		errorMessage := fmt.Sprintf("Pod %s failed to reach deleted state. Deletion was triggered by failure to reach created state.", podName)
+		request.Log.Error("Pod failed to reach deleted state after it failed creation", "reason", finished.Reason())
 		return errors.New(errorMessage)
 	}
 	return nil
 }
 
+// Call for deletion of the user's storage if all of their remaining pods are being deleted
+// and the storage isn't already being deleted. If StorageRetention is set, the storage is only
+// marked as unused, and the sweeper deletes it later if the user hasn't created another pod.
+// If this fails, log the error, but don't tell the user, because at this point their pod will be deleted.
+func (s *Server) deleteStorageIfUnused(user managed.User, actor string, remoteIP string) error {
+	if s.userHasRemainingPods(user) {
+		return nil
+	}
+	if s.GlobalConfig.StorageRetention > 0 {
+		err := user.MarkUserStorageUnused(time.Now())
+		if err != nil {
+			return errors.New(fmt.Sprintf("Couldn't mark user storage as unused: %s", err.Error()))
+		}
+		user.Log.Info("Keeping user storage after the last pod", "retention", s.GlobalConfig.StorageRetention.String())
+		return nil
+	}
+	_, err := s.deleteUserStorage(user, actor, remoteIP)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't call for deletion of user storage: %s", err.Error()))
+	}
+	return nil
+}
+
 func (s *Server) deletePod(request DeletePodRequest, finished *util.ReadyChannel) (DeletePodResponse, error) {
 	response := DeletePodResponse{Requested: false}
+	start := time.Now()
+	record := audit.Record{
+		Action:   audit.ActionDeletePod,
+		Actor:    request.Actor,
+		RemoteIP: request.RemoteIP,
+		UserID:   request.UserID,
+		PodName:  request.PodName,
+	}
+	if record.Actor == "" {
+		record.Actor = audit.ActorSilo
+	}
 	s.mutex.Lock()
 	_, podIsBeingDeleted := s.DeletingPods[request.PodName]
 	s.mutex.Unlock()
 	if podIsBeingDeleted {
 		finished.Send(false)
-		return response, errors.New(fmt.Sprintf("pod %s is already being deleted", request.PodName))
+		err := errors.New(fmt.Sprintf("pod %s is already being deleted", request.PodName))
+		s.audit(record, start, auditReason(err))
+		return response, err
 	}
 
 	// Try to initialize a podDeleter (this will check that the username matches)
-	deleter, err := poddeleter.NewPodDeleter(request.PodName, request.UserID, s.Client, s.GlobalConfig)
+	deleter, err := poddeleter.NewPodDeleter(request.PodName, request.UserID, s.Client, s.GlobalConfig, request.Log)
 	if err != nil {
 		finished.Send(false)
-		return response, errors.New(fmt.Sprintf("Error starting pod deletion for %s: %s", request.PodName, err.Error()))
+		err = errors.New(fmt.Sprintf("Error starting pod deletion for %s: %s", request.PodName, err.Error()))
+		s.audit(record, start, auditReason(err))
+		return response, err
 	}
+	record.Manifest = deleter.Pod.GetManifestName()
+	// Keep track that this pod is deleting before calling for it, since its pre-stop hooks run first
+	s.addToWatchMaps(
+		request.PodName,
+		watchMapEntry{readyChannel: finished, authCheck: request.UserID},
+		DeletingPods)
 	// Attempt to call for deletion
 	err = deleter.DeletePod(finished)
 	if err != nil {
+		metrics.PodDeletions.Inc(record.Manifest, metrics.OutcomeFailure, "delete_call")
 		finished.Send(false)
+		s.audit(record, start, auditReason(err))
 		return response, err
 	}
-	// If that was successful, the server should keep track that this pod is deleting
-	s.addToWatchMaps(
-		request.PodName,
-		watchMapEntry{readyChannel: finished, authCheck: request.UserID},
-		DeletingPods)
+	go s.recordDeletion(record, start, finished)
 
-	// Then if the user doesn't have remaining pods, call for deletion of their storage,
-	// If this fails, log the error, but don't tell the user, because at this point their pod will be deleted.
-	if !s.userHasRemainingPods(deleter.Pod.Owner) {
-		// Check whether the user's storage is already being deleted
-		s.mutex.Lock()
-		_, cleaningStorage := s.DeletingStorage[deleter.Pod.Owner.Name]
-		s.mutex.Unlock()
-		// If it's not already being deleted, then call for deletion
-		if !cleaningStorage {
-			cleanedStorage := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-			err = deleter.Pod.Owner.DeleteUserStorage(cleanedStorage)
-			if err != nil {
-				fmt.Printf("Error: Couldn't call for deletion of user storage for %s: %s\n", deleter.Pod.Owner.UserID, err.Error())
-			} else {
-				s.addToWatchMaps(
-					deleter.Pod.Owner.Name,
-					watchMapEntry{readyChannel: cleanedStorage},
-					DeletingStorage)
-			}
-		}
+	// Then if the user doesn't have remaining pods, call for deletion of their storage
+	err = s.deleteStorageIfUnused(deleter.Pod.Owner, record.Actor, request.RemoteIP)
+	if err != nil {
+		request.Log.Error("Couldn't clean up user storage", "error", err)
 	}
+	// and do the same for the storage of the projects it mounted
+	s.deleteProjectStorageIfUnused(deleter.Pod.Object, record.Actor, request.RemoteIP, request.Log)
 
 	response.Requested = true
 	return response, nil
@@ -479,26 +766,36 @@ func (s *Server) deletePod(request DeletePodRequest, finished *util.ReadyChannel
 func (s *Server) ServeDeletePod(w http.ResponseWriter, r *http.Request) {
 	// Parse the POSTed request JSON and log the request
 	var request DeletePodRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(&request)
+	log := s.newRequestLogger(w, r, "delete_pod")
+	if s.rejectIfDraining(w, log) {
+		return
+	}
+	defer s.requestDone()
+	err := s.decodeRequest(w, r, &request)
+	if err == nil {
+		err = request.validate()
+	}
 	request.RemoteIP = s.getRemoteIP(r)
-	fmt.Printf("deletePod request: %+v\n", request)
+	if err != nil {
+		log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	request.Log = log.With("user_id", request.UserID, "pod_name", request.PodName)
+	request.Log.Info("Request received")
 
 	// Default to an error status and empty response
 	status := http.StatusBadRequest
 	var response DeletePodResponse
-	// If the input is valid
-	if validUserID(request.UserID) {
-		// Call for pod deletion
-		finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-		r, err := s.deletePod(request, finished)
-		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-		} else {
-			// If the delete request was successful, set the response and status
-			status = http.StatusOK
-			response = r
-		}
+	// Call for pod deletion
+	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
+	requested, err := s.deletePod(request, finished)
+	if err != nil {
+		request.Log.Error("Couldn't delete pod", "error", err)
+	} else {
+		// If the delete request was successful, set the response and status
+		status = http.StatusOK
+		response = requested
 	}
 
 	// write the response
@@ -540,13 +837,22 @@ func (s *Server) watchDeletePod(request WatchDeletePodRequest) (WatchDeletePodRe
 
 func (s *Server) ServeWatchDeletePod(w http.ResponseWriter, r *http.Request) {
 	var request WatchDeletePodRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(&request)
-	fmt.Printf("watchDeletePod request %+v\n", request)
+	log := s.newRequestLogger(w, r, "watch_delete_pod")
+	err := s.decodeRequest(w, r, &request)
+	if err == nil {
+		err = request.validate()
+	}
+	if err != nil {
+		log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	request.Log = log.With("user_id", request.UserID, "pod_name", request.PodName)
+	request.Log.Debug("Request received")
 
 	response, err := s.watchDeletePod(request)
 	if err != nil {
-		fmt.Printf("Error while watching for pod deletion: %s\n", err.Error())
+		request.Log.Warn("Couldn't watch pod deletion", "error", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -554,8 +860,11 @@ func (s *Server) ServeWatchDeletePod(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) deleteAllUserPods(userID string, finished *util.ReadyChannel) error {
+func (s *Server) deleteAllUserPods(request DeleteAllPodsRequest, finished *util.ReadyChannel) error {
+	userID := request.UserID
+	log := request.Log
 	user := managed.NewUser(userID, s.Client, s.GlobalConfig)
+	user.SetLogger(log)
 	// Get a list of managed.Pod objects for all of the user's pods
 	podList, err := user.ListPods()
 	if err != nil {
@@ -574,31 +883,55 @@ func (s *Server) deleteAllUserPods(userID string, finished *util.ReadyChannel) e
 		}
 
 		// Then initialize a deleter and call for the pod's deletion
+		pod.SetLogger(log)
 		deleter := poddeleter.NewFromPod(pod)
 		ch := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
+		start := time.Now()
+		record := audit.Record{
+			Action:   audit.ActionDeletePod,
+			Actor:    audit.ActorSilo,
+			RemoteIP: request.RemoteIP,
+			UserID:   userID,
+			PodName:  pod.Object.Name,
+			Manifest: pod.GetManifestName(),
+		}
+		// Add the pod to `s.DeletingPods` before calling for its deletion, since its pre-stop hooks run first
+		s.addToWatchMaps(
+			pod.Object.Name,
+			watchMapEntry{readyChannel: ch, authCheck: userID},
+			DeletingPods)
 		err := deleter.DeletePod(ch)
 		// If something went wrong, log it
 		if err != nil {
-			fmt.Printf("Error calling deletion of pod %s: %s\n", pod.Object.Name, err.Error())
+			metrics.PodDeletions.Inc(record.Manifest, metrics.OutcomeFailure, "delete_call")
+			pod.Log.Error("Couldn't call for deletion of pod", "error", err)
+			ch.Fail("delete_call")
+			s.audit(record, start, auditReason(err))
 			continue
 		}
+		go s.recordDeletion(record, start, ch)
 		chanList = append(chanList, ch)
-		// If the delete call was made successfully, then add the pod to `s.DeletingPods`,
-		s.addToWatchMaps(
-			pod.Object.Name,
-			watchMapEntry{readyChannel: ch, authCheck: userID},
-			DeletingPods)
 	}
 
 	// Finally, remove the user's storage PV and PVC
+	storageRecord := audit.Record{
+		Action:   audit.ActionDeleteUserStorage,
+		Actor:    audit.ActorSilo,
+		RemoteIP: request.RemoteIP,
+		UserID:   userID,
+		Resource: user.GetStoragePVName(),
+	}
+	storageStart := time.Now()
 	cleanedStorage := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
 	err = user.DeleteUserStorage(cleanedStorage)
 	if err != nil {
+		s.audit(storageRecord, storageStart, auditReason(err))
 		return errors.New(fmt.Sprintf("Couldn't call for deletion of user storage for %s: %s", userID, err.Error()))
 	}
+	go s.auditWhenFinished(storageRecord, storageStart, cleanedStorage)
 	s.addToWatchMaps(
-		user.Name,
-		watchMapEntry{readyChannel: cleanedStorage},
+		userID,
+		watchMapEntry{readyChannel: cleanedStorage, authCheck: userID},
 		DeletingStorage)
 	chanList = append(chanList, cleanedStorage)
 	go util.CombineReadyChannels(chanList, finished)
@@ -608,27 +941,38 @@ func (s *Server) deleteAllUserPods(userID string, finished *util.ReadyChannel) e
 func (s *Server) ServeDeleteAllUserPods(w http.ResponseWriter, r *http.Request) {
 	// Parse the POSTed request JSON and log the request
 	var request DeleteAllPodsRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(&request)
+	log := s.newRequestLogger(w, r, "delete_all_user")
+	if s.rejectIfDraining(w, log) {
+		return
+	}
+	defer s.requestDone()
+	err := s.decodeRequest(w, r, &request)
+	if err == nil {
+		err = request.validate()
+	}
 	request.RemoteIP = s.getRemoteIP(r)
-	fmt.Printf("deleteAllUserPods request: %+v\n", request)
+	if err != nil {
+		log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	request.Log = log.With("user_id", request.UserID)
+	request.Log.Info("Request received")
 
 	// Default to an error status and empty response
 	status := http.StatusBadRequest
 	var response DeleteAllPodsResponse
-	if validUserID(request.UserID) {
-		// give a long enough timout that it will accommodate slowly deleting PV/PVC in worst case
-		finished := util.NewReadyChannel(2 * s.GlobalConfig.TimeoutDelete)
-		err := s.deleteAllUserPods(request.UserID, finished)
-		if err != nil {
-			response.Deleted = false
-			fmt.Printf("Error: %s\n", err.Error())
-		} else {
-			// if the request was made without error, set the status
-			status = http.StatusOK
-			// wait for the result, and set the response to whether all objects were deleted
-			response.Deleted = finished.Receive()
-		}
+	// give a long enough timout that it will accommodate slowly deleting PV/PVC in worst case
+	finished := util.NewReadyChannel(2 * s.GlobalConfig.TimeoutDelete)
+	err = s.deleteAllUserPods(request, finished)
+	if err != nil {
+		response.Deleted = false
+		request.Log.Error("Couldn't delete all user pods", "error", err)
+	} else {
+		// if the request was made without error, set the status
+		status = http.StatusOK
+		// wait for the result, and set the response to whether all objects were deleted
+		response.Deleted = finished.Receive()
 	}
 
 	// write the response
@@ -637,22 +981,22 @@ func (s *Server) ServeDeleteAllUserPods(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) cleanAllUnused(finished *util.ReadyChannel) error {
+// Delete services, user storage and podcaches whose pods no longer exist.
+// remoteIP is the address that asked for the cleanup, for the audit log.
+func (s *Server) cleanAllUnused(finished *util.ReadyChannel, remoteIP string, log *logging.Logger) error {
 	var taskChannelList []*util.ReadyChannel
 
-	// Clean orphaned services.
-	// Find all the services that were created for a pod.
-	serviceList, err := s.Client.ListServices(
-		metav1.ListOptions{LabelSelector: "createdForPod"},
-	)
+	// Clean orphaned services and companion objects.
+	// Find all the objects that were created for a pod.
+	createdObjects, err := managed.ListCreatedObjects(s.Client, managed.CreatedForPodLabel)
 	if err != nil {
 		return err
 	}
-	// For all of the services that belong to a pod,
-	for _, service := range serviceList.Items {
-		podName, exists := service.Labels["createdForPod"]
+	// For all of the objects that belong to a pod,
+	for _, object := range createdObjects {
+		podName, exists := object.Labels[managed.CreatedForPodLabel]
 		if !exists {
-			return errors.New(fmt.Sprintf("Service %s didn't have createdForPod label", service.Name))
+			return errors.New(fmt.Sprintf("%s %s didn't have createdForPod label", object.Kind, object.Name))
 		}
 		podList, err := s.Client.ListPods(
 			metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", podName)},
@@ -660,20 +1004,70 @@ func (s *Server) cleanAllUnused(finished *util.ReadyChannel) error {
 		if err != nil {
 			return err
 		}
-		// If the pod that the service was created for no longer exists, then delete the service
+		// If the pod that the object was created for no longer exists, then delete the object
 		if len(podList.Items) == 0 {
+			metrics.OrphansFound.Inc(strings.ToLower(object.Kind))
 			ch := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
 			taskChannelList = append(taskChannelList, ch)
-			// Make a watcher that will announce its deletion
+			record := audit.Record{
+				Action:   audit.ActionDeleteService,
+				Actor:    audit.ActorSystem,
+				RemoteIP: remoteIP,
+				UserID:   util.GetUserIDFromMeta(metav1.ObjectMeta{Labels: object.Labels, Annotations: object.Annotations}),
+				PodName:  podName,
+				Resource: object.Name,
+			}
+			if object.Kind != "Service" {
+				record.Action = audit.ActionDeleteCompanion
+				record.Resource = fmt.Sprintf("%s/%s", object.Kind, object.Name)
+			}
+			start := time.Now()
+			object := object
+			// Announce its deletion once the watcher sees it
 			go func() {
-				s.Client.WatchDeleteService(service.Name, ch)
 				if ch.Receive() {
-					fmt.Printf("Deleted SVC %s\n", service.Name)
+					log.Info("Deleted orphaned object", "kind", object.Kind, "name", object.Name)
 				} else {
-					fmt.Printf("Warning: failed to delete SVC %s\n", service.Name)
+					log.Warn("Failed to delete orphaned object", "kind", object.Kind, "name", object.Name, "reason", ch.Reason())
 				}
+				s.auditWhenFinished(record, start, ch)
 			}()
-			s.Client.DeleteService(service.Name)
+			err := managed.DeleteCreatedObject(object, s.Client, ch)
+			if err != nil {
+				ch.Fail("delete_call")
+			}
+		}
+	}
+
+	// Clean the helper pods that measurements of storage usage left behind
+	stalePods, err := managed.ListStaleStorageUsagePods(s.Client)
+	if err != nil {
+		return err
+	}
+	for _, pod := range stalePods {
+		metrics.OrphansFound.Inc("storage_usage_pod")
+		ch := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
+		taskChannelList = append(taskChannelList, ch)
+		record := audit.Record{
+			Action:   audit.ActionDeletePod,
+			Actor:    audit.ActorSystem,
+			RemoteIP: remoteIP,
+			UserID:   util.GetUserIDFromMeta(pod.ObjectMeta),
+			PodName:  pod.Name,
+		}
+		start := time.Now()
+		podName := pod.Name
+		go func() {
+			if ch.Receive() {
+				log.Info("Deleted stale storage usage pod", "pod_name", podName)
+			} else {
+				log.Warn("Failed to delete stale storage usage pod", "pod_name", podName, "reason", ch.Reason())
+			}
+			s.auditWhenFinished(record, start, ch)
+		}()
+		go s.Client.WatchDeletePod(podName, ch)
+		if err := s.Client.DeletePod(podName); err != nil {
+			ch.Fail("delete_call")
 		}
 	}
 
@@ -685,20 +1079,22 @@ func (s *Server) cleanAllUnused(finished *util.ReadyChannel) error {
 	}
 	// For all of the persistent volume claims in this namespace,
 	for _, pvc := range pvcList.Items {
-		// If the pvc is for user storage
+		// If the pvc is for user storage, delete it if its owner doesn't have any pods
 		if strings.Contains(pvc.Name, "user-storage") {
-			u := managed.NewUser(util.GetUserIDFromLabels(pvc.Labels), s.Client, s.GlobalConfig)
-			userPodList, err := u.ListPods()
+			ch, err := s.sweepStoragePVC(pvc, remoteIP, log)
 			if err != nil {
 				return err
 			}
-			// If the user who owns this PVC doesn't have any pods, then delete the storage
-			if len(userPodList) == 0 {
-				ch := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
-				err := u.DeleteUserStorage(ch)
-				if err != nil {
-					return err
-				}
+			if ch != nil {
+				taskChannelList = append(taskChannelList, ch)
+			}
+		}
+		if _, isProject := managed.ProjectIDFromStorageName(pvc.Name); isProject {
+			ch, err := s.sweepProjectStoragePVC(pvc, remoteIP, log)
+			if err != nil {
+				return err
+			}
+			if ch != nil {
 				taskChannelList = append(taskChannelList, ch)
 			}
 		}
@@ -724,7 +1120,15 @@ func (s *Server) cleanAllUnused(finished *util.ReadyChannel) error {
 		}
 		// If there is no pod whose name matches this file, then it is an orphaned podcache
 		if len(podList.Items) == 0 {
+			metrics.OrphansFound.Inc("pod_cache")
+			start := time.Now()
 			err := os.Remove(fmt.Sprintf("%s/%s", s.GlobalConfig.TokenDir, fileName))
+			s.audit(audit.Record{
+				Action:   audit.ActionDeletePodCache,
+				Actor:    audit.ActorSystem,
+				RemoteIP: remoteIP,
+				PodName:  fileName,
+			}, start, auditReason(err))
 			if err != nil {
 				return errors.New(fmt.Sprintf("Couldn't delete orphaned podcache %s: %s", fileName, err.Error()))
 			}
@@ -736,19 +1140,23 @@ func (s *Server) cleanAllUnused(finished *util.ReadyChannel) error {
 }
 
 func (s *Server) ServeCleanAllUnused(w http.ResponseWriter, r *http.Request) {
-	remoteIP := s.getRemoteIP(r)
-	fmt.Printf("Clean all request from IP %s", remoteIP)
+	log := s.newRequestLogger(w, r, "clean_all_unused")
+	if s.rejectIfDraining(w, log) {
+		return
+	}
+	defer s.requestDone()
+	log.Info("Request received")
 	// Could limit this to a whitelisted IP range
 
 	finished := util.NewReadyChannel(3 * s.GlobalConfig.TimeoutDelete)
-	err := s.cleanAllUnused(finished)
+	err := s.cleanAllUnused(finished, s.getRemoteIP(r), log)
 	status := http.StatusOK
 	if err != nil {
-		fmt.Printf("Error during cleanAllUnused: %s\n", err.Error())
+		log.Error("Error during cleanAllUnused", "error", err)
 		status = http.StatusBadRequest
 	} else {
 		if !finished.Receive() {
-			fmt.Printf("Warning: cleanAllUnused didn't finish successfully\n")
+			log.Warn("cleanAllUnused didn't finish successfully", "reason", finished.Reason())
 			status = http.StatusBadRequest
 		}
 	}
@@ -764,7 +1172,7 @@ func (s *Server) ReloadPodCaches() error {
 	}
 	for _, podObject := range allPodList.Items {
 		// If this is a pod without an owner, skip it
-		userID := util.GetUserIDFromLabels(podObject.ObjectMeta.Labels)
+		userID := util.GetUserIDFromMeta(podObject.ObjectMeta)
 		if userID == "" {
 			continue
 		}
@@ -774,5 +1182,8 @@ func (s *Server) ReloadPodCaches() error {
 			return errors.New(fmt.Sprintf("Failed to save podcache for pod %s: %s", podObject.Name, err.Error()))
 		}
 	}
+	s.health.mutex.Lock()
+	s.health.podCachesLoaded = true
+	s.health.mutex.Unlock()
 	return nil
 }
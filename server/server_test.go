@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
 	"github.com/deic.dk/user_pods_k8s_backend/managed"
 	"github.com/deic.dk/user_pods_k8s_backend/testingutil"
 	"github.com/deic.dk/user_pods_k8s_backend/util"
@@ -160,7 +161,7 @@ func TestDeleteAllUserPods(t *testing.T) {
 	// Now call delete all Pods and ensure that it works
 	deleteAllRequest := DeleteAllPodsRequest{UserID: testingutil.TestUser}
 	finished := util.NewReadyChannel(2 * s.GlobalConfig.TimeoutDelete)
-	err = s.deleteAllUserPods(deleteAllRequest.UserID, finished)
+	err = s.deleteAllUserPods(deleteAllRequest, finished)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
@@ -293,7 +294,7 @@ func TestStandardPodCreation(t *testing.T) {
 	if len(podList) != 0 {
 		deleteAllRequest := DeleteAllPodsRequest{UserID: testingutil.TestUser}
 		finished := util.NewReadyChannel(2 * s.GlobalConfig.TimeoutDelete)
-		err = s.deleteAllUserPods(deleteAllRequest.UserID, finished)
+		err = s.deleteAllUserPods(deleteAllRequest, finished)
 		if err != nil {
 			t.Fatal(err.Error())
 		}
@@ -542,7 +543,7 @@ func TestDeletePod(t *testing.T) {
 		t.Fatalf("Error calling deletePod: %s", err.Error())
 	}
 	s.mutex.Lock()
-	storageCleanedEntry, storageCleanedChannelExists := s.DeletingStorage[u.Name]
+	storageCleanedEntry, storageCleanedChannelExists := s.DeletingStorage[u.UserID]
 	s.mutex.Unlock()
 	if storageCleanedChannelExists {
 		// If the storageCleanedChannel does exist, then receive to check that the storage is cleaned
@@ -762,7 +763,7 @@ func TestCleanAllUnused(t *testing.T) {
 	}
 
 	finished := util.NewReadyChannel(3 * s.GlobalConfig.TimeoutDelete)
-	err = s.cleanAllUnused(finished)
+	err = s.cleanAllUnused(finished, testingutil.RemoteIP, logging.Default())
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
@@ -869,7 +870,7 @@ func TestCleanAllUnused(t *testing.T) {
 	// delete the testUser pods to clean up
 	deleteAllRequest := DeleteAllPodsRequest{UserID: testingutil.TestUser}
 	finished = util.NewReadyChannel(2 * s.GlobalConfig.TimeoutDelete)
-	err = s.deleteAllUserPods(deleteAllRequest.UserID, finished)
+	err = s.deleteAllUserPods(deleteAllRequest, finished)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/audit"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Used when GlobalConfig.ShutdownTimeout isn't set
+const defaultShutdownTimeout = 25 * time.Second
+
+// Names of the watch maps in the shutdown state file
+var watchMapNames = map[watchMapName]string{
+	CreatingPods:    "creating_pods",
+	DeletingPods:    "deleting_pods",
+	DeletingStorage: "deleting_storage",
+}
+
+// A watch map entry that hadn't finished at shutdown, saved so it can be resumed on the next start
+type unfinishedEntry struct {
+	Map    string `json:"map"`
+	Key    string `json:"key"`
+	UserID string `json:"user_id"`
+}
+
+// Stop accepting requests that create or delete anything.
+// Watch and get requests are still served so silos can follow what is in progress.
+func (s *Server) StartDraining() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.draining = true
+}
+
+func (s *Server) isDraining() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.draining
+}
+
+// If the server is shutting down, write a 503 response and return true.
+// Otherwise the request counts as in flight until the handler calls requestDone,
+// so that shutdown waits for whatever it adds to the watch maps.
+func (s *Server) rejectIfDraining(w http.ResponseWriter, log *logging.Logger) bool {
+	s.mutex.Lock()
+	draining := s.draining
+	if !draining {
+		s.inFlight++
+	}
+	s.mutex.Unlock()
+	if !draining {
+		return false
+	}
+	log.Warn("Rejected request while shutting down")
+	w.Header().Set("Retry-After", "10")
+	writeErrorResponse(w, &requestError{status: http.StatusServiceUnavailable, message: "server is shutting down"})
+	return true
+}
+
+// Called when a request that got past rejectIfDraining returns
+func (s *Server) requestDone() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.inFlight--
+}
+
+func (s *Server) inFlightRequests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.inFlight
+}
+
+func (s *Server) checkNotDraining() error {
+	if s.isDraining() {
+		return errors.New("Server is shutting down")
+	}
+	return nil
+}
+
+// Return the configured time to wait for the watch maps to empty at shutdown
+func (s *Server) ShutdownTimeout() time.Duration {
+	if s.GlobalConfig.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return s.GlobalConfig.ShutdownTimeout
+}
+
+// Block until no mutating requests are in flight and every watch map is empty, or timeout has passed,
+// returning true if they emptied
+func (s *Server) WaitForWatchMaps(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if s.inFlightRequests()+s.watchMapSize(CreatingPods)+s.watchMapSize(DeletingPods)+s.watchMapSize(DeletingStorage) == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func (s *Server) unfinishedEntries() []unfinishedEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var entries []unfinishedEntry
+	for mapName, watchMap := range map[watchMapName]map[string]watchMapEntry{
+		CreatingPods:    s.CreatingPods,
+		DeletingPods:    s.DeletingPods,
+		DeletingStorage: s.DeletingStorage,
+	} {
+		for key, entry := range watchMap {
+			entries = append(entries, unfinishedEntry{Map: watchMapNames[mapName], Key: key, UserID: entry.authCheck})
+		}
+	}
+	return entries
+}
+
+// Write whatever is still in the watch maps to path, so the next server to start can resume it
+func (s *Server) SaveUnfinished(path string) error {
+	entries := s.unfinishedEntries()
+	for _, entry := range entries {
+		logging.Default().Warn("Unfinished at shutdown", "map", entry.Map, "key", entry.Key, "user_id", entry.UserID)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if path == "" {
+		return errors.New("ShutdownStateFile isn't set, unfinished operations won't be resumed")
+	}
+	encoded, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, encoded, 0600)
+}
+
+// Resume the operations saved to path by SaveUnfinished, then remove the file
+func (s *Server) ResumeUnfinished(path string) error {
+	if path == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var entries []unfinishedEntry
+	err = json.Unmarshal(contents, &entries)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't decode shutdown state file %s: %s", path, err.Error()))
+	}
+	for _, entry := range entries {
+		log := logging.Default().With("operation", "resume", "map", entry.Map, "key", entry.Key, "user_id", entry.UserID)
+		if !validUserID(entry.UserID) {
+			log.Warn("Skipped unfinished operation without a valid user")
+			continue
+		}
+		switch entry.Map {
+		case watchMapNames[CreatingPods]:
+			err = s.resumeCreation(entry.Key, entry.UserID, log)
+		case watchMapNames[DeletingPods]:
+			err = s.resumeDeletion(entry.Key, entry.UserID, log)
+		case watchMapNames[DeletingStorage]:
+			// The key is the user ID, except in files saved when it was the user's name, so the entry's UserID is used
+			user := managed.NewUser(entry.UserID, s.Client, s.GlobalConfig)
+			user.SetLogger(log)
+			err = s.deleteStorageIfUnused(user, audit.ActorSystem, "")
+		default:
+			err = errors.New(fmt.Sprintf("unknown watch map %s", entry.Map))
+		}
+		if err != nil {
+			log.Error("Couldn't resume unfinished operation", "error", err)
+		} else {
+			log.Info("Resumed unfinished operation")
+		}
+	}
+	return os.Remove(path)
+}
+
+// Return the pod named podName if it exists and belongs to userID
+func (s *Server) getOwnedPod(podName string, userID string) (*apiv1.Pod, error) {
+	podList, err := s.Client.ListPods(metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", podName)})
+	if err != nil {
+		return nil, err
+	}
+	if len(podList.Items) == 0 {
+		return nil, nil
+	}
+	if util.GetUserIDFromMeta(podList.Items[0].ObjectMeta) != userID {
+		return nil, errors.New(fmt.Sprintf("pod %s doesn't belong to %s", podName, userID))
+	}
+	return &podList.Items[0], nil
+}
+
+func podIsReady(podObject *apiv1.Pod) bool {
+	for _, condition := range podObject.Status.Conditions {
+		if condition.Type == apiv1.PodReady {
+			return condition.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Wait for a pod that was created before the last shutdown to be ready, then run its start jobs again.
+// As after a normal creation, the pod is deleted if that fails.
+func (s *Server) resumeCreation(podName string, userID string, log *logging.Logger) error {
+	podObject, err := s.getOwnedPod(podName, userID)
+	if err != nil || podObject == nil {
+		return err
+	}
+	pod := managed.NewPod(podObject, s.Client, s.GlobalConfig)
+	pod.SetLogger(log)
+
+	start := time.Now()
+	podReady := util.NewReadyChannel(s.GlobalConfig.TimeoutCreate)
+	go s.Client.WatchCreatePod(podName, podReady)
+	// The pod may have become ready before the watcher started
+	if podIsReady(podObject) {
+		podReady.Send(true)
+	}
+	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutCreate)
+	go pod.RunStartJobsWhenReady([]*util.ReadyChannel{podReady}, finished)
+	s.addToWatchMaps(podName, watchMapEntry{readyChannel: finished, authCheck: userID}, CreatingPods)
+	go s.auditWhenFinished(audit.Record{
+		Action:   audit.ActionCreatePod,
+		Actor:    audit.ActorSystem,
+		UserID:   userID,
+		PodName:  podName,
+		Manifest: pod.GetManifestName(),
+	}, start, finished)
+	go func() {
+		if !finished.Receive() {
+			s.deletePodIfFailedCreate(podName, CreatePodRequest{UserID: userID, Log: log})
+		}
+	}()
+	return nil
+}
+
+// Finish deleting a pod whose deletion was requested before the last shutdown.
+// If the pod is already gone, only its delete jobs and the user's storage are left.
+func (s *Server) resumeDeletion(podName string, userID string, log *logging.Logger) error {
+	podObject, err := s.getOwnedPod(podName, userID)
+	if err != nil {
+		return err
+	}
+	finished := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
+	if podObject != nil {
+		_, err = s.deletePod(DeletePodRequest{UserID: userID, PodName: podName, Log: log, Actor: audit.ActorSystem}, finished)
+		return err
+	}
+
+	user := managed.NewUser(userID, s.Client, s.GlobalConfig)
+	pod := managed.NewPod(
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        podName,
+			Labels:      user.GetLabels(),
+			Annotations: user.GetAnnotations(),
+		}},
+		s.Client,
+		s.GlobalConfig,
+	)
+	pod.SetLogger(log)
+	podDeleted := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
+	podDeleted.Send(true)
+	go pod.RunDeleteJobsWhenReady(podDeleted, finished)
+	s.addToWatchMaps(podName, watchMapEntry{readyChannel: finished, authCheck: userID}, DeletingPods)
+	return s.deleteStorageIfUnused(pod.Owner, audit.ActorSystem, "")
+}
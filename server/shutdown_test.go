@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+)
+
+func TestDraining(t *testing.T) {
+	s := New(k8sclient.K8sClient{}, util.GlobalConfig{})
+	w := httptest.NewRecorder()
+	s.ServeCreatePod(w, httptest.NewRequest("POST", "/create_pod", strings.NewReader("{}")))
+	if w.Code == http.StatusServiceUnavailable {
+		t.Fatal("Request was rejected before draining")
+	}
+	if s.inFlightRequests() != 0 {
+		t.Fatalf("Finished request is still counted as in flight: %d", s.inFlightRequests())
+	}
+
+	// A request that got past rejectIfDraining holds up shutdown until it returns
+	if s.rejectIfDraining(httptest.NewRecorder(), logging.Default()) {
+		t.Fatal("Request was rejected before draining")
+	}
+	if s.WaitForWatchMaps(300 * time.Millisecond) {
+		t.Fatal("Shutdown shouldn't wait only for the watch maps while a request is in flight")
+	}
+	s.requestDone()
+	if !s.WaitForWatchMaps(300 * time.Millisecond) {
+		t.Fatal("Nothing should be in flight")
+	}
+
+	s.StartDraining()
+	for _, handler := range []http.HandlerFunc{s.ServeCreatePod, s.ServeDeletePod, s.ServeDeleteAllUserPods, s.ServeCleanAllUnused, s.ServeStorageUsage} {
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/", strings.NewReader("{}")))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected status %d while draining, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+	}
+	if s.checkNotDraining() == nil {
+		t.Fatal("Readiness should fail while draining")
+	}
+}
+
+func TestSaveAndResumeUnfinished(t *testing.T) {
+	s := New(k8sclient.K8sClient{}, util.GlobalConfig{})
+	creating := util.NewReadyChannel(time.Minute)
+	deleting := util.NewReadyChannel(time.Minute)
+	s.addToWatchMaps("jupyter-foo", watchMapEntry{readyChannel: creating, authCheck: "foo"}, CreatingPods)
+	s.addToWatchMaps("jupyter-bar", watchMapEntry{readyChannel: deleting, authCheck: "bar"}, DeletingPods)
+	if s.WaitForWatchMaps(300 * time.Millisecond) {
+		t.Fatal("Watch maps shouldn't be empty yet")
+	}
+
+	path := filepath.Join(t.TempDir(), "shutdown.json")
+	if err := s.SaveUnfinished(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var entries []unfinishedEntry
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 saved entries, got %+v", entries)
+	}
+
+	creating.Send(true)
+	deleting.Send(true)
+	if !s.WaitForWatchMaps(time.Second) {
+		t.Fatal("Watch maps should be empty once their channels have values")
+	}
+
+	// Entries that can't be resumed are skipped, and the file is removed either way
+	ioutil.WriteFile(path, []byte(`[{"map": "creating_pods", "key": "jupyter-foo", "user_id": "Not Valid"}, {"map": "other", "key": "x", "user_id": "foo"}]`), 0600)
+	if err := s.ResumeUnfinished(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("State file should be removed after resuming")
+	}
+	if err := s.ResumeUnfinished(path); err != nil {
+		t.Fatalf("A missing state file should be ignored, got %s", err.Error())
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/audit"
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/metrics"
+	"github.com/deic.dk/user_pods_k8s_backend/podcreator"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// How often the sweeper looks for expired storage if StorageSweepInterval isn't set
+const defaultStorageSweepInterval = time.Minute
+
+// Call for deletion of the user's storage, unless it's already being deleted.
+// Return the channel that receives true once it's deleted, or nil if it was already being deleted.
+func (s *Server) deleteUserStorage(user managed.User, actor string, remoteIP string) (*util.ReadyChannel, error) {
+	// Check whether the user's storage is already being deleted
+	s.mutex.Lock()
+	_, cleaningStorage := s.DeletingStorage[user.UserID]
+	s.mutex.Unlock()
+	if cleaningStorage {
+		return nil, nil
+	}
+	// If it's not already being deleted, then call for deletion
+	record := audit.Record{
+		Action:   audit.ActionDeleteUserStorage,
+		Actor:    actor,
+		RemoteIP: remoteIP,
+		UserID:   user.UserID,
+		Resource: user.GetStoragePVName(),
+	}
+	start := time.Now()
+	cleanedStorage := util.NewReadyChannel(s.GlobalConfig.TimeoutDelete)
+	err := user.DeleteUserStorage(cleanedStorage)
+	if err != nil {
+		s.audit(record, start, auditReason(err))
+		return nil, err
+	}
+	go s.auditWhenFinished(record, start, cleanedStorage)
+	s.addToWatchMaps(
+		user.UserID,
+		watchMapEntry{readyChannel: cleanedStorage, authCheck: user.UserID},
+		DeletingStorage)
+	return cleanedStorage, nil
+}
+
+// Return whether a pod is being created for the user, which may have prepared their storage but not exist yet
+func (s *Server) userIsCreatingPods(userID string) bool {
+	if podcreator.UserLocked(userID) {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, entry := range s.CreatingPods {
+		if entry.authCheck == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the PVC named name as it is now, or nil if it no longer exists
+func (s *Server) getPVC(name string) (*apiv1.PersistentVolumeClaim, error) {
+	pvcList, err := s.Client.ListPVC(metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", name)})
+	if err != nil {
+		return nil, err
+	}
+	if len(pvcList.Items) == 0 {
+		return nil, nil
+	}
+	return &pvcList.Items[0], nil
+}
+
+// Return whether the PVC still exists with the mark it was listed with,
+// since a pod created after it was listed removes the mark to keep the storage
+func (s *Server) pvcUnchangedSinceListed(pvc apiv1.PersistentVolumeClaim) (bool, error) {
+	current, err := s.getPVC(pvc.Name)
+	if err != nil || current == nil {
+		return false, err
+	}
+	listedSince, listedMarked := managed.StorageUnusedSince(pvc)
+	currentSince, currentMarked := managed.StorageUnusedSince(*current)
+	return listedMarked == currentMarked && listedSince.Equal(currentSince), nil
+}
+
+// What sweepStorage needs to know about the user or project storage it sweeps
+type sweptStorage struct {
+	// Label of the storage in OrphansFound, e.g. user_storage
+	kind string
+	// Whether pods use the storage, or may be about to
+	inUse  bool
+	log    *logging.Logger
+	keep   func() error
+	mark   func(since time.Time) error
+	delete func() (*util.ReadyChannel, error)
+}
+
+// Keep the storage that pvc belongs to if it's in use, and otherwise delete it once it has been unused
+// for StorageRetention, marking it as unused from now if it isn't yet.
+// Return the channel for its deletion, or nil if it isn't being deleted.
+func (s *Server) sweepStorage(pvc apiv1.PersistentVolumeClaim, storage sweptStorage) (*util.ReadyChannel, error) {
+	unusedSince, marked := managed.StorageUnusedSince(pvc)
+	if storage.inUse {
+		// A pod was created since the storage was marked
+		if marked {
+			return nil, storage.keep()
+		}
+		return nil, nil
+	}
+
+	// Marked storage was counted when it was marked
+	if !marked {
+		metrics.OrphansFound.Inc(storage.kind)
+	}
+	retention := s.GlobalConfig.StorageRetention
+	if retention > 0 && !marked {
+		storage.log.Info("Found unused storage, keeping it until its retention expires", "pvc", pvc.Name, "retention", retention.String())
+		return nil, storage.mark(time.Now())
+	}
+	if retention > 0 && time.Since(unusedSince) < retention {
+		return nil, nil
+	}
+	unchanged, err := s.pvcUnchangedSinceListed(pvc)
+	if err != nil || !unchanged {
+		return nil, err
+	}
+	return storage.delete()
+}
+
+// As sweepStorage for the user storage that pvc belongs to, which is in use while its owner has pods
+func (s *Server) sweepStoragePVC(pvc apiv1.PersistentVolumeClaim, remoteIP string, log *logging.Logger) (*util.ReadyChannel, error) {
+	userID := util.GetUserIDFromMeta(pvc.ObjectMeta)
+	if userID == "" {
+		log.Warn("User storage PVC doesn't have an owner", "pvc", pvc.Name)
+		return nil, nil
+	}
+	if s.userIsCreatingPods(userID) {
+		return nil, nil
+	}
+	u := managed.NewUser(userID, s.Client, s.GlobalConfig)
+	u.SetLogger(log)
+	userPodList, err := u.ListPods()
+	if err != nil {
+		return nil, err
+	}
+	return s.sweepStorage(pvc, sweptStorage{
+		kind:  "user_storage",
+		inUse: len(userPodList) > 0,
+		log:   u.Log,
+		keep:  u.KeepUserStorage,
+		mark:  u.MarkUserStorageUnused,
+		delete: func() (*util.ReadyChannel, error) {
+			return s.deleteUserStorage(u, audit.ActorSystem, remoteIP)
+		},
+	})
+}
+
+// Delete the user and project storage whose retention has expired, and keep the storage that pods have used since
+func (s *Server) sweepUserStorage(log *logging.Logger) error {
+	pvcList, err := s.Client.ListPVC(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, pvc := range pvcList.Items {
+		// Storage that wasn't marked when the last pod using it was deleted is left to clean_all_unused
+		if _, marked := managed.StorageUnusedSince(pvc); !marked {
+			continue
+		}
+		if _, isProject := managed.ProjectIDFromStorageName(pvc.Name); isProject {
+			_, err := s.sweepProjectStoragePVC(pvc, "", log)
+			if err != nil {
+				log.Error("Couldn't sweep project storage", "pvc", pvc.Name, "error", err)
+			}
+			continue
+		}
+		if !strings.Contains(pvc.Name, "user-storage") {
+			continue
+		}
+		_, err := s.sweepStoragePVC(pvc, "", log)
+		if err != nil {
+			log.Error("Couldn't sweep user storage", "pvc", pvc.Name, "error", err)
+		}
+	}
+	return nil
+}
+
+// Sweep user storage every StorageSweepInterval until the server starts draining.
+// Does nothing if StorageRetention isn't set, since storage is then deleted along with the last pod.
+func (s *Server) RunStorageSweeper() {
+	if s.GlobalConfig.StorageRetention <= 0 {
+		return
+	}
+	interval := s.GlobalConfig.StorageSweepInterval
+	if interval <= 0 {
+		interval = defaultStorageSweepInterval
+	}
+	log := logging.Default().With("operation", "sweep_user_storage")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.isDraining() {
+			return
+		}
+		err := s.sweepUserStorage(log)
+		if err != nil {
+			log.Error("Couldn't list user storage to sweep", "error", err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// How long a measurement of storage usage is reused if StorageUsageTTL isn't set
+const defaultStorageUsageTTL = 10 * time.Minute
+
+type StorageUsageRequest struct {
+	UserID   string          `json:"user_id"`
+	RemoteIP string          `json:"-"`
+	Log      *logging.Logger `json:"-"`
+}
+
+type StorageUsageResponse struct {
+	UsedBytes int64 `json:"used_bytes"`
+	// StorageSoftQuota in bytes, or 0 if there's no quota
+	QuotaBytes int64     `json:"quota_bytes"`
+	OverQuota  bool      `json:"over_quota"`
+	MeasuredAt time.Time `json:"measured_at"`
+}
+
+type storageUsage struct {
+	usedBytes  int64
+	measuredAt time.Time
+}
+
+// Measurements of users' storage usage, keyed by user ID, so that du isn't run on every request
+type storageUsageCache struct {
+	entries map[string]storageUsage
+	// measureLocks[userID] is held while the user's storage is being measured, so concurrent requests share one measurement
+	measureLocks map[string]*sync.Mutex
+	mutex        *sync.Mutex
+}
+
+func newStorageUsageCache() *storageUsageCache {
+	var m sync.Mutex
+	return &storageUsageCache{
+		entries:      make(map[string]storageUsage),
+		measureLocks: make(map[string]*sync.Mutex),
+		mutex:        &m,
+	}
+}
+
+func (c *storageUsageCache) get(userID string) (storageUsage, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	usage, exists := c.entries[userID]
+	return usage, exists
+}
+
+func (c *storageUsageCache) set(userID string, usage storageUsage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[userID] = usage
+}
+
+func (c *storageUsageCache) measureLock(userID string) *sync.Mutex {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lock, exists := c.measureLocks[userID]
+	if !exists {
+		var m sync.Mutex
+		lock = &m
+		c.measureLocks[userID] = lock
+	}
+	return lock
+}
+
+// Measure the user's storage and cache the result
+func (s *Server) measureStorageUsage(user managed.User) (storageUsage, error) {
+	used, err := user.MeasureStorageUsage()
+	if err != nil {
+		return storageUsage{}, err
+	}
+	usage := storageUsage{usedBytes: used, measuredAt: time.Now()}
+	s.storageUsage.set(user.UserID, usage)
+	return usage, nil
+}
+
+func (s *Server) storageUsageTTL() time.Duration {
+	if s.GlobalConfig.StorageUsageTTL <= 0 {
+		return defaultStorageUsageTTL
+	}
+	return s.GlobalConfig.StorageUsageTTL
+}
+
+// Return the usage of the user's storage, measuring it if the cached measurement is older than StorageUsageTTL
+func (s *Server) getStorageUsage(user managed.User) (storageUsage, error) {
+	lock := s.storageUsage.measureLock(user.UserID)
+	lock.Lock()
+	defer lock.Unlock()
+	if cached, exists := s.storageUsage.get(user.UserID); exists && time.Since(cached.measuredAt) < s.storageUsageTTL() {
+		return cached, nil
+	}
+	return s.measureStorageUsage(user)
+}
+
+// Measure the user's storage in the background, unless it's already being measured or the server is shutting down.
+// The measurement counts as an in-flight request, so that shutdown waits for its helper pod.
+func (s *Server) refreshStorageUsage(user managed.User) {
+	lock := s.storageUsage.measureLock(user.UserID)
+	if !lock.TryLock() {
+		return
+	}
+	s.mutex.Lock()
+	draining := s.draining
+	if !draining {
+		s.inFlight++
+	}
+	s.mutex.Unlock()
+	if draining {
+		lock.Unlock()
+		return
+	}
+	go func() {
+		defer s.requestDone()
+		defer lock.Unlock()
+		if _, err := s.measureStorageUsage(user); err != nil {
+			user.Log.Warn("Couldn't measure storage usage to check the quota", "error", err)
+		}
+	}()
+}
+
+// Return a requestError if the user's storage usage is over StorageSoftQuota.
+// Measuring the storage takes a helper pod, so only the cached measurement is used,
+// and it's refreshed in the background for later requests when it's older than StorageUsageTTL.
+// The quota is soft, so until the usage has been measured, the user isn't blocked.
+func (s *Server) checkStorageQuota(user managed.User) error {
+	quota := s.GlobalConfig.StorageSoftQuotaBytes()
+	if quota <= 0 {
+		return nil
+	}
+	usage, exists := s.storageUsage.get(user.UserID)
+	if !exists || time.Since(usage.measuredAt) >= s.storageUsageTTL() {
+		s.refreshStorageUsage(user)
+	}
+	if !exists || usage.usedBytes <= quota {
+		return nil
+	}
+	return &requestError{
+		status: http.StatusConflict,
+		message: fmt.Sprintf("The user's storage uses %s, which is over the quota of %s",
+			resource.NewQuantity(usage.usedBytes, resource.BinarySI).String(), s.GlobalConfig.StorageSoftQuota),
+	}
+}
+
+// Handles the http request for the usage of a user's storage
+func (s *Server) ServeStorageUsage(w http.ResponseWriter, r *http.Request) {
+	var request StorageUsageRequest
+	log := s.newRequestLogger(w, r, "storage_usage")
+	// Measuring the storage may start a helper pod, which shutdown must wait for
+	if s.rejectIfDraining(w, log) {
+		return
+	}
+	defer s.requestDone()
+	err := s.decodeRequest(w, r, &request)
+	if err == nil {
+		err = request.validate()
+	}
+	request.RemoteIP = s.getRemoteIP(r)
+	if err != nil {
+		log.Warn("Rejected request", "error", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	request.Log = log.With("user_id", request.UserID)
+	request.Log.Debug("Request received")
+
+	user := managed.NewUser(request.UserID, s.Client, s.GlobalConfig)
+	user.SetLogger(request.Log)
+	usage, err := s.getStorageUsage(user)
+	if err != nil {
+		request.Log.Error("Couldn't measure storage usage", "error", err)
+		writeErrorResponse(w, &requestError{status: http.StatusInternalServerError, message: "Couldn't measure the user's storage usage"})
+		return
+	}
+	quota := s.GlobalConfig.StorageSoftQuotaBytes()
+	response := StorageUsageResponse{
+		UsedBytes:  usage.usedBytes,
+		QuotaBytes: quota,
+		OverQuota:  quota > 0 && usage.usedBytes > quota,
+		MeasuredAt: usage.measuredAt,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
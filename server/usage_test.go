@@ -0,0 +1,39 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/k8sclient"
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+)
+
+func TestCheckStorageQuota(t *testing.T) {
+	s := &Server{
+		GlobalConfig: util.GlobalConfig{StorageSoftQuota: "1Gi", StorageUsageTTL: time.Minute},
+		storageUsage: newStorageUsageCache(),
+	}
+	user := managed.NewUser("someone@example.com", k8sclient.K8sClient{}, s.GlobalConfig)
+	// Hold the measurement lock, as if a measurement were running, so that no helper pod is started
+	lock := s.storageUsage.measureLock(user.UserID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// The request isn't blocked while the usage hasn't been measured
+	if err := s.checkStorageQuota(user); err != nil {
+		t.Fatalf("Expected no error without a measurement, got %v", err)
+	}
+	s.storageUsage.set(user.UserID, storageUsage{usedBytes: 512 << 20, measuredAt: time.Now()})
+	if err := s.checkStorageQuota(user); err != nil {
+		t.Fatalf("Expected no error under the quota, got %v", err)
+	}
+	// A stale measurement is still used while it's refreshed
+	s.storageUsage.set(user.UserID, storageUsage{usedBytes: 2 << 30, measuredAt: time.Now().Add(-time.Hour)})
+	var reqErr *requestError
+	if err := s.checkStorageQuota(user); !errors.As(err, &reqErr) || reqErr.status != http.StatusConflict {
+		t.Fatalf("Expected a conflict over the quota, got %v", err)
+	}
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/deic.dk/user_pods_k8s_backend/managed"
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/podcreator"
+	"github.com/deic.dk/user_pods_k8s_backend/policy"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// Used when GlobalConfig.MaxRequestBytes isn't set
+	defaultMaxRequestBytes = 1 << 20
+	// Upper bounds on the shape of the settings map in a create_pod request
+	maxSettingsContainers   = 16
+	maxSettingsPerContainer = 64
+	maxSettingValueBytes    = 4096
+	maxProjectMembers       = 1000
+)
+
+// A problem with a single field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// The body written in place of the normal response when a request is rejected
+type ErrorResponse struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// Every field-level problem found while validating a request
+type validationErrors []FieldError
+
+func (v validationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, fieldError := range v {
+		messages[i] = fmt.Sprintf("%s: %s", fieldError.Field, fieldError.Message)
+	}
+	return fmt.Sprintf("invalid request: %s", strings.Join(messages, "; "))
+}
+
+func (v *validationErrors) add(field string, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Return nil if there were no problems, so the result can be used directly as an error
+func (v validationErrors) orNil() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// An error while reading the request body, with the http status that should be returned for it
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// Return whether err is from reading past the limit of an http.MaxBytesReader.
+// http.MaxBytesError only exists from go 1.19, so until go.mod requires it,
+// the error can only be recognised by its message. Then this can be errors.As(err, new(*http.MaxBytesError)).
+func isBodyTooLarge(err error) bool {
+	return err.Error() == "http: request body too large"
+}
+
+// Decode the json body of r into request.
+// The body must be a single json object no larger than the configured limit,
+// containing only fields that exist in request.
+func (s *Server) decodeRequest(w http.ResponseWriter, r *http.Request, request interface{}) error {
+	maxBytes := s.GlobalConfig.MaxRequestBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxRequestBytes
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(request)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			return &requestError{
+				status:  http.StatusRequestEntityTooLarge,
+				message: fmt.Sprintf("request body larger than %d bytes", maxBytes),
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return &requestError{status: http.StatusBadRequest, message: "request body is empty"}
+		}
+		return &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("couldn't decode request: %s", err.Error())}
+	}
+	// Anything after the first json value is an error
+	if _, err := decoder.Token(); err != io.EOF {
+		return &requestError{status: http.StatusBadRequest, message: "request body must contain a single json object"}
+	}
+	return nil
+}
+
+// Write err as an ErrorResponse with a status that matches the kind of error
+func writeErrorResponse(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	response := ErrorResponse{Error: err.Error()}
+	var fieldErrors validationErrors
+	var settingsErrors manifest.SettingsErrors
+	var violations policy.Violations
+	var reqErr *requestError
+	if errors.As(err, &fieldErrors) {
+		response.Error = "invalid request"
+		response.Fields = fieldErrors
+	} else if errors.As(err, &settingsErrors) {
+		// The settings don't fit the parameters declared by the manifest
+		response.Error = "invalid request"
+		for _, settingError := range settingsErrors {
+			response.Fields = append(response.Fields, FieldError{Field: settingError.Field, Message: settingError.Message})
+		}
+	} else if errors.As(err, &violations) {
+		// The manifest has fields the policy doesn't allow
+		response.Error = "manifest violates policy"
+		for _, violation := range violations {
+			response.Fields = append(response.Fields, FieldError{Field: violation.Field, Message: violation.Message})
+		}
+	} else if errors.As(err, &reqErr) {
+		status = reqErr.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func validateUserIDField(errs *validationErrors, userID string) {
+	if userID == "" {
+		errs.add("user_id", "required")
+	} else if !validUserID(userID) {
+		errs.add("user_id", "must match %s", userIDregex)
+	}
+}
+
+func validatePodNameField(errs *validationErrors, podName string) {
+	if podName == "" {
+		errs.add("pod_name", "required")
+		return
+	}
+	for _, message := range validation.IsDNS1123Label(podName) {
+		errs.add("pod_name", message)
+	}
+}
+
+func validateYamlURLField(errs *validationErrors, yamlURL string, globalConfig util.GlobalConfig) {
+	if yamlURL == "" {
+		errs.add("yaml_url", "required")
+		return
+	}
+	parsed, err := url.Parse(yamlURL)
+	if err != nil {
+		errs.add("yaml_url", "not a valid url: %s", err.Error())
+		return
+	}
+	if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		errs.add("yaml_url", "scheme must be http or https")
+		return
+	}
+	if parsed.Host == "" {
+		errs.add("yaml_url", "must include a host")
+		return
+	}
+	if !globalConfig.ManifestWhitelist().MatchString(yamlURL) {
+		errs.add("yaml_url", "not matched to the manifest whitelist")
+	}
+}
+
+func validateManifestIDField(errs *validationErrors, manifestID string) {
+	if !manifest.ValidCatalogID(manifestID) {
+		errs.add("manifest_id", "not a valid catalog ID")
+		return
+	}
+	if _, exists := manifest.DefaultCatalog().Get(manifestID); !exists {
+		errs.add("manifest_id", "not in the manifest catalog")
+	}
+}
+
+// Check that settings has the shape settings[container_name][env_var_name] = env_var_value
+// with names that kubernetes would accept
+func validateSettingsField(errs *validationErrors, settings map[string]map[string]string) {
+	if len(settings) > maxSettingsContainers {
+		errs.add("settings", "at most %d containers may be configured", maxSettingsContainers)
+		return
+	}
+	for containerName, envVars := range settings {
+		field := fmt.Sprintf("settings.%s", containerName)
+		for _, message := range validation.IsDNS1123Label(containerName) {
+			errs.add(field, "invalid container name: %s", message)
+		}
+		if len(envVars) > maxSettingsPerContainer {
+			errs.add(field, "at most %d env vars may be set per container", maxSettingsPerContainer)
+			continue
+		}
+		for name, value := range envVars {
+			envField := fmt.Sprintf("%s.%s", field, name)
+			for _, message := range validation.IsEnvVarName(name) {
+				errs.add(envField, "invalid env var name: %s", message)
+			}
+			if len(value) > maxSettingValueBytes {
+				errs.add(envField, "value longer than %d bytes", maxSettingValueBytes)
+			}
+		}
+	}
+}
+
+func validateResourcesField(errs *validationErrors, resources map[string]map[string]string) {
+	if len(resources) > maxSettingsContainers {
+		errs.add("resources", "at most %d containers may be configured", maxSettingsContainers)
+		return
+	}
+	for containerName, quantities := range resources {
+		field := fmt.Sprintf("resources.%s", containerName)
+		for _, message := range validation.IsDNS1123Label(containerName) {
+			errs.add(field, "invalid container name: %s", message)
+		}
+		for name, value := range quantities {
+			quantityField := fmt.Sprintf("%s.%s", field, name)
+			if !util.IsBoundedResource(name) {
+				errs.add(quantityField, "must be one of %s", strings.Join(util.BoundedResources, ", "))
+				continue
+			}
+			if _, err := resource.ParseQuantity(value); err != nil {
+				errs.add(quantityField, "must be a quantity such as 500m or 2Gi")
+			}
+		}
+	}
+}
+
+func validateVolumeSubPathsField(errs *validationErrors, volumeSubPaths map[string]string) {
+	if len(volumeSubPaths) > maxSettingsContainers {
+		errs.add("volume_subpaths", "at most %d volumes may be configured", maxSettingsContainers)
+		return
+	}
+	for volumeName, subPath := range volumeSubPaths {
+		field := fmt.Sprintf("volume_subpaths.%s", volumeName)
+		for _, message := range validation.IsDNS1123Label(volumeName) {
+			errs.add(field, "invalid volume name: %s", message)
+		}
+		if err := util.ValidateSubPath(subPath); err != nil {
+			errs.add(field, "%s", err.Error())
+		}
+	}
+}
+
+func validateStorageField(errs *validationErrors, storage podcreator.StorageMount) {
+	if storage.SubPath == "" {
+		return
+	}
+	if err := util.ValidateSubPath(storage.SubPath); err != nil {
+		errs.add("storage.subpath", "%s", err.Error())
+	}
+}
+
+func (r GetPodsRequest) validate() error {
+	var errs validationErrors
+	validateUserIDField(&errs, r.UserID)
+	return errs.orNil()
+}
+
+func (r CreatePodRequest) validate(globalConfig util.GlobalConfig) error {
+	var errs validationErrors
+	validateUserIDField(&errs, r.UserID)
+	// The manifest is given either by url or by its ID in the catalog
+	if r.ManifestID == "" {
+		validateYamlURLField(&errs, r.YamlURL, globalConfig)
+	} else if r.YamlURL != "" {
+		errs.add("manifest_id", "can't be given together with yaml_url")
+	} else {
+		validateManifestIDField(&errs, r.ManifestID)
+	}
+	validateSettingsField(&errs, r.ContainerEnvVars)
+	validateResourcesField(&errs, r.Resources)
+	validateVolumeSubPathsField(&errs, r.VolumeSubPaths)
+	validateStorageField(&errs, r.Storage)
+	return errs.orNil()
+}
+
+func validateProjectIDField(errs *validationErrors, projectID string) {
+	if projectID == "" {
+		errs.add("project_id", "required")
+		return
+	}
+	if len(projectID) > managed.MaxProjectIDLength {
+		errs.add("project_id", "must be at most %d characters", managed.MaxProjectIDLength)
+	}
+	for _, message := range validation.IsDNS1123Label(projectID) {
+		errs.add("project_id", "%s", message)
+	}
+}
+
+func validateMembersField(errs *validationErrors, field string, members []string) {
+	if len(members) > maxProjectMembers {
+		errs.add(field, "at most %d members may be given", maxProjectMembers)
+		return
+	}
+	for i, member := range members {
+		if !validUserID(member) {
+			errs.add(fmt.Sprintf("%s[%d]", field, i), "must match %s", userIDregex)
+		}
+	}
+}
+
+func (r CreateProjectRequest) validate() error {
+	var errs validationErrors
+	validateUserIDField(&errs, r.UserID)
+	validateProjectIDField(&errs, r.ProjectID)
+	validateMembersField(&errs, "members", r.Members)
+	return errs.orNil()
+}
+
+func (r ProjectMembersRequest) validate() error {
+	var errs validationErrors
+	validateUserIDField(&errs, r.UserID)
+	validateProjectIDField(&errs, r.ProjectID)
+	validateMembersField(&errs, "add", r.Add)
+	validateMembersField(&errs, "remove", r.Remove)
+	return errs.orNil()
+}
+
+func (r DeleteProjectRequest) validate() error {
+	var errs validationErrors
+	validateUserIDField(&errs, r.UserID)
+	validateProjectIDField(&errs, r.ProjectID)
+	return errs.orNil()
+}
+
+func (r StorageUsageRequest) validate() error {
+	var errs validationErrors
+	validateUserIDField(&errs, r.UserID)
+	return errs.orNil()
+}
+
+func (r WatchCreatePodRequest) validate() error {
+	var errs validationErrors
+	validateUserIDField(&errs, r.UserID)
+	validatePodNameField(&errs, r.PodName)
+	return errs.orNil()
+}
+
+func (r DeletePodRequest) validate() error {
+	var errs validationErrors
+	validateUserIDField(&errs, r.UserID)
+	validatePodNameField(&errs, r.PodName)
+	return errs.orNil()
+}
+
+func (r WatchDeletePodRequest) validate() error {
+	var errs validationErrors
+	validateUserIDField(&errs, r.UserID)
+	validatePodNameField(&errs, r.PodName)
+	return errs.orNil()
+}
+
+func (r DeleteAllPodsRequest) validate() error {
+	var errs validationErrors
+	validateUserIDField(&errs, r.UserID)
+	return errs.orNil()
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/deic.dk/user_pods_k8s_backend/manifest"
+	"github.com/deic.dk/user_pods_k8s_backend/podcreator"
+	"github.com/deic.dk/user_pods_k8s_backend/policy"
+	"github.com/deic.dk/user_pods_k8s_backend/util"
+)
+
+func validationTestServer() *Server {
+	return &Server{
+		GlobalConfig: util.GlobalConfig{
+			WhitelistManifestRegex: `^https://raw[.]githubusercontent[.]com/deic-dk/pod_manifests/`,
+			MaxRequestBytes:        256,
+		},
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	s := validationTestServer()
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"user_id": "foo@bar", "pod_name": "jupyter-foo-bar"}`, 0},
+		{`{"user_id": "foo@bar", "pod_name": "jupyter-foo-bar", "extra": 1}`, http.StatusBadRequest},
+		{`{"user_id": "foo@bar", "RemoteIP": "1.2.3.4"}`, http.StatusBadRequest},
+		{`{"user_id": "foo@bar"} {"user_id": "baz"}`, http.StatusBadRequest},
+		{`{"user_id": `, http.StatusBadRequest},
+		{``, http.StatusBadRequest},
+		{`{"user_id": "` + strings.Repeat("a", 300) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		var request DeletePodRequest
+		r := httptest.NewRequest("POST", "/delete_pod", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		err := s.decodeRequest(w, r, &request)
+		if test.status == 0 {
+			if err != nil {
+				t.Fatalf("Decoding %s failed: %s", test.body, err.Error())
+			}
+			continue
+		}
+		reqErr, ok := err.(*requestError)
+		if !ok {
+			t.Fatalf("Decoding %s gave %v, expected a requestError", test.body, err)
+		}
+		if reqErr.status != test.status {
+			t.Fatalf("Decoding %s gave status %d, expected %d", test.body, reqErr.status, test.status)
+		}
+	}
+}
+
+func TestValidateCreatePodRequest(t *testing.T) {
+	config := validationTestServer().GlobalConfig
+	validURL := "https://raw.githubusercontent.com/deic-dk/pod_manifests/testing/jupyter_sciencedata.yaml"
+	tests := []struct {
+		request CreatePodRequest
+		fields  []string
+	}{
+		{CreatePodRequest{UserID: "foo@bar", YamlURL: validURL}, nil},
+		{
+			CreatePodRequest{
+				UserID:           "foo@bar",
+				YamlURL:          validURL,
+				ContainerEnvVars: map[string]map[string]string{"jupyter": {"FILE": "", "WORKING_DIRECTORY": "jupyter"}},
+			},
+			nil,
+		},
+		{CreatePodRequest{}, []string{"user_id", "yaml_url"}},
+		{CreatePodRequest{UserID: "Foo@bar", YamlURL: validURL}, []string{"user_id"}},
+		{CreatePodRequest{UserID: "foo", YamlURL: "https://example.com/pod.yaml"}, []string{"yaml_url"}},
+		{CreatePodRequest{UserID: "foo", YamlURL: "file:///etc/passwd"}, []string{"yaml_url"}},
+		{
+			CreatePodRequest{
+				UserID:           "foo",
+				YamlURL:          validURL,
+				ContainerEnvVars: map[string]map[string]string{"Jupyter_1": {"FILE": ""}},
+			},
+			[]string{"settings.Jupyter_1"},
+		},
+		{
+			CreatePodRequest{
+				UserID:           "foo",
+				YamlURL:          validURL,
+				ContainerEnvVars: map[string]map[string]string{"jupyter": {"1FILE": "", "OK": strings.Repeat("a", maxSettingValueBytes+1)}},
+			},
+			[]string{"settings.jupyter.1FILE", "settings.jupyter.OK"},
+		},
+		{
+			CreatePodRequest{
+				UserID:    "foo",
+				YamlURL:   validURL,
+				Resources: map[string]map[string]string{"jupyter": {"cpu": "500m", "memory": "4Gi", "ephemeral-storage": "1G"}},
+			},
+			nil,
+		},
+		{
+			CreatePodRequest{
+				UserID:    "foo",
+				YamlURL:   validURL,
+				Resources: map[string]map[string]string{"jupyter": {"cpu": "lots", "nvidia.com/gpu": "1"}},
+			},
+			[]string{"resources.jupyter.cpu", "resources.jupyter.nvidia.com/gpu"},
+		},
+		{
+			CreatePodRequest{
+				UserID:         "foo",
+				YamlURL:        validURL,
+				VolumeSubPaths: map[string]string{"user-subdir": "projects/thesis"},
+			},
+			nil,
+		},
+		{
+			CreatePodRequest{
+				UserID:         "foo",
+				YamlURL:        validURL,
+				VolumeSubPaths: map[string]string{"user-subdir": "../other-user", "Bad_Name": "data"},
+			},
+			[]string{"volume_subpaths.user-subdir", "volume_subpaths.Bad_Name"},
+		},
+		{
+			CreatePodRequest{
+				UserID:  "foo",
+				YamlURL: validURL,
+				Storage: podcreator.StorageMount{SubPath: "shared/notebooks", ReadOnly: true},
+			},
+			nil,
+		},
+		{
+			CreatePodRequest{
+				UserID:  "foo",
+				YamlURL: validURL,
+				Storage: podcreator.StorageMount{SubPath: "shared/../../other-user"},
+			},
+			[]string{"storage.subpath"},
+		},
+	}
+	for _, test := range tests {
+		err := test.request.validate(config)
+		if test.fields == nil {
+			if err != nil {
+				t.Fatalf("Valid request %+v was rejected: %s", test.request, err.Error())
+			}
+			continue
+		}
+		fieldErrors, ok := err.(validationErrors)
+		if !ok {
+			t.Fatalf("Invalid request %+v gave %v, expected validationErrors", test.request, err)
+		}
+		for _, field := range test.fields {
+			found := false
+			for _, fieldError := range fieldErrors {
+				if fieldError.Field == field {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Fatalf("Request %+v should have an error for field %s, got %s", test.request, field, err.Error())
+			}
+		}
+	}
+}
+
+func TestValidateProjectRequests(t *testing.T) {
+	valid := CreateProjectRequest{UserID: "owner@example.com", ProjectID: "genomics", Members: []string{"member@example.com"}}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("Valid request %+v was rejected: %s", valid, err.Error())
+	}
+	tests := []struct {
+		request interface{ validate() error }
+		fields  []string
+	}{
+		{CreateProjectRequest{UserID: "owner@example.com"}, []string{"project_id"}},
+		{CreateProjectRequest{UserID: "owner@example.com", ProjectID: "Genomics_Lab", Members: []string{"not a user"}}, []string{"project_id", "members[0]"}},
+		{ProjectMembersRequest{UserID: "owner@example.com", ProjectID: strings.Repeat("a", 41), Remove: []string{""}}, []string{"project_id", "remove[0]"}},
+		{DeleteProjectRequest{ProjectID: "genomics"}, []string{"user_id"}},
+	}
+	for _, test := range tests {
+		fieldErrors, ok := test.request.validate().(validationErrors)
+		if !ok {
+			t.Fatalf("Expected validationErrors for %+v", test.request)
+		}
+		for _, field := range test.fields {
+			found := false
+			for _, fieldError := range fieldErrors {
+				if fieldError.Field == field {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("Expected an error for field %s of %+v, got %v", field, test.request, fieldErrors)
+			}
+		}
+	}
+}
+
+func TestValidateManifestID(t *testing.T) {
+	config := validationTestServer().GlobalConfig
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "ubuntu.yaml"), []byte("apiVersion: v1\nkind: Pod\nmetadata:\n  name: ubuntu\n"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer manifest.SetDefaultCatalog(manifest.DefaultCatalog())
+	manifest.SetDefaultCatalog(manifest.NewCatalog(manifest.CatalogOptions{Dirs: []string{dir}}, manifest.Default()))
+
+	request := CreatePodRequest{UserID: "foo@bar", ManifestID: "ubuntu"}
+	if err := request.validate(config); err != nil {
+		t.Fatalf("Request with a catalog ID was rejected: %s", err.Error())
+	}
+	if err := request.resolveManifestID(); err != nil || request.manifestLocation() != "file://"+filepath.Join(dir, "ubuntu.yaml") {
+		t.Fatalf("Catalog ID resolved to %s, %v", request.manifestLocation(), err)
+	}
+	// The local path isn't logged or audited
+	if request.YamlURL != "" || request.auditManifestURL() != "catalog:ubuntu" {
+		t.Fatalf("Local path of the manifest is exposed: %s, %s", request.YamlURL, request.auditManifestURL())
+	}
+	for _, invalid := range []CreatePodRequest{
+		{UserID: "foo@bar", ManifestID: "jupyter"},
+		{UserID: "foo@bar", ManifestID: "../ubuntu"},
+		{UserID: "foo@bar", ManifestID: "ubuntu", YamlURL: "https://raw.githubusercontent.com/deic-dk/pod_manifests/testing/jupyter_sciencedata.yaml"},
+	} {
+		err := invalid.validate(config)
+		fieldErrors, ok := err.(validationErrors)
+		if !ok || len(fieldErrors) != 1 || fieldErrors[0].Field != "manifest_id" {
+			t.Fatalf("Request %+v should have an error for manifest_id, got %v", invalid, err)
+		}
+	}
+}
+
+func TestValidatePodName(t *testing.T) {
+	tests := []struct {
+		podName string
+		valid   bool
+	}{
+		{"jupyter-foo-bar", true},
+		{"jupyter-foo-bar-1", true},
+		{"", false},
+		{"Jupyter", false},
+		{"jupyter_foo", false},
+		{"-jupyter", false},
+		{strings.Repeat("a", 64), false},
+	}
+	for _, test := range tests {
+		err := WatchCreatePodRequest{UserID: "foo", PodName: test.podName}.validate()
+		if (err == nil) != test.valid {
+			t.Fatalf("Pod name %s should be valid: %t, got error %v", test.podName, test.valid, err)
+		}
+	}
+}
+
+func TestWriteErrorResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeErrorResponse(w, DeleteAllPodsRequest{}.validate())
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	var response ErrorResponse
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(response.Fields) != 1 || response.Fields[0].Field != "user_id" {
+		t.Fatalf("Expected a single error for user_id, got %+v", response)
+	}
+
+	// Settings that don't fit the manifest's parameters are reported per field, even when wrapped
+	w = httptest.NewRecorder()
+	settingsErr := manifest.SettingsErrors{{Field: "settings.jupyter.PORT", Message: "must be an integer"}}
+	writeErrorResponse(w, fmt.Errorf("Couldn't initialize PodCreator: %w", settingsErr))
+	response = ErrorResponse{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusBadRequest || len(response.Fields) != 1 || response.Fields[0].Field != "settings.jupyter.PORT" {
+		t.Fatalf("Expected a single error for settings.jupyter.PORT, got %d %+v", w.Code, response)
+	}
+
+	w = httptest.NewRecorder()
+	violations := policy.Violations{{Field: "spec.hostNetwork", Message: "host namespaces aren't allowed"}}
+	writeErrorResponse(w, fmt.Errorf("Couldn't initialize PodCreator: %w", violations))
+	response = ErrorResponse{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusBadRequest || len(response.Fields) != 1 || response.Fields[0].Field != "spec.hostNetwork" {
+		t.Fatalf("Expected a single error for spec.hostNetwork, got %d %+v", w.Code, response)
+	}
+
+	w = httptest.NewRecorder()
+	writeErrorResponse(w, &requestError{status: http.StatusRequestEntityTooLarge, message: "too large"})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
@@ -27,7 +27,7 @@ type CreatePodRequest struct {
 	UserID        string                       `json:"user_id"`
 	YamlURL       string                       `json:"yaml_url"`
 	Settings      map[string]map[string]string `json:"settings"`
-	Supplementary SupplementaryPodInfo
+	Supplementary SupplementaryPodInfo         `json:"-"`
 }
 
 type CreatePodResponse struct {
@@ -61,8 +61,7 @@ type deletePodResponse struct {
 }
 
 type getPodNamesRequest struct {
-	UserID   string `json:"user_id"`
-	RemoteIP string
+	UserID string `json:"user_id"`
 }
 
 type reducedPodInfo struct {
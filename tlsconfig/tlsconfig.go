@@ -0,0 +1,153 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/deic.dk/user_pods_k8s_backend/logging"
+)
+
+// Return the modification time of each file, to tell when they have been replaced
+func modTimes(files ...string) ([]time.Time, error) {
+	times := make([]time.Time, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		times[i] = info.ModTime()
+	}
+	return times, nil
+}
+
+func sameTimes(a []time.Time, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Something loaded from files that is loaded again whenever one of the files changes.
+// If reloading fails, the last good value is kept, so a half-written renewal doesn't break serving.
+type reloader struct {
+	files    []string
+	load     func() (interface{}, error)
+	value    interface{}
+	modTimes []time.Time
+	mutex    *sync.Mutex
+}
+
+func newReloader(load func() (interface{}, error), files ...string) (*reloader, error) {
+	var m sync.Mutex
+	r := &reloader{files: files, load: load, mutex: &m}
+	times, err := modTimes(files...)
+	if err != nil {
+		return nil, err
+	}
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	r.value = value
+	r.modTimes = times
+	return r, nil
+}
+
+func (r *reloader) get() interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	times, err := modTimes(r.files...)
+	if err != nil || sameTimes(times, r.modTimes) {
+		return r.value
+	}
+	value, err := r.load()
+	if err != nil {
+		logging.Default().Error("Couldn't reload TLS files, keeping the previous ones", "files", r.files, "error", err)
+		return r.value
+	}
+	logging.Default().Info("Reloaded TLS files", "files", r.files)
+	r.value = value
+	r.modTimes = times
+	return r.value
+}
+
+// Options for serving https
+type Options struct {
+	CertFile string
+	KeyFile  string
+	// PEM bundle of CAs that client certificates are verified against, client certificates aren't checked if empty
+	ClientCAFile string
+	// Reject clients that don't present a certificate signed by a CA in ClientCAFile
+	RequireClientCert bool
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(fmt.Sprintf("No certificates found in %s", file))
+	}
+	return pool, nil
+}
+
+// Return a tls.Config for serving with the certificate and key in options,
+// which picks up new certificates, keys and client CAs as soon as the files change on disk
+func NewServerConfig(options Options) (*tls.Config, error) {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, errors.New("TLS needs both a certificate and a key file")
+	}
+	if options.RequireClientCert && options.ClientCAFile == "" {
+		return nil, errors.New("Client certificates can't be required without a client CA file")
+	}
+	certs, err := newReloader(func() (interface{}, error) {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		return &cert, err
+	}, options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't load TLS certificate: %s", err.Error()))
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.get().(*tls.Certificate), nil
+		},
+	}
+	if options.ClientCAFile == "" {
+		return config, nil
+	}
+
+	clientCAs, err := newReloader(func() (interface{}, error) {
+		return loadCertPool(options.ClientCAFile)
+	}, options.ClientCAFile)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't load client CAs: %s", err.Error()))
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if options.RequireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	// The client CAs are part of the config rather than looked up per connection,
+	// so hand out a config with the current CAs for each connection
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		perClient := config.Clone()
+		perClient.GetConfigForClient = nil
+		perClient.ClientAuth = clientAuth
+		perClient.ClientCAs = clientCAs.get().(*x509.CertPool)
+		return perClient, nil
+	}
+	return config, nil
+}
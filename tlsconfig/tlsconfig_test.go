@@ -0,0 +1,170 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// Make a certificate signed by parent, or self-signed if parent is nil
+func makeCert(t *testing.T, serial int64, commonName string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// Write the files and move their modification time forward, so a rewrite within the same second is noticed
+func writeFiles(t *testing.T, files map[string][]byte, modTime time.Time) {
+	for path, contents := range files {
+		if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	first := makeCert(t, 1, "backend", nil)
+	writeFiles(t, map[string][]byte{certFile: first.certPEM, keyFile: first.keyPEM}, time.Now())
+
+	config, err := NewServerConfig(Options{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	serial := func() int64 {
+		cert, err := config.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+		return parsed.SerialNumber.Int64()
+	}
+	if serial() != 1 {
+		t.Fatal("Expected the first certificate")
+	}
+
+	second := makeCert(t, 2, "backend", nil)
+	writeFiles(t, map[string][]byte{certFile: second.certPEM, keyFile: second.keyPEM}, time.Now().Add(time.Minute))
+	if serial() != 2 {
+		t.Fatal("Expected the certificate to be reloaded after the files changed")
+	}
+
+	// A broken certificate file shouldn't replace the working one
+	writeFiles(t, map[string][]byte{certFile: []byte("not a certificate")}, time.Now().Add(2*time.Minute))
+	if serial() != 2 {
+		t.Fatal("Expected the last good certificate to be kept")
+	}
+
+	if _, err := NewServerConfig(Options{CertFile: certFile, KeyFile: keyFile, RequireClientCert: true}); err == nil {
+		t.Fatal("Requiring client certificates without a CA should fail")
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := makeCert(t, 1, "silo-ca", nil)
+	serverCert := makeCert(t, 2, "backend", ca)
+	siloCert := makeCert(t, 3, "silo1", ca)
+	otherCert := makeCert(t, 4, "intruder", nil)
+	files := map[string][]byte{
+		filepath.Join(dir, "tls.crt"): serverCert.certPEM,
+		filepath.Join(dir, "tls.key"): serverCert.keyPEM,
+		filepath.Join(dir, "ca.crt"):  ca.certPEM,
+	}
+	writeFiles(t, files, time.Now())
+
+	config, err := NewServerConfig(Options{
+		CertFile:          filepath.Join(dir, "tls.crt"),
+		KeyFile:           filepath.Join(dir, "tls.key"),
+		ClientCAFile:      filepath.Join(dir, "ca.crt"),
+		RequireClientCert: true,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+	}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(client *testCert) (string, error) {
+		tlsConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if client != nil {
+			tlsConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{client.cert.Raw}, PrivateKey: client.key}}
+		}
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		response, err := httpClient.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		return string(body), err
+	}
+
+	if body, err := get(siloCert); err != nil || body != "silo1" {
+		t.Fatalf("Silo with a valid certificate should be served, got %q, %v", body, err)
+	}
+	if _, err := get(nil); err == nil {
+		t.Fatal("Client without a certificate should be rejected")
+	}
+	if _, err := get(otherCert); err == nil {
+		t.Fatal("Client with a certificate from another CA should be rejected")
+	}
+}
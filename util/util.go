@@ -2,50 +2,84 @@ package util
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	yaml "gopkg.in/yaml.v3"
 
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 const configFile = "config.yaml"
 
+// Reason given for a false value sent by a ReadyChannel's timeout
+const ReasonTimeout = "timeout"
+
 // type for signalling whether one-off events have completed successfully within a timeout
 type ReadyChannel struct {
-	ch          chan bool
+	ch          chan readyValue
 	receivedYet bool
-	firstValue  bool
+	firstValue  readyValue
 	mutex       *sync.Mutex
+	// When the timeout sends false
+	deadline time.Time
+}
+
+// A value sent into a ReadyChannel, with the reason if it signals failure
+type readyValue struct {
+	ready  bool
+	reason string
 }
 
 // Return a new safeBoolChannel whith the timeout counting down
 func NewReadyChannel(timeout time.Duration) *ReadyChannel {
-	ch := make(chan bool, 1)
+	ch := make(chan readyValue, 1)
 	var m sync.Mutex
 	rc := &ReadyChannel{
 		ch:          ch,
 		receivedYet: false,
-		firstValue:  false,
+		firstValue:  readyValue{},
 		mutex:       &m,
+		deadline:    time.Now().Add(timeout),
 	}
 	go func() {
 		time.Sleep(timeout)
-		rc.Send(false)
+		rc.Fail(ReasonTimeout)
 	}()
 	return rc
 }
 
+// Return when the ReadyChannel's timeout sends false, so that work signalled by it can be stopped in time
+func (t *ReadyChannel) Deadline() time.Time {
+	return t.deadline
+}
+
 // Attempt to send value into the ReadyChannel's channel.
 // If the buffer is already full, this will do nothing.
 func (t *ReadyChannel) Send(value bool) {
+	t.send(readyValue{ready: value})
+}
+
+// Attempt to send false into the ReadyChannel's channel, recording why the event failed.
+// If the buffer is already full, this will do nothing.
+func (t *ReadyChannel) Fail(reason string) {
+	t.send(readyValue{ready: false, reason: reason})
+}
+
+func (t *ReadyChannel) send(value readyValue) {
 	select {
 	case t.ch <- value:
 	default:
@@ -55,6 +89,16 @@ func (t *ReadyChannel) Send(value bool) {
 // Return the first value that was input to t.Send().
 // If there hasn't been one yet, block until there is one.
 func (t *ReadyChannel) Receive() bool {
+	return t.receive().ready
+}
+
+// Return the reason given with the first value, which is empty unless it was sent by t.Fail().
+// If there hasn't been a value yet, block until there is one.
+func (t *ReadyChannel) Reason() string {
+	return t.receive().reason
+}
+
+func (t *ReadyChannel) receive() readyValue {
 	// use the ReadyChannel's mutex to block other goroutines where t.Receive is called until this returns
 	t.mutex.Lock()
 	defer func() {
@@ -77,9 +121,18 @@ func (t *ReadyChannel) Receive() bool {
 
 // Block until an input was received from each channel in inputChannels,
 // then send output <- input0 && input 1 && input2...
+// If any input failed, the output fails with the reason of the first input that failed.
 func CombineReadyChannels(inputChannels []*ReadyChannel, outputChannel *ReadyChannel) {
-	output := ReceiveReadyChannels(inputChannels)
-	outputChannel.Send(output)
+	if ReceiveReadyChannels(inputChannels) {
+		outputChannel.Send(true)
+		return
+	}
+	for _, ch := range inputChannels {
+		if !ch.Receive() {
+			outputChannel.Fail(ch.Reason())
+			return
+		}
+	}
 }
 
 func ReceiveReadyChannels(inputChannels []*ReadyChannel) bool {
@@ -94,6 +147,54 @@ func ReceiveReadyChannels(inputChannels []*ReadyChannel) bool {
 	return output
 }
 
+// Annotation with the full userID of the user an object belongs to,
+// since the user and domain labels may be shortened to fit in a label value
+const UserIDAnnotation = "sciencedata.dk/user-id"
+
+// Label with HashUserID of the user an object belongs to
+const UserHashLabel = "userHash"
+
+// Length of HashUserID, in hex characters
+const userHashLength = 10
+
+// Return a short hash of userID that can be used in names and label values
+func HashUserID(userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return hex.EncodeToString(sum[:])[:userHashLength]
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Return s lowercased, with runs of characters other than a-z and 0-9 replaced with a single -,
+// and shortened to at most maxLength characters, so that it can be part of a DNS label
+func NameSlug(s string, maxLength int) string {
+	slug := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if len(slug) > maxLength {
+		slug = strings.TrimRight(slug[:maxLength], "-")
+	}
+	return slug
+}
+
+// Return s shortened to a valid label value, which must be at most 63 characters
+// and start and end with an alphanumeric character
+func LabelValue(s string) string {
+	if len(s) > validation.LabelValueMaxLength {
+		s = s[:validation.LabelValueMaxLength]
+	}
+	return strings.TrimFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	})
+}
+
+// Return the userID of the user an object belongs to, from its UserIDAnnotation,
+// or from its labels for objects made before the annotation was added
+func GetUserIDFromMeta(meta metav1.ObjectMeta) string {
+	if userID, exists := meta.Annotations[UserIDAnnotation]; exists && userID != "" {
+		return userID
+	}
+	return GetUserIDFromLabels(meta.Labels)
+}
+
 func GetUserIDFromLabels(labels map[string]string) string {
 	user, hasUser := labels["user"]
 	if !hasUser {
@@ -111,6 +212,132 @@ func GetUserIDFromLabels(labels map[string]string) string {
 	return user
 }
 
+// Names of the container resources that requests can set and that ResourceBounds can limit
+var BoundedResources = []string{"cpu", "memory", "ephemeral-storage"}
+
+func IsBoundedResource(name string) bool {
+	for _, bounded := range BoundedResources {
+		if name == bounded {
+			return true
+		}
+	}
+	return false
+}
+
+// Bounds on the resources of each container, like a LimitRange.
+// Each map is keyed by a name in BoundedResources, with quantities such as 500m or 2Gi.
+type ResourceBounds struct {
+	// Smallest and largest requests and limits a container may have
+	Min map[string]string
+	Max map[string]string
+	// Limits of containers that don't set them
+	Default map[string]string
+	// Requests of containers that don't set them, which default to the container's limits
+	DefaultRequest map[string]string
+}
+
+// Return an error if the bounds name a resource that isn't bounded or have an invalid quantity
+func (b ResourceBounds) Validate() error {
+	for _, quantities := range []map[string]string{b.Min, b.Max, b.Default, b.DefaultRequest} {
+		for name, quantity := range quantities {
+			if !IsBoundedResource(name) {
+				return errors.New(fmt.Sprintf("resource %s can't be bounded", name))
+			}
+			if _, err := resource.ParseQuantity(quantity); err != nil {
+				return errors.New(fmt.Sprintf("invalid quantity %s for %s: %s", quantity, name, err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+// Longest subpath of a volume that a request may mount
+const maxSubPathLength = 255
+
+// Return an error unless subPath is a clean relative path inside a volume, e.g. projects/thesis,
+// so that it can't be used to reach outside the volume
+func ValidateSubPath(subPath string) error {
+	if subPath == "" {
+		return errors.New("must not be empty")
+	}
+	if len(subPath) > maxSubPathLength {
+		return errors.New(fmt.Sprintf("must be at most %d characters", maxSubPathLength))
+	}
+	if strings.HasPrefix(subPath, "/") {
+		return errors.New("must be relative")
+	}
+	if strings.ContainsAny(subPath, "\\\x00") {
+		return errors.New("must not contain backslashes or null characters")
+	}
+	for _, segment := range strings.Split(subPath, "/") {
+		switch segment {
+		case "", ".", "..":
+			return errors.New("must not contain empty, . or .. components")
+		}
+	}
+	return nil
+}
+
+// Kinds of StorageConfig.Provisioner
+const (
+	StorageProvisionerNFS          = "nfs"
+	StorageProvisionerStorageClass = "storageclass"
+	StorageProvisionerHostPath     = "hostpath"
+)
+
+// How the PV and PVC of a user's storage are made
+type StorageConfig struct {
+	// nfs (the default) for a PV exported by the silo's nfs server under NfsStorageRoot,
+	// storageclass for a PVC that's provisioned dynamically by a StorageClass,
+	// or hostpath for a directory under HostPathRoot on the node, for development
+	Provisioner string
+	// Size of the volume, 10Gi if empty
+	Capacity string
+	// Options the PV is mounted with, hard and nfsvers=4.1 for nfs if empty. Not used by hostpath.
+	MountOptions []string
+	// What happens to the PV when its PVC is deleted, which can only be Retain (the default),
+	// since the PV and PVC are deleted along with the storage but the data has to outlive them
+	ReclaimPolicy string
+	// For nfs and hostpath, the storage class of the PV, nfs for nfs if empty.
+	// For storageclass, the StorageClass that provisions the volume, the cluster's default if empty.
+	StorageClass string
+	// Directory that hostpath makes each user's directory in
+	HostPathRoot string
+}
+
+// Return an error if the storage config has an unknown provisioner or settings that don't apply to it
+func (c StorageConfig) Validate() error {
+	if c.Capacity != "" {
+		if _, err := resource.ParseQuantity(c.Capacity); err != nil {
+			return errors.New(fmt.Sprintf("invalid Capacity %s: %s", c.Capacity, err.Error()))
+		}
+	}
+	switch apiv1.PersistentVolumeReclaimPolicy(c.ReclaimPolicy) {
+	case apiv1.PersistentVolumeReclaimRetain:
+	case "":
+	default:
+		return errors.New(fmt.Sprintf("invalid ReclaimPolicy %s, must be Retain or empty", c.ReclaimPolicy))
+	}
+	switch c.Provisioner {
+	case StorageProvisionerNFS, "":
+	case StorageProvisionerStorageClass:
+		// A dynamically provisioned PV gets these from its StorageClass, and is then patched to Retain
+		if len(c.MountOptions) > 0 || c.ReclaimPolicy != "" {
+			return errors.New("MountOptions and ReclaimPolicy are set on the StorageClass for storageclass")
+		}
+	case StorageProvisionerHostPath:
+		if c.HostPathRoot == "" {
+			return errors.New("hostpath needs HostPathRoot")
+		}
+		if len(c.MountOptions) > 0 {
+			return errors.New("hostpath volumes can't have MountOptions")
+		}
+	default:
+		return errors.New(fmt.Sprintf("invalid Provisioner %s, must be nfs, storageclass, hostpath or empty", c.Provisioner))
+	}
+	return nil
+}
+
 type GlobalConfig struct {
 	RestartPolicy          apiv1.RestartPolicy
 	TimeoutCreate          time.Duration
@@ -123,6 +350,156 @@ type GlobalConfig struct {
 	NfsStorageRoot         string
 	MandatoryEnvVars       map[string]string
 	TestingHost            string
+	// Largest request body the server will accept, in bytes
+	MaxRequestBytes int64
+	// Minimum level of log lines that are written: debug, info, warn or error
+	LogLevel string
+	// File that the audit log of pod and storage actions is appended to, auditing is off if empty
+	AuditLogFile string
+	// Address ranges allowed to use the /admin endpoints, e.g. 10.0.0.0/8
+	AdminCIDRs []string
+	// Address ranges of reverse proxies whose X-Forwarded-For header is trusted for the /admin endpoints
+	TrustedProxies []string
+	// How long to wait at shutdown for pods and storage that are being created or deleted.
+	// The pod's terminationGracePeriodSeconds should be longer than this.
+	ShutdownTimeout time.Duration
+	// File that operations still unfinished at shutdown are saved to and resumed from on the next start
+	ShutdownStateFile string
+	// Address the server listens on, ":80" if empty
+	ListenAddress string
+	// Certificate and key to serve https with, plain http is served if these are empty.
+	// Both files are reloaded when they change.
+	TLSCertFile string
+	TLSKeyFile  string
+	// CA bundle that client certificates are verified against, client certificates aren't checked if empty
+	TLSClientCAFile string
+	// Reject connections without a client certificate signed by a CA in TLSClientCAFile
+	TLSRequireClientCert bool
+	// How long a fetched manifest is used before it's revalidated upstream
+	ManifestCacheTTL time.Duration
+	// Longest time a manifest fetch may take
+	ManifestFetchTimeout time.Duration
+	// Largest manifest that will be fetched, in bytes
+	ManifestMaxBytes int64
+	// Most manifests kept in the cache, 500 if 0
+	ManifestCacheMaxEntries int
+	// Directories, e.g. git checkouts, whose manifests are listed at /manifests and can be created by ID
+	ManifestCatalogDirs []string
+	// Whitelisted manifest urls that are also listed in the catalog
+	ManifestCatalogURLs []string
+	// Whether manifests must have a detached ed25519 signature, fetched from the manifest's url with .sig appended
+	// or read from the file next to a local manifest: require, warn when it's missing, or skip the check (the default)
+	ManifestSignatureMode string
+	// Public keys that manifests may be signed with, as base64 encoded ed25519 keys or PEM blocks
+	TrustedManifestKeys []string
+	// Registries, with the registry written out, or image prefixes that pods may use images from,
+	// e.g. kube.sciencedata.dk:5000 or docker.io/sciencedata. Images from any registry are allowed if empty.
+	PolicyAllowedRegistries []string
+	// Capabilities that containers may add, e.g. SYS_CHROOT. None are allowed if empty.
+	PolicyAllowedCapabilities []string
+	// Allow privileged containers and privilege escalation
+	PolicyAllowPrivileged bool
+	// Run every pod with runAsNonRoot, and reject manifests that run as root explicitly
+	PolicyRequireRunAsNonRoot bool
+	// Volume types that pods may use, named as in the pod spec, e.g. hostPath.
+	// Defaults to persistentVolumeClaim, configMap, secret, emptyDir, projected and downwardAPI.
+	PolicyAllowedVolumeTypes []string
+	// Allow hostNetwork, hostPID, hostIPC and host ports
+	PolicyAllowHostNamespaces bool
+	// Service accounts that pods may run as besides the namespace's default
+	PolicyAllowedServiceAccounts []string
+	// Types that Services in manifests may have, ClusterIP only if empty
+	PolicyAllowedServiceTypes []string
+	// Allow Services in manifests to set externalIPs
+	PolicyAllowExternalIPs bool
+	// Hosts that Ingresses in manifests may route, exactly or as *.domain for any of its subdomains. Any host if empty.
+	PolicyAllowedIngressHosts []string
+	// Annotations that Ingresses in manifests may set, exactly or as prefix/ for any annotation with the prefix.
+	// Any annotation if empty, except snippet annotations, e.g. nginx.ingress.kubernetes.io/configuration-snippet,
+	// which are never allowed.
+	PolicyAllowedIngressAnnotations []string
+	// Types that Secrets in manifests may have, Opaque, kubernetes.io/tls and kubernetes.io/dockerconfigjson if empty
+	PolicyAllowedSecretTypes []string
+	// Remove disallowed fields where that's possible, e.g. capabilities, instead of rejecting the manifest
+	PolicyMutate bool
+	// Bounds on the resources of every container, and defaults for containers whose manifest doesn't set them
+	ResourceBounds ResourceBounds
+	// Bounds for specific users by user ID, used instead of ResourceBounds
+	UserResourceBounds map[string]ResourceBounds
+	// How users' storage is provisioned
+	Storage StorageConfig
+	// Storage configs for the users of specific silos by IP, used instead of Storage
+	SiloStorage map[string]StorageConfig
+	// Storage configs for users in specific domains, used instead of Storage for users of other silos
+	DomainStorage map[string]StorageConfig
+	// How long a user's storage is kept after their last pod is deleted, in case they create another.
+	// Storage is deleted along with the last pod if 0.
+	StorageRetention time.Duration
+	// How often storage that has been kept for StorageRetention is looked for and deleted, every minute if 0
+	StorageSweepInterval time.Duration
+	// Well-known volumes, e.g. scratch, that manifests may mount without declaring them, and project for
+	// the project:<id> volumes of projects. All of them if empty.
+	PolicyAllowedVolumeNames []string
+	// Size limit of the scratch volume, 1Gi if empty
+	ScratchVolumeSizeLimit string
+	// Back the scratch volume with memory instead of the node's disk
+	ScratchVolumeInMemory bool
+	// PVC in the namespace with shared datasets, which manifests can mount read-only as the datasets volume
+	DatasetsClaimName string
+	// How long a measurement of a user's storage usage is reused, 10 minutes if 0
+	StorageUsageTTL time.Duration
+	// Image with du of the helper pod that measures storage usage, pinned by digest, e.g. busybox@sha256:<digest>.
+	// Storage usage can't be measured if empty.
+	StorageUsageImage string
+	// User ID the helper pod runs du as, which must be able to read all of a user's storage.
+	// The image's user if 0.
+	StorageUsageRunAsUser int64
+	// Usage of a user's storage above which they can't create pods, e.g. 50Gi. No quota if empty.
+	StorageSoftQuota string
+	// Directory under the storage root, e.g. NfsStorageRoot, with a directory for each project's storage, projects if empty.
+	// It mustn't be a user ID, or that user's storage would contain every project's.
+	ProjectStorageDirectory string
+	// WhitelistManifestRegex compiled once when the config is loaded
+	whitelistManifestRegex *regexp.Regexp
+}
+
+// Return WhitelistManifestRegex compiled, which is only compiled here if the config wasn't loaded by MustLoadGlobalConfig
+func (c GlobalConfig) ManifestWhitelist() *regexp.Regexp {
+	if c.whitelistManifestRegex != nil {
+		return c.whitelistManifestRegex
+	}
+	return regexp.MustCompile(c.WhitelistManifestRegex)
+}
+
+// Return StorageSoftQuota in bytes, or 0 if there's no quota
+func (c GlobalConfig) StorageSoftQuotaBytes() int64 {
+	if c.StorageSoftQuota == "" {
+		return 0
+	}
+	quota, err := resource.ParseQuantity(c.StorageSoftQuota)
+	if err != nil {
+		return 0
+	}
+	return quota.Value()
+}
+
+// Return the resource bounds for the user
+func (c GlobalConfig) ResourceBoundsFor(userID string) ResourceBounds {
+	if bounds, exists := c.UserResourceBounds[userID]; exists {
+		return bounds
+	}
+	return c.ResourceBounds
+}
+
+// Return the storage config for a user of the silo at siloIP in the domain
+func (c GlobalConfig) StorageConfigFor(siloIP string, domain string) StorageConfig {
+	if storage, exists := c.SiloStorage[siloIP]; exists {
+		return storage
+	}
+	if storage, exists := c.DomainStorage[domain]; exists {
+		return storage
+	}
+	return c.Storage
 }
 
 func getConfigFilename() string {
@@ -159,10 +536,15 @@ func MustLoadGlobalConfig() GlobalConfig {
 	}
 
 	// Check that WhitelistManifestRegex compiles to a regex
-	_, err = regexp.Compile(config.WhitelistManifestRegex)
+	config.whitelistManifestRegex, err = regexp.Compile(config.WhitelistManifestRegex)
 	if err != nil {
 		panic(fmt.Sprintf("Invalid WhitelistManifestRegex in config: %s", err.Error()))
 	}
+	for _, catalogURL := range config.ManifestCatalogURLs {
+		if !config.whitelistManifestRegex.MatchString(catalogURL) {
+			panic(fmt.Sprintf("ManifestCatalogURLs entry %s isn't matched to WhitelistManifestRegex", catalogURL))
+		}
+	}
 
 	// Check that RestartPolicy is an allowed value
 	switch config.RestartPolicy {
@@ -182,5 +564,109 @@ func MustLoadGlobalConfig() GlobalConfig {
 		panic(fmt.Sprintf("TestingHost %s not a valid ip address", config.TestingHost))
 	}
 
+	// Check that the TLS settings are complete
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		panic("TLSCertFile and TLSKeyFile must be set together")
+	}
+	if config.TLSClientCAFile != "" && config.TLSCertFile == "" {
+		panic("TLSClientCAFile requires TLSCertFile and TLSKeyFile")
+	}
+	if config.TLSRequireClientCert && config.TLSClientCAFile == "" {
+		panic("TLSRequireClientCert requires TLSClientCAFile")
+	}
+
+	// Check that ManifestSignatureMode is an allowed value
+	switch config.ManifestSignatureMode {
+	case "require", "warn":
+		if len(config.TrustedManifestKeys) == 0 {
+			panic("ManifestSignatureMode require and warn need TrustedManifestKeys")
+		}
+	case "skip":
+	case "":
+	default:
+		panic(fmt.Sprintf("Invalid ManifestSignatureMode. Must be \"require\", \"warn\", \"skip\", or empty"))
+	}
+
+	// Check that resource bounds are valid
+	if err := config.ResourceBounds.Validate(); err != nil {
+		panic(fmt.Sprintf("Invalid ResourceBounds: %s", err.Error()))
+	}
+	for userID, bounds := range config.UserResourceBounds {
+		if err := bounds.Validate(); err != nil {
+			panic(fmt.Sprintf("Invalid UserResourceBounds for %s: %s", userID, err.Error()))
+		}
+	}
+
+	// Check that the storage configs are valid
+	if err := config.Storage.Validate(); err != nil {
+		panic(fmt.Sprintf("Invalid Storage: %s", err.Error()))
+	}
+	for siloIP, storage := range config.SiloStorage {
+		if err := storage.Validate(); err != nil {
+			panic(fmt.Sprintf("Invalid SiloStorage for %s: %s", siloIP, err.Error()))
+		}
+	}
+	for domain, storage := range config.DomainStorage {
+		if err := storage.Validate(); err != nil {
+			panic(fmt.Sprintf("Invalid DomainStorage for %s: %s", domain, err.Error()))
+		}
+	}
+
+	// Check that the scratch volume's size limit is a quantity
+	if config.ScratchVolumeSizeLimit != "" {
+		if _, err := resource.ParseQuantity(config.ScratchVolumeSizeLimit); err != nil {
+			panic(fmt.Sprintf("Invalid ScratchVolumeSizeLimit %s: %s", config.ScratchVolumeSizeLimit, err.Error()))
+		}
+	}
+
+	// Check that the storage quota is a quantity
+	if config.StorageSoftQuota != "" {
+		if _, err := resource.ParseQuantity(config.StorageSoftQuota); err != nil {
+			panic(fmt.Sprintf("Invalid StorageSoftQuota %s: %s", config.StorageSoftQuota, err.Error()))
+		}
+		if config.StorageUsageImage == "" {
+			panic("StorageSoftQuota is set, but StorageUsageImage isn't, so storage usage can't be measured")
+		}
+	}
+
+	// Check that the helper pod's image can't change under the same name
+	if config.StorageUsageImage != "" && !strings.Contains(config.StorageUsageImage, "@sha256:") {
+		panic(fmt.Sprintf("StorageUsageImage %s isn't pinned by digest", config.StorageUsageImage))
+	}
+	if config.StorageUsageRunAsUser < 0 {
+		panic(fmt.Sprintf("Invalid StorageUsageRunAsUser %d", config.StorageUsageRunAsUser))
+	}
+
+	// Check that the project storage directory stays under the storage root
+	if config.ProjectStorageDirectory != "" {
+		if err := ValidateSubPath(config.ProjectStorageDirectory); err != nil {
+			panic(fmt.Sprintf("Invalid ProjectStorageDirectory %s: %s", config.ProjectStorageDirectory, err.Error()))
+		}
+	}
+
+	// Check that PolicyAllowedServiceTypes are service types
+	for _, serviceType := range config.PolicyAllowedServiceTypes {
+		switch apiv1.ServiceType(serviceType) {
+		case apiv1.ServiceTypeClusterIP:
+		case apiv1.ServiceTypeNodePort:
+		case apiv1.ServiceTypeLoadBalancer:
+		case apiv1.ServiceTypeExternalName:
+		default:
+			panic(fmt.Sprintf("Invalid PolicyAllowedServiceTypes entry %s", serviceType))
+		}
+	}
+
+	// Check that AdminCIDRs are valid CIDR ranges
+	for _, cidr := range config.AdminCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			panic(fmt.Sprintf("Invalid AdminCIDRs entry %s: %s", cidr, err.Error()))
+		}
+	}
+	for _, cidr := range config.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			panic(fmt.Sprintf("Invalid TrustedProxies entry %s: %s", cidr, err.Error()))
+		}
+	}
+
 	return config
 }
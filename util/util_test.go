@@ -1,6 +1,7 @@
 package util
 
 import (
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -51,3 +52,100 @@ func TestGetUserIDFromLabels(t *testing.T) {
 		}
 	}
 }
+
+func TestNameSlug(t *testing.T) {
+	tests := []struct {
+		input     string
+		maxLength int
+		want      string
+	}{
+		{"foo@bar.dk", 20, "foo-bar-dk"},
+		{"Foo..Bar@_x_", 20, "foo-bar-x"},
+		{"jupyter-sciencedata", 8, "jupyter"},
+	}
+	for _, test := range tests {
+		if got := NameSlug(test.input, test.maxLength); got != test.want {
+			t.Fatalf("NameSlug(%s, %d) gave %s, wanted %s", test.input, test.maxLength, got, test.want)
+		}
+	}
+	long := strings.Repeat("a", 62) + ".b"
+	if got := LabelValue(long); got != strings.Repeat("a", 62) {
+		t.Fatalf("LabelValue(%s) gave %s", long, got)
+	}
+	if got := LabelValue("_foo."); got != "foo" {
+		t.Fatalf("LabelValue(_foo.) gave %s", got)
+	}
+}
+
+func TestReadyChannelReason(t *testing.T) {
+	timedOut := NewReadyChannel(10 * time.Millisecond)
+	if timedOut.Receive() || timedOut.Reason() != ReasonTimeout {
+		t.Fatalf("Expected timeout, got %t with reason %s", timedOut.Receive(), timedOut.Reason())
+	}
+
+	failed := NewReadyChannel(time.Second)
+	failed.Fail("pod_cache")
+	failed.Send(true)
+	if failed.Receive() || failed.Reason() != "pod_cache" {
+		t.Fatalf("Expected failure with reason pod_cache, got %t with reason %s", failed.Receive(), failed.Reason())
+	}
+
+	succeeded := NewReadyChannel(time.Second)
+	succeeded.Send(true)
+	combined := NewReadyChannel(time.Second)
+	CombineReadyChannels([]*ReadyChannel{succeeded, failed, timedOut}, combined)
+	if combined.Receive() || combined.Reason() != "pod_cache" {
+		t.Fatalf("Combined channel should fail with the first failing reason, got %t with reason %s", combined.Receive(), combined.Reason())
+	}
+}
+
+func TestStorageConfigFor(t *testing.T) {
+	globalConfig := GlobalConfig{
+		Storage:       StorageConfig{Capacity: "10Gi"},
+		SiloStorage:   map[string]StorageConfig{"10.0.0.20": {Capacity: "20Gi"}},
+		DomainStorage: map[string]StorageConfig{"example.com": {Capacity: "30Gi"}},
+	}
+	for _, c := range []struct {
+		siloIP   string
+		domain   string
+		capacity string
+	}{
+		{"10.0.0.20", "example.com", "20Gi"},
+		{"10.0.0.21", "example.com", "30Gi"},
+		{"10.0.0.21", "other.com", "10Gi"},
+	} {
+		if capacity := globalConfig.StorageConfigFor(c.siloIP, c.domain).Capacity; capacity != c.capacity {
+			t.Fatalf("Expected %s for %s in %s, got %s", c.capacity, c.siloIP, c.domain, capacity)
+		}
+	}
+}
+
+func TestValidateSubPath(t *testing.T) {
+	for subPath, valid := range map[string]bool{
+		"projects":               true,
+		"projects/thesis/data":   true,
+		"..hidden/file..":        true,
+		"":                       false,
+		"/etc":                   false,
+		"../other":               false,
+		"projects/../../other":   false,
+		"projects//thesis":       false,
+		"projects/":              false,
+		"./projects":             false,
+		"projects\\..\\other":    false,
+		strings.Repeat("a", 256): false,
+	} {
+		if err := ValidateSubPath(subPath); (err == nil) != valid {
+			t.Fatalf("Expected ValidateSubPath(%q) to be valid: %t, got %v", subPath, valid, err)
+		}
+	}
+}
+
+func TestStorageSoftQuotaBytes(t *testing.T) {
+	for quota, expected := range map[string]int64{"": 0, "50Gi": 50 * 1024 * 1024 * 1024, "1G": 1000 * 1000 * 1000} {
+		config := GlobalConfig{StorageSoftQuota: quota}
+		if actual := config.StorageSoftQuotaBytes(); actual != expected {
+			t.Fatalf("Expected %d bytes for quota %q, got %d", expected, quota, actual)
+		}
+	}
+}